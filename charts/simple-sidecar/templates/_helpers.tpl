@@ -60,3 +60,14 @@ Create the name of the service account to use
 {{- default "default" .Values.serviceAccount.name }}
 {{- end }}
 {{- end }}
+
+{{/*
+The IMPERSONATE env of the impersonate values, <feature>=<namespace>/<name> comma separated
+*/}}
+{{- define "simple-sidecar.impersonate" -}}
+{{- $entries := list }}
+{{- range $feature, $account := .Values.impersonate }}
+{{- $entries = append $entries (printf "%s=%s" $feature $account) }}
+{{- end }}
+{{- join "," $entries }}
+{{- end }}
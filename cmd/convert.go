@@ -0,0 +1,350 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"sigs.k8s.io/yaml"
+
+	"github.com/centml/simple-sidecar/pkg/webhook"
+)
+
+const (
+	convertFromSidecarInjector = "k8s-sidecar-injector"
+	convertFromIstio           = "istio-annotations"
+
+	// istioProxyName is the name of the container istio injects, and of the config converted from its
+	// annotations by default
+	istioProxyName = "istio-proxy"
+)
+
+// converted is a config converted from another injector, written with the keys of our config files
+type converted map[string]interface{}
+
+// convert translates the configs of another injector into a config file and writes it to stdout, what
+// can't be translated is reported on stderr. It returns the exit code for the process.
+func convert(args []string) int {
+	flags := flag.NewFlagSet("convert", flag.ExitOnError)
+	from := flags.String("from", "", "the injector the configs are from, "+convertFromSidecarInjector+" or "+convertFromIstio)
+	name := flags.String("name", istioProxyName, "the name of the config converted from "+convertFromIstio)
+	image := flags.String("image", "", "the proxy image for "+convertFromIstio+" when the annotations don't set sidecar.istio.io/proxyImage")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: simple-sidecar convert --from %s|%s [flags] <file or directory>...\n", convertFromSidecarInjector, convertFromIstio)
+		flags.PrintDefaults()
+	}
+	_ = flags.Parse(args)
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return 2
+	}
+
+	documents, err := readConvertDocuments(flags.Args())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to read the configs: %v\n", err)
+		return 1
+	}
+	warn := func(format string, a ...interface{}) {
+		fmt.Fprintf(os.Stderr, "WARN: "+format+"\n", a...)
+	}
+
+	var configs map[string]converted
+	switch *from {
+	case convertFromSidecarInjector:
+		configs, err = convertSidecarInjector(documents, warn)
+	case convertFromIstio:
+		configs, err = convertIstioAnnotations(documents, *name, *image, warn)
+	default:
+		flags.Usage()
+		return 2
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to convert the configs: %v\n", err)
+		return 1
+	}
+
+	data, err := yaml.Marshal(configs)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to encode the configs: %v\n", err)
+		return 1
+	}
+	// the result is only useful if it loads
+	if _, err := webhook.LoadConfigFromBytes(data); err != nil {
+		fmt.Fprintf(os.Stderr, "The converted configs don't load, fix them by hand:\n%s\n%v\n", data, err)
+		return 1
+	}
+	fmt.Print(string(data))
+	return 0
+}
+
+// convertDocument is a YAML document of a file to convert
+type convertDocument struct {
+	file string
+	data []byte
+}
+
+// readConvertDocuments reads the YAML documents of the files, and of the *.yaml, *.yml and *.json files
+// of directories, in lexical order
+func readConvertDocuments(paths []string) ([]convertDocument, error) {
+	var files []string
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		if !info.IsDir() {
+			files = append(files, path)
+			continue
+		}
+		entries, err := os.ReadDir(path)
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			switch filepath.Ext(entry.Name()) {
+			case ".yaml", ".yml", ".json":
+				if !entry.IsDir() && !strings.HasPrefix(entry.Name(), ".") {
+					files = append(files, filepath.Join(path, entry.Name()))
+				}
+			}
+		}
+	}
+	sort.Strings(files)
+
+	var documents []convertDocument
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		for _, doc := range bytes.Split(append([]byte("\n"), data...), []byte("\n---")) {
+			if len(bytes.TrimSpace(doc)) > 0 {
+				documents = append(documents, convertDocument{file: file, data: doc})
+			}
+		}
+	}
+	return documents, nil
+}
+
+// sidecarInjectorConfig is an injection config of tumblr/k8s-sidecar-injector
+type sidecarInjectorConfig struct {
+	Name           string               `json:"name"`
+	Inherits       string               `json:"inherits"`
+	Containers     []corev1.Container   `json:"containers"`
+	InitContainers []corev1.Container   `json:"initContainers"`
+	Volumes        []corev1.Volume      `json:"volumes"`
+	VolumeMounts   []corev1.VolumeMount `json:"volumeMounts"`
+	Env            []corev1.EnvVar      `json:"env"`
+
+	HostAliases        []corev1.HostAlias `json:"hostAliases"`
+	ServiceAccountName string             `json:"serviceAccountName"`
+	HostNetwork        bool               `json:"hostNetwork"`
+	HostPID            bool               `json:"hostPID"`
+}
+
+// convertSidecarInjector converts k8s-sidecar-injector configs, one per document, named after their name.
+// A config inheriting another's file extends the config of that file.
+func convertSidecarInjector(documents []convertDocument, warn func(string, ...interface{})) (map[string]converted, error) {
+	var injectorConfigs []sidecarInjectorConfig
+	names := map[string]string{}
+	for _, doc := range documents {
+		var c sidecarInjectorConfig
+		if err := yaml.Unmarshal(doc.data, &c); err != nil {
+			return nil, fmt.Errorf("%s: %v", doc.file, err)
+		}
+		if c.Name == "" {
+			return nil, fmt.Errorf("%s: a config needs a name", doc.file)
+		}
+		if other, ok := names[c.Name]; ok {
+			return nil, fmt.Errorf("%s: config %s is also defined in %s", doc.file, c.Name, other)
+		}
+		names[c.Name] = doc.file
+		injectorConfigs = append(injectorConfigs, c)
+	}
+	// inherits names a file, relative to the injector's config directory
+	byFile := map[string]string{}
+	for name, file := range names {
+		byFile[filepath.Base(file)] = name
+	}
+
+	configs := map[string]converted{}
+	for _, c := range injectorConfigs {
+		config := converted{}
+		if c.Inherits != "" {
+			if base, ok := byFile[filepath.Base(c.Inherits)]; ok {
+				config["extends"] = base
+			} else {
+				warn("config %s: inherits %s, which isn't among the converted files, convert it too or merge it by hand", c.Name, c.Inherits)
+			}
+		}
+		setList(config, "containers", c.Containers)
+		setList(config, "initContainers", c.InitContainers)
+		setList(config, "volumes", c.Volumes)
+		setList(config, "volumeMounts", c.VolumeMounts)
+		setList(config, "envVars", c.Env)
+		if len(c.HostAliases) > 0 {
+			warn("config %s: hostAliases aren't supported, skipped", c.Name)
+		}
+		if c.ServiceAccountName != "" {
+			warn("config %s: serviceAccountName isn't supported, skipped", c.Name)
+		}
+		if c.HostNetwork || c.HostPID {
+			warn("config %s: hostNetwork and hostPID aren't supported, skipped", c.Name)
+		}
+		configs[c.Name] = config
+	}
+	return configs, nil
+}
+
+// istio's sidecar annotations
+const (
+	istioInjectAnnotation           = "sidecar.istio.io/inject"
+	istioProxyImageAnnotation       = "sidecar.istio.io/proxyImage"
+	istioProxyCPUAnnotation         = "sidecar.istio.io/proxyCPU"
+	istioProxyMemoryAnnotation      = "sidecar.istio.io/proxyMemory"
+	istioProxyCPULimitAnnotation    = "sidecar.istio.io/proxyCPULimit"
+	istioProxyMemoryLimitAnnotation = "sidecar.istio.io/proxyMemoryLimit"
+	istioUserVolumeAnnotation       = "sidecar.istio.io/userVolume"
+	istioUserVolumeMountAnnotation  = "sidecar.istio.io/userVolumeMount"
+)
+
+// convertIstioAnnotations converts the istio sidecar annotations of a pod, a workload's pod template or a
+// plain map of annotations into a config injecting the proxy container. The annotations of every document
+// are merged, later ones win.
+func convertIstioAnnotations(documents []convertDocument, name, image string, warn func(string, ...interface{})) (map[string]converted, error) {
+	annotations := map[string]string{}
+	for _, doc := range documents {
+		found, err := istioDocumentAnnotations(doc.data)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", doc.file, err)
+		}
+		for key, value := range found {
+			annotations[key] = value
+		}
+	}
+
+	proxy := corev1.Container{Name: istioProxyName, Image: image}
+	var volumes []corev1.Volume
+	keys := make([]string, 0, len(annotations))
+	for key := range annotations {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		value := annotations[key]
+		var err error
+		switch key {
+		case istioInjectAnnotation:
+		case istioProxyImageAnnotation:
+			proxy.Image = value
+		case istioProxyCPUAnnotation:
+			err = setQuantity(&proxy.Resources.Requests, corev1.ResourceCPU, value)
+		case istioProxyMemoryAnnotation:
+			err = setQuantity(&proxy.Resources.Requests, corev1.ResourceMemory, value)
+		case istioProxyCPULimitAnnotation:
+			err = setQuantity(&proxy.Resources.Limits, corev1.ResourceCPU, value)
+		case istioProxyMemoryLimitAnnotation:
+			err = setQuantity(&proxy.Resources.Limits, corev1.ResourceMemory, value)
+		case istioUserVolumeAnnotation:
+			var byName map[string]corev1.Volume
+			if err = json.Unmarshal([]byte(value), &byName); err == nil {
+				for _, volumeName := range sortedKeys(byName) {
+					volume := byName[volumeName]
+					volume.Name = volumeName
+					volumes = append(volumes, volume)
+				}
+			}
+		case istioUserVolumeMountAnnotation:
+			var byName map[string]corev1.VolumeMount
+			if err = json.Unmarshal([]byte(value), &byName); err == nil {
+				for _, volumeName := range sortedKeys(byName) {
+					mount := byName[volumeName]
+					mount.Name = volumeName
+					proxy.VolumeMounts = append(proxy.VolumeMounts, mount)
+				}
+			}
+		default:
+			if strings.HasPrefix(key, "sidecar.istio.io/") || strings.HasPrefix(key, "proxy.istio.io/") {
+				warn("annotation %s isn't supported, skipped", key)
+			}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("annotation %s: %v", key, err)
+		}
+	}
+	if proxy.Image == "" {
+		return nil, fmt.Errorf("there's no %s annotation, set the proxy image with -image", istioProxyImageAnnotation)
+	}
+
+	config := converted{}
+	setList(config, "containers", []corev1.Container{proxy})
+	setList(config, "volumes", volumes)
+	warn("config %s: istio also configures the proxy, traffic interception and certificates through its mesh config, only the annotations were converted", name)
+	return map[string]converted{name: config}, nil
+}
+
+// istioDocumentAnnotations returns the annotations of a pod, of the pod template of a workload, or the
+// document itself if it's a map of annotations
+func istioDocumentAnnotations(data []byte) (map[string]string, error) {
+	var object struct {
+		Kind     string `json:"kind"`
+		Metadata struct {
+			Annotations map[string]string `json:"annotations"`
+		} `json:"metadata"`
+		Spec struct {
+			Template struct {
+				Metadata struct {
+					Annotations map[string]string `json:"annotations"`
+				} `json:"metadata"`
+			} `json:"template"`
+		} `json:"spec"`
+	}
+	if err := yaml.Unmarshal(data, &object); err == nil && object.Kind != "" {
+		if object.Kind == "Pod" {
+			return object.Metadata.Annotations, nil
+		}
+		return object.Spec.Template.Metadata.Annotations, nil
+	}
+	var annotations map[string]string
+	if err := yaml.Unmarshal(data, &annotations); err != nil {
+		return nil, fmt.Errorf("not a pod, a workload or a map of annotations: %v", err)
+	}
+	return annotations, nil
+}
+
+// setQuantity parses the quantity and sets it for the resource
+func setQuantity(list *corev1.ResourceList, name corev1.ResourceName, value string) error {
+	quantity, err := resource.ParseQuantity(value)
+	if err != nil {
+		return err
+	}
+	if *list == nil {
+		*list = corev1.ResourceList{}
+	}
+	(*list)[name] = quantity
+	return nil
+}
+
+// setList sets the key of the config to the list unless it's empty
+func setList[T any](config converted, key string, list []T) {
+	if len(list) > 0 {
+		config[key] = list
+	}
+}
+
+// sortedKeys returns the keys of the map in order
+func sortedKeys[T any](m map[string]T) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -7,13 +7,12 @@ import (
 	"syscall"
 
 	"github.com/centml/simple-sidecar/pkg/webhook"
-	"github.com/spf13/viper"
 )
 
 var (
-	infoLogger    *log.Logger
-	warnLogger *log.Logger
-	errorLogger   *log.Logger
+	infoLogger  *log.Logger
+	warnLogger  *log.Logger
+	errorLogger *log.Logger
 )
 
 func init() {
@@ -21,28 +20,26 @@ func init() {
 	infoLogger = log.New(os.Stderr, "INFO: ", log.Ldate|log.Ltime|log.Lshortfile)
 	warnLogger = log.New(os.Stderr, "WARN: ", log.Ldate|log.Ltime|log.Lshortfile)
 	errorLogger = log.New(os.Stderr, "ERROR: ", log.Ldate|log.Ltime|log.Lshortfile)
-
-	viper.AutomaticEnv()
-	viper.SetDefault("PORT", 8443)
-	viper.SetDefault("CONFIG_FILE", "/etc/webhook/config/sidecarconfig.yaml")
-	viper.SetDefault("CERT_FILE", "/etc/webhook/certs/tls.crt")
-	viper.SetDefault("KEY_FILE", "/etc/webhook/certs/tls.key")
 }
 
 func main() {
-	sidecarConfigs, err := webhook.LoadConfig(viper.GetString("CONFIG_FILE"))
-	if err != nil {
-		errorLogger.Fatalf("Failed to load configuration: %v", err)
+	if len(os.Args) > 1 && os.Args[1] == "validate" {
+		os.Exit(validate(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "convert" {
+		os.Exit(convert(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "simulate" {
+		os.Exit(simulate(os.Args[2:]))
 	}
 
-	cfg := &webhook.WebhookServerConfig{
-		Port:           viper.GetInt("PORT"),
-		CertPEM:        viper.GetString("CERT_FILE"),
-		KeyPEM:         viper.GetString("KEY_FILE"),
-		SidecarConfigs: sidecarConfigs,
-		InfoLogger:     infoLogger,
-		WarnLogger:     warnLogger,
-		ErrorLogger:    errorLogger,
+	opts, err := webhook.LoadServerConfigFromEnv()
+	if err != nil {
+		errorLogger.Fatalf("Failed to read the webhook server options: %v", err)
+	}
+	cfg, err := opts.WebhookServerConfig(infoLogger, warnLogger, errorLogger)
+	if err != nil {
+		errorLogger.Fatalf("Failed to configure webhook server: %v", err)
 	}
 	whsvr := webhook.NewWebhookServer(cfg)
 
@@ -53,6 +50,17 @@ func main() {
 		}
 	}()
 
+	// SIGHUP forces a config reload, e.g. after updating the ConfigMap
+	reloadChan := make(chan os.Signal, 1)
+	signal.Notify(reloadChan, syscall.SIGHUP)
+	go func() {
+		for range reloadChan {
+			infoLogger.Printf("Got SIGHUP, reloading configs...")
+			// failures are logged and the current configs are kept
+			_ = whsvr.ReloadConfig()
+		}
+	}()
+
 	// listening OS shutdown singal
 	signalChan := make(chan os.Signal, 1)
 	signal.Notify(signalChan, syscall.SIGINT, syscall.SIGTERM)
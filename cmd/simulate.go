@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"text/tabwriter"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/tools/clientcmd"
+	"sigs.k8s.io/yaml"
+
+	"github.com/centml/simple-sidecar/pkg/webhook"
+)
+
+// simulate reports what changing the configs from one file to another does to a set of pods: the pods
+// of exported manifests, or the live pods of the current kubeconfig context. It returns the exit code for
+// the process, 1 if a pod conflicts with the new configs.
+func simulate(args []string) int {
+	flags := flag.NewFlagSet("simulate", flag.ExitOnError)
+	selector := flags.String("selector", "", "the label selector of the live pods, when no manifests are given")
+	namespace := flags.String("namespace", "", "the namespace of the live pods, all namespaces if empty")
+	asJSON := flags.Bool("json", false, "write the report as JSON")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: simple-sidecar simulate [flags] <base config> <head config> [<pod manifest file or directory>...]\n")
+		flags.PrintDefaults()
+	}
+	_ = flags.Parse(args)
+	if flags.NArg() < 2 {
+		flags.Usage()
+		return 2
+	}
+
+	opts, err := configLoadOptions()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 1
+	}
+	servers := make([]*webhook.WebhookServer, 2)
+	for i, configFile := range flags.Args()[:2] {
+		configs, err := webhook.LoadConfigWithOptions(configFile, opts)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to load configuration %s: %v\n", configFile, err)
+			return 1
+		}
+		discard := log.New(io.Discard, "", 0)
+		servers[i] = webhook.NewWebhookServer(&webhook.WebhookServerConfig{
+			SidecarConfigs: configs,
+			InfoLogger:     discard,
+			WarnLogger:     discard,
+			ErrorLogger:    discard,
+		})
+	}
+
+	var pods []corev1.Pod
+	if paths := flags.Args()[2:]; len(paths) > 0 {
+		pods, err = readPodManifests(paths)
+	} else {
+		pods, err = listLivePods(*namespace, *selector)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to read the pods: %v\n", err)
+		return 1
+	}
+
+	report := webhook.Simulate(servers[0], servers[1], pods)
+	if *asJSON {
+		data, err := json.MarshalIndent(struct {
+			Configs []webhook.ConfigSimulation `json:"configs"`
+			Pods    []webhook.SimulatedPod     `json:"pods"`
+		}{report.ByConfig(), report.Pods}, "", "  ")
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to encode the report: %v\n", err)
+			return 1
+		}
+		fmt.Println(string(data))
+	} else {
+		printSimulation(report)
+	}
+	if report.Count(webhook.SimulationConflicted) > 0 {
+		return 1
+	}
+	return 0
+}
+
+// printSimulation writes the outcomes by config and the pods the change does something to
+func printSimulation(report webhook.SimulationReport) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "CONFIG\tINJECTED\tREINJECTED\tREMOVED\tCONFLICTED\tUNCHANGED")
+	for _, c := range report.ByConfig() {
+		fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%d\t%d\n", c.Config, c.Injected, c.Reinjected, c.Removed, c.Conflicted, c.Unchanged)
+	}
+	_ = w.Flush()
+
+	changed := false
+	for _, pod := range report.Pods {
+		if pod.Outcome == webhook.SimulationUnchanged {
+			continue
+		}
+		if !changed {
+			fmt.Println()
+			changed = true
+		}
+		line := fmt.Sprintf("%-10s %s/%s (%s)", pod.Outcome, pod.Namespace, pod.Name, pod.Config)
+		if pod.Reason != "" {
+			line += ": " + pod.Reason
+		}
+		fmt.Println(line)
+	}
+	fmt.Printf("\n%d pods: %s\n", len(report.Pods), report.Summary())
+}
+
+// readPodManifests reads the pods of the YAML or JSON documents of the files and directories, as written
+// by kubectl get pods -o yaml. Lists are read item by item and documents of other kinds are skipped.
+func readPodManifests(paths []string) ([]corev1.Pod, error) {
+	documents, err := readConvertDocuments(paths)
+	if err != nil {
+		return nil, err
+	}
+	var pods []corev1.Pod
+	for _, doc := range documents {
+		var object struct {
+			Kind  string            `json:"kind"`
+			Items []json.RawMessage `json:"items"`
+		}
+		if err := yaml.Unmarshal(doc.data, &object); err != nil {
+			return nil, fmt.Errorf("%s: %v", doc.file, err)
+		}
+		items := [][]byte{doc.data}
+		switch object.Kind {
+		case "Pod":
+		case "List", "PodList":
+			items = items[:0]
+			for _, item := range object.Items {
+				items = append(items, item)
+			}
+		default:
+			continue
+		}
+		for _, item := range items {
+			var pod corev1.Pod
+			if err := yaml.Unmarshal(item, &pod); err != nil {
+				return nil, fmt.Errorf("%s: %v", doc.file, err)
+			}
+			// the items of a PodList have no kind, those of a List may be of any
+			if object.Kind == "List" && pod.Kind != "Pod" {
+				continue
+			}
+			pods = append(pods, pod)
+		}
+	}
+	return pods, nil
+}
+
+// listLivePods lists the pods matching the selector with the current kubeconfig context, or in-cluster
+// config
+func listLivePods(namespace, selector string) ([]corev1.Pod, error) {
+	rules := clientcmd.NewDefaultClientConfigLoadingRules()
+	restConfig, err := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(rules, &clientcmd.ConfigOverrides{}).ClientConfig()
+	if err != nil {
+		return nil, err
+	}
+	client, err := dynamic.NewForConfig(restConfig)
+	if err != nil {
+		return nil, err
+	}
+	list, err := client.Resource(schema.GroupVersionResource{Version: "v1", Resource: "pods"}).Namespace(namespace).
+		List(context.Background(), metav1.ListOptions{LabelSelector: selector})
+	if err != nil {
+		return nil, err
+	}
+	pods := make([]corev1.Pod, len(list.Items))
+	for i, item := range list.Items {
+		if err := runtime.DefaultUnstructuredConverter.FromUnstructured(item.Object, &pods[i]); err != nil {
+			return nil, err
+		}
+	}
+	return pods, nil
+}
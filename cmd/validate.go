@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/centml/simple-sidecar/pkg/webhook"
+)
+
+// validate loads the config file given as the first argument (or CONFIG_FILE) and runs the tests
+// declared in it. It returns the exit code for the process.
+func validate(args []string) int {
+	server, err := webhook.LoadServerConfigFromEnv()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 1
+	}
+	configFile := server.ConfigFile
+	if len(args) > 0 {
+		configFile = args[0]
+	}
+
+	opts, err := server.ConfigLoadOptions(log.New(os.Stderr, "", 0))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 1
+	}
+	sidecarConfigs, err := webhook.LoadConfigWithOptions(configFile, opts)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to load configuration %s: %v\n", configFile, err)
+		return 1
+	}
+
+	failed := 0
+	results := webhook.RunConfigTests(sidecarConfigs)
+	for _, result := range results {
+		if result.Passed() {
+			fmt.Printf("PASS %s/%s\n", result.Config, result.Test)
+			continue
+		}
+		failed++
+		fmt.Printf("FAIL %s/%s\n", result.Config, result.Test)
+		for _, e := range result.Errors {
+			fmt.Printf("    %s\n", e)
+		}
+	}
+
+	fmt.Printf("%d configs, %d tests, %d failed\n", len(sidecarConfigs), len(results), failed)
+	if failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+// configLoadOptions returns the options the server loads config files with, from the same variables
+func configLoadOptions() (webhook.ConfigLoadOptions, error) {
+	server, err := webhook.LoadServerConfigFromEnv()
+	if err != nil {
+		return webhook.ConfigLoadOptions{}, err
+	}
+	return server.ConfigLoadOptions(log.New(os.Stderr, "", 0))
+}
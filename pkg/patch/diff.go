@@ -0,0 +1,183 @@
+package patch
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"sort"
+	"strconv"
+)
+
+// null is the value of operations setting null, a nil Value would be left out of the operation
+var null = json.RawMessage("null")
+
+// Diff returns the operations turning the original JSON document into the modified one. Objects are
+// compared key by key and lists element by element, so only what changed is patched and list elements
+// are always addressed by index, never with "-". Elements of lists are matched by name when they're
+// objects with one, e.g. containers, env vars and volumes, and by value otherwise.
+func Diff(original, modified []byte) ([]Operation, error) {
+	a, err := decode(original)
+	if err != nil {
+		return nil, err
+	}
+	b, err := decode(modified)
+	if err != nil {
+		return nil, err
+	}
+	return diffValues("", a, b), nil
+}
+
+// decode decodes a JSON document keeping numbers as they're written
+func decode(data []byte) (interface{}, error) {
+	d := json.NewDecoder(bytes.NewReader(data))
+	d.UseNumber()
+	var v interface{}
+	if err := d.Decode(&v); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// diffValues returns the operations turning a into b at path
+func diffValues(path string, a, b interface{}) []Operation {
+	switch a := a.(type) {
+	case map[string]interface{}:
+		if b, ok := b.(map[string]interface{}); ok {
+			return diffObjects(path, a, b)
+		}
+	case []interface{}:
+		if b, ok := b.([]interface{}); ok {
+			return diffLists(path, a, b)
+		}
+	}
+	if reflect.DeepEqual(a, b) {
+		return nil
+	}
+	return []Operation{Replace(path, value(b))}
+}
+
+// diffObjects returns the operations turning the object a into b at path, by key in order
+func diffObjects(path string, a, b map[string]interface{}) []Operation {
+	keys := make([]string, 0, len(a)+len(b))
+	for key := range a {
+		keys = append(keys, key)
+	}
+	for key := range b {
+		if _, ok := a[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	var ops []Operation
+	for _, key := range keys {
+		keyPath := path + "/" + EscapeJSONPointer(key)
+		av, inA := a[key]
+		bv, inB := b[key]
+		switch {
+		case !inB:
+			ops = append(ops, Operation{Op: "remove", Path: keyPath})
+		case !inA:
+			ops = append(ops, Operation{Op: "add", Path: keyPath, Value: value(bv)})
+		default:
+			ops = append(ops, diffValues(keyPath, av, bv)...)
+		}
+	}
+	return ops
+}
+
+// diffLists returns the operations turning the list a into b at path. The elements a and b have in
+// common, in order, are kept and patched in place, the rest of a is removed from the highest index down
+// and the rest of b is added at its index.
+func diffLists(path string, a, b []interface{}) []Operation {
+	matches := matchElements(a, b)
+	if len(matches) == 0 && len(a) > 0 {
+		return []Operation{Replace(path, b)}
+	}
+
+	kept := make(map[int]bool, len(matches))
+	matched := make(map[int]int, len(matches))
+	for _, m := range matches {
+		kept[m[0]] = true
+		matched[m[1]] = m[0]
+	}
+	var removed []int
+	for i := range a {
+		if !kept[i] {
+			removed = append(removed, i)
+		}
+	}
+	ops := RemoveFromList(path, removed)
+	// once the rest of a is removed, the elements before index j are final when b[j] is reached
+	for j, bv := range b {
+		elementPath := path + "/" + strconv.Itoa(j)
+		if i, ok := matched[j]; ok {
+			ops = append(ops, diffValues(elementPath, a[i], bv)...)
+		} else {
+			ops = append(ops, Operation{Op: "add", Path: elementPath, Value: value(bv)})
+		}
+	}
+	return ops
+}
+
+// matchElements returns the index pairs of the longest common sequence of elements of a and b, by
+// identity
+func matchElements(a, b []interface{}) [][2]int {
+	ka, kb := identities(a), identities(b)
+	// lengths[i][j] is the length of the longest common sequence of a[i:] and b[j:]
+	lengths := make([][]int, len(a)+1)
+	for i := range lengths {
+		lengths[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			switch {
+			case ka[i] == kb[j]:
+				lengths[i][j] = lengths[i+1][j+1] + 1
+			case lengths[i+1][j] >= lengths[i][j+1]:
+				lengths[i][j] = lengths[i+1][j]
+			default:
+				lengths[i][j] = lengths[i][j+1]
+			}
+		}
+	}
+	var matches [][2]int
+	for i, j := 0, 0; i < len(a) && j < len(b); {
+		switch {
+		case ka[i] == kb[j]:
+			matches = append(matches, [2]int{i, j})
+			i++
+			j++
+		case lengths[i+1][j] >= lengths[i][j+1]:
+			i++
+		default:
+			j++
+		}
+	}
+	return matches
+}
+
+// identities returns what identifies each element of the list: the name of objects with a name, the
+// value of everything else
+func identities(list []interface{}) []string {
+	keys := make([]string, len(list))
+	for i, v := range list {
+		if object, ok := v.(map[string]interface{}); ok {
+			if name, ok := object["name"].(string); ok {
+				keys[i] = "name\x00" + name
+				continue
+			}
+		}
+		data, _ := json.Marshal(v)
+		keys[i] = "value\x00" + string(data)
+	}
+	return keys
+}
+
+// value returns v as the value of an operation
+func value(v interface{}) interface{} {
+	if v == nil {
+		return null
+	}
+	return v
+}
@@ -0,0 +1,164 @@
+package patch
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	jsonpatch "github.com/evanphx/json-patch"
+)
+
+func TestDiff(t *testing.T) {
+	tests := []struct {
+		name     string
+		original string
+		modified string
+		want     string
+	}{
+		{
+			name:     "no changes",
+			original: `{"a":1,"b":[{"name":"x"}]}`,
+			modified: `{"a":1,"b":[{"name":"x"}]}`,
+			want:     `[]`,
+		},
+		{
+			name:     "inserts in the middle of a list by index",
+			original: `{"c":[{"name":"a"},{"name":"c"}]}`,
+			modified: `{"c":[{"name":"a"},{"name":"b"},{"name":"c"}]}`,
+			want:     `[{"op":"add","path":"/c/1","value":{"name":"b"}}]`,
+		},
+		{
+			name:     "removes from the middle of a list from the highest index down",
+			original: `{"c":[{"name":"a"},{"name":"b"},{"name":"c"},{"name":"d"}]}`,
+			modified: `{"c":[{"name":"a"},{"name":"c"}]}`,
+			want:     `[{"op":"remove","path":"/c/3"},{"op":"remove","path":"/c/1"}]`,
+		},
+		{
+			name:     "removes and inserts in the same list",
+			original: `{"c":[{"name":"a"},{"name":"old"},{"name":"c"}]}`,
+			modified: `{"c":[{"name":"new"},{"name":"a"},{"name":"c"},{"name":"d"}]}`,
+			want: `[{"op":"remove","path":"/c/1"},{"op":"add","path":"/c/0","value":{"name":"new"}},` +
+				`{"op":"add","path":"/c/3","value":{"name":"d"}}]`,
+		},
+		{
+			name:     "patches matched elements in place",
+			original: `{"env":[{"name":"A","value":"1"},{"name":"B","value":"2"}]}`,
+			modified: `{"env":[{"name":"A","value":"9"},{"name":"B","value":"2"}]}`,
+			want:     `[{"op":"replace","path":"/env/0/value","value":"9"}]`,
+		},
+		{
+			name:     "matches elements with duplicate names in order",
+			original: `{"env":[{"name":"A","value":"1"},{"name":"A","value":"2"}]}`,
+			modified: `{"env":[{"name":"A","value":"1"},{"name":"A","value":"3"},{"name":"A","value":"4"}]}`,
+			want: `[{"op":"replace","path":"/env/1/value","value":"3"},` +
+				`{"op":"add","path":"/env/2","value":{"name":"A","value":"4"}}]`,
+		},
+		{
+			name:     "matches elements without a name by value",
+			original: `{"t":[{"key":"a"},{"key":"b"}]}`,
+			modified: `{"t":[{"key":"a"},{"key":"c"},{"key":"b"}]}`,
+			want:     `[{"op":"add","path":"/t/1","value":{"key":"c"}}]`,
+		},
+		{
+			name:     "replaces a list without elements in common",
+			original: `{"args":["a","b"]}`,
+			modified: `{"args":["c"]}`,
+			want:     `[{"op":"replace","path":"/args","value":["c"]}]`,
+		},
+		{
+			name:     "adds to an empty list by index",
+			original: `{"args":[]}`,
+			modified: `{"args":["a","b"]}`,
+			want:     `[{"op":"add","path":"/args/0","value":"a"},{"op":"add","path":"/args/1","value":"b"}]`,
+		},
+		{
+			name:     "adds a missing list whole",
+			original: `{}`,
+			modified: `{"env":[{"name":"A"}]}`,
+			want:     `[{"op":"add","path":"/env","value":[{"name":"A"}]}]`,
+		},
+		{
+			name:     "sets null values",
+			original: `{"a":1,"b":{"c":2}}`,
+			modified: `{"a":null,"b":{"c":2,"d":null}}`,
+			want:     `[{"op":"replace","path":"/a","value":null},{"op":"add","path":"/b/d","value":null}]`,
+		},
+		{
+			name:     "replaces null values",
+			original: `{"a":null}`,
+			modified: `{"a":{"b":1}}`,
+			want:     `[{"op":"replace","path":"/a","value":{"b":1}}]`,
+		},
+		{
+			name:     "removes absent keys",
+			original: `{"a":null,"b":1,"c":{"d":1}}`,
+			modified: `{"c":{}}`,
+			want:     `[{"op":"remove","path":"/a"},{"op":"remove","path":"/b"},{"op":"remove","path":"/c/d"}]`,
+		},
+		{
+			name:     "escapes keys",
+			original: `{"metadata":{"annotations":{"example.com/a":"1","a~b":"1"}}}`,
+			modified: `{"metadata":{"annotations":{"example.com/a":"2","a~b":"2","c~/d":"3"}}}`,
+			want: `[{"op":"replace","path":"/metadata/annotations/a~0b","value":"2"},` +
+				`{"op":"add","path":"/metadata/annotations/c~0~1d","value":"3"},` +
+				`{"op":"replace","path":"/metadata/annotations/example.com~1a","value":"2"}]`,
+		},
+		{
+			name:     "keeps numbers as written",
+			original: `{"n":10,"m":1.50}`,
+			modified: `{"n":10.0,"m":1.50}`,
+			want:     `[{"op":"replace","path":"/n","value":10.0}]`,
+		},
+		{
+			name:     "replaces values of another type",
+			original: `{"a":[1],"b":{"c":1},"d":"x"}`,
+			modified: `{"a":{"c":1},"b":[1],"d":1}`,
+			want: `[{"op":"replace","path":"/a","value":{"c":1}},{"op":"replace","path":"/b","value":[1]},` +
+				`{"op":"replace","path":"/d","value":1}]`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ops, err := Diff([]byte(tt.original), []byte(tt.modified))
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := Marshal(ops)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("Diff() = %s, want %s", got, tt.want)
+			}
+
+			// the operations turn the original into the modified document
+			p, err := jsonpatch.DecodePatch(got)
+			if err != nil {
+				t.Fatal(err)
+			}
+			patched, err := p.Apply([]byte(tt.original))
+			if err != nil {
+				t.Fatalf("applying %s: %v", got, err)
+			}
+			var gotDoc, wantDoc interface{}
+			if err := json.Unmarshal(patched, &gotDoc); err != nil {
+				t.Fatal(err)
+			}
+			if err := json.Unmarshal([]byte(tt.modified), &wantDoc); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(gotDoc, wantDoc) {
+				t.Errorf("applying %s = %s, want %s", got, patched, tt.modified)
+			}
+		})
+	}
+}
+
+func TestDiffInvalid(t *testing.T) {
+	if _, err := Diff([]byte(`{`), []byte(`{}`)); err == nil {
+		t.Error("Diff() of an invalid original succeeded")
+	}
+	if _, err := Diff([]byte(`{}`), []byte(`[`)); err == nil {
+		t.Error("Diff() of an invalid modified succeeded")
+	}
+}
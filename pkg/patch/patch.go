@@ -0,0 +1,99 @@
+// Package patch builds RFC 6902 JSON patches for Kubernetes objects. The helpers take care of the
+// details that are easy to get wrong when patching by hand: a list or map that doesn't exist yet has to
+// be created with its first element rather than appended to, and map keys have to be escaped before
+// they're used in a path.
+package patch
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Operation is a single JSON patch operation.
+type Operation struct {
+	Op    string      `json:"op"`
+	Path  string      `json:"path"`
+	From  string      `json:"from,omitempty"`
+	Value interface{} `json:"value,omitempty"`
+}
+
+// AddToList returns the operations appending added to the list at path, existing is the current content
+// of the list. When the list is empty it may not exist at all, so it's created with the first element
+// and the rest are appended to it.
+func AddToList[T any](existing, added []T, path string) []Operation {
+	var ops []Operation
+	first := len(existing) == 0
+	for _, add := range added {
+		if first {
+			first = false
+			ops = append(ops, Operation{Op: "add", Path: path, Value: []T{add}})
+			continue
+		}
+		ops = append(ops, Operation{Op: "add", Path: path + "/-", Value: add})
+	}
+	return ops
+}
+
+// SetMapEntries returns the operations setting the added entries of the string map at path, such as
+// /metadata/annotations or /metadata/labels, existing is the current content of the map. A nil map is
+// created with all the entries, otherwise each entry is added or replaced individually so the other
+// entries are preserved. Operations are sorted by key so the patch is deterministic.
+func SetMapEntries(existing, added map[string]string, path string) []Operation {
+	if len(added) == 0 {
+		return nil
+	}
+	if existing == nil {
+		return []Operation{{Op: "add", Path: path, Value: added}}
+	}
+
+	keys := make([]string, 0, len(added))
+	for key := range added {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	ops := make([]Operation, 0, len(keys))
+	for _, key := range keys {
+		op := "add"
+		if _, ok := existing[key]; ok {
+			op = "replace"
+		}
+		ops = append(ops, Operation{Op: op, Path: path + "/" + EscapeJSONPointer(key), Value: added[key]})
+	}
+	return ops
+}
+
+// RemoveFromList returns the operations removing the elements at indexes from the list at path. They're
+// removed from the highest index down so every index still refers to the original list.
+func RemoveFromList(path string, indexes []int) []Operation {
+	sorted := append([]int(nil), indexes...)
+	sort.Sort(sort.Reverse(sort.IntSlice(sorted)))
+	ops := make([]Operation, 0, len(sorted))
+	for i, index := range sorted {
+		if i > 0 && index == sorted[i-1] {
+			continue
+		}
+		ops = append(ops, Operation{Op: "remove", Path: fmt.Sprintf("%s/%d", path, index)})
+	}
+	return ops
+}
+
+// Replace returns the operation replacing the value at path.
+func Replace(path string, value interface{}) Operation {
+	return Operation{Op: "replace", Path: path, Value: value}
+}
+
+// EscapeJSONPointer escapes a map key for use as a segment of a JSON patch path (RFC 6901).
+func EscapeJSONPointer(key string) string {
+	return strings.ReplaceAll(strings.ReplaceAll(key, "~", "~0"), "/", "~1")
+}
+
+// Marshal encodes the operations as a JSON patch.
+func Marshal(ops []Operation) ([]byte, error) {
+	if ops == nil {
+		ops = []Operation{}
+	}
+	return json.Marshal(ops)
+}
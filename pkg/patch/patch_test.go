@@ -0,0 +1,116 @@
+package patch
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestAddToList(t *testing.T) {
+	tests := []struct {
+		name     string
+		existing []string
+		added    []string
+		want     []Operation
+	}{
+		{
+			name:  "creates the list with the first element",
+			added: []string{"a", "b"},
+			want: []Operation{
+				{Op: "add", Path: "/spec/list", Value: []string{"a"}},
+				{Op: "add", Path: "/spec/list/-", Value: "b"},
+			},
+		},
+		{
+			name:     "appends to an existing list",
+			existing: []string{"x"},
+			added:    []string{"a", "b"},
+			want: []Operation{
+				{Op: "add", Path: "/spec/list/-", Value: "a"},
+				{Op: "add", Path: "/spec/list/-", Value: "b"},
+			},
+		},
+		{
+			name:     "adds nothing",
+			existing: []string{"x"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := AddToList(tt.existing, tt.added, "/spec/list"); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("AddToList() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSetMapEntries(t *testing.T) {
+	added := map[string]string{"b.io/y": "2", "a": "1"}
+	tests := []struct {
+		name     string
+		existing map[string]string
+		added    map[string]string
+		want     []Operation
+	}{
+		{
+			name:  "creates a nil map with all the entries",
+			added: added,
+			want:  []Operation{{Op: "add", Path: "/metadata/labels", Value: added}},
+		},
+		{
+			name:     "adds and replaces entries of an existing map by key",
+			existing: map[string]string{"a": "0", "c": "3"},
+			added:    added,
+			want: []Operation{
+				{Op: "replace", Path: "/metadata/labels/a", Value: "1"},
+				{Op: "add", Path: "/metadata/labels/b.io~1y", Value: "2"},
+			},
+		},
+		{
+			name:     "adds nothing",
+			existing: map[string]string{"a": "0"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := SetMapEntries(tt.existing, tt.added, "/metadata/labels"); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("SetMapEntries() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRemoveFromList(t *testing.T) {
+	want := []Operation{
+		{Op: "remove", Path: "/spec/volumes/4"},
+		{Op: "remove", Path: "/spec/volumes/2"},
+		{Op: "remove", Path: "/spec/volumes/0"},
+	}
+	if got := RemoveFromList("/spec/volumes", []int{2, 0, 4, 2}); !reflect.DeepEqual(got, want) {
+		t.Errorf("RemoveFromList() = %v, want %v", got, want)
+	}
+}
+
+func TestEscapeJSONPointer(t *testing.T) {
+	tests := map[string]string{
+		"plain":              "plain",
+		"example.com/key":    "example.com~1key",
+		"a~b":                "a~0b",
+		"~/":                 "~0~1",
+		"simple-sidecar/a~1": "simple-sidecar~1a~01",
+	}
+	for key, want := range tests {
+		if got := EscapeJSONPointer(key); got != want {
+			t.Errorf("EscapeJSONPointer(%q) = %q, want %q", key, got, want)
+		}
+	}
+}
+
+func TestMarshal(t *testing.T) {
+	got, err := Marshal(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "[]" {
+		t.Errorf("Marshal(nil) = %s, want []", got)
+	}
+}
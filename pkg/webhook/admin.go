@@ -0,0 +1,90 @@
+package webhook
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+const (
+	adminConfigReportPath = "/admin/config-report"
+)
+
+// newAdminServer creates the plain HTTP server for the admin API, it's only started when an admin
+// port is configured.
+func (whs *WebhookServer) newAdminServer(port int) *http.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc(adminConfigReportPath, whs.serveConfigReport)
+	mux.HandleFunc(adminReadyPath, whs.serveReady)
+	mux.HandleFunc(adminInventoryPath, whs.serveInventory)
+	mux.HandleFunc(adminFreezePath, whs.serveFreeze)
+	mux.Handle(adminMetricsPath, serveMetrics)
+	return &http.Server{
+		Addr:    fmt.Sprintf(":%v", port),
+		Handler: mux,
+	}
+}
+
+// authorizeAdmin returns whether the request carries the admin token as a bearer token, and writes the
+// error response if it doesn't. Without an admin token nothing may be changed through the admin API.
+func (whs *WebhookServer) authorizeAdmin(w http.ResponseWriter, r *http.Request) bool {
+	if whs.adminToken == "" {
+		http.Error(w, "the admin API is read-only, no admin token is configured", http.StatusForbidden)
+		return false
+	}
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(whs.adminToken)) != 1 {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+// writeJSON writes v as an indented JSON response
+func (whs *WebhookServer) writeJSON(w http.ResponseWriter, v interface{}) {
+	resp, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		whs.warningLogger.Printf("Can't encode admin response: %v", err)
+		http.Error(w, fmt.Sprintf("could not encode response: %v", err), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if _, err := w.Write(resp); err != nil {
+		whs.warningLogger.Printf("Can't write admin response: %v", err)
+	}
+}
+
+// configReports returns the reports for the configs of this server and its tenants
+func (whs *WebhookServer) configReports() []ConfigReport {
+	var reports []ConfigReport
+	for _, server := range append([]*WebhookServer{whs}, whs.tenants...) {
+		for _, report := range BuildConfigReports(server.state().sidecarConfigs) {
+			report.Tenant = server.name
+			reports = append(reports, report)
+		}
+	}
+	return reports
+}
+
+// serveConfigReport serves the sanity report of the loaded configs
+func (whs *WebhookServer) serveConfigReport(w http.ResponseWriter, r *http.Request) {
+	whs.writeJSON(w, whs.configReports())
+}
+
+// logConfigReports logs a one line JSON report per config, warnings are logged separately so they stand out
+func (whs *WebhookServer) logConfigReports() {
+	for _, report := range whs.configReports() {
+		data, err := json.Marshal(report)
+		if err != nil {
+			whs.warningLogger.Printf("Can't encode report for config %s/%s: %v", report.Tenant, report.Name, err)
+			continue
+		}
+		whs.infoLogger.Printf("Config report: %s", data)
+		for _, warning := range report.Warnings {
+			whs.warningLogger.Printf("Config %s/%s: %s", report.Tenant, report.Name, warning)
+		}
+	}
+}
@@ -0,0 +1,133 @@
+package webhook
+
+import (
+	"fmt"
+	"reflect"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// addAffinity merges the config's affinity into the pod's. The pod's own rules are kept, so the patch
+// replaces the pod's affinity with the merged one, or adds it if the pod has none.
+func (whs *WebhookServer) addAffinity(target, added *corev1.Affinity) []patchOperation {
+	if added == nil {
+		return nil
+	}
+	if target == nil {
+		return []patchOperation{{Op: "add", Path: "/spec/affinity", Value: added}}
+	}
+	merged := mergeAffinity(target, added)
+	if reflect.DeepEqual(merged, target) {
+		return nil
+	}
+	return []patchOperation{{Op: "replace", Path: "/spec/affinity", Value: merged}}
+}
+
+// mergeAffinity returns the pod's affinity with the added rules. Required node selector terms are ORed so
+// each of the pod's terms is ANDed with each added one, every other rule is appended unless the pod has it.
+func mergeAffinity(pod, added *corev1.Affinity) *corev1.Affinity {
+	merged := pod.DeepCopy()
+	if added.NodeAffinity != nil {
+		if merged.NodeAffinity == nil {
+			merged.NodeAffinity = &corev1.NodeAffinity{}
+		}
+		node := merged.NodeAffinity
+		node.RequiredDuringSchedulingIgnoredDuringExecution = mergeNodeSelector(node.RequiredDuringSchedulingIgnoredDuringExecution, added.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution)
+		node.PreferredDuringSchedulingIgnoredDuringExecution = appendMissing(node.PreferredDuringSchedulingIgnoredDuringExecution, added.NodeAffinity.PreferredDuringSchedulingIgnoredDuringExecution)
+	}
+	if added.PodAffinity != nil {
+		if merged.PodAffinity == nil {
+			merged.PodAffinity = &corev1.PodAffinity{}
+		}
+		pa := merged.PodAffinity
+		pa.RequiredDuringSchedulingIgnoredDuringExecution = appendMissing(pa.RequiredDuringSchedulingIgnoredDuringExecution, added.PodAffinity.RequiredDuringSchedulingIgnoredDuringExecution)
+		pa.PreferredDuringSchedulingIgnoredDuringExecution = appendMissing(pa.PreferredDuringSchedulingIgnoredDuringExecution, added.PodAffinity.PreferredDuringSchedulingIgnoredDuringExecution)
+	}
+	if added.PodAntiAffinity != nil {
+		if merged.PodAntiAffinity == nil {
+			merged.PodAntiAffinity = &corev1.PodAntiAffinity{}
+		}
+		paa := merged.PodAntiAffinity
+		paa.RequiredDuringSchedulingIgnoredDuringExecution = appendMissing(paa.RequiredDuringSchedulingIgnoredDuringExecution, added.PodAntiAffinity.RequiredDuringSchedulingIgnoredDuringExecution)
+		paa.PreferredDuringSchedulingIgnoredDuringExecution = appendMissing(paa.PreferredDuringSchedulingIgnoredDuringExecution, added.PodAntiAffinity.PreferredDuringSchedulingIgnoredDuringExecution)
+	}
+	return merged
+}
+
+// mergeNodeSelector returns a node selector matching the nodes both selectors match. A nil selector
+// matches every node.
+func mergeNodeSelector(pod, added *corev1.NodeSelector) *corev1.NodeSelector {
+	if added == nil || len(added.NodeSelectorTerms) == 0 {
+		return pod
+	}
+	if pod == nil || len(pod.NodeSelectorTerms) == 0 {
+		return added.DeepCopy()
+	}
+	merged := &corev1.NodeSelector{}
+	for _, p := range pod.NodeSelectorTerms {
+		for _, a := range added.NodeSelectorTerms {
+			merged.NodeSelectorTerms = append(merged.NodeSelectorTerms, corev1.NodeSelectorTerm{
+				MatchExpressions: appendMissing(append([]corev1.NodeSelectorRequirement{}, p.MatchExpressions...), a.MatchExpressions),
+				MatchFields:      appendMissing(append([]corev1.NodeSelectorRequirement{}, p.MatchFields...), a.MatchFields),
+			})
+		}
+	}
+	return merged
+}
+
+// appendMissing appends the added entries the list doesn't have yet
+func appendMissing[T any](list, added []T) []T {
+	for _, a := range added {
+		found := false
+		for _, l := range list {
+			if reflect.DeepEqual(l, a) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			list = append(list, a)
+		}
+	}
+	return list
+}
+
+// validateAffinity checks the weights of preferred rules and that pod rules have a topology key
+func (c Config) validateAffinity() error {
+	a := c.Affinity
+	if a == nil {
+		return nil
+	}
+	if a.NodeAffinity != nil {
+		for i, term := range a.NodeAffinity.PreferredDuringSchedulingIgnoredDuringExecution {
+			if term.Weight < 1 || term.Weight > 100 {
+				return fmt.Errorf("affinity.nodeAffinity.preferredDuringSchedulingIgnoredDuringExecution[%d].weight: must be between 1 and 100", i)
+			}
+		}
+	}
+	validatePodRules := func(path string, required []corev1.PodAffinityTerm, preferred []corev1.WeightedPodAffinityTerm) error {
+		for i, term := range required {
+			if term.TopologyKey == "" {
+				return fmt.Errorf("%s.requiredDuringSchedulingIgnoredDuringExecution[%d].topologyKey: must not be empty", path, i)
+			}
+		}
+		for i, term := range preferred {
+			if term.Weight < 1 || term.Weight > 100 {
+				return fmt.Errorf("%s.preferredDuringSchedulingIgnoredDuringExecution[%d].weight: must be between 1 and 100", path, i)
+			}
+			if term.PodAffinityTerm.TopologyKey == "" {
+				return fmt.Errorf("%s.preferredDuringSchedulingIgnoredDuringExecution[%d].podAffinityTerm.topologyKey: must not be empty", path, i)
+			}
+		}
+		return nil
+	}
+	if a.PodAffinity != nil {
+		if err := validatePodRules("affinity.podAffinity", a.PodAffinity.RequiredDuringSchedulingIgnoredDuringExecution, a.PodAffinity.PreferredDuringSchedulingIgnoredDuringExecution); err != nil {
+			return err
+		}
+	}
+	if a.PodAntiAffinity != nil {
+		return validatePodRules("affinity.podAntiAffinity", a.PodAntiAffinity.RequiredDuringSchedulingIgnoredDuringExecution, a.PodAntiAffinity.PreferredDuringSchedulingIgnoredDuringExecution)
+	}
+	return nil
+}
@@ -0,0 +1,86 @@
+package webhook
+
+import (
+	"fmt"
+	"strings"
+)
+
+// configNameIndex maps the lowercased names and aliases of the configs to the config they name. A name
+// two configs only differ in the case of is left out, pods must request either exactly.
+func configNameIndex(configs MultiConfig) map[string]string {
+	index := map[string]string{}
+	ambiguous := map[string]bool{}
+	add := func(key, name string) {
+		key = strings.ToLower(key)
+		if other, ok := index[key]; ok && other != name {
+			ambiguous[key] = true
+		}
+		index[key] = name
+	}
+	for name, config := range configs {
+		add(name, name)
+		for _, alias := range config.Aliases {
+			add(alias, name)
+		}
+	}
+	for key := range ambiguous {
+		delete(index, key)
+	}
+	return index
+}
+
+// configName returns the name of the config requested by name, which may be an alias or differ in case.
+// A name that matches no config is returned as it is.
+func (st *serverState) configName(name string) string {
+	if _, ok := st.sidecarConfigs[name]; ok {
+		return name
+	}
+	if config, ok := st.configNames[strings.ToLower(name)]; ok {
+		return config
+	}
+	return name
+}
+
+// aliasProblems returns the problems of the aliases of the named config, an alias must not be the name
+// or alias of another config in any case
+func aliasProblems(name string, configs MultiConfig) []string {
+	var problems []string
+	seen := map[string]bool{strings.ToLower(name): true}
+	for i, alias := range configs[name].Aliases {
+		path := fmt.Sprintf("aliases[%d]", i)
+		key := strings.ToLower(alias)
+		switch {
+		case alias == "":
+			problems = append(problems, path+": an alias can't be empty")
+			continue
+		case key == "true":
+			problems = append(problems, fmt.Sprintf("%s: an alias can't be \"true\", pods annotated with true get the %s config", path, defaultConfigName))
+			continue
+		case injectionDisabled(key):
+			problems = append(problems, fmt.Sprintf("%s: an alias can't be %q, pods annotated with it aren't injected", path, alias))
+			continue
+		case strings.Contains(alias, configNameSeparator):
+			problems = append(problems, fmt.Sprintf("%s: an alias can't contain a comma, it separates the configs of pods requesting several", path))
+			continue
+		case seen[key]:
+			problems = append(problems, fmt.Sprintf("%s: %q is already a name of the config", path, alias))
+			continue
+		}
+		seen[key] = true
+		for _, other := range sortedKeys(configs) {
+			if other == name {
+				continue
+			}
+			if strings.ToLower(other) == key {
+				problems = append(problems, fmt.Sprintf("%s: %q is the name of config %s", path, alias, other))
+			}
+			for _, otherAlias := range configs[other].Aliases {
+				if strings.ToLower(otherAlias) == key {
+					problems = append(problems, fmt.Sprintf("%s: %q is also an alias of config %s", path, alias, other))
+					break
+				}
+			}
+		}
+	}
+	return problems
+}
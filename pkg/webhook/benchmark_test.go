@@ -0,0 +1,220 @@
+package webhook
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+// Benchmarks for admissions: generating the patch, the whole mutation with and without the patch cache,
+// and serving the HTTP request, for every config and pod fixture. Run them with
+//
+//	go test ./pkg/webhook -run '^$' -bench . -benchmem
+//
+// and compare runs before and after a change with benchstat.
+
+// podFixture is a pod shape admissions are benchmarked with
+type podFixture struct {
+	name           string
+	containers     int
+	initContainers int
+	annotations    int
+	annotationSize int
+}
+
+// podFixtures range from a plain Deployment pod to the largest pods we see: many containers and
+// annotations carrying whole config files
+var podFixtures = []podFixture{
+	{name: "small", containers: 1},
+	{name: "wide", containers: 20, initContainers: 4, annotations: 20, annotationSize: 64},
+	{name: "huge", containers: 100, initContainers: 10, annotations: 200, annotationSize: 512},
+}
+
+// pod returns the fixture's pod requesting injection of config
+func (f podFixture) pod(config string) *corev1.Pod {
+	annotations := map[string]string{
+		"simple-sidecar.centml.ai/inject":     config,
+		"simple-sidecar.centml.ai/vault-role": "app",
+	}
+	for i := 0; i < f.annotations; i++ {
+		annotations[fmt.Sprintf("example.com/annotation-%d", i)] = strings.Repeat("x", f.annotationSize)
+	}
+
+	container := func(name string) corev1.Container {
+		return corev1.Container{
+			Name:  name,
+			Image: "registry.example.com/app:1.2.3",
+			Env: []corev1.EnvVar{
+				{Name: "LOG_LEVEL", Value: "info"},
+				{Name: "POD_NAME", ValueFrom: &corev1.EnvVarSource{FieldRef: &corev1.ObjectFieldSelector{FieldPath: "metadata.name"}}},
+			},
+			VolumeMounts: []corev1.VolumeMount{
+				{Name: "data", MountPath: "/data"},
+				{Name: "kube-api-access-abcde", MountPath: "/var/run/secrets/kubernetes.io/serviceaccount", ReadOnly: true},
+			},
+		}
+	}
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			GenerateName: "app-7d9f8b6c5-",
+			Namespace:    "default",
+			Labels:       map[string]string{"app": "app", "pod-template-hash": "7d9f8b6c5"},
+			Annotations:  annotations,
+		},
+		Spec: corev1.PodSpec{
+			Volumes: []corev1.Volume{
+				{Name: "data", VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{}}},
+				{Name: "kube-api-access-abcde", VolumeSource: corev1.VolumeSource{Projected: &corev1.ProjectedVolumeSource{}}},
+			},
+		},
+	}
+	for i := 0; i < f.initContainers; i++ {
+		pod.Spec.InitContainers = append(pod.Spec.InitContainers, container(fmt.Sprintf("init-%d", i)))
+	}
+	for i := 0; i < f.containers; i++ {
+		pod.Spec.Containers = append(pod.Spec.Containers, container(fmt.Sprintf("app-%d", i)))
+	}
+	return pod
+}
+
+// configFixtures are the configs admissions are benchmarked with: plain containers and env, and the
+// presets that render per pod
+var configFixtures = MultiConfig{
+	"basic": {
+		Containers: []corev1.Container{{Name: "proxy", Image: "registry.example.com/proxy:1.0.0"}},
+		ExistingContainerConfig: ExistingContainerConfig{
+			Volumes:      []corev1.Volume{{Name: "proxy-certs", VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{}}}},
+			VolumeMounts: []corev1.VolumeMount{{Name: "proxy-certs", MountPath: "/etc/proxy"}},
+			EnvVars: []corev1.EnvVar{
+				{Name: "PROXY_ADDR", Value: "localhost:15001"},
+				{Name: "HTTP_PROXY", Value: "http://$(PROXY_ADDR)"},
+				{Name: "HTTPS_PROXY", Value: "http://$(PROXY_ADDR)"},
+			},
+		},
+	},
+	"vault": {
+		Vault: &VaultAgentConfig{
+			Address:   "https://vault.example.com:8200",
+			Templates: map[string]string{"db.txt": `{{ with secret "db/creds/app" }}{{ .Data.password }}{{ end }}`},
+		},
+	},
+	"otel": {
+		OTelCollector: &OTelCollectorConfig{Endpoint: "collector.observability:4317"},
+	},
+}
+
+// benchmarkServer returns a webhook server with the config fixtures that doesn't log
+func benchmarkServer(cache PatchCache) *WebhookServer {
+	discard := log.New(io.Discard, "", 0)
+	return NewWebhookServer(&WebhookServerConfig{
+		SidecarConfigs: configFixtures,
+		PatchCache:     cache,
+		InfoLogger:     discard,
+		WarnLogger:     discard,
+		ErrorLogger:    discard,
+	})
+}
+
+// benchmarkReview returns the admission review creating the pod and its encoding
+func benchmarkReview(b *testing.B, pod *corev1.Pod) (*admissionv1.AdmissionReview, []byte) {
+	raw, err := json.Marshal(pod)
+	if err != nil {
+		b.Fatal(err)
+	}
+	ar := &admissionv1.AdmissionReview{
+		TypeMeta: metav1.TypeMeta{APIVersion: "admission.k8s.io/v1", Kind: "AdmissionReview"},
+		Request: &admissionv1.AdmissionRequest{
+			UID:       "benchmark",
+			Kind:      metav1.GroupVersionKind{Version: "v1", Kind: "Pod"},
+			Resource:  metav1.GroupVersionResource{Version: "v1", Resource: "pods"},
+			Namespace: pod.Namespace,
+			Operation: admissionv1.Create,
+			Object:    runtime.RawExtension{Raw: raw},
+		},
+	}
+	body, err := json.Marshal(ar)
+	if err != nil {
+		b.Fatal(err)
+	}
+	return ar, body
+}
+
+// runFixtures runs f as a sub-benchmark for every config and pod fixture
+func runFixtures(b *testing.B, f func(b *testing.B, config string, pod *corev1.Pod)) {
+	for _, config := range []string{"basic", "vault", "otel"} {
+		for _, fixture := range podFixtures {
+			pod := fixture.pod(config)
+			b.Run(fmt.Sprintf("config=%s/pod=%s", config, fixture.name), func(b *testing.B) {
+				b.ReportAllocs()
+				f(b, config, pod)
+			})
+		}
+	}
+}
+
+func BenchmarkCreatePatch(b *testing.B) {
+	runFixtures(b, func(b *testing.B, name string, pod *corev1.Pod) {
+		whs := benchmarkServer(nil)
+		config := whs.state().sidecarConfigs[name]
+		annotations := whs.injectionAnnotations(config, name)
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if _, err := whs.createPatch(pod, config, annotations); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkMutate(b *testing.B) {
+	runFixtures(b, func(b *testing.B, _ string, pod *corev1.Pod) {
+		benchmarkMutate(b, benchmarkServer(nil), pod)
+	})
+}
+
+func BenchmarkMutateCached(b *testing.B) {
+	runFixtures(b, func(b *testing.B, _ string, pod *corev1.Pod) {
+		benchmarkMutate(b, benchmarkServer(NewTTLPatchCache(time.Hour, 100)), pod)
+	})
+}
+
+// benchmarkMutate benchmarks the mutation of an admission review creating the pod
+func benchmarkMutate(b *testing.B, whs *WebhookServer, pod *corev1.Pod) {
+	ar, _ := benchmarkReview(b, pod)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if resp := whs.mutate(ar, whs.state()); !resp.Allowed {
+			b.Fatal(resp.Result.Message)
+		}
+	}
+}
+
+func BenchmarkServe(b *testing.B) {
+	runFixtures(b, func(b *testing.B, _ string, pod *corev1.Pod) {
+		whs := benchmarkServer(nil)
+		_, body := benchmarkReview(b, pod)
+		b.SetBytes(int64(len(body)))
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			req := httptest.NewRequest(http.MethodPost, webhookInjectPath, bytes.NewReader(body))
+			req.Header.Set("Content-Type", "application/json")
+			w := httptest.NewRecorder()
+			whs.Serve(w, req)
+			if w.Code != http.StatusOK {
+				b.Fatalf("unexpected status %d", w.Code)
+			}
+		}
+	})
+}
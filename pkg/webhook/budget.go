@@ -0,0 +1,163 @@
+package webhook
+
+import (
+	"fmt"
+	"runtime"
+	"time"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/centml/simple-sidecar/pkg/patch"
+)
+
+var partialInjections = newCounterVec("partial_injections_total", "Pods injected with only the static part of their config because the patch exceeded the latency budget.", "config")
+
+// staticConfig returns the part of the config that doesn't depend on the pod, the presets rendered per pod
+// are dropped, topology env only uses the Downward API and the rest of the config mutators are applied up
+// front, except for the overrides and conflict checks staticForPod applies. It's what's injected when the
+// latency budget runs out.
+func staticConfig(config Config) (Config, error) {
+	config.Vault = nil
+	config.OTelCollector = nil
+	config = topologyEnv(config, nil)
+	config = expandDownwardAPI(config)
+	config, err := orderStartup(config)
+	if err != nil {
+		return config, err
+	}
+	config = addInitCheck(config)
+	envVars, err := orderEnvVars(config.EnvVars)
+	config.EnvVars = envVars
+	return config, err
+}
+
+// staticConfigs returns the static part of every config, configs it can't be computed for are left out
+// and always wait for their full patch
+func (whs *WebhookServer) staticConfigs(configs MultiConfig) map[string]Config {
+	static := map[string]Config{}
+	for name, config := range configs {
+		if config.RenderTemplates || len(config.Files) > 0 || len(config.NamespaceOverrides) > 0 {
+			// rendered templates and files depend on the pod throughout, overrides on its namespace
+			continue
+		}
+		s, err := staticConfig(config)
+		if err != nil {
+			whs.warningLogger.Printf("Can't precompute the static part of config %s, it won't be partially injected: %v", name, err)
+			continue
+		}
+		static[name] = s
+	}
+	return static
+}
+
+// budgetedPatchesPerCPU bounds the patches generated under the latency budget at once, patches that
+// overrun it keep running in the background and must not pile up under load
+const budgetedPatchesPerCPU = 16
+
+// newBudgetSlots returns the slots of the patches generated under the latency budget
+func newBudgetSlots() chan struct{} {
+	return make(chan struct{}, budgetedPatchesPerCPU*runtime.GOMAXPROCS(0))
+}
+
+// patchWithinBudget returns the patch for the pod like patchFor. When a latency budget is set and the
+// patch isn't ready by deadline, the patch of the config's static part is returned instead and partial
+// is true. The full patch keeps being generated in the background so it still lands in the patch cache.
+// Every patch generated under the budget takes a slot until it's done, when there's none left the static
+// part is injected straight away rather than piling up more background work.
+func (whs *WebhookServer) patchWithinBudget(st *serverState, req *admissionv1.AdmissionRequest, pod *corev1.Pod, configName string, config Config, annotations map[string]string, variant bool, deadline time.Time) (data []byte, partial bool, err error) {
+	static, ok := st.staticConfigs[configName]
+	if whs.latencyBudget <= 0 || !ok {
+		data, err = whs.patchFor(st, req, pod, configName, config, annotations, variant)
+		return data, false, err
+	}
+
+	select {
+	case whs.budgetSlots <- struct{}{}:
+	default:
+		whs.warningLogger.Printf("%d patches are already being generated, injecting the static part of config %s into %s",
+			cap(whs.budgetSlots), configName, podIdentity(req.Namespace, pod))
+		return whs.partialPatch(pod, configName, static, annotations, variant)
+	}
+
+	type result struct {
+		data []byte
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		defer func() { <-whs.budgetSlots }()
+		data, err := whs.patchFor(st, req, pod, configName, config, annotations, variant)
+		done <- result{data, err}
+	}()
+
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+	select {
+	case r := <-done:
+		return r.data, false, r.err
+	case <-timer.C:
+	}
+
+	whs.warningLogger.Printf("Patch for %s exceeded the %v latency budget, injecting the static part of config %s",
+		podIdentity(req.Namespace, pod), whs.latencyBudget, configName)
+	return whs.partialPatch(pod, configName, static, annotations, variant)
+}
+
+// partialPatch returns the patch injecting the static part of a config into the pod
+func (whs *WebhookServer) partialPatch(pod *corev1.Pod, configName string, static Config, annotations map[string]string, variant bool) ([]byte, bool, error) {
+	static, err := whs.staticForPod(pod, static)
+	if err != nil {
+		return nil, false, err
+	}
+	ops, err := whs.patchOperations(&patchInput{
+		admitted:    pod,
+		pod:         withoutContainers(pod, static.RemoveContainers),
+		config:      static,
+		excluded:    whs.excludedContainers(pod, static.ExistingContainerConfig),
+		annotations: whs.partialAnnotations(annotations),
+	})
+	var data []byte
+	if err == nil {
+		data, err = patch.Marshal(ops)
+	}
+	if err == nil {
+		data, err = whs.completePatch(pod, data, configName, static, variant)
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	partialInjections.WithLabelValues(configName).Inc()
+	return data, true, nil
+}
+
+// staticForPod applies the config mutators that depend on the pod but are cheap to the static part of a
+// config: the pod's overrides and the env and volume conflict policies
+func (whs *WebhookServer) staticForPod(pod *corev1.Pod, static Config) (Config, error) {
+	static, err := whs.applyOverrides(pod, static)
+	if err != nil {
+		return static, err
+	}
+	if err := whs.checkEnvConflicts(pod, static); err != nil {
+		return static, err
+	}
+	return static, whs.checkVolumeConflicts(pod, static)
+}
+
+// partialAnnotations returns the annotations recorded on a partially injected pod. Its status says so and
+// it has no config hash, it wasn't injected with the config the hash is of.
+func (whs *WebhookServer) partialAnnotations(annotations map[string]string) map[string]string {
+	partial := make(map[string]string, len(annotations))
+	for k, v := range annotations {
+		if k != whs.annotations.hash {
+			partial[k] = v
+		}
+	}
+	partial[whs.annotations.status] = statusPartiallyInjected
+	return partial
+}
+
+// partialWarning is the warning returned with a partially injected pod
+func (whs *WebhookServer) partialWarning(configName string) string {
+	return fmt.Sprintf("simple-sidecar config %q was partially injected, the %v latency budget was exceeded", configName, whs.latencyBudget)
+}
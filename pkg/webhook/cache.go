@@ -0,0 +1,151 @@
+package webhook
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"sync"
+	"time"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+var patchCacheRequests = newCounterVec("patch_cache_requests_total", "Patch cache lookups by result (hit or miss).", "result")
+
+// PatchCache caches generated patches so pods that only differ by name, such as the replicas of a
+// Deployment during a scale up, skip patch generation entirely. Implementations must be safe for
+// concurrent use.
+type PatchCache interface {
+	// Get returns the patch cached for the key, if any.
+	Get(key string) ([]byte, bool)
+
+	// Add caches the patch for the key.
+	Add(key string, patch []byte)
+}
+
+// ttlPatchCache is an in-memory PatchCache with expiring entries and a bounded size
+type ttlPatchCache struct {
+	ttl        time.Duration
+	maxEntries int
+
+	mu      sync.Mutex
+	entries map[string]ttlPatchCacheEntry
+}
+
+type ttlPatchCacheEntry struct {
+	patch   []byte
+	expires time.Time
+}
+
+// NewTTLPatchCache returns an in-memory PatchCache whose entries expire after ttl. Once maxEntries is
+// reached expired entries are dropped and, if that's not enough, arbitrary entries are evicted.
+func NewTTLPatchCache(ttl time.Duration, maxEntries int) PatchCache {
+	return &ttlPatchCache{
+		ttl:        ttl,
+		maxEntries: maxEntries,
+		entries:    map[string]ttlPatchCacheEntry{},
+	}
+}
+
+func (c *ttlPatchCache) Get(key string) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	if time.Now().After(entry.expires) {
+		delete(c.entries, key)
+		return nil, false
+	}
+	return entry.patch, true
+}
+
+func (c *ttlPatchCache) Add(key string, patch []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.entries[key]; !ok && len(c.entries) >= c.maxEntries {
+		now := time.Now()
+		for k, entry := range c.entries {
+			if now.After(entry.expires) {
+				delete(c.entries, k)
+			}
+		}
+		for k := range c.entries {
+			if len(c.entries) < c.maxEntries {
+				break
+			}
+			delete(c.entries, k)
+		}
+	}
+	c.entries[key] = ttlPatchCacheEntry{patch: patch, expires: time.Now().Add(c.ttl)}
+}
+
+// configHash returns the sha256 of the config in hex
+func configHash(config Config) (string, error) {
+	data, err := json.Marshal(struct {
+		Config      Config
+		JSONPatches []patchOperation
+	}{config, config.jsonPatches})
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// patchCacheKey hashes everything the generated patch depends on: the request, except for the pod's
+// per-instance identity, the tenant, the config and the annotations the patch records, and the labels of
+// the pod's node for configs with topology env. withName keeps the pod's name, which templates may render,
+// variant is whether the config is an experiment's variant, which labels the pod.
+// The request's operation, dry-run flag and user are part of the key, so no patch is ever shared between
+// admissions that differ by them.
+func patchCacheKey(req *admissionv1.AdmissionRequest, pod *corev1.Pod, withName bool, tenant, configName, configHash string, variant bool, annotations, nodeLabels map[string]string) (string, error) {
+	var name string
+	if withName {
+		name = pod.Name
+	}
+	key := struct {
+		Tenant      string
+		Namespace   string
+		Operation   admissionv1.Operation
+		DryRun      bool
+		UserInfo    authenticationv1.UserInfo
+		ConfigName  string
+		ConfigHash  string
+		Variant     bool
+		Annotations map[string]string
+		NodeLabels  map[string]string
+		Metadata    metav1.ObjectMeta
+		Spec        corev1.PodSpec
+	}{
+		Tenant:      tenant,
+		Namespace:   req.Namespace,
+		Operation:   req.Operation,
+		DryRun:      req.DryRun != nil && *req.DryRun,
+		UserInfo:    req.UserInfo,
+		ConfigName:  configName,
+		ConfigHash:  configHash,
+		Variant:     variant,
+		Annotations: annotations,
+		NodeLabels:  nodeLabels,
+		Metadata: metav1.ObjectMeta{
+			Name:            name,
+			GenerateName:    pod.GenerateName,
+			Namespace:       pod.Namespace,
+			Labels:          pod.Labels,
+			Annotations:     pod.Annotations,
+			OwnerReferences: pod.OwnerReferences,
+		},
+		Spec: pod.Spec,
+	}
+	data, err := json.Marshal(key)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
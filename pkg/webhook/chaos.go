@@ -0,0 +1,146 @@
+package webhook
+
+import (
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	admissionv1 "k8s.io/api/admission/v1"
+)
+
+// chaosMalformedPatch is the patch of malformed responses, it isn't valid JSON
+const chaosMalformedPatch = `[{"op":"add","path":"/metadata/annotations`
+
+var chaosInjections = newCounterVec("chaos_injections_total", "Failures injected by chaos mode by fault (latency, error or malformed).", "fault")
+
+// ChaosConfig makes admissions fail on purpose, so the failurePolicy and timeoutSeconds of the
+// MutatingWebhookConfiguration can be checked to behave as intended before an outage does. It's only
+// meant for test clusters.
+type ChaosConfig struct {
+	// Latency - the delay added to delayed admissions, e.g. longer than timeoutSeconds.
+	Latency time.Duration
+
+	// LatencyRate - the share of admissions delayed, from 0 to 1. Every admission is delayed if it's 0 and
+	// Latency is set.
+	LatencyRate float64
+
+	// ErrorRate - the share of admissions answered with HTTP 500, from 0 to 1.
+	ErrorRate float64
+
+	// MalformedRate - the share of admissions answered with a patch the API server can't decode, from 0
+	// to 1.
+	MalformedRate float64
+}
+
+// ParseChaos parses a comma separated list of <fault>=<value>, e.g. latency=15s,latencyRate=0.2,error=0.1.
+// The faults are latency (a duration), latencyRate, error and malformed (shares from 0 to 1). An empty
+// string is no chaos and returns nil.
+func ParseChaos(s string) (*ChaosConfig, error) {
+	var c ChaosConfig
+	set := false
+	for _, entry := range strings.Split(s, ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid chaos %q, expected <fault>=<value>", entry)
+		}
+		key, value := strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
+		var err error
+		switch key {
+		case "latency":
+			c.Latency, err = time.ParseDuration(value)
+		case "latencyRate":
+			c.LatencyRate, err = parseChaosRate(value)
+		case "error":
+			c.ErrorRate, err = parseChaosRate(value)
+		case "malformed":
+			c.MalformedRate, err = parseChaosRate(value)
+		default:
+			return nil, fmt.Errorf("unknown chaos fault %q, expected latency, latencyRate, error or malformed", key)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("chaos %s: %v", key, err)
+		}
+		set = true
+	}
+	if !set {
+		return nil, nil
+	}
+	if c.ErrorRate+c.MalformedRate > 1 {
+		return nil, fmt.Errorf("chaos error and malformed rates add up to more than 1")
+	}
+	return &c, nil
+}
+
+// parseChaosRate parses a share of admissions
+func parseChaosRate(value string) (float64, error) {
+	rate, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return 0, err
+	}
+	if rate < 0 || rate > 1 {
+		return 0, fmt.Errorf("%v isn't between 0 and 1", rate)
+	}
+	return rate, nil
+}
+
+// String returns the chaos in the form ParseChaos reads.
+func (c *ChaosConfig) String() string {
+	if c == nil {
+		return ""
+	}
+	var entries []string
+	if c.Latency > 0 {
+		entries = append(entries, "latency="+c.Latency.String())
+		if c.LatencyRate > 0 {
+			entries = append(entries, "latencyRate="+strconv.FormatFloat(c.LatencyRate, 'g', -1, 64))
+		}
+	}
+	if c.ErrorRate > 0 {
+		entries = append(entries, "error="+strconv.FormatFloat(c.ErrorRate, 'g', -1, 64))
+	}
+	if c.MalformedRate > 0 {
+		entries = append(entries, "malformed="+strconv.FormatFloat(c.MalformedRate, 'g', -1, 64))
+	}
+	return strings.Join(entries, ",")
+}
+
+// injectChaos delays the admission and replaces its response as the chaos says. It returns false if it
+// answered the request with an error itself.
+func (whs *WebhookServer) injectChaos(w http.ResponseWriter, r *http.Request, response *admissionv1.AdmissionResponse) bool {
+	c := whs.chaos
+	if c == nil {
+		return true
+	}
+	if c.Latency > 0 && (c.LatencyRate == 0 || rand.Float64() < c.LatencyRate) {
+		chaosInjections.WithLabelValues("latency").Inc()
+		whs.warningLogger.Printf("Chaos: delaying the admission by %s", c.Latency)
+		select {
+		case <-time.After(c.Latency):
+		case <-r.Context().Done():
+		}
+	}
+
+	roll := rand.Float64()
+	switch {
+	case roll < c.ErrorRate:
+		chaosInjections.WithLabelValues("error").Inc()
+		whs.warningLogger.Println("Chaos: failing the admission")
+		http.Error(w, "chaos: injected failure", http.StatusInternalServerError)
+		return false
+	case roll < c.ErrorRate+c.MalformedRate && response != nil:
+		chaosInjections.WithLabelValues("malformed").Inc()
+		whs.warningLogger.Println("Chaos: answering the admission with a malformed patch")
+		pt := admissionv1.PatchTypeJSONPatch
+		response.Allowed = true
+		response.Result = nil
+		response.Patch = []byte(chaosMalformedPatch)
+		response.PatchType = &pt
+	}
+	return true
+}
@@ -0,0 +1,171 @@
+package webhook
+
+import (
+	"fmt"
+	"log"
+	"reflect"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// configFieldAliases are the keys other injectors' config formats use for fields of ours, by the type they
+// appear in. Configs are often copied from them, e.g. the env of k8s-sidecar-injector configs.
+var configFieldAliases = map[reflect.Type]map[string]string{
+	reflect.TypeOf(Config{}):          {"env": "envVars"},
+	reflect.TypeOf(ConfigTemplates{}): {"env": "envVars"},
+}
+
+// fieldSeparators are removed from keys such as init_containers or volume-mounts before they're matched
+var fieldSeparators = strings.NewReplacer("_", "", "-", "")
+
+// compatConfigFile renames the keys of a config file that are spelled differently from the fields they're
+// read as, e.g. EnvVars, envvars, init_containers or the env of other injectors, and logs a warning for
+// each so the file can be fixed. Keys are matched case-insensitively when decoding anyway, renaming them
+// makes the rest explicit and lets strict loading accept them.
+func compatConfigFile(data []byte, opts ConfigLoadOptions) ([]byte, error) {
+	doc, ok := decodeConfigFile(data)
+	if !ok {
+		return data, nil
+	}
+	names := make([]string, 0, len(doc))
+	for name := range doc {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var warnings []string
+	for _, name := range names {
+		t, prefix := reflect.TypeOf(Config{}), "config "+name
+		if name == configTemplatesKey {
+			t, prefix = reflect.TypeOf(ConfigTemplates{}), configTemplatesKey
+		}
+		if name == configProfilesKey {
+			t, prefix = reflect.TypeOf(configProfiles{}), configProfilesKey
+		}
+		renamed, err := compatFields(doc[name], t, "")
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", prefix, err)
+		}
+		for _, warning := range renamed {
+			warnings = append(warnings, prefix+": "+warning)
+		}
+	}
+	if len(warnings) == 0 {
+		return data, nil
+	}
+
+	logger := opts.Logger
+	if logger == nil {
+		logger = log.Default()
+	}
+	for _, warning := range warnings {
+		logger.Printf("Config compatibility: %s", warning)
+	}
+	return encodeConfigFile(data, doc, opts)
+}
+
+// compatFields renames the keys of the decoded JSON value spelled differently from the fields of t they're
+// read as and returns a warning for each. Keys that match no field are left for strict loading to report.
+func compatFields(value interface{}, t reflect.Type, path string) ([]string, error) {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if reflect.PtrTo(t).Implements(jsonUnmarshalerType) {
+		return nil, nil
+	}
+
+	var warnings []string
+	switch t.Kind() {
+	case reflect.Struct:
+		obj, ok := value.(map[string]interface{})
+		if !ok {
+			return nil, nil
+		}
+		keys := make([]string, 0, len(obj))
+		for key := range obj {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		fields := jsonFields(t)
+		for _, key := range keys {
+			name, ok := compatFieldName(key, t, fields)
+			if !ok {
+				continue
+			}
+			if name != key {
+				if _, set := obj[name]; set {
+					return nil, fmt.Errorf("%s and %s are both set, %s is read as %s", joinFieldPath(path, key), joinFieldPath(path, name), key, name)
+				}
+				obj[name] = obj[key]
+				delete(obj, key)
+				warnings = append(warnings, fmt.Sprintf("%s is read as %s, rename it", joinFieldPath(path, key), name))
+			}
+			nested, err := compatFields(obj[name], fields[strings.ToLower(name)].typ, joinFieldPath(path, name))
+			if err != nil {
+				return nil, err
+			}
+			warnings = append(warnings, nested...)
+		}
+	case reflect.Slice, reflect.Array:
+		items, ok := value.([]interface{})
+		if !ok {
+			return nil, nil
+		}
+		for i, item := range items {
+			nested, err := compatFields(item, t.Elem(), fmt.Sprintf("%s[%d]", path, i))
+			if err != nil {
+				return nil, err
+			}
+			warnings = append(warnings, nested...)
+		}
+	case reflect.Map:
+		obj, ok := value.(map[string]interface{})
+		if !ok {
+			return nil, nil
+		}
+		keys := make([]string, 0, len(obj))
+		for key := range obj {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			nested, err := compatFields(obj[key], t.Elem(), joinFieldPath(path, key))
+			if err != nil {
+				return nil, err
+			}
+			warnings = append(warnings, nested...)
+		}
+	}
+	return warnings, nil
+}
+
+// compatFieldName returns the spelling of the field of t the key is read as, ok is false if there's none
+func compatFieldName(key string, t reflect.Type, fields map[string]jsonField) (name string, ok bool) {
+	f, ok := fields[strings.ToLower(key)]
+	if !ok {
+		f, ok = fields[strings.ToLower(fieldSeparators.Replace(key))]
+	}
+	if !ok {
+		alias, ok := configFieldAliases[t][key]
+		return alias, ok
+	}
+	if f.tagged {
+		return f.name, true
+	}
+	return lowerCamel(f.name), true
+}
+
+// lowerCamel returns the spelling configs use for an untagged field, e.g. envVars for EnvVars, jsonPatches
+// for JSONPatches, cpu for CPU and otelCollector for OTelCollector
+func lowerCamel(name string) string {
+	n := 0
+	for n < len(name) && unicode.IsUpper(rune(name[n])) {
+		n++
+	}
+	// the last capital of a longer acronym starts the next word
+	if n > 2 && n < len(name) {
+		n--
+	}
+	return strings.ToLower(name[:n]) + name[n:]
+}
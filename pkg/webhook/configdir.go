@@ -0,0 +1,57 @@
+package webhook
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// configDirFiles returns the *.yaml, *.yml and *.json files in dir in lexical order, hidden files such as the
+// ..data entries of ConfigMap volumes are skipped
+func configDirFiles(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if strings.HasPrefix(name, ".") {
+			continue
+		}
+		if ext := filepath.Ext(name); ext != ".yaml" && ext != ".yml" && !isJSONConfigName(name) {
+			continue
+		}
+		files = append(files, filepath.Join(dir, name))
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// loadConfigDir loads every config file in dir, conf.d style, and merges them into one MultiConfig so
+// teams can own their configs in separate files or ConfigMaps. A config defined in two files is an error.
+func loadConfigDir(dir string, opts ConfigLoadOptions) (MultiConfig, error) {
+	files, err := configDirFiles(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := MultiConfig{}
+	source := map[string]string{}
+	for _, file := range files {
+		configs, err := loadConfigFile(file, opts)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", file, err)
+		}
+		for name, config := range configs {
+			if other, ok := source[name]; ok {
+				return nil, fmt.Errorf("config %s is defined in both %s and %s", name, other, file)
+			}
+			source[name] = file
+			cfg[name] = config
+		}
+	}
+	return cfg, nil
+}
@@ -0,0 +1,55 @@
+package webhook
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+)
+
+// configListSeparator separates the files and directories of a config list
+const configListSeparator = ","
+
+// configPaths returns the files and directories of a comma separated config list
+func configPaths(configFile string) []string {
+	var paths []string
+	for _, path := range strings.Split(configFile, configListSeparator) {
+		if path = strings.TrimSpace(path); path != "" {
+			paths = append(paths, path)
+		}
+	}
+	return paths
+}
+
+// loadConfigList loads every file or directory of the list in order and merges them. A config defined
+// again replaces the earlier one, so a platform's base catalog can be followed by a team's additions and
+// overrides. Where each config comes from is logged.
+func loadConfigList(paths []string, opts ConfigLoadOptions) (MultiConfig, error) {
+	logger := opts.Logger
+	if logger == nil {
+		logger = log.Default()
+	}
+
+	cfg := MultiConfig{}
+	source := map[string]string{}
+	for _, path := range paths {
+		configs, err := loadConfigPath(path, opts)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		names := make([]string, 0, len(configs))
+		for name := range configs {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			if other, ok := source[name]; ok {
+				logger.Printf("Config %s from %s overrides the one from %s", name, path, other)
+			}
+			source[name] = path
+			cfg[name] = configs[name]
+		}
+		logger.Printf("Loaded %d configs from %s: %s", len(names), path, strings.Join(names, ", "))
+	}
+	return cfg, nil
+}
@@ -0,0 +1,202 @@
+package webhook
+
+import (
+	"encoding/base64"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/tools/cache"
+)
+
+const (
+	configMapResync = 10 * time.Minute
+
+	// defaultConfigMapKey is the key of the helm chart's ConfigMap
+	defaultConfigMapKey = "sidecarconfig.yaml"
+)
+
+// ConfigMapSource is the ConfigMap or Secret key configs are read from through the API server, its value is
+// a config file as with CONFIG_FILE.
+type ConfigMapSource struct {
+	// Namespace - the namespace of the ConfigMap.
+	Namespace string
+
+	// Name - the name of the ConfigMap.
+	Name string
+
+	// Key - the data key holding the configs.
+	Key string
+
+	// Secret - the key is read from a Secret of that name instead, for configs with sensitive values such
+	// as tokens in env vars.
+	Secret bool
+}
+
+// ParseConfigMapSource parses a configmap://<namespace>/<name>#<key> or secret://<namespace>/<name>#<key>
+// config source, the key defaults to sidecarconfig.yaml, the key of the helm chart's ConfigMap.
+func ParseConfigMapSource(source string) (ConfigMapSource, error) {
+	s := ConfigMapSource{Key: defaultConfigMapKey}
+	prefix := ConfigSourceConfigMapPrefix
+	if strings.HasPrefix(source, ConfigSourceSecretPrefix) {
+		s.Secret, prefix = true, ConfigSourceSecretPrefix
+	}
+	rest := strings.TrimPrefix(source, prefix)
+	if rest == source {
+		return ConfigMapSource{}, fmt.Errorf("config source %q doesn't start with %s or %s", source, ConfigSourceConfigMapPrefix, ConfigSourceSecretPrefix)
+	}
+	if i := strings.Index(rest, "#"); i >= 0 {
+		rest, s.Key = rest[:i], rest[i+1:]
+	}
+	parts := strings.Split(rest, "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" || s.Key == "" {
+		return ConfigMapSource{}, fmt.Errorf("config source %q isn't of the form %s<namespace>/<name>#<key>", source, prefix)
+	}
+	s.Namespace, s.Name = parts[0], parts[1]
+	return s, nil
+}
+
+func (s ConfigMapSource) String() string {
+	prefix := ConfigSourceConfigMapPrefix
+	if s.Secret {
+		prefix = ConfigSourceSecretPrefix
+	}
+	return fmt.Sprintf("%s%s/%s#%s", prefix, s.Namespace, s.Name, s.Key)
+}
+
+// kind returns the kind of the resource holding the configs, for logs
+func (s ConfigMapSource) kind() string {
+	if s.Secret {
+		return "Secret"
+	}
+	return "ConfigMap"
+}
+
+// resource returns the resource holding the configs
+func (s ConfigMapSource) resource() schema.GroupVersionResource {
+	if s.Secret {
+		return corev1.SchemeGroupVersion.WithResource("secrets")
+	}
+	return corev1.SchemeGroupVersion.WithResource("configmaps")
+}
+
+// configMapConfigs keeps the server's configs in sync with a ConfigMap or Secret key, changes are seen as
+// soon as the API server has them rather than when the kubelet syncs a mounted volume
+type configMapConfigs struct {
+	source        ConfigMapSource
+	informer      cache.SharedIndexInformer
+	warningLogger *log.Logger
+}
+
+// newConfigMapConfigs creates the informer updating the server's configs from the ConfigMap or Secret
+func (whs *WebhookServer) newConfigMapConfigs(client dynamic.Interface, source ConfigMapSource) *configMapConfigs {
+	selectName := func(options *metav1.ListOptions) {
+		options.FieldSelector = fields.OneTermEqualSelector("metadata.name", source.Name).String()
+	}
+	factory := dynamicinformer.NewFilteredDynamicSharedInformerFactory(client, configMapResync, source.Namespace, selectName)
+	c := &configMapConfigs{
+		source:        source,
+		informer:      factory.ForResource(source.resource()).Informer(),
+		warningLogger: whs.warningLogger,
+	}
+	c.informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) { whs.loadConfigMap(source, obj) },
+		UpdateFunc: func(old, obj interface{}) {
+			// resyncs deliver the same object again
+			if o, ok := old.(*unstructured.Unstructured); ok {
+				if u, ok := obj.(*unstructured.Unstructured); ok && o.GetResourceVersion() == u.GetResourceVersion() {
+					return
+				}
+			}
+			whs.loadConfigMap(source, obj)
+		},
+		DeleteFunc: func(interface{}) {
+			whs.warningLogger.Printf("%s %s was deleted, keeping the current configs", source.kind(), source)
+		},
+	})
+	return c
+}
+
+// Run runs the informer until stop is closed
+func (c *configMapConfigs) Run(stop <-chan struct{}) {
+	c.informer.Run(stop)
+}
+
+// waitForSync waits until the informer has listed the ConfigMap or Secret, it returns false if stop was
+// closed first
+func (c *configMapConfigs) waitForSync(stop <-chan struct{}) bool {
+	if !cache.WaitForCacheSync(stop, c.informer.HasSynced) {
+		return false
+	}
+	if len(c.informer.GetStore().List()) == 0 {
+		c.warningLogger.Printf("%s %s doesn't exist, there are no configs until it's created", c.source.kind(), c.source)
+	}
+	return true
+}
+
+// loadConfigMap loads, validates and tests the configs in the ConfigMap or Secret and swaps them in. Invalid
+// configs are logged and the current ones are kept, as when a config file is reloaded.
+func (whs *WebhookServer) loadConfigMap(source ConfigMapSource, obj interface{}) {
+	u, ok := obj.(*unstructured.Unstructured)
+	if !ok || u.GetName() != source.Name {
+		return
+	}
+	configs, err := configsFromConfigMap(u, source, whs.configLoad)
+	if err == nil {
+		err = checkConfigTests(configs)
+	}
+	if err == nil {
+		err = whs.required.check(configs)
+	}
+	if err != nil {
+		configReloads.WithLabelValues("failure").Inc()
+		whs.errorLogger.Printf("Can't load %s, keeping the current configs: %v", source, err)
+		return
+	}
+
+	whs.UpdateConfigs(configs)
+	configReloads.WithLabelValues("success").Inc()
+	whs.infoLogger.Printf("Loaded %d configs from %s", len(configs), source)
+	whs.logConfigReports()
+}
+
+// configsFromConfigMap parses and validates the configs in the key of the ConfigMap or Secret
+func configsFromConfigMap(configMap *unstructured.Unstructured, source ConfigMapSource, opts ConfigLoadOptions) (MultiConfig, error) {
+	key := source.Key
+	value, ok, err := unstructured.NestedString(configMap.Object, "data", key)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, fmt.Errorf("key %s is missing", key)
+	}
+	data := []byte(value)
+	if source.Secret {
+		// the API server returns the data of Secrets base64 encoded
+		if data, err = base64.StdEncoding.DecodeString(value); err != nil {
+			return nil, fmt.Errorf("key %s isn't base64 encoded: %v", key, err)
+		}
+	}
+	if err := checkJSONConfig(key, data); err != nil {
+		return nil, err
+	}
+	configs, err := parseConfigs(data, opts)
+	if err != nil {
+		return nil, err
+	}
+	// there's no directory to resolve patch files against
+	for name, config := range configs {
+		if len(config.JSONPatches) > 0 {
+			return nil, fmt.Errorf("config %s: jsonPatches files aren't supported in %s sources", name, source.kind())
+		}
+	}
+	return configs, nil
+}
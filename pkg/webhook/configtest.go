@@ -0,0 +1,173 @@
+package webhook
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"reflect"
+	"sort"
+
+	jsonpatch "github.com/evanphx/json-patch"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// ConfigTest is a declarative test that lives alongside a Config. The sample Pod is run through the
+// same patch generation used at admission time and the result is checked against Expect.
+type ConfigTest struct {
+	// Name - a short description of the test, used when reporting results.
+	Name string
+
+	// Pod - the sample pod the config is applied to.
+	Pod corev1.Pod
+
+	// Expect - the expected state of the pod after injection.
+	Expect ConfigTestExpectation
+}
+
+// ConfigTestExpectation describes what a pod must look like after injection for a ConfigTest to pass.
+type ConfigTestExpectation struct {
+	// Containers - names of containers that must be present after injection.
+	Containers []string
+
+	// InitContainers - names of initContainers that must be present after injection.
+	InitContainers []string
+
+	// Env - environment variables that must be set after injection, keyed by container name.
+	Env map[string][]corev1.EnvVar
+}
+
+// ConfigTestResult is the outcome of running a single ConfigTest.
+type ConfigTestResult struct {
+	Config string
+	Test   string
+	Errors []string
+}
+
+// Passed returns true if the test produced no errors.
+func (r ConfigTestResult) Passed() bool {
+	return len(r.Errors) == 0
+}
+
+// RunConfigTests runs the tests declared by every Config in configs and returns one result per test,
+// ordered by config name and then declaration order.
+func RunConfigTests(configs MultiConfig) []ConfigTestResult {
+	discard := log.New(io.Discard, "", 0)
+	whs := &WebhookServer{
+		name:          "default",
+		annotations:   defaultAnnotationKeys,
+		infoLogger:    discard,
+		warningLogger: discard,
+		errorLogger:   discard,
+	}
+
+	names := make([]string, 0, len(configs))
+	for name := range configs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var results []ConfigTestResult
+	for _, name := range names {
+		config := configs[name]
+		for i, test := range config.Tests {
+			testName := test.Name
+			if testName == "" {
+				testName = fmt.Sprintf("test[%d]", i)
+			}
+			results = append(results, ConfigTestResult{
+				Config: name,
+				Test:   testName,
+				Errors: whs.runConfigTest(config, test),
+			})
+		}
+	}
+	return results
+}
+
+// runConfigTest applies the config to the test pod and returns every unmet expectation
+func (whs *WebhookServer) runConfigTest(config Config, test ConfigTest) []string {
+	pod := test.Pod.DeepCopy()
+	config = config.forNamespace(pod.Namespace)
+	annotations := map[string]string{whs.annotations.status: config.injectedStatus()}
+	patchBytes, err := whs.createPatch(pod, config, annotations)
+	if err != nil {
+		return []string{fmt.Sprintf("could not create patch: %v", err)}
+	}
+
+	mutated, err := applyPatch(pod, patchBytes)
+	if err != nil {
+		return []string{err.Error()}
+	}
+
+	var errs []string
+	containers := map[string]corev1.Container{}
+	for _, c := range mutated.Spec.Containers {
+		containers[c.Name] = c
+	}
+	for _, name := range test.Expect.Containers {
+		if _, ok := containers[name]; !ok {
+			errs = append(errs, fmt.Sprintf("expected container %q to be present", name))
+		}
+	}
+
+	initContainers := map[string]bool{}
+	for _, c := range mutated.Spec.InitContainers {
+		initContainers[c.Name] = true
+	}
+	for _, name := range test.Expect.InitContainers {
+		if !initContainers[name] {
+			errs = append(errs, fmt.Sprintf("expected initContainer %q to be present", name))
+		}
+	}
+
+	containerNames := make([]string, 0, len(test.Expect.Env))
+	for name := range test.Expect.Env {
+		containerNames = append(containerNames, name)
+	}
+	sort.Strings(containerNames)
+	for _, name := range containerNames {
+		container, ok := containers[name]
+		if !ok {
+			errs = append(errs, fmt.Sprintf("expected env on container %q but it is not present", name))
+			continue
+		}
+		for _, want := range test.Expect.Env[name] {
+			if !hasEnvVar(container.Env, want) {
+				errs = append(errs, fmt.Sprintf("expected env %s=%q on container %q", want.Name, want.Value, name))
+			}
+		}
+	}
+	return errs
+}
+
+// applyPatch applies a JSON patch to the pod and returns the resulting pod
+func applyPatch(pod *corev1.Pod, patchBytes []byte) (*corev1.Pod, error) {
+	podBytes, err := json.Marshal(pod)
+	if err != nil {
+		return nil, fmt.Errorf("could not encode pod: %v", err)
+	}
+	patch, err := jsonpatch.DecodePatch(patchBytes)
+	if err != nil {
+		return nil, fmt.Errorf("could not decode patch: %v", err)
+	}
+	patched, err := patch.Apply(podBytes)
+	if err != nil {
+		return nil, fmt.Errorf("could not apply patch: %v", err)
+	}
+	var mutated corev1.Pod
+	if err := json.Unmarshal(patched, &mutated); err != nil {
+		return nil, fmt.Errorf("could not decode patched pod: %v", err)
+	}
+	return &mutated, nil
+}
+
+// hasEnvVar returns true if env contains a variable matching want by name, value and source
+func hasEnvVar(env []corev1.EnvVar, want corev1.EnvVar) bool {
+	for _, e := range env {
+		if e.Name == want.Name && e.Value == want.Value && reflect.DeepEqual(e.ValueFrom, want.ValueFrom) {
+			return true
+		}
+	}
+	return false
+}
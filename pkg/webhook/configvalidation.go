@@ -0,0 +1,302 @@
+package webhook
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// ConfigError is every problem found in a named config, each prefixed with the path of the offending
+// field, e.g. containers[0].name.
+type ConfigError struct {
+	Config   string
+	Problems []string
+}
+
+func (e *ConfigError) Error() string {
+	return fmt.Sprintf("config %s: %s", e.Config, strings.Join(e.Problems, "; "))
+}
+
+// ConfigErrors is every invalid config of a MultiConfig, ordered by config name.
+type ConfigErrors []*ConfigError
+
+func (e ConfigErrors) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "\n")
+}
+
+// validateConfigs validates every config and returns ConfigErrors listing the problems of the invalid ones
+func validateConfigs(configs MultiConfig) error {
+	names := make([]string, 0, len(configs))
+	for name := range configs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var errs ConfigErrors
+	for _, name := range names {
+		problems := append(configs[name].validate(), experimentProblems(name, configs)...)
+		problems = append(problems, aliasProblems(name, configs)...)
+		if name == "true" {
+			// the annotation value true selects the default config
+			problems = append(problems, fmt.Sprintf("a config can't be named \"true\", pods annotated with true get the %s config", defaultConfigName))
+		}
+		if strings.Contains(name, configNameSeparator) {
+			problems = append(problems, "a config name can't contain a comma, it separates the configs of pods requesting several")
+		}
+		if injectionDisabled(name) {
+			problems = append(problems, fmt.Sprintf("a config can't be named %q, pods annotated with it aren't injected", name))
+		}
+		if len(problems) > 0 {
+			errs = append(errs, &ConfigError{Config: name, Problems: problems})
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// validate returns every problem of the config that would otherwise only show when a pod is injected
+func (c Config) validate() []string {
+	var problems []string
+	add := func(path string, msgs ...string) {
+		for _, msg := range msgs {
+			problems = append(problems, fmt.Sprintf("%s: %s", path, msg))
+		}
+	}
+
+	// names rendered per pod are only known once they're rendered
+	rendered := func(s string) bool {
+		return c.RenderTemplates && templated(s)
+	}
+
+	// the volumes the config's mounts may reference, including the ones its presets add
+	volumes := map[string]bool{}
+	for i, v := range c.Volumes {
+		path := fmt.Sprintf("volumes[%d].name", i)
+		if !rendered(v.Name) {
+			add(path, validation.IsDNS1123Label(v.Name)...)
+		}
+		if volumes[v.Name] {
+			add(path, fmt.Sprintf("duplicate volume %q", v.Name))
+		}
+		volumes[v.Name] = true
+	}
+	for i, v := range c.VolumesIfMissing {
+		path := fmt.Sprintf("volumesIfMissing[%d].name", i)
+		if !rendered(v.Name) {
+			add(path, validation.IsDNS1123Label(v.Name)...)
+		}
+		if volumes[v.Name] {
+			add(path, fmt.Sprintf("duplicate volume %q", v.Name))
+		}
+		volumes[v.Name] = true
+	}
+	if c.Vault != nil {
+		volumes[vaultSecretsVolumeName] = true
+		volumes[vaultHomeVolumeName] = true
+	}
+	if c.OTelCollector != nil {
+		volumes[otelConfigVolumeName] = true
+	}
+
+	validateEnv := func(path string, env []corev1.EnvVar) {
+		for i, e := range env {
+			if !rendered(e.Name) {
+				add(fmt.Sprintf("%s[%d].name", path, i), validation.IsEnvVarName(e.Name)...)
+			}
+		}
+	}
+	validateEnvFrom := func(path string, envFrom []corev1.EnvFromSource) {
+		for i, source := range envFrom {
+			path := fmt.Sprintf("%s[%d]", path, i)
+			if source.Prefix != "" && !rendered(source.Prefix) {
+				add(path+".prefix", validation.IsEnvVarName(source.Prefix)...)
+			}
+			switch {
+			case source.ConfigMapRef != nil && source.SecretRef != nil:
+				add(path, "must set only one of configMapRef and secretRef")
+			case source.ConfigMapRef != nil:
+				if !rendered(source.ConfigMapRef.Name) {
+					add(path+".configMapRef.name", validation.IsDNS1123Subdomain(source.ConfigMapRef.Name)...)
+				}
+			case source.SecretRef != nil:
+				if !rendered(source.SecretRef.Name) {
+					add(path+".secretRef.name", validation.IsDNS1123Subdomain(source.SecretRef.Name)...)
+				}
+			default:
+				add(path, "must set configMapRef or secretRef")
+			}
+		}
+	}
+	validateMounts := func(path string, mounts []corev1.VolumeMount) {
+		for i, vm := range mounts {
+			if !volumes[vm.Name] {
+				add(fmt.Sprintf("%s[%d].name", path, i), fmt.Sprintf("volume %q is not declared by the config", vm.Name))
+			}
+			if vm.MountPath == "" {
+				add(fmt.Sprintf("%s[%d].mountPath", path, i), "must not be empty")
+			}
+		}
+	}
+
+	containers := map[string]bool{}
+	validateContainers := func(path string, list []corev1.Container) {
+		for i, container := range list {
+			path := fmt.Sprintf("%s[%d]", path, i)
+			if !rendered(container.Name) {
+				add(path+".name", validation.IsDNS1123Label(container.Name)...)
+			}
+			if containers[container.Name] {
+				add(path+".name", fmt.Sprintf("duplicate container %q", container.Name))
+			}
+			containers[container.Name] = true
+			if strings.TrimSpace(container.Image) == "" {
+				add(path+".image", "must not be empty")
+			}
+			validateEnv(path+".env", container.Env)
+			validateEnvFrom(path+".envFrom", container.EnvFrom)
+			validateMounts(path+".volumeMounts", container.VolumeMounts)
+		}
+	}
+	validateContainers("initContainers", c.InitContainers)
+	validateContainers("containers", c.Containers)
+	validateEnv("envVars", c.EnvVars)
+	for i, name := range c.TargetContainers {
+		add(fmt.Sprintf("targetContainers[%d]", i), validation.IsDNS1123Label(name)...)
+	}
+	for i, name := range c.RemoveContainers {
+		add(fmt.Sprintf("removeContainers[%d]", i), validation.IsDNS1123Label(name)...)
+	}
+	for i, name := range c.ExcludeContainers {
+		add(fmt.Sprintf("excludeContainers[%d]", i), validation.IsDNS1123Label(name)...)
+		if contains(c.TargetContainers, name) {
+			add(fmt.Sprintf("excludeContainers[%d]", i), fmt.Sprintf("container %q is also targeted", name))
+		}
+	}
+	validateEnvFrom("envFrom", c.EnvFrom)
+	validateMounts("volumeMounts", c.VolumeMounts)
+
+	for _, key := range sortedKeys(c.Labels) {
+		add("labels."+key, validation.IsQualifiedName(key)...)
+		add("labels."+key, validation.IsValidLabelValue(c.Labels[key])...)
+	}
+
+	if c.ServiceAccountName != "" {
+		add("serviceAccountName", validation.IsDNS1123Subdomain(c.ServiceAccountName)...)
+	} else if c.OverrideExistingServiceAccount {
+		add("overrideExistingServiceAccount", "is only supported with serviceAccountName")
+	}
+
+	if c.MinTerminationGracePeriodSeconds < 0 {
+		add("minTerminationGracePeriodSeconds", "must not be negative")
+	}
+
+	for i, t := range c.Tolerations {
+		path := fmt.Sprintf("tolerations[%d]", i)
+		if t.Key != "" {
+			add(path+".key", validation.IsQualifiedName(t.Key)...)
+		}
+		switch t.Operator {
+		case "", corev1.TolerationOpEqual:
+			if t.Key == "" {
+				add(path+".operator", "must be Exists when the key is empty")
+			}
+		case corev1.TolerationOpExists:
+			if t.Value != "" {
+				add(path+".value", "must be empty when the operator is Exists")
+			}
+		default:
+			add(path+".operator", fmt.Sprintf("unsupported operator %q, expected Equal or Exists", t.Operator))
+		}
+		switch t.Effect {
+		case "", corev1.TaintEffectNoSchedule, corev1.TaintEffectPreferNoSchedule, corev1.TaintEffectNoExecute:
+		default:
+			add(path+".effect", fmt.Sprintf("unsupported effect %q, expected NoSchedule, PreferNoSchedule or NoExecute", t.Effect))
+		}
+		if t.TolerationSeconds != nil && t.Effect != corev1.TaintEffectNoExecute {
+			add(path+".tolerationSeconds", "is only supported with the NoExecute effect")
+		}
+	}
+
+	if c.Topology != nil {
+		if c.Topology.NodeName != "" {
+			add("topology.nodeName", validation.IsEnvVarName(c.Topology.NodeName)...)
+		}
+		names := make([]string, 0, len(c.Topology.Labels))
+		for name := range c.Topology.Labels {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			add("topology.labels."+name, validation.IsEnvVarName(name)...)
+		}
+	}
+
+	// these name the offending field themselves
+	if err := c.validateInitOnly(); err != nil {
+		problems = append(problems, err.Error())
+	}
+	if err := c.validateOnError(); err != nil {
+		problems = append(problems, err.Error())
+	}
+	if err := c.validateEnvConflictPolicy(); err != nil {
+		problems = append(problems, err.Error())
+	}
+	if err := c.validateVolumeConflictPolicy(); err != nil {
+		problems = append(problems, err.Error())
+	}
+	if err := c.validateOverridable(); err != nil {
+		problems = append(problems, err.Error())
+	}
+	if err := c.validateTemplates(); err != nil {
+		problems = append(problems, err.Error())
+	}
+	if err := c.validateExperiment(); err != nil {
+		problems = append(problems, err.Error())
+	}
+	if err := c.validateSizing(); err != nil {
+		problems = append(problems, err.Error())
+	}
+	if err := c.validateNamespaceOverrides(); err != nil {
+		problems = append(problems, err.Error())
+	}
+	if err := c.validateStartup(); err != nil {
+		problems = append(problems, err.Error())
+	}
+	if err := c.validateInsertPositions(); err != nil {
+		problems = append(problems, err.Error())
+	}
+	if err := c.validatePreconditions(); err != nil {
+		problems = append(problems, err.Error())
+	}
+	if err := c.validateFiles(); err != nil {
+		problems = append(problems, err.Error())
+	}
+	if err := c.validateAffinity(); err != nil {
+		problems = append(problems, err.Error())
+	}
+	if err := c.validatePodSecurityContext(); err != nil {
+		problems = append(problems, err.Error())
+	}
+	if err := c.validateContainerSecurityContext(); err != nil {
+		problems = append(problems, err.Error())
+	}
+	if err := c.validateDefaultResources(); err != nil {
+		problems = append(problems, err.Error())
+	}
+	if err := c.validateEphemeralContainers(); err != nil {
+		problems = append(problems, err.Error())
+	}
+	if err := c.validateDownwardAPI(); err != nil {
+		problems = append(problems, err.Error())
+	}
+	return problems
+}
@@ -0,0 +1,109 @@
+package webhook
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	// configVersionKey is the top-level key of a config file holding the version of its schema
+	configVersionKey = "version"
+
+	// currentConfigVersion is the config file schema this build reads, files without a version are v1
+	currentConfigVersion = "v1"
+)
+
+// configMigration upgrades a decoded config file from one schema version to the next
+type configMigration struct {
+	from, to string
+	migrate  func(doc map[string]interface{}) error
+}
+
+// configMigrations upgrade config files written for older schema versions step by step to
+// currentConfigVersion. A schema change, e.g. moving the fields of ExistingContainerConfig under a key of
+// their own, bumps currentConfigVersion and adds the migration from the previous version here so files
+// written for it keep loading.
+var configMigrations []configMigration
+
+// migrateConfigFile removes the version from a config file and migrates the file to the current schema.
+// Files without a version are v1 and are returned as they are.
+func migrateConfigFile(data []byte, opts ConfigLoadOptions) ([]byte, error) {
+	doc, ok := decodeConfigFile(data)
+	if !ok {
+		return data, nil
+	}
+	raw, ok := doc[configVersionKey]
+	if !ok {
+		return data, nil
+	}
+	version, ok := raw.(string)
+	if !ok {
+		return nil, fmt.Errorf("%s must be a string such as %s, got %v", configVersionKey, currentConfigVersion, raw)
+	}
+
+	from := version
+	for version != currentConfigVersion {
+		m, ok := configMigrationFrom(version)
+		if !ok {
+			return nil, fmt.Errorf("config file version %s isn't supported, this build reads %s", version, supportedConfigVersions())
+		}
+		if err := m.migrate(doc); err != nil {
+			return nil, fmt.Errorf("can't migrate the config file from %s to %s: %v", m.from, m.to, err)
+		}
+		version = m.to
+	}
+	if from != version && opts.Logger != nil {
+		opts.Logger.Printf("Migrated a config file from version %s to %s, update it to skip the migration", from, version)
+	}
+	delete(doc, configVersionKey)
+	return encodeConfigFile(data, doc, opts)
+}
+
+// decodeConfigFile decodes a config file into a document migrations and compatibility shims can rewrite,
+// ok is false if it isn't a map, decoding the configs reports why
+func decodeConfigFile(data []byte) (doc map[string]interface{}, ok bool) {
+	jsonData, err := yaml.YAMLToJSON(data)
+	if err != nil {
+		return nil, false
+	}
+	decoder := json.NewDecoder(bytes.NewReader(jsonData))
+	// numbers are kept as they're written, float64 would turn large integers into exponents
+	decoder.UseNumber()
+	if err := decoder.Decode(&doc); err != nil {
+		return nil, false
+	}
+	return doc, true
+}
+
+// encodeConfigFile encodes a rewritten config file document, data is the file it was decoded from
+func encodeConfigFile(data []byte, doc map[string]interface{}, opts ConfigLoadOptions) ([]byte, error) {
+	if !opts.Lenient {
+		// re-encoding the file drops duplicate keys, strict loading must still see them
+		if _, err := yaml.YAMLToJSONStrict(data); err != nil {
+			return nil, err
+		}
+	}
+	return json.Marshal(doc)
+}
+
+// configMigrationFrom returns the migration upgrading files of the version
+func configMigrationFrom(version string) (configMigration, bool) {
+	for _, m := range configMigrations {
+		if m.from == version {
+			return m, true
+		}
+	}
+	return configMigration{}, false
+}
+
+// supportedConfigVersions returns the config file versions that can be loaded, for error messages
+func supportedConfigVersions() string {
+	versions := ""
+	for _, m := range configMigrations {
+		versions += m.from + ", "
+	}
+	return versions + currentConfigVersion
+}
@@ -0,0 +1,177 @@
+package webhook
+
+import (
+	"fmt"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/centml/simple-sidecar/pkg/patch"
+)
+
+// the policies for what's injected into the pod that it already has
+const (
+	// conflictAppend appends injected env vars a container already has, the later one wins
+	conflictAppend = "append"
+
+	// conflictSkip keeps the pod's own env var, volume or volume mount
+	conflictSkip = "skip"
+
+	// conflictOverride replaces the pod's own env var, volume or volume mount
+	conflictOverride = "override"
+
+	// conflictError fails the patch of pods that already have what's injected
+	conflictError = "error"
+)
+
+// validateEnvConflictPolicy checks the config's envConflictPolicy
+func (c Config) validateEnvConflictPolicy() error {
+	switch c.EnvConflictPolicy {
+	case "", conflictAppend, conflictSkip, conflictOverride, conflictError:
+		return nil
+	}
+	return fmt.Errorf("envConflictPolicy: unsupported policy %q, expected append, skip, override or error", c.EnvConflictPolicy)
+}
+
+// checkEnvConflicts returns an error naming the injected vars the pod's containers already have when the
+// config's envConflictPolicy is error
+func (whs *WebhookServer) checkEnvConflicts(pod *corev1.Pod, config Config) error {
+	if config.EnvConflictPolicy != conflictError || len(config.EnvVars) == 0 {
+		return nil
+	}
+	injected := map[string]bool{}
+	for _, envVar := range config.EnvVars {
+		injected[envVar.Name] = true
+	}
+	var conflicts []string
+	for _, existing := range existingContainers(pod, config.ApplyToInitContainers, whs.excludedContainers(pod, config.ExistingContainerConfig)) {
+		var names []string
+		for _, envVar := range existing.container.Env {
+			if injected[envVar.Name] {
+				names = append(names, envVar.Name)
+			}
+		}
+		if len(names) > 0 {
+			conflicts = append(conflicts, fmt.Sprintf("container %s sets %s", existing.container.Name, strings.Join(names, ", ")))
+		}
+	}
+	if len(conflicts) == 0 {
+		return nil
+	}
+	return fmt.Errorf("env vars injected with envConflictPolicy error are already set: %s", strings.Join(conflicts, "; "))
+}
+
+// validateVolumeConflictPolicy checks the config's volumeConflictPolicy
+func (c Config) validateVolumeConflictPolicy() error {
+	switch c.VolumeConflictPolicy {
+	case "", conflictSkip, conflictOverride, conflictError:
+		return nil
+	}
+	return fmt.Errorf("volumeConflictPolicy: unsupported policy %q, expected skip, override or error", c.VolumeConflictPolicy)
+}
+
+// checkVolumeConflicts returns an error naming the injected volumes and volume mounts the pod already has
+// when the config's volumeConflictPolicy is error
+func (whs *WebhookServer) checkVolumeConflicts(pod *corev1.Pod, config Config) error {
+	if config.VolumeConflictPolicy != conflictError {
+		return nil
+	}
+	var conflicts []string
+	for _, volume := range config.Volumes {
+		for _, existing := range pod.Spec.Volumes {
+			if existing.Name == volume.Name {
+				conflicts = append(conflicts, "the pod has volume "+volume.Name)
+			}
+		}
+	}
+	if len(config.VolumeMounts) > 0 {
+		for _, existing := range existingContainers(pod, config.ApplyToInitContainers, whs.excludedContainers(pod, config.ExistingContainerConfig)) {
+			var paths []string
+			for _, vm := range config.VolumeMounts {
+				if _, ok := mountIndex(existing.container.VolumeMounts, vm.MountPath); ok {
+					paths = append(paths, vm.MountPath)
+				}
+			}
+			if len(paths) > 0 {
+				conflicts = append(conflicts, fmt.Sprintf("container %s mounts %s", existing.container.Name, strings.Join(paths, ", ")))
+			}
+		}
+	}
+	if len(conflicts) == 0 {
+		return nil
+	}
+	return fmt.Errorf("volumes injected with volumeConflictPolicy error are already set: %s", strings.Join(conflicts, "; "))
+}
+
+// mountIndex returns the index of the volume mount at the path
+func mountIndex(mounts []corev1.VolumeMount, path string) (int, bool) {
+	for i, vm := range mounts {
+		if vm.MountPath == path {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+// volumesIfMissing returns the config's volumesIfMissing neither the pod nor the config's volumes have
+func volumesIfMissing(pod []corev1.Volume, config Config) []corev1.Volume {
+	var missing []corev1.Volume
+	for _, volume := range config.VolumesIfMissing {
+		found := false
+		for _, list := range [][]corev1.Volume{pod, config.Volumes} {
+			for _, v := range list {
+				found = found || v.Name == volume.Name
+			}
+		}
+		if !found {
+			missing = append(missing, volume)
+		}
+	}
+	return missing
+}
+
+// addVolumes adds the config's volumes to the pod's, the volumes the pod already has by name are skipped
+// or replaced as the policy says
+func (whs *WebhookServer) addVolumes(target, added []corev1.Volume, policy string) []patchOperation {
+	index := map[string]int{}
+	for i, volume := range target {
+		index[volume.Name] = i
+	}
+	var ops []patchOperation
+	var missing []corev1.Volume
+	for _, volume := range added {
+		i, ok := index[volume.Name]
+		switch {
+		case !ok:
+			missing = append(missing, volume)
+		case policy == conflictOverride:
+			ops = append(ops, patch.Replace(fmt.Sprintf("/spec/volumes/%d", i), volume))
+		}
+	}
+	return append(ops, patch.AddToList(target, missing, "/spec/volumes")...)
+}
+
+// withVolumes returns the pod's volumes with the config's added like addVolumes
+func withVolumes(target, added []corev1.Volume, policy string) []corev1.Volume {
+	for _, volume := range added {
+		volume = *volume.DeepCopy()
+		i, ok := volumeIndex(target, volume.Name)
+		switch {
+		case !ok:
+			target = append(target, volume)
+		case policy == conflictOverride:
+			target[i] = volume
+		}
+	}
+	return target
+}
+
+// volumeIndex returns the index of the volume with the name
+func volumeIndex(volumes []corev1.Volume, name string) (int, bool) {
+	for i, volume := range volumes {
+		if volume.Name == name {
+			return i, true
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,151 @@
+package webhook
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/tools/cache"
+	"sigs.k8s.io/yaml"
+)
+
+const sidecarConfigResync = 10 * time.Minute
+
+// SidecarConfigResource is the SidecarConfig custom resource configs are read from in CRD mode, the
+// resource name is the config name and its spec is a config as in the config file.
+var SidecarConfigResource = schema.GroupVersionResource{Group: "simple-sidecar.centml.ai", Version: "v1alpha1", Resource: "sidecarconfigs"}
+
+// crdConfigs keeps the server's configs in sync with the SidecarConfig resources in a namespace, or the
+// whole cluster
+type crdConfigs struct {
+	informer cache.SharedIndexInformer
+}
+
+// newCRDConfigs creates the informer updating the server's configs, namespace "" watches all namespaces
+func (whs *WebhookServer) newCRDConfigs(client dynamic.Interface, namespace string) *crdConfigs {
+	factory := dynamicinformer.NewFilteredDynamicSharedInformerFactory(client, sidecarConfigResync, namespace, nil)
+	c := &crdConfigs{
+		informer: factory.ForResource(SidecarConfigResource).Informer(),
+	}
+	update := func() {
+		configs := whs.sidecarConfigsFrom(c.informer.GetStore().List())
+		// the resources are added one by one until they're listed, Start checks the listed configs
+		if c.informer.HasSynced() {
+			if err := whs.required.check(configs); err != nil {
+				whs.errorLogger.Printf("Can't update the configs from SidecarConfig resources, keeping the current configs: %v", err)
+				return
+			}
+		}
+		whs.UpdateConfigs(configs)
+		whs.infoLogger.Printf("Updated %d configs from SidecarConfig resources", len(configs))
+	}
+	c.informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    func(interface{}) { update() },
+		UpdateFunc: func(interface{}, interface{}) { update() },
+		DeleteFunc: func(interface{}) { update() },
+	})
+	return c
+}
+
+// Run runs the informer until stop is closed
+func (c *crdConfigs) Run(stop <-chan struct{}) {
+	c.informer.Run(stop)
+}
+
+// waitForSync waits until the informer has listed the resources, it returns false if stop was closed first
+func (c *crdConfigs) waitForSync(stop <-chan struct{}) bool {
+	return cache.WaitForCacheSync(stop, c.informer.HasSynced)
+}
+
+// sidecarConfigsFrom converts SidecarConfig resources into configs. Invalid resources are skipped, and
+// when resources in different namespaces have the same name the one in the first namespace wins.
+func (whs *WebhookServer) sidecarConfigsFrom(objs []interface{}) MultiConfig {
+	resources := make([]*unstructured.Unstructured, 0, len(objs))
+	for _, obj := range objs {
+		if u, ok := obj.(*unstructured.Unstructured); ok {
+			resources = append(resources, u)
+		}
+	}
+	sort.Slice(resources, func(i, j int) bool {
+		if resources[i].GetNamespace() != resources[j].GetNamespace() {
+			return resources[i].GetNamespace() < resources[j].GetNamespace()
+		}
+		return resources[i].GetName() < resources[j].GetName()
+	})
+
+	configs := MultiConfig{}
+	source := map[string]string{}
+	for _, resource := range resources {
+		key := resource.GetNamespace() + "/" + resource.GetName()
+		name := resource.GetName()
+		if other, ok := source[name]; ok {
+			whs.warningLogger.Printf("Skipping SidecarConfig %s, config %s is already defined by %s", key, name, other)
+			continue
+		}
+		config, err := sidecarConfigFromResource(resource, whs.configLoad)
+		if err != nil {
+			whs.warningLogger.Printf("Skipping invalid SidecarConfig %s: %v", key, err)
+			continue
+		}
+		source[name] = key
+		configs[name] = config
+	}
+	return configs
+}
+
+// sidecarConfigFromResource parses, expands and validates the spec of a SidecarConfig resource
+func sidecarConfigFromResource(resource *unstructured.Unstructured, opts ConfigLoadOptions) (Config, error) {
+	var config Config
+	spec, ok := resource.Object["spec"]
+	if !ok {
+		return config, fmt.Errorf("spec is missing")
+	}
+	if obj, ok := spec.(map[string]interface{}); ok {
+		if _, err := moveContainerFlags(obj); err != nil {
+			return config, err
+		}
+	}
+	if !opts.Lenient {
+		if err := checkUnknownFields(spec, reflect.TypeOf(config)); err != nil {
+			return config, err
+		}
+	}
+	data, err := json.Marshal(spec)
+	if err != nil {
+		return config, err
+	}
+	if err := yaml.Unmarshal(data, &config); err != nil {
+		return config, err
+	}
+	if opts.ExpandEnv {
+		if err := expandConfigEnv(&config, os.LookupEnv); err != nil {
+			return config, err
+		}
+	}
+	if err := pinConfigImages(resource.GetName(), &config, opts); err != nil {
+		return config, err
+	}
+	if problems := config.validate(); len(problems) > 0 {
+		return config, fmt.Errorf("%s", strings.Join(problems, "; "))
+	}
+	// resources are resolved one by one and have no templates section
+	if config.Extends != "" {
+		return config, fmt.Errorf("extends isn't supported in SidecarConfig resources")
+	}
+	if config.Include != nil {
+		return config, fmt.Errorf("include isn't supported in SidecarConfig resources")
+	}
+	// there's no directory to resolve patch files against
+	if len(config.JSONPatches) > 0 {
+		return config, fmt.Errorf("jsonPatches files aren't supported in SidecarConfig resources")
+	}
+	return config, nil
+}
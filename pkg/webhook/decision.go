@@ -0,0 +1,198 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	defaultDecisionTimeout = 3 * time.Second
+
+	// decisionResponseLimit bounds the decision responses that are read
+	decisionResponseLimit = 1 << 20
+)
+
+var decisionRequests = newCounterVec("decision_requests_total", "External decisions by result (inject, skip, deny, error or fail_open).", "result")
+
+// DecisionRequest is the summary of a pod an external decision service is asked about.
+type DecisionRequest struct {
+	Namespace      string            `json:"namespace"`
+	Name           string            `json:"name,omitempty"`
+	GenerateName   string            `json:"generateName,omitempty"`
+	Pod            string            `json:"pod"`
+	Owner          *DecisionOwner    `json:"owner,omitempty"`
+	ServiceAccount string            `json:"serviceAccount,omitempty"`
+	Labels         map[string]string `json:"labels,omitempty"`
+	Annotations    map[string]string `json:"annotations,omitempty"`
+	Containers     []DecisionImage   `json:"containers"`
+	InitContainers []DecisionImage   `json:"initContainers,omitempty"`
+}
+
+// DecisionOwner is the controller of a pod.
+type DecisionOwner struct {
+	Kind string `json:"kind"`
+	Name string `json:"name"`
+}
+
+// DecisionImage is a container of a pod and its image.
+type DecisionImage struct {
+	Name  string `json:"name"`
+	Image string `json:"image"`
+}
+
+// DecisionResponse is the verdict of an external decision service. A pod that isn't allowed is denied
+// with Message, an allowed pod is injected with Config or admitted as is if Config is empty.
+type DecisionResponse struct {
+	Allowed bool   `json:"allowed"`
+	Config  string `json:"config,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+// DecisionResolver asks an external policy service which config a pod gets, so the decision logic can
+// stay in an organization's policy system while the webhook generates the patch. The pod summary is
+// POSTed to URL as a DecisionRequest and a DecisionResponse is expected back.
+type DecisionResolver struct {
+	// URL - the decision endpoint.
+	URL string
+
+	// Timeout - how long a decision may take, 3s by default. Keep it well below the webhook's timeout.
+	Timeout time.Duration
+
+	// FailOpen - admit pods without injection when the service fails or times out, rather than denying
+	// them.
+	FailOpen bool
+
+	// Client - the HTTP client, http.DefaultClient by default.
+	Client *http.Client
+
+	// Logger - optional, failures admitting pods with FailOpen are logged to it.
+	Logger *log.Logger
+}
+
+// NewDecisionClient returns an HTTP client for a decision service whose certificate is signed by the CA
+// in caFile, the system roots are used when caFile is empty.
+func NewDecisionClient(caFile string) (*http.Client, error) {
+	if caFile == "" {
+		return &http.Client{}, nil
+	}
+	ca, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, fmt.Errorf("no certificates in %s", caFile)
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	return &http.Client{Transport: transport}, nil
+}
+
+// Resolve asks the decision service about the pod. A deny verdict is returned as a *PolicyDenial, a
+// failure as an error unless FailOpen is set.
+func (r *DecisionResolver) Resolve(namespace string, pod *corev1.Pod) (string, bool, error) {
+	decision, err := r.decide(namespace, pod)
+	if err != nil {
+		if r.FailOpen {
+			decisionRequests.WithLabelValues("fail_open").Inc()
+			if r.Logger != nil {
+				r.Logger.Printf("Decision service failed, admitting %s without injection: %v", podIdentity(namespace, pod), err)
+			}
+			return "", false, nil
+		}
+		decisionRequests.WithLabelValues("error").Inc()
+		return "", false, fmt.Errorf("decision service: %v", err)
+	}
+	switch {
+	case !decision.Allowed:
+		decisionRequests.WithLabelValues("deny").Inc()
+		message := decision.Message
+		if message == "" {
+			message = "denied by the decision service"
+		}
+		return "", false, &PolicyDenial{Message: message}
+	case decision.Config == "":
+		decisionRequests.WithLabelValues("skip").Inc()
+		return "", false, nil
+	default:
+		decisionRequests.WithLabelValues("inject").Inc()
+		return decision.Config, true, nil
+	}
+}
+
+// decide posts the pod summary to the decision service and returns its verdict
+func (r *DecisionResolver) decide(namespace string, pod *corev1.Pod) (*DecisionResponse, error) {
+	body, err := json.Marshal(newDecisionRequest(namespace, pod))
+	if err != nil {
+		return nil, err
+	}
+	timeout := r.Timeout
+	if timeout <= 0 {
+		timeout = defaultDecisionTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, r.URL, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	client := r.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(resp.Body, decisionResponseLimit))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	var decision DecisionResponse
+	if err := json.Unmarshal(data, &decision); err != nil {
+		return nil, fmt.Errorf("can't decode the decision: %v", err)
+	}
+	return &decision, nil
+}
+
+// newDecisionRequest summarises the pod for the decision service
+func newDecisionRequest(namespace string, pod *corev1.Pod) DecisionRequest {
+	req := DecisionRequest{
+		Namespace:      namespace,
+		Name:           pod.Name,
+		GenerateName:   pod.GenerateName,
+		Pod:            podIdentity(namespace, pod),
+		ServiceAccount: pod.Spec.ServiceAccountName,
+		Labels:         pod.Labels,
+		Annotations:    pod.Annotations,
+		Containers:     []DecisionImage{},
+	}
+	if ref := metav1.GetControllerOf(pod); ref != nil {
+		req.Owner = &DecisionOwner{Kind: ref.Kind, Name: ref.Name}
+	}
+	for _, c := range pod.Spec.InitContainers {
+		req.InitContainers = append(req.InitContainers, DecisionImage{Name: c.Name, Image: c.Image})
+	}
+	for _, c := range pod.Spec.Containers {
+		req.Containers = append(req.Containers, DecisionImage{Name: c.Name, Image: c.Image})
+	}
+	return req
+}
@@ -0,0 +1,85 @@
+package webhook
+
+import (
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// addDefaultResources sets the default requests and limits the containers in the given pod are missing,
+// skipping excluded containers
+func (whs *WebhookServer) addDefaultResources(pod *corev1.Pod, defaults *corev1.ResourceRequirements, excluded map[string]bool) (ops []patchOperation) {
+	if defaults == nil {
+		return nil
+	}
+	for i, container := range pod.Spec.Containers {
+		if excluded[container.Name] {
+			continue
+		}
+		if resources, changed := withDefaultResources(container.Resources, *defaults); changed {
+			// add replaces the resources if the container has them
+			ops = append(ops, patchOperation{Op: "add", Path: fmt.Sprintf("/spec/containers/%d/resources", i), Value: resources})
+		}
+	}
+	return ops
+}
+
+// withDefaultResources returns the container's resources with the defaults it's missing and whether any
+// was added. A request isn't added for a resource the container limits, Kubernetes defaults it to the
+// limit, and a limit isn't added below the container's request.
+func withDefaultResources(container, defaults corev1.ResourceRequirements) (corev1.ResourceRequirements, bool) {
+	resources := *container.DeepCopy()
+	changed := false
+	for _, name := range sortedKeys(defaults.Requests) {
+		_, requested := resources.Requests[name]
+		_, limited := resources.Limits[name]
+		if requested || limited {
+			continue
+		}
+		if resources.Requests == nil {
+			resources.Requests = corev1.ResourceList{}
+		}
+		resources.Requests[name] = defaults.Requests[name].DeepCopy()
+		changed = true
+	}
+	for _, name := range sortedKeys(defaults.Limits) {
+		if _, limited := resources.Limits[name]; limited {
+			continue
+		}
+		limit := defaults.Limits[name]
+		if request, ok := resources.Requests[name]; ok && request.Cmp(limit) > 0 {
+			continue
+		}
+		if resources.Limits == nil {
+			resources.Limits = corev1.ResourceList{}
+		}
+		resources.Limits[name] = limit.DeepCopy()
+		changed = true
+	}
+	return resources, changed
+}
+
+// validateDefaultResources checks the default quantities aren't negative and requests don't exceed limits
+func (c Config) validateDefaultResources() error {
+	defaults := c.DefaultResources
+	if defaults == nil {
+		return nil
+	}
+	for _, list := range []struct {
+		field     string
+		resources corev1.ResourceList
+	}{{"requests", defaults.Requests}, {"limits", defaults.Limits}} {
+		for _, name := range sortedKeys(list.resources) {
+			if q := list.resources[name]; q.Sign() < 0 {
+				return fmt.Errorf("defaultResources.%s.%s: must not be negative", list.field, name)
+			}
+		}
+	}
+	for _, name := range sortedKeys(defaults.Requests) {
+		request := defaults.Requests[name]
+		if limit, ok := defaults.Limits[name]; ok && request.Cmp(limit) > 0 {
+			return fmt.Errorf("defaultResources.requests.%s: must not be more than the limit %s", name, limit.String())
+		}
+	}
+	return nil
+}
@@ -0,0 +1,482 @@
+package webhook
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	defaultDigestTimeout  = 10 * time.Second
+	defaultDigestCacheTTL = 10 * time.Minute
+
+	// digestResponseLimit bounds the manifests and tokens read from registries
+	digestResponseLimit = 4 << 20
+
+	// dockerHubRegistry is the registry API host of docker.io images
+	dockerHubRegistry = "registry-1.docker.io"
+)
+
+var imageDigestResolutions = newCounterVec("image_digest_resolutions_total", "Image tags resolved to digests by result (resolved, cached or error).", "result")
+
+// manifestMediaTypes are the manifests a tag may point to, multi-arch indexes first so a tag is pinned to
+// the index rather than the manifest of one platform
+var manifestMediaTypes = []string{
+	"application/vnd.oci.image.index.v1+json",
+	"application/vnd.docker.distribution.manifest.list.v2+json",
+	"application/vnd.oci.image.manifest.v1+json",
+	"application/vnd.docker.distribution.manifest.v2+json",
+}
+
+// ImageDigestPolicy is what happens to a config injecting an image that isn't pinned to a digest, e.g.
+// busybox:1.36 rather than busybox:1.36@sha256:....
+type ImageDigestPolicy string
+
+const (
+	// ImageDigestsAllow accepts images without digests, the default.
+	ImageDigestsAllow ImageDigestPolicy = ""
+	// ImageDigestsWarn logs a warning for each image without a digest when the configs are loaded.
+	ImageDigestsWarn ImageDigestPolicy = "warn"
+	// ImageDigestsDeny fails loading configs with images without digests.
+	ImageDigestsDeny ImageDigestPolicy = "deny"
+)
+
+// ParseImageDigestPolicy parses warn, deny or an empty string.
+func ParseImageDigestPolicy(s string) (ImageDigestPolicy, error) {
+	switch p := ImageDigestPolicy(strings.TrimSpace(s)); p {
+	case ImageDigestsAllow, ImageDigestsWarn, ImageDigestsDeny:
+		return p, nil
+	}
+	return "", fmt.Errorf("unknown image digest policy %q, expected %s or %s", s, ImageDigestsWarn, ImageDigestsDeny)
+}
+
+// RegistryCredentials authenticate to a registry.
+type RegistryCredentials struct {
+	Username string
+	Password string
+}
+
+// DigestResolver pins image tags to the digest they point to when configs are loaded, so the images
+// injected can't change under a moved tag until the configs are reloaded. Manifests are looked up with
+// the registry API anonymously or with Credentials, and digests are cached for CacheTTL.
+type DigestResolver struct {
+	// Client - the HTTP client, one with a 10s timeout by default.
+	Client *http.Client
+
+	// Credentials - credentials by registry host, e.g. docker.io or ghcr.io.
+	Credentials map[string]RegistryCredentials
+
+	// CacheTTL - how long resolved digests are reused, 10m by default.
+	CacheTTL time.Duration
+
+	mu    sync.Mutex
+	cache map[string]digestCacheEntry
+}
+
+type digestCacheEntry struct {
+	digest  string
+	expires time.Time
+}
+
+// NewDigestResolver returns a DigestResolver with the credentials of the Docker config file, anonymous if
+// it's empty, caching digests for cacheTTL.
+func NewDigestResolver(credentialsFile string, cacheTTL time.Duration) (*DigestResolver, error) {
+	r := &DigestResolver{CacheTTL: cacheTTL}
+	if credentialsFile != "" {
+		credentials, err := LoadRegistryCredentials(credentialsFile)
+		if err != nil {
+			return nil, err
+		}
+		r.Credentials = credentials
+	}
+	return r, nil
+}
+
+// LoadRegistryCredentials reads the credentials of a Docker config file, the .dockerconfigjson of an
+// image pull secret.
+func LoadRegistryCredentials(file string) (map[string]RegistryCredentials, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var config struct {
+		Auths map[string]struct {
+			Auth     string `json:"auth"`
+			Username string `json:"username"`
+			Password string `json:"password"`
+		} `json:"auths"`
+	}
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("%s: %v", file, err)
+	}
+	credentials := map[string]RegistryCredentials{}
+	for server, auth := range config.Auths {
+		c := RegistryCredentials{Username: auth.Username, Password: auth.Password}
+		if auth.Auth != "" {
+			decoded, err := base64.StdEncoding.DecodeString(auth.Auth)
+			if err != nil {
+				return nil, fmt.Errorf("%s: auth of %s: %v", file, server, err)
+			}
+			c.Username, c.Password, _ = strings.Cut(string(decoded), ":")
+		}
+		credentials[credentialsHost(server)] = c
+	}
+	return credentials, nil
+}
+
+// credentialsHost returns the registry host of a Docker config server, e.g. docker.io for
+// https://index.docker.io/v1/
+func credentialsHost(server string) string {
+	host := server
+	if u, err := url.Parse(server); err == nil && u.Host != "" {
+		host = u.Host
+	}
+	host = strings.TrimSuffix(host, "/")
+	switch host {
+	case "index.docker.io", dockerHubRegistry:
+		return "docker.io"
+	}
+	return host
+}
+
+// pinImage returns the image pinned to the digest its tag points to, images with a digest are returned
+// as they are. The tag is kept for readability, the digest is what's pulled.
+func (r *DigestResolver) pinImage(image string) (string, error) {
+	if strings.Contains(image, "@") {
+		return image, nil
+	}
+	digest, err := r.resolve(image)
+	if err != nil {
+		return image, err
+	}
+	return image + "@" + digest, nil
+}
+
+// resolve returns the digest the image's tag points to, from the cache while it's fresh
+func (r *DigestResolver) resolve(image string) (string, error) {
+	r.mu.Lock()
+	if entry, ok := r.cache[image]; ok && time.Now().Before(entry.expires) {
+		r.mu.Unlock()
+		imageDigestResolutions.WithLabelValues("cached").Inc()
+		return entry.digest, nil
+	}
+	r.mu.Unlock()
+
+	digest, err := r.manifestDigest(image)
+	if err != nil {
+		imageDigestResolutions.WithLabelValues("error").Inc()
+		return "", err
+	}
+	imageDigestResolutions.WithLabelValues("resolved").Inc()
+
+	ttl := r.CacheTTL
+	if ttl == 0 {
+		ttl = defaultDigestCacheTTL
+	}
+	r.mu.Lock()
+	if r.cache == nil {
+		r.cache = map[string]digestCacheEntry{}
+	}
+	r.cache[image] = digestCacheEntry{digest: digest, expires: time.Now().Add(ttl)}
+	r.mu.Unlock()
+	return digest, nil
+}
+
+// manifestDigest asks the registry for the digest of the image's manifest
+func (r *DigestResolver) manifestDigest(image string) (string, error) {
+	registry, repository, tag := splitImage(image)
+	host := registry
+	if host == "docker.io" {
+		host = dockerHubRegistry
+	}
+	manifestURL := fmt.Sprintf("https://%s/v2/%s/manifests/%s", host, repository, tag)
+
+	var auth string
+	resp, err := r.manifestRequest(http.MethodHead, manifestURL, auth)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusUnauthorized {
+		if auth, err = r.authorization(resp.Header.Get("WWW-Authenticate"), registry, repository); err != nil {
+			return "", fmt.Errorf("%s: %v", image, err)
+		}
+		if resp, err = r.manifestRequest(http.MethodHead, manifestURL, auth); err != nil {
+			return "", err
+		}
+		resp.Body.Close()
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("%s: registry returned %s", image, resp.Status)
+	}
+	if digest := resp.Header.Get("Docker-Content-Digest"); digest != "" {
+		return digest, nil
+	}
+
+	// registries don't have to return the digest, it's the hash of the manifest
+	if resp, err = r.manifestRequest(http.MethodGet, manifestURL, auth); err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("%s: registry returned %s", image, resp.Status)
+	}
+	manifest, err := io.ReadAll(io.LimitReader(resp.Body, digestResponseLimit))
+	if err != nil {
+		return "", fmt.Errorf("%s: %v", image, err)
+	}
+	sum := sha256.Sum256(manifest)
+	return "sha256:" + hex.EncodeToString(sum[:]), nil
+}
+
+// manifestRequest sends a manifest request with the authorization header, if any
+func (r *DigestResolver) manifestRequest(method, manifestURL, auth string) (*http.Response, error) {
+	req, err := http.NewRequest(method, manifestURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", strings.Join(manifestMediaTypes, ", "))
+	if auth != "" {
+		req.Header.Set("Authorization", auth)
+	}
+	return r.client().Do(req)
+}
+
+// authorization answers the registry's challenge: basic auth with the registry's credentials, or a
+// bearer token from the registry's token service, anonymous without credentials
+func (r *DigestResolver) authorization(challenge, registry, repository string) (string, error) {
+	scheme, params := parseAuthChallenge(challenge)
+	credentials, hasCredentials := r.Credentials[registry]
+	switch strings.ToLower(scheme) {
+	case "basic":
+		if !hasCredentials {
+			return "", fmt.Errorf("the registry requires credentials for %s", registry)
+		}
+		return "Basic " + base64.StdEncoding.EncodeToString([]byte(credentials.Username+":"+credentials.Password)), nil
+	case "bearer":
+	default:
+		return "", fmt.Errorf("unsupported registry authentication %q", challenge)
+	}
+
+	tokenURL, err := url.Parse(params["realm"])
+	if err != nil || params["realm"] == "" {
+		return "", fmt.Errorf("invalid token realm %q", params["realm"])
+	}
+	query := tokenURL.Query()
+	if service := params["service"]; service != "" {
+		query.Set("service", service)
+	}
+	scope := params["scope"]
+	if scope == "" {
+		scope = "repository:" + repository + ":pull"
+	}
+	query.Set("scope", scope)
+	tokenURL.RawQuery = query.Encode()
+
+	req, err := http.NewRequest(http.MethodGet, tokenURL.String(), nil)
+	if err != nil {
+		return "", err
+	}
+	if hasCredentials {
+		req.SetBasicAuth(credentials.Username, credentials.Password)
+	}
+	resp, err := r.client().Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("token service returned %s", resp.Status)
+	}
+	var token struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, digestResponseLimit)).Decode(&token); err != nil {
+		return "", fmt.Errorf("invalid token response: %v", err)
+	}
+	if token.Token == "" {
+		token.Token = token.AccessToken
+	}
+	return "Bearer " + token.Token, nil
+}
+
+// client returns the resolver's HTTP client
+func (r *DigestResolver) client() *http.Client {
+	if r.Client != nil {
+		return r.Client
+	}
+	return &http.Client{Timeout: defaultDigestTimeout}
+}
+
+// parseAuthChallenge returns the scheme and parameters of a WWW-Authenticate header, e.g.
+// Bearer realm="https://auth.docker.io/token",service="registry.docker.io"
+func parseAuthChallenge(challenge string) (string, map[string]string) {
+	scheme, rest, _ := strings.Cut(strings.TrimSpace(challenge), " ")
+	params := map[string]string{}
+	for rest != "" {
+		var key, value string
+		key, rest, _ = strings.Cut(rest, "=")
+		key = strings.ToLower(strings.TrimSpace(strings.TrimLeft(key, ", ")))
+		if strings.HasPrefix(rest, `"`) {
+			end := strings.Index(rest[1:], `"`)
+			if end < 0 {
+				value, rest = rest[1:], ""
+			} else {
+				value, rest = rest[1:end+1], rest[end+2:]
+			}
+		} else {
+			value, rest, _ = strings.Cut(rest, ",")
+		}
+		if key != "" {
+			params[key] = value
+		}
+	}
+	return scheme, params
+}
+
+// splitImage returns the registry host, repository and tag of an image without a digest, e.g.
+// docker.io, library/busybox and latest for busybox
+func splitImage(image string) (registry, repository, tag string) {
+	registry = imageRegistry(image)
+	repository = image
+	if strings.HasPrefix(image, registry+"/") {
+		repository = strings.TrimPrefix(image, registry+"/")
+	}
+	if tag = imageTag(image); tag != "" {
+		repository = strings.TrimSuffix(repository, ":"+tag)
+	} else {
+		tag = "latest"
+	}
+	if registry == "docker.io" && !strings.Contains(repository, "/") {
+		repository = "library/" + repository
+	}
+	return registry, repository, tag
+}
+
+// configImage is an image a config injects
+type configImage struct {
+	path  string
+	image string
+	set   func(string)
+}
+
+// configImages returns the images of the config, including the default images of its presets and the
+// images of its namespace overrides. The lists and presets are copied so setting an image never changes
+// another config sharing them.
+func configImages(config *Config) []configImage {
+	var images []configImage
+	containers := func(field string, list []corev1.Container) []corev1.Container {
+		list = append([]corev1.Container(nil), list...)
+		for i := range list {
+			c := &list[i]
+			images = append(images, configImage{fmt.Sprintf("%s[%d] (%s)", field, i, c.Name), c.Image, func(s string) { c.Image = s }})
+		}
+		return list
+	}
+	config.InitContainers = containers("initContainers", config.InitContainers)
+	config.Containers = containers("containers", config.Containers)
+
+	overrides := append([]NamespaceOverride(nil), config.NamespaceOverrides...)
+	for i := range overrides {
+		overrides[i].Containers = append([]ContainerOverride(nil), overrides[i].Containers...)
+		for j := range overrides[i].Containers {
+			co := &overrides[i].Containers[j]
+			if co.Image != "" {
+				images = append(images, configImage{fmt.Sprintf("namespaceOverrides[%d].containers[%d] (%s)", i, j, co.Name), co.Image, func(s string) { co.Image = s }})
+			}
+		}
+	}
+	if config.NamespaceOverrides != nil {
+		config.NamespaceOverrides = overrides
+	}
+
+	orDefault := func(image, defaultImage string) string {
+		if image == "" {
+			return defaultImage
+		}
+		return image
+	}
+	if config.Vault != nil {
+		vault := *config.Vault
+		config.Vault = &vault
+		images = append(images, configImage{"vault.image", orDefault(vault.Image, defaultVaultImage), func(s string) { vault.Image = s }})
+	}
+	if config.OTelCollector != nil {
+		otel := *config.OTelCollector
+		config.OTelCollector = &otel
+		images = append(images,
+			configImage{"otelCollector.image", orDefault(otel.Image, defaultOTelImage), func(s string) { otel.Image = s }},
+			configImage{"otelCollector.bootstrapImage", orDefault(otel.BootstrapImage, defaultOTelBootstrapImage), func(s string) { otel.BootstrapImage = s }})
+	}
+	return images
+}
+
+// pinConfigImages pins the images of the named config to digests with the resolver, if any, and applies
+// the digest policy to the images that are left without one. Images that fail to resolve are left as they
+// are and logged. Images rendered per pod can't be checked and count as unpinned.
+func pinConfigImages(name string, config *Config, opts ConfigLoadOptions) error {
+	if opts.ImageDigests == ImageDigestsAllow && opts.DigestResolver == nil {
+		return nil
+	}
+	logger := opts.Logger
+	if logger == nil {
+		logger = log.Default()
+	}
+
+	var unpinned []string
+	for _, img := range configImages(config) {
+		if config.RenderTemplates && templated(img.image) {
+			unpinned = append(unpinned, fmt.Sprintf("%s: image %q is rendered per pod and can't be pinned to a digest", img.path, img.image))
+			continue
+		}
+		if opts.DigestResolver != nil && !strings.Contains(img.image, "@") {
+			pinned, err := opts.DigestResolver.pinImage(img.image)
+			if err != nil {
+				logger.Printf("Config %s: can't pin %s to a digest: %v", name, img.path, err)
+			} else {
+				img.set(pinned)
+				img.image = pinned
+			}
+		}
+		if !strings.Contains(img.image, "@") {
+			unpinned = append(unpinned, fmt.Sprintf("%s: image %q isn't pinned to a digest", img.path, img.image))
+		}
+	}
+
+	switch opts.ImageDigests {
+	case ImageDigestsWarn:
+		for _, problem := range unpinned {
+			logger.Printf("Config %s: %s", name, problem)
+		}
+	case ImageDigestsDeny:
+		if len(unpinned) > 0 {
+			return fmt.Errorf("config %s: %s", name, strings.Join(unpinned, "; "))
+		}
+	}
+	return nil
+}
+
+// pinImages pins the images of every config, see pinConfigImages
+func pinImages(configs MultiConfig, opts ConfigLoadOptions) error {
+	for _, name := range sortedKeys(configs) {
+		config := configs[name]
+		if err := pinConfigImages(name, &config, opts); err != nil {
+			return err
+		}
+		configs[name] = config
+	}
+	return nil
+}
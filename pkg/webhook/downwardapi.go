@@ -0,0 +1,61 @@
+package webhook
+
+import (
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// downwardAPIField is an env var set from a field of the pod through the Downward API
+type downwardAPIField struct {
+	env       string
+	fieldPath string
+}
+
+// downwardAPIFields are the env vars the injectDownwardAPI shorthands expand to
+var downwardAPIFields = map[string]downwardAPIField{
+	"podName":            {"POD_NAME", "metadata.name"},
+	"namespace":          {"POD_NAMESPACE", "metadata.namespace"},
+	"podUID":             {"POD_UID", "metadata.uid"},
+	"nodeName":           {"NODE_NAME", "spec.nodeName"},
+	"serviceAccountName": {"SERVICE_ACCOUNT_NAME", "spec.serviceAccountName"},
+	"podIP":              {"POD_IP", "status.podIP"},
+	"hostIP":             {"HOST_IP", "status.hostIP"},
+}
+
+// expandDownwardAPI returns a copy of the config with the env vars of its injectDownwardAPI shorthands
+// appended to its envVars. Env vars the config already sets keep their definition.
+func expandDownwardAPI(config Config) Config {
+	if len(config.InjectDownwardAPI) == 0 {
+		return config
+	}
+	defined := map[string]bool{}
+	for _, e := range config.EnvVars {
+		defined[e.Name] = true
+	}
+	config.EnvVars = append([]corev1.EnvVar{}, config.EnvVars...)
+	for _, name := range config.InjectDownwardAPI {
+		field, ok := downwardAPIFields[name]
+		if !ok || defined[field.env] {
+			continue
+		}
+		defined[field.env] = true
+		config.EnvVars = append(config.EnvVars, corev1.EnvVar{
+			Name: field.env,
+			ValueFrom: &corev1.EnvVarSource{
+				FieldRef: &corev1.ObjectFieldSelector{APIVersion: "v1", FieldPath: field.fieldPath},
+			},
+		})
+	}
+	return config
+}
+
+// validateDownwardAPI checks the injectDownwardAPI shorthands are known
+func (c Config) validateDownwardAPI() error {
+	for i, name := range c.InjectDownwardAPI {
+		if _, ok := downwardAPIFields[name]; !ok {
+			return fmt.Errorf("injectDownwardAPI[%d]: unknown field %q, expected one of %v", i, name, sortedKeys(downwardAPIFields))
+		}
+	}
+	return nil
+}
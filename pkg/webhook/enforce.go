@@ -0,0 +1,76 @@
+package webhook
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// EnforcedNamespace turns on deny-by-default for matching namespaces: pods are only admitted if they
+// are successfully injected with one of the required configs (or were already injected).
+type EnforcedNamespace struct {
+	// Namespace - the namespace, shell patterns such as secure-* are supported.
+	Namespace string
+
+	// RequiredConfigs - pods must be injected with one of these configs, empty accepts any config.
+	RequiredConfigs []string
+}
+
+// enforcement returns the first enforced namespace policy matching the namespace, or nil
+func (st *serverState) enforcement(namespace string) *EnforcedNamespace {
+	for i := range st.enforcedNamespaces {
+		if ok, _ := path.Match(st.enforcedNamespaces[i].Namespace, namespace); ok {
+			return &st.enforcedNamespaces[i]
+		}
+	}
+	return nil
+}
+
+// allows returns true if injecting the named config satisfies the policy
+func (e *EnforcedNamespace) allows(configName string) bool {
+	if len(e.RequiredConfigs) == 0 {
+		return true
+	}
+	for _, name := range e.RequiredConfigs {
+		if name == configName {
+			return true
+		}
+	}
+	return false
+}
+
+// denyUninjected rejects a pod in an enforced namespace that isn't going to be injected
+func (whs *WebhookServer) denyUninjected(e *EnforcedNamespace, namespace, pod, reason string) *admissionv1.AdmissionResponse {
+	whs.warningLogger.Printf("Denying %s, namespace requires injection: %s", pod, reason)
+	required := "a simple-sidecar config"
+	if len(e.RequiredConfigs) > 0 {
+		required = fmt.Sprintf("one of the simple-sidecar configs [%s]", strings.Join(e.RequiredConfigs, ", "))
+	}
+	return &admissionv1.AdmissionResponse{
+		Result: &metav1.Status{
+			Message: fmt.Sprintf("pods in namespace %q must be injected with %s (set the %s annotation): %s", namespace, required, whs.annotations.inject, reason),
+		},
+	}
+}
+
+// ParseEnforcedNamespaces parses a comma separated list of namespaces, each optionally followed by a
+// colon and the | separated configs pods must receive, e.g. "secure-*:vault|otel,payments".
+func ParseEnforcedNamespaces(value string) []EnforcedNamespace {
+	var enforced []EnforcedNamespace
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		namespace, configs, _ := strings.Cut(entry, ":")
+		e := EnforcedNamespace{Namespace: namespace}
+		if configs != "" {
+			e.RequiredConfigs = strings.Split(configs, "|")
+		}
+		enforced = append(enforced, e)
+	}
+	return enforced
+}
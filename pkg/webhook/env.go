@@ -0,0 +1,94 @@
+package webhook
+
+import (
+	"fmt"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// envVarReferences returns the names referenced with the $(VAR) syntax in value, $$(VAR) is an escaped
+// reference and is ignored just like Kubernetes does
+func envVarReferences(value string) []string {
+	var refs []string
+	for i := 0; i < len(value)-1; i++ {
+		if value[i] != '$' {
+			continue
+		}
+		if value[i+1] == '$' {
+			i++
+			continue
+		}
+		if value[i+1] != '(' {
+			continue
+		}
+		end := strings.IndexByte(value[i+2:], ')')
+		if end < 0 {
+			break
+		}
+		refs = append(refs, value[i+2:i+2+end])
+		i += 2 + end
+	}
+	return refs
+}
+
+// orderEnvVars returns the env vars ordered so every variable comes after the variables in the list it
+// references with $(VAR), Kubernetes only expands references to variables defined earlier. Variables
+// otherwise keep their relative order. Duplicate names are left where they are and a reference cycle
+// is an error.
+func orderEnvVars(envVars []corev1.EnvVar) ([]corev1.EnvVar, error) {
+	index := map[string]int{}
+	for i, e := range envVars {
+		if _, ok := index[e.Name]; !ok {
+			index[e.Name] = i
+		}
+	}
+
+	const (
+		unvisited = iota
+		visiting
+		done
+	)
+	state := make([]int, len(envVars))
+	ordered := make([]corev1.EnvVar, 0, len(envVars))
+
+	var visit func(i int, path []string) error
+	visit = func(i int, path []string) error {
+		switch state[i] {
+		case done:
+			return nil
+		case visiting:
+			return fmt.Errorf("env var reference cycle: %s", strings.Join(append(path, envVars[i].Name), " -> "))
+		}
+		state[i] = visiting
+		for _, ref := range envVarReferences(envVars[i].Value) {
+			if j, ok := index[ref]; ok && j != i {
+				if err := visit(j, append(path, envVars[i].Name)); err != nil {
+					return err
+				}
+			}
+		}
+		state[i] = done
+		ordered = append(ordered, envVars[i])
+		return nil
+	}
+
+	for i := range envVars {
+		if err := visit(i, nil); err != nil {
+			return nil, err
+		}
+	}
+	return ordered, nil
+}
+
+// referencesAny returns true if any of the env vars references one of the names
+func referencesAny(envVars []corev1.EnvVar, names map[string]bool) bool {
+	for _, e := range envVars {
+		for _, ref := range envVarReferences(e.Value) {
+			if names[ref] {
+				return true
+			}
+		}
+	}
+	return false
+}
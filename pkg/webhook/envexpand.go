@@ -0,0 +1,162 @@
+package webhook
+
+import (
+	"fmt"
+	"log"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// envReference matches ${NAME} references to the server's environment and the $${ escape
+var envReference = regexp.MustCompile(`\$\$\{|\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// ConfigLoadOptions are how configs are decoded, the zero value is what LoadConfig does.
+type ConfigLoadOptions struct {
+	// Lenient - ignore unknown fields and duplicate keys.
+	Lenient bool
+
+	// ExpandEnv - replace ${NAME} in string fields with the server's environment variable NAME, $${NAME}
+	// is a literal ${NAME}. Referencing a variable that isn't set is an error.
+	ExpandEnv bool
+
+	// SOPS - decrypt config files encrypted with SOPS by running the sops binary. Encrypted files are an
+	// error without it.
+	SOPS bool
+
+	// SOPSBinary - the sops binary, sops in PATH by default.
+	SOPSBinary string
+
+	// Profile - the profile of the config file applied to its configs, e.g. prod, none if empty.
+	Profile string
+
+	// ImageDigests - what happens to configs injecting images that aren't pinned to a digest.
+	ImageDigests ImageDigestPolicy
+
+	// DigestResolver - pins the images of configs to the digests of their tags when they're loaded.
+	DigestResolver *DigestResolver
+
+	// Logger - where the source of each config is logged when a list of files is merged, the standard
+	// logger if nil.
+	Logger *log.Logger
+}
+
+// LoadConfigWithOptions loads the configuration like LoadConfig, decoded as opts says.
+func LoadConfigWithOptions(configFile string, opts ConfigLoadOptions) (MultiConfig, error) {
+	return loadConfig(configFile, opts)
+}
+
+// expandConfigsEnv expands the environment references of every config
+func expandConfigsEnv(configs MultiConfig, lookup func(string) (string, bool)) error {
+	names := make([]string, 0, len(configs))
+	for name := range configs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		config := configs[name]
+		if err := expandConfigEnv(&config, lookup); err != nil {
+			return fmt.Errorf("config %s: %v", name, err)
+		}
+		configs[name] = config
+	}
+	return nil
+}
+
+// expandConfigEnv replaces the environment references in the string fields of the config
+func expandConfigEnv(config *Config, lookup func(string) (string, bool)) error {
+	return rewriteStrings(reflect.ValueOf(config).Elem(), "", func(s string) (string, error) {
+		return expandEnv(s, lookup)
+	})
+}
+
+// rewriteStrings replaces the strings of v, including string map values, with what rewrite returns for
+// them. path is used in errors.
+func rewriteStrings(v reflect.Value, path string, rewrite func(string) (string, error)) error {
+	switch v.Kind() {
+	case reflect.String:
+		rewritten, err := rewrite(v.String())
+		if err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+		if v.CanSet() {
+			v.SetString(rewritten)
+		}
+	case reflect.Ptr:
+		if !v.IsNil() {
+			return rewriteStrings(v.Elem(), path, rewrite)
+		}
+	case reflect.Struct:
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if !f.IsExported() {
+				continue
+			}
+			fieldPath := path
+			if !f.Anonymous {
+				fieldPath = joinFieldPath(path, fieldPathName(f))
+			}
+			if err := rewriteStrings(v.Field(i), fieldPath, rewrite); err != nil {
+				return err
+			}
+		}
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			if err := rewriteStrings(v.Index(i), fmt.Sprintf("%s[%d]", path, i), rewrite); err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		if v.Type().Elem().Kind() != reflect.String {
+			// values of other maps aren't addressable, they're left as they are
+			return nil
+		}
+		keys := v.MapKeys()
+		sort.Slice(keys, func(i, j int) bool { return keys[i].String() < keys[j].String() })
+		for _, key := range keys {
+			rewritten, err := rewrite(v.MapIndex(key).String())
+			if err != nil {
+				return fmt.Errorf("%s: %v", joinFieldPath(path, key.String()), err)
+			}
+			v.SetMapIndex(key, reflect.ValueOf(rewritten).Convert(v.Type().Elem()))
+		}
+	}
+	return nil
+}
+
+// expandEnv replaces the ${NAME} references in s and unescapes $${
+func expandEnv(s string, lookup func(string) (string, bool)) (string, error) {
+	if !strings.Contains(s, "${") {
+		return s, nil
+	}
+	var err error
+	expanded := envReference.ReplaceAllStringFunc(s, func(match string) string {
+		if match == "$${" {
+			return "${"
+		}
+		name := match[2 : len(match)-1]
+		value, ok := lookup(name)
+		if !ok && err == nil {
+			err = fmt.Errorf("environment variable %s isn't set, write $${%s} for a literal ${%s}", name, name, name)
+		}
+		return value
+	})
+	return expanded, err
+}
+
+// fieldPathName returns the name of the field as it's written in config files
+func fieldPathName(f reflect.StructField) string {
+	if name, _, _ := strings.Cut(f.Tag.Get("json"), ","); name != "" && name != "-" {
+		return name
+	}
+	return lowerCamel(f.Name)
+}
+
+func joinFieldPath(path, name string) string {
+	if path == "" {
+		return name
+	}
+	return path + "." + name
+}
@@ -0,0 +1,137 @@
+package webhook
+
+import (
+	"encoding/json"
+	"fmt"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+
+	"github.com/centml/simple-sidecar/pkg/patch"
+)
+
+// ephemeralContainersSubresource is the subresource ephemeral containers are added to running pods through
+const ephemeralContainersSubresource = "ephemeralcontainers"
+
+var ephemeralInjections = newCounterVec("ephemeral_injections_total", "Running pods the ephemeral containers of a config were added to on demand, by config.", "config")
+
+// isEphemeralContainersUpdate returns whether the request updates the ephemeral containers of a pod, the
+// API server sends the pod itself since 1.22
+func isEphemeralContainersUpdate(req *admissionv1.AdmissionRequest) bool {
+	return req.SubResource == ephemeralContainersSubresource && req.Operation == admissionv1.Update &&
+		req.Kind.Group == "" && req.Kind.Kind == "Pod" && len(req.Object.Raw) > 0
+}
+
+// injectEphemeral returns the response to an update of a pod's ephemeral containers. A pod whose debug
+// annotation names configs gets the ephemeral containers of each it doesn't have yet, other pods are
+// admitted as they are. Ephemeral containers can't be removed, so they're only ever added once.
+func (whs *WebhookServer) injectEphemeral(req *admissionv1.AdmissionRequest, st *serverState) *admissionv1.AdmissionResponse {
+	var pod corev1.Pod
+	if err := json.Unmarshal(req.Object.Raw, &pod); err != nil {
+		whs.warningLogger.Printf("Could not unmarshal raw object: %v", err)
+		return &admissionv1.AdmissionResponse{
+			Result: &metav1.Status{
+				Message: err.Error(),
+			},
+		}
+	}
+	if pod.Namespace == "" {
+		pod.Namespace = req.Namespace
+	}
+	id := podIdentity(req.Namespace, &pod)
+	names := splitConfigNames(pod.GetAnnotations()[whs.annotations.debug])
+	if len(names) == 0 {
+		return &admissionv1.AdmissionResponse{Allowed: true}
+	}
+
+	present := map[string]bool{}
+	for _, c := range pod.Spec.EphemeralContainers {
+		present[c.Name] = true
+	}
+	var added []corev1.EphemeralContainer
+	var injected []string
+	for _, name := range names {
+		name = st.configName(name)
+		if st.freeze.frozen(name) {
+			return whs.frozenAdmission(name, id)
+		}
+		config, ok := st.sidecarConfigs[name]
+		if !ok || len(config.EphemeralContainers) == 0 {
+			whs.warningLogger.Printf("Skipping ephemeral containers of %s for %s, the config doesn't exist or has none", name, id)
+			continue
+		}
+		if err := config.Scope.checkScope(req.Namespace, &pod); err != nil {
+			whs.warningLogger.Printf("Refusing ephemeral containers of %s for %s: %v", name, id, err)
+			return &admissionv1.AdmissionResponse{
+				Result: &metav1.Status{
+					Message: fmt.Sprintf("simple-sidecar config %q may not be applied to this pod: %v", name, err),
+				},
+			}
+		}
+		count := len(added)
+		for _, c := range config.EphemeralContainers {
+			if !present[c.Name] {
+				present[c.Name] = true
+				added = append(added, c)
+			}
+		}
+		if len(added) > count {
+			injected = append(injected, name)
+		}
+	}
+	if len(added) == 0 {
+		return &admissionv1.AdmissionResponse{Allowed: true}
+	}
+
+	patchBytes, err := patch.Marshal(patch.AddToList(pod.Spec.EphemeralContainers, added, "/spec/ephemeralContainers"))
+	if err != nil {
+		whs.warningLogger.Printf("Can't add the ephemeral containers to %s: %v", id, err)
+		return &admissionv1.AdmissionResponse{
+			Result: &metav1.Status{
+				Message: err.Error(),
+			},
+		}
+	}
+	for _, name := range injected {
+		ephemeralInjections.WithLabelValues(name).Inc()
+	}
+	whs.infoLogger.Printf("Adding the ephemeral containers of %v to %s", injected, id)
+	pt := admissionv1.PatchTypeJSONPatch
+	return &admissionv1.AdmissionResponse{
+		Allowed:   true,
+		Patch:     patchBytes,
+		PatchType: &pt,
+	}
+}
+
+// validateEphemeralContainers checks the config's ephemeral containers have a name and an image and don't
+// set the fields ephemeral containers can't have
+func (c Config) validateEphemeralContainers() error {
+	for i, container := range c.EphemeralContainers {
+		path := fmt.Sprintf("ephemeralContainers[%d]", i)
+		if errs := validation.IsDNS1123Label(container.Name); len(errs) > 0 {
+			return fmt.Errorf("%s.name: %s", path, errs[0])
+		}
+		if container.Image == "" {
+			return fmt.Errorf("%s.image: must not be empty", path)
+		}
+		switch {
+		case len(container.Ports) > 0:
+			return fmt.Errorf("%s.ports: ephemeral containers can't have ports", path)
+		case container.LivenessProbe != nil, container.ReadinessProbe != nil, container.StartupProbe != nil:
+			return fmt.Errorf("%s: ephemeral containers can't have probes", path)
+		case container.Lifecycle != nil:
+			return fmt.Errorf("%s.lifecycle: ephemeral containers can't have lifecycle hooks", path)
+		case len(container.Resources.Limits) > 0 || len(container.Resources.Requests) > 0:
+			return fmt.Errorf("%s.resources: ephemeral containers can't have resources", path)
+		}
+		for j, other := range c.EphemeralContainers[:i] {
+			if other.Name == container.Name {
+				return fmt.Errorf("%s.name: %q is also the name of ephemeralContainers[%d]", path, container.Name, j)
+			}
+		}
+	}
+	return nil
+}
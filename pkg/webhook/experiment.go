@@ -0,0 +1,109 @@
+package webhook
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+
+	"github.com/centml/simple-sidecar/pkg/patch"
+)
+
+var experimentInjections = newCounterVec("experiment_injections_total", "Pods injected by experiment config and the config they received, the experiment's config or its variant.", "config", "variant")
+
+// ExperimentConfig splits the pods requesting a config between it and a variant, e.g. the next release
+// of the sidecar, so the two can be compared on real workloads before the variant is promoted. Injected
+// pods are labelled with the name of the config they received.
+type ExperimentConfig struct {
+	// Variant - the name of the config a share of the pods receive instead.
+	Variant string
+
+	// Percent - the share of pods, 0 to 100, that receive Variant. Pods with the same controller, e.g. the
+	// pods of a ReplicaSet, receive the same config.
+	Percent int
+}
+
+// validateExperiment checks the experiment's split
+func (c Config) validateExperiment() error {
+	if c.Experiment == nil {
+		return nil
+	}
+	if c.Experiment.Percent < 0 || c.Experiment.Percent > 100 {
+		return fmt.Errorf("experiment.percent must be between 0 and 100, got %d", c.Experiment.Percent)
+	}
+	return nil
+}
+
+// experimentProblems returns the problems of the named config's experiment that depend on the other configs
+func experimentProblems(name string, configs MultiConfig) []string {
+	e := configs[name].Experiment
+	if e == nil {
+		return nil
+	}
+	var problems []string
+	// both names end up as the value of the variant label
+	for _, msg := range validation.IsValidLabelValue(name) {
+		problems = append(problems, fmt.Sprintf("experiment: the config name must be a label value: %s", msg))
+	}
+	variant, ok := configs[e.Variant]
+	switch {
+	case e.Variant == name:
+		problems = append(problems, "experiment.variant: a config can't be its own variant")
+	case !ok:
+		problems = append(problems, fmt.Sprintf("experiment.variant: config %q doesn't exist", e.Variant))
+	case variant.Experiment != nil:
+		problems = append(problems, fmt.Sprintf("experiment.variant: config %q runs an experiment itself", e.Variant))
+	}
+	for _, msg := range validation.IsValidLabelValue(e.Variant) {
+		problems = append(problems, fmt.Sprintf("experiment.variant: %s", msg))
+	}
+	return problems
+}
+
+// inVariant reports whether the pod falls in the share of the experiment's variant. The pod's identity,
+// which is its controller for pods that have one, picks the bucket so workloads aren't split.
+func (e *ExperimentConfig) inVariant(configName, namespace string, pod *corev1.Pod) bool {
+	h := fnv.New32a()
+	h.Write([]byte(configName + "\x00" + podIdentity(namespace, pod)))
+	return int(h.Sum32()%100) < e.Percent
+}
+
+// experimentVariant returns the name of the config the pod receives from the config's experiment and the
+// config itself
+func (whs *WebhookServer) experimentVariant(st *serverState, namespace string, pod *corev1.Pod, configName string, config Config) (string, Config) {
+	injected := configName
+	if config.Experiment.inVariant(configName, namespace, pod) {
+		variant, ok := st.sidecarConfigs[config.Experiment.Variant]
+		if ok {
+			injected, config = config.Experiment.Variant, variant
+		} else {
+			whs.warningLogger.Printf("Variant %s of config %s doesn't exist, injecting %s with %s", config.Experiment.Variant, configName, podIdentity(namespace, pod), configName)
+		}
+	}
+	experimentInjections.WithLabelValues(configName, injected).Inc()
+	return injected, config
+}
+
+// labelVariant adds the label recording the config the pod received in an experiment to the patch, added
+// are the labels the patch already adds
+func (whs *WebhookServer) labelVariant(patchBytes []byte, pod *corev1.Pod, configName string, added map[string]string) ([]byte, error) {
+	var ops []patchOperation
+	if err := json.Unmarshal(patchBytes, &ops); err != nil {
+		return nil, err
+	}
+	labels := pod.Labels
+	if len(added) > 0 {
+		// the patch creates the labels map if the pod has none
+		labels = make(map[string]string, len(pod.Labels)+len(added))
+		for k, v := range pod.Labels {
+			labels[k] = v
+		}
+		for k, v := range added {
+			labels[k] = v
+		}
+	}
+	ops = append(ops, whs.addLabels(labels, map[string]string{whs.annotations.variant: configName})...)
+	return patch.Marshal(ops)
+}
@@ -0,0 +1,144 @@
+package webhook
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// configKeys returns the fields each config of a config file sets, by lowercase key as they're matched
+// when decoding. Fields set to null count as unset.
+func configKeys(data []byte) map[string]map[string]bool {
+	doc, ok := decodeConfigFile(data)
+	if !ok {
+		return nil
+	}
+	keys := map[string]map[string]bool{}
+	for name, value := range doc {
+		fields, ok := value.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		keys[name] = map[string]bool{}
+		for key, v := range fields {
+			if v != nil {
+				keys[name][strings.ToLower(key)] = true
+			}
+		}
+	}
+	return keys
+}
+
+// resolveExtends replaces every config that extends another with the result of extending its base, bases
+// are resolved first so chains of configs work. keys are the fields each config sets, see configKeys.
+func resolveExtends(configs MultiConfig, keys map[string]map[string]bool) error {
+	names := make([]string, 0, len(configs))
+	for name := range configs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	resolved := map[string]bool{}
+	var resolve func(name string, chain []string) error
+	resolve = func(name string, chain []string) error {
+		if resolved[name] {
+			return nil
+		}
+		config := configs[name]
+		if config.Extends != "" {
+			for i, n := range chain {
+				if n == name {
+					return fmt.Errorf("config %s: extends cycle %s", name, strings.Join(append(chain[i:], name), " -> "))
+				}
+			}
+			if _, ok := configs[config.Extends]; !ok {
+				return fmt.Errorf("config %s: extends config %q, which doesn't exist", name, config.Extends)
+			}
+			if err := resolve(config.Extends, append(chain, name)); err != nil {
+				return err
+			}
+			configs[name] = extendConfig(configs[config.Extends], config, keys[name])
+		}
+		resolved[name] = true
+		return nil
+	}
+	for _, name := range names {
+		if err := resolve(name, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// extendConfig returns config with the fields it doesn't set taken from base. A field is set if its key is
+// in set, so e.g. nativeSidecar: false turns off the base's, or if it isn't zero. Containers, initContainers,
+// volumes, envVars and files are merged by name and volumeMounts by mountPath, the entries of config replacing
+// the base's. Aliases, tests and the experiment belong to a config and aren't inherited.
+func extendConfig(base, config Config, set map[string]bool) Config {
+	extended := config
+	inheritUnsetFields(reflect.ValueOf(&extended).Elem(), reflect.ValueOf(base), set)
+
+	extended.InitContainers = mergeByKey(base.InitContainers, config.InitContainers, func(c corev1.Container) string { return c.Name })
+	extended.Containers = mergeByKey(base.Containers, config.Containers, func(c corev1.Container) string { return c.Name })
+	extended.Volumes = mergeByKey(base.Volumes, config.Volumes, func(v corev1.Volume) string { return v.Name })
+	extended.VolumesIfMissing = mergeByKey(base.VolumesIfMissing, config.VolumesIfMissing, func(v corev1.Volume) string { return v.Name })
+	extended.EnvVars = mergeByKey(base.EnvVars, config.EnvVars, func(e corev1.EnvVar) string { return e.Name })
+	extended.Files = mergeByKey(base.Files, config.Files, func(f ConfigFile) string { return f.Name })
+	extended.VolumeMounts = mergeByKey(base.VolumeMounts, config.VolumeMounts, func(vm corev1.VolumeMount) string { return vm.MountPath })
+	extended.Aliases = config.Aliases
+	extended.Tests = config.Tests
+	extended.Experiment = config.Experiment
+	return extended
+}
+
+// inheritUnsetFields sets the exported fields of v that are zero and whose lowercase name isn't in set to
+// the field of base, the fields of embedded structs are inherited one by one
+func inheritUnsetFields(v, base reflect.Value, set map[string]bool) {
+	for i := 0; i < v.NumField(); i++ {
+		f := v.Field(i)
+		if !f.CanSet() {
+			continue
+		}
+		field := v.Type().Field(i)
+		if field.Anonymous && f.Kind() == reflect.Struct {
+			inheritUnsetFields(f, base.Field(i), set)
+			continue
+		}
+		if f.IsZero() && !set[strings.ToLower(field.Name)] {
+			f.Set(base.Field(i))
+		}
+	}
+}
+
+// mergeByKey returns the entries of base with the entries of override that have the same key replacing
+// them in place, followed by the other entries of override
+func mergeByKey[T any](base, override []T, key func(T) string) []T {
+	if len(override) == 0 {
+		return base
+	}
+	if len(base) == 0 {
+		return override
+	}
+	overrides := map[string]T{}
+	for _, o := range override {
+		overrides[key(o)] = o
+	}
+	merged := make([]T, 0, len(base)+len(override))
+	replaced := map[string]bool{}
+	for _, b := range base {
+		if o, ok := overrides[key(b)]; ok {
+			b = o
+			replaced[key(b)] = true
+		}
+		merged = append(merged, b)
+	}
+	for _, o := range override {
+		if !replaced[key(o)] {
+			merged = append(merged, o)
+		}
+	}
+	return merged
+}
@@ -0,0 +1,54 @@
+package webhook
+
+import "testing"
+
+func TestExtendsOverridesBaseFields(t *testing.T) {
+	configs, err := LoadConfigFromBytes([]byte(`
+base:
+  containers:
+  - name: agent
+    image: registry.example.com/agent:1.0
+  nativeSidecar: true
+  reorderExistingEnv: true
+  release: "1.0"
+overridden:
+  extends: base
+  nativeSidecar: false
+  reorderExistingEnv: false
+  release: ""
+inherited:
+  extends: base
+unset:
+  extends: base
+  nativeSidecar: null
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name          string
+		nativeSidecar bool
+		reorder       bool
+		release       string
+	}{
+		{name: "base", nativeSidecar: true, reorder: true, release: "1.0"},
+		{name: "overridden"},
+		{name: "inherited", nativeSidecar: true, reorder: true, release: "1.0"},
+		{name: "unset", nativeSidecar: true, reorder: true, release: "1.0"},
+	}
+	for _, tt := range tests {
+		config := configs[tt.name]
+		if config.NativeSidecar != tt.nativeSidecar {
+			t.Errorf("config %s: nativeSidecar = %v, want %v", tt.name, config.NativeSidecar, tt.nativeSidecar)
+		}
+		if config.ReorderExistingEnv != tt.reorder {
+			t.Errorf("config %s: reorderExistingEnv = %v, want %v", tt.name, config.ReorderExistingEnv, tt.reorder)
+		}
+		if config.Release != tt.release {
+			t.Errorf("config %s: release = %q, want %q", tt.name, config.Release, tt.release)
+		}
+		if len(config.Containers) != 1 {
+			t.Errorf("config %s: containers = %v, want the base's", tt.name, config.Containers)
+		}
+	}
+}
@@ -0,0 +1,267 @@
+package webhook
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"sigs.k8s.io/yaml"
+)
+
+// configIncludeKey is the top-level key of a config file listing the files whose configs and templates it
+// includes, it can't name a config
+const configIncludeKey = "include"
+
+// configFileIncluder merges a config file and the files it includes into one config file
+type configFileIncluder struct {
+	opts ConfigLoadOptions
+
+	// dir is the directory of the main file, jsonPatches files are resolved against it
+	dir string
+
+	doc    map[string]interface{}
+	source map[string]string
+	read   map[string]bool
+	stack  []string
+	files  []string
+
+	// profileSource is the file of each profile's config, by <profile>/<config>
+	profileSource map[string]string
+}
+
+// includeConfigFiles returns the config file with the configs and templates of the files it includes, and
+// of the files they include, merged in, and the included files. Included paths are relative to the
+// including file. A file included twice is read once, an include cycle or a config defined in two files is
+// an error. The file is returned decrypted and migrated either way.
+func includeConfigFiles(file string, data []byte, opts ConfigLoadOptions) ([]byte, []string, error) {
+	in := &configFileIncluder{
+		opts:   opts,
+		dir:    filepath.Dir(file),
+		doc:    map[string]interface{}{},
+		source: map[string]string{},
+		read:   map[string]bool{},
+
+		profileSource: map[string]string{},
+	}
+	prepared, includes, err := in.add(file, data)
+	if err != nil || !includes {
+		return prepared, nil, err
+	}
+	merged, err := json.Marshal(in.doc)
+	if err != nil {
+		return nil, nil, err
+	}
+	return merged, in.files, nil
+}
+
+// includedConfigFiles returns the files the config file includes, none if it can't be read
+func includedConfigFiles(file string, opts ConfigLoadOptions) []string {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil
+	}
+	_, files, _ := includeConfigFiles(file, data, opts)
+	return files
+}
+
+// add merges the configs and templates of the file, and of the files it includes, into the document. It
+// returns the prepared file and whether it includes any.
+func (in *configFileIncluder) add(file string, data []byte) ([]byte, bool, error) {
+	path, err := filepath.Abs(file)
+	if err != nil {
+		return nil, false, err
+	}
+	for i, including := range in.stack {
+		if including == path {
+			return nil, false, fmt.Errorf("include cycle: %s", strings.Join(append(in.stack[i:], path), " -> "))
+		}
+	}
+	if in.read[path] {
+		return nil, false, nil
+	}
+	in.read[path] = true
+	in.stack = append(in.stack, path)
+	defer func() { in.stack = in.stack[:len(in.stack)-1] }()
+
+	if err := checkJSONConfig(file, data); err != nil {
+		return nil, false, err
+	}
+	if data, err = prepareConfigFile(data, in.opts); err != nil {
+		return nil, false, err
+	}
+	doc, ok := decodeConfigFile(data)
+	if !ok {
+		if len(in.stack) == 1 {
+			// decoding the configs reports why
+			return data, false, nil
+		}
+		var configs MultiConfig
+		if err := unmarshalConfigs(data, &configs); err != nil {
+			return nil, false, err
+		}
+		return nil, false, fmt.Errorf("not a map of configs")
+	}
+	raw, ok := doc[configIncludeKey]
+	if !ok && len(in.stack) == 1 {
+		return data, false, nil
+	}
+	if !in.opts.Lenient {
+		// merging the files drops duplicate keys, strict loading must still see them
+		if _, err := yaml.YAMLToJSONStrict(data); err != nil {
+			return nil, false, err
+		}
+	}
+	includes, err := includeList(raw)
+	if err != nil {
+		return nil, false, err
+	}
+	delete(doc, configIncludeKey)
+	if err := in.merge(file, doc); err != nil {
+		return nil, false, err
+	}
+
+	for _, include := range includes {
+		if !filepath.IsAbs(include) {
+			include = filepath.Join(filepath.Dir(file), include)
+		}
+		included, err := os.ReadFile(include)
+		if err != nil {
+			return nil, false, fmt.Errorf("%s: %v", configIncludeKey, err)
+		}
+		in.files = append(in.files, include)
+		if _, _, err := in.add(include, included); err != nil {
+			return nil, false, fmt.Errorf("%s: %v", include, err)
+		}
+	}
+	return data, true, nil
+}
+
+// merge adds the configs of the file's document, and appends its templates to the templates of the files
+// merged before
+func (in *configFileIncluder) merge(file string, doc map[string]interface{}) error {
+	for name, value := range doc {
+		if name == configTemplatesKey {
+			if err := mergeTemplates(in.doc, value); err != nil {
+				return fmt.Errorf("%s: %v", configTemplatesKey, err)
+			}
+			continue
+		}
+		if name == configProfilesKey {
+			if err := in.mergeProfiles(file, value); err != nil {
+				return fmt.Errorf("%s: %v", configProfilesKey, err)
+			}
+			continue
+		}
+		if other, ok := in.source[name]; ok {
+			return fmt.Errorf("config %s is defined in both %s and %s", name, other, file)
+		}
+		in.source[name] = file
+		in.rebasePatches(file, value)
+		in.doc[name] = value
+	}
+	return nil
+}
+
+// rebasePatches makes the relative jsonPatches files of a config from an included file in another
+// directory relative to the main file's directory, which they're resolved against
+func (in *configFileIncluder) rebasePatches(file string, config interface{}) {
+	dir := filepath.Dir(file)
+	rel, err := filepath.Rel(in.dir, dir)
+	if err != nil {
+		rel = dir
+	}
+	if rel == "." {
+		return
+	}
+	fields, ok := config.(map[string]interface{})
+	if !ok {
+		return
+	}
+	patches, ok := fields["jsonPatches"].([]interface{})
+	if !ok {
+		return
+	}
+	for i, patch := range patches {
+		if p, ok := patch.(string); ok && !filepath.IsAbs(p) {
+			patches[i] = filepath.Join(rel, p)
+		}
+	}
+}
+
+// mergeTemplates appends the lists of the templates section to the lists of the document's templates
+func mergeTemplates(doc map[string]interface{}, value interface{}) error {
+	section, ok := value.(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("must be a map of template lists")
+	}
+	merged, _ := doc[configTemplatesKey].(map[string]interface{})
+	if merged == nil {
+		merged = map[string]interface{}{}
+		doc[configTemplatesKey] = merged
+	}
+	for key, list := range section {
+		items, ok := list.([]interface{})
+		if !ok {
+			return fmt.Errorf("%s must be a list", key)
+		}
+		existing, _ := merged[key].([]interface{})
+		merged[key] = append(existing, items...)
+	}
+	return nil
+}
+
+// mergeProfiles adds the configs of the file's profiles to the profiles of the files merged before, a
+// config changed by the same profile in two files is an error
+func (in *configFileIncluder) mergeProfiles(file string, value interface{}) error {
+	section, ok := value.(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("must be a map of profiles to configs")
+	}
+	merged, _ := in.doc[configProfilesKey].(map[string]interface{})
+	if merged == nil {
+		merged = map[string]interface{}{}
+		in.doc[configProfilesKey] = merged
+	}
+	for profile, value := range section {
+		configs, ok := value.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("%s must be a map of configs", profile)
+		}
+		existing, _ := merged[profile].(map[string]interface{})
+		if existing == nil {
+			existing = map[string]interface{}{}
+			merged[profile] = existing
+		}
+		for name, config := range configs {
+			key := profile + "/" + name
+			if other, ok := in.profileSource[key]; ok {
+				return fmt.Errorf("%s.%s is defined in both %s and %s", profile, name, other, file)
+			}
+			in.profileSource[key] = file
+			existing[name] = config
+		}
+	}
+	return nil
+}
+
+// includeList returns the files of an include key
+func includeList(raw interface{}) ([]string, error) {
+	if raw == nil {
+		return nil, nil
+	}
+	items, ok := raw.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%s must be a list of files", configIncludeKey)
+	}
+	files := make([]string, 0, len(items))
+	for i, item := range items {
+		file, ok := item.(string)
+		if !ok || file == "" {
+			return nil, fmt.Errorf("%s[%d] must be a file name", configIncludeKey, i)
+		}
+		files = append(files, file)
+	}
+	return files, nil
+}
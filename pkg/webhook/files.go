@@ -0,0 +1,325 @@
+package webhook
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/client-go/dynamic"
+)
+
+const (
+	fileStoreAnnotation = "annotation"
+	fileStoreConfigMap  = "configmap"
+
+	// filesVolumeName is the volume the rendered files of a config are mounted from
+	filesVolumeName = "simple-sidecar-files"
+
+	// fileConfigMapPrefix starts the names of the ConfigMaps files are stored in, the rest is a hash of
+	// their contents
+	fileConfigMapPrefix = "simple-sidecar-files-"
+
+	// fileConfigMapTimeout bounds the creation of a ConfigMap during an admission
+	fileConfigMapTimeout = 2 * time.Second
+
+	// fileConfigMapCacheSize is the number of ConfigMaps remembered as created
+	fileConfigMapCacheSize = 10000
+
+	// fileConfigMapCacheTTL is how long a ConfigMap is remembered as created. ConfigMaps deleted since,
+	// e.g. by a namespace cleanup, are created again once it's over.
+	fileConfigMapCacheTTL = time.Minute
+)
+
+var fileConfigMapResults = newCounterVec("file_configmaps_total", "ConfigMaps storing rendered files by result (created, exists, cached, dry-run or error).", "result")
+
+// configMapResource is the resource files are stored in with the configmap store
+var configMapResource = schema.GroupVersionResource{Version: "v1", Resource: "configmaps"}
+
+// ConfigFile is a configuration file rendered per pod and mounted into the injected containers, for
+// sidecars whose configuration can't be expressed with env vars alone.
+type ConfigFile struct {
+	// Name - the name of the file, a ConfigMap key such as envoy.yaml.
+	Name string
+
+	// MountPath - the path of the file in the containers, e.g. /etc/envoy/envoy.yaml.
+	MountPath string
+
+	// Template - the contents of the file as a Go template, rendered with the pod like RenderTemplates,
+	// e.g. {{ .Pod.Namespace }} or {{ .Labels "app.kubernetes.io/name" }}.
+	Template string
+
+	// Containers - the injected containers and initContainers the file is mounted into, all of them if
+	// empty.
+	Containers []string
+}
+
+// validateFiles checks the names, paths, templates and containers of the config's files
+func (c Config) validateFiles() error {
+	if len(c.Files) == 0 {
+		return nil
+	}
+	switch c.FileStore {
+	case "", fileStoreAnnotation, fileStoreConfigMap:
+	default:
+		return fmt.Errorf("fileStore must be %q or %q, got %q", fileStoreAnnotation, fileStoreConfigMap, c.FileStore)
+	}
+	for _, v := range c.Volumes {
+		if v.Name == filesVolumeName || strings.HasPrefix(v.Name, filesVolumeName+"-") {
+			return fmt.Errorf("files: volume %s is reserved for the files, as are the volumes starting with %s-", filesVolumeName, filesVolumeName)
+		}
+	}
+
+	containers := map[string]bool{}
+	for _, container := range append(append([]corev1.Container{}, c.InitContainers...), c.Containers...) {
+		containers[container.Name] = true
+	}
+	names := map[string]bool{}
+	for i, f := range c.Files {
+		if errs := validation.IsConfigMapKey(f.Name); len(errs) > 0 {
+			return fmt.Errorf("files[%d].name: %s", i, strings.Join(errs, ", "))
+		}
+		if c.FileStore != fileStoreConfigMap {
+			if errs := validation.IsQualifiedName(defaultAnnotationKeys.file + f.Name); len(errs) > 0 {
+				return fmt.Errorf("files[%d].name: %s, use the configmap store for long names", i, strings.Join(errs, ", "))
+			}
+		}
+		if names[f.Name] {
+			return fmt.Errorf("files[%d].name: duplicate file %q", i, f.Name)
+		}
+		names[f.Name] = true
+		if !path.IsAbs(f.MountPath) {
+			return fmt.Errorf("files[%d].mountPath: must be an absolute path", i)
+		}
+		if _, err := parseConfigTemplate(f.Template); err != nil {
+			return fmt.Errorf("files[%d].template: %v", i, err)
+		}
+		for j, name := range f.Containers {
+			if !containers[name] {
+				return fmt.Errorf("files[%d].containers[%d]: container %q is not injected by the config", i, j, name)
+			}
+		}
+	}
+	return nil
+}
+
+// renderFiles renders the config's files for the pod, by name
+func renderFiles(pod *corev1.Pod, config Config) (map[string]string, error) {
+	data := newConfigTemplateData(pod)
+	files := make(map[string]string, len(config.Files))
+	for _, f := range config.Files {
+		tmpl, err := parseConfigTemplate(f.Template)
+		if err != nil {
+			return nil, fmt.Errorf("file %s: %v", f.Name, err)
+		}
+		var rendered strings.Builder
+		if err := tmpl.Execute(&rendered, data); err != nil {
+			return nil, fmt.Errorf("file %s: %v", f.Name, err)
+		}
+		files[f.Name] = rendered.String()
+	}
+	return files, nil
+}
+
+// fileConfigMapName returns the name of the ConfigMap storing the files, pods with the same files share it
+func fileConfigMapName(files map[string]string) string {
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	h := sha256.New()
+	for _, name := range names {
+		fmt.Fprintf(h, "%d:%s%d:%s", len(name), name, len(files[name]), files[name])
+	}
+	return fileConfigMapPrefix + hex.EncodeToString(h.Sum(nil))[:16]
+}
+
+// addFiles returns a copy of the config with its files rendered for the pod and mounted into the injected
+// containers. With the annotation store the files are added to the pod's annotations and projected by the
+// Downward API, with the configmap store they're read from the ConfigMap storeFiles creates.
+func (whs *WebhookServer) addFiles(pod *corev1.Pod, config Config) (Config, error) {
+	if len(config.Files) == 0 {
+		return config, nil
+	}
+	files, err := renderFiles(pod, config)
+	if err != nil {
+		return config, err
+	}
+
+	volume := corev1.Volume{Name: config.filesVolumeName()}
+	if config.FileStore == fileStoreConfigMap {
+		source := &corev1.ConfigMapVolumeSource{LocalObjectReference: corev1.LocalObjectReference{Name: fileConfigMapName(files)}}
+		for _, f := range config.Files {
+			source.Items = append(source.Items, corev1.KeyToPath{Key: f.Name, Path: f.Name})
+		}
+		volume.ConfigMap = source
+	} else {
+		source := &corev1.DownwardAPIVolumeSource{}
+		annotations := make(map[string]string, len(files))
+		for _, f := range config.Files {
+			key := whs.annotations.file + f.Name
+			annotations[key] = files[f.Name]
+			source.Items = append(source.Items, corev1.DownwardAPIVolumeFile{
+				Path:     f.Name,
+				FieldRef: &corev1.ObjectFieldSelector{FieldPath: fmt.Sprintf("metadata.annotations['%s']", key)},
+			})
+		}
+		volume.DownwardAPI = source
+		config.fileAnnotations = annotations
+	}
+
+	// copy what's mounted into so the shared config is never modified
+	config.InitContainers = deepCopyList(config.InitContainers)
+	config.Containers = deepCopyList(config.Containers)
+	mount := func(containers []corev1.Container) {
+		for i := range containers {
+			for _, f := range config.Files {
+				if len(f.Containers) > 0 && !contains(f.Containers, containers[i].Name) {
+					continue
+				}
+				containers[i].VolumeMounts = append(containers[i].VolumeMounts, corev1.VolumeMount{
+					Name:      volume.Name,
+					MountPath: f.MountPath,
+					SubPath:   f.Name,
+					ReadOnly:  true,
+				})
+			}
+		}
+	}
+	mount(config.InitContainers)
+	mount(config.Containers)
+	config.Volumes = append(append([]corev1.Volume{}, config.Volumes...), volume)
+	return config, nil
+}
+
+// filesVolumeName returns the name of the volume the config's files are mounted from
+func (c Config) filesVolumeName() string {
+	if c.filesVolume != "" {
+		return c.filesVolume
+	}
+	return filesVolumeName
+}
+
+// contains returns whether the list contains s
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// fileConfigMaps creates the ConfigMaps files are stored in. ConfigMaps are named after their contents so
+// the pods of a workload share one, and the ones created recently aren't created again.
+type fileConfigMaps struct {
+	client dynamic.Interface
+
+	mu sync.Mutex
+	// created is when each ConfigMap stops being remembered as created
+	created map[string]time.Time
+}
+
+// newFileConfigMaps returns a fileConfigMaps creating ConfigMaps with the client
+func newFileConfigMaps(client dynamic.Interface) *fileConfigMaps {
+	return &fileConfigMaps{
+		client:  client,
+		created: map[string]time.Time{},
+	}
+}
+
+// ensure creates the ConfigMap in the namespace unless it already exists. The ConfigMap is immutable and
+// isn't owned by the pod, which has no UID yet, so ConfigMaps outlive their pods. ConfigMaps are only
+// remembered as created for fileConfigMapCacheTTL, so one deleted since is created again.
+func (m *fileConfigMaps) ensure(namespace, name string, files map[string]string) error {
+	key := namespace + "/" + name
+	now := time.Now()
+	m.mu.Lock()
+	known := now.Before(m.created[key])
+	m.mu.Unlock()
+	if known {
+		fileConfigMapResults.WithLabelValues("cached").Inc()
+		return nil
+	}
+
+	immutable := true
+	configMap := &corev1.ConfigMap{
+		TypeMeta: metav1.TypeMeta{APIVersion: "v1", Kind: "ConfigMap"},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: namespace,
+			Labels:    map[string]string{"app.kubernetes.io/managed-by": "simple-sidecar"},
+		},
+		Immutable: &immutable,
+		Data:      files,
+	}
+	obj, err := runtime.DefaultUnstructuredConverter.ToUnstructured(configMap)
+	if err != nil {
+		fileConfigMapResults.WithLabelValues("error").Inc()
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), fileConfigMapTimeout)
+	defer cancel()
+	_, err = m.client.Resource(configMapResource).Namespace(namespace).Create(ctx, &unstructured.Unstructured{Object: obj}, metav1.CreateOptions{})
+	switch {
+	case err == nil:
+		fileConfigMapResults.WithLabelValues("created").Inc()
+	case apierrors.IsAlreadyExists(err):
+		fileConfigMapResults.WithLabelValues("exists").Inc()
+	default:
+		fileConfigMapResults.WithLabelValues("error").Inc()
+		return fmt.Errorf("can't create ConfigMap %s for the files: %v", key, err)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(m.created) >= fileConfigMapCacheSize {
+		for k, expires := range m.created {
+			if !now.Before(expires) {
+				delete(m.created, k)
+			}
+		}
+	}
+	if len(m.created) >= fileConfigMapCacheSize {
+		for k := range m.created {
+			delete(m.created, k)
+			break
+		}
+	}
+	m.created[key] = now.Add(fileConfigMapCacheTTL)
+	return nil
+}
+
+// storeFiles creates the ConfigMap the files of a config with the configmap store are mounted from. Dry
+// run admissions have no side effects, their pods are never created.
+func (whs *WebhookServer) storeFiles(pod *corev1.Pod, config Config, dryRun bool) error {
+	if len(config.Files) == 0 || config.FileStore != fileStoreConfigMap {
+		return nil
+	}
+	if whs.fileConfigMaps == nil {
+		return fmt.Errorf("the config stores its files in a ConfigMap but the server has no client to create it with, see FILE_CONFIGMAPS")
+	}
+	files, err := renderFiles(pod, config)
+	if err != nil {
+		return err
+	}
+	name := fileConfigMapName(files)
+	if dryRun {
+		fileConfigMapResults.WithLabelValues("dry-run").Inc()
+		return nil
+	}
+	return whs.fileConfigMaps.ensure(pod.Namespace, name, files)
+}
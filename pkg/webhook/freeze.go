@@ -0,0 +1,127 @@
+package webhook
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	admissionv1 "k8s.io/api/admission/v1"
+)
+
+const (
+	adminFreezePath = "/admin/freeze"
+
+	// freezeAll freezes every config in ParseFreeze, and is the config label of pods admitted by it
+	freezeAll = "*"
+)
+
+var frozenAdmissions = newCounterVec("frozen_admissions_total", "Pods admitted without injection because injection is frozen, by config (* when everything is frozen).", "config")
+
+// Freeze is the kill switch for injection during incidents: pods requesting a frozen config, or every
+// pod when All is set, are admitted without a patch and with a warning.
+type Freeze struct {
+	// All - freeze every config of every tenant.
+	All bool `json:"all"`
+
+	// Configs - the configs frozen, in every tenant.
+	Configs []string `json:"configs"`
+}
+
+// ParseFreeze parses a comma separated list of the configs to freeze, * freezes every config.
+func ParseFreeze(value string) Freeze {
+	var f Freeze
+	for _, name := range strings.Split(value, ",") {
+		name = strings.TrimSpace(name)
+		switch name {
+		case "":
+		case freezeAll:
+			f.All = true
+		default:
+			f.Configs = append(f.Configs, name)
+		}
+	}
+	return f
+}
+
+// frozen returns whether the config is frozen
+func (f Freeze) frozen(config string) bool {
+	if f.All {
+		return true
+	}
+	for _, name := range f.Configs {
+		if name == config {
+			return true
+		}
+	}
+	return false
+}
+
+// SetFreeze replaces the freeze of the server and its tenants, it applies to the admissions that start
+// after it.
+func (whs *WebhookServer) SetFreeze(f Freeze) {
+	for _, server := range append([]*WebhookServer{whs}, whs.tenants...) {
+		server.updateState(func(next *serverState) {
+			next.freeze = f
+		})
+	}
+}
+
+// frozenAdmission returns the response admitting a pod untouched because its config, or everything if
+// config is *, is frozen
+func (whs *WebhookServer) frozenAdmission(config, pod string) *admissionv1.AdmissionResponse {
+	frozenAdmissions.WithLabelValues(config).Inc()
+	warning := "simple-sidecar injection is frozen, the pod was admitted without injection"
+	if config != freezeAll {
+		warning = fmt.Sprintf("simple-sidecar config %q is frozen, the pod was admitted without injection", config)
+	}
+	whs.warningLogger.Printf("Admitting %s untouched: %s", pod, warning)
+	return &admissionv1.AdmissionResponse{
+		Allowed:  true,
+		Warnings: []string{warning},
+	}
+}
+
+// frozenResponse returns the response to a pod requesting a frozen config, or any config if config is *.
+// Pods in enforced namespaces may only be admitted injected, so they're denied rather than admitted
+// untouched.
+func (whs *WebhookServer) frozenResponse(enforced *EnforcedNamespace, namespace, config, pod string) *admissionv1.AdmissionResponse {
+	if enforced != nil {
+		return whs.denyUninjected(enforced, namespace, pod, "injection is frozen")
+	}
+	return whs.frozenAdmission(config, pod)
+}
+
+// serveFreeze serves the freeze: GET returns it, PUT replaces it with the JSON body and DELETE lifts it.
+// Changes need the admin token.
+func (whs *WebhookServer) serveFreeze(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		if !whs.authorizeAdmin(w, r) {
+			return
+		}
+		var f Freeze
+		if err := json.NewDecoder(r.Body).Decode(&f); err != nil {
+			http.Error(w, fmt.Sprintf("invalid freeze: %v", err), http.StatusBadRequest)
+			return
+		}
+		whs.SetFreeze(f)
+		whs.warningLogger.Printf("Injection freeze set through the admin API: all=%v configs=%v", f.All, f.Configs)
+	case http.MethodDelete:
+		if !whs.authorizeAdmin(w, r) {
+			return
+		}
+		whs.SetFreeze(Freeze{})
+		whs.warningLogger.Printf("Injection freeze lifted through the admin API")
+	default:
+		w.Header().Set("Allow", "GET, PUT, DELETE")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	f := whs.state().freeze
+	if f.Configs == nil {
+		f.Configs = []string{}
+	}
+	whs.writeJSON(w, f)
+}
@@ -0,0 +1,117 @@
+package webhook
+
+import (
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+var hookVetoes = newCounterVec("hook_vetoes_total", "Pods denied by a hook registered by the embedding program, by hook (decision or patch).", "hook")
+
+// InjectionEvent describes an admission to the hooks. The pod is the one being admitted, hooks must not
+// modify it.
+type InjectionEvent struct {
+	// Tenant - the name of the tenant admitting the pod, "default" for the default injection domain.
+	Tenant string
+
+	// Namespace - the namespace of the admission.
+	Namespace string
+
+	// Operation - the operation admitted, CREATE unless injection on UPDATE is enabled.
+	Operation admissionv1.Operation
+
+	// Pod - the pod, nil when it couldn't be decoded.
+	Pod *corev1.Pod
+
+	// Config - the config injected into the pod, empty when it isn't injected.
+	Config string
+
+	// Patch - the JSON patch returned for the pod, only set for OnPatchGenerated.
+	Patch []byte
+
+	// Partial - the patch is the static part of the config because the latency budget ran out.
+	Partial bool
+
+	// Err - what went wrong, only set for OnError.
+	Err error
+}
+
+// Hooks are callbacks a program embedding the webhook registers with AddHooks, e.g. for custom metrics
+// or to veto injections. Every hook is optional. They're called on the admission path, so they must be
+// quick and safe for concurrent use.
+type Hooks struct {
+	// OnDecision - called once it's decided which config, if any, the pod is injected with. An error
+	// denies the pod with its message.
+	OnDecision func(e InjectionEvent) error
+
+	// OnPatchGenerated - called with the patch of an injected pod before it's returned. An error denies
+	// the pod with its message.
+	OnPatchGenerated func(e InjectionEvent) error
+
+	// OnError - called when a pod can't be decoded, its config can't be resolved or isn't allowed for
+	// it, or its patch can't be generated, whether or not the pod is admitted.
+	OnError func(e InjectionEvent)
+}
+
+// AddHooks registers hooks with the server and its tenants. Hooks are called in the order they were
+// added, the first error vetoing a pod stops the later hooks from being called.
+func (whs *WebhookServer) AddHooks(hooks Hooks) {
+	for _, server := range append([]*WebhookServer{whs}, whs.tenants...) {
+		server.updateState(func(next *serverState) {
+			next.hooks = append(append([]Hooks{}, next.hooks...), hooks)
+		})
+	}
+}
+
+// injectionEvent returns the event for the admission of the pod
+func (whs *WebhookServer) injectionEvent(req *admissionv1.AdmissionRequest, pod *corev1.Pod, config string) InjectionEvent {
+	return InjectionEvent{Tenant: whs.name, Namespace: req.Namespace, Operation: req.Operation, Pod: pod, Config: config}
+}
+
+// onDecision calls the OnDecision hooks, it returns the response denying the pod if one vetoes it
+func (st *serverState) onDecision(e InjectionEvent) *admissionv1.AdmissionResponse {
+	for _, h := range st.hooks {
+		if h.OnDecision == nil {
+			continue
+		}
+		if err := h.OnDecision(e); err != nil {
+			hookVetoes.WithLabelValues("decision").Inc()
+			return vetoed(err)
+		}
+	}
+	return nil
+}
+
+// onPatchGenerated calls the OnPatchGenerated hooks, it returns the response denying the pod if one
+// vetoes it
+func (st *serverState) onPatchGenerated(e InjectionEvent) *admissionv1.AdmissionResponse {
+	for _, h := range st.hooks {
+		if h.OnPatchGenerated == nil {
+			continue
+		}
+		if err := h.OnPatchGenerated(e); err != nil {
+			hookVetoes.WithLabelValues("patch").Inc()
+			return vetoed(err)
+		}
+	}
+	return nil
+}
+
+// onError calls the OnError hooks
+func (st *serverState) onError(e InjectionEvent, err error) {
+	e.Err = err
+	for _, h := range st.hooks {
+		if h.OnError != nil {
+			h.OnError(e)
+		}
+	}
+}
+
+// vetoed returns the response denying a pod a hook vetoed
+func vetoed(err error) *admissionv1.AdmissionResponse {
+	return &admissionv1.AdmissionResponse{
+		Result: &metav1.Status{
+			Message: err.Error(),
+		},
+	}
+}
@@ -0,0 +1,38 @@
+package webhook
+
+import (
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// podIdentityAuditKey is the audit annotation admission responses carry the pod identity in, the API
+// server prefixes it with the webhook name
+const podIdentityAuditKey = "pod"
+
+// podIdentity returns how the pod is referred to in logs and audit records. Pods created by controllers
+// usually have no name yet at admission, so they're shown by their generateName and controller instead,
+// e.g. default/app-7d9f8b6c5-* (ReplicaSet app-7d9f8b6c5).
+func podIdentity(namespace string, pod *corev1.Pod) string {
+	if pod.Namespace != "" {
+		namespace = pod.Namespace
+	}
+	name := pod.Name
+	if name == "" && pod.GenerateName != "" {
+		name = pod.GenerateName + "*"
+	}
+	if name == "" {
+		name = "<unnamed>"
+	}
+	id := name
+	if namespace != "" {
+		id = namespace + "/" + name
+	}
+	if pod.Name == "" {
+		if ref := metav1.GetControllerOf(pod); ref != nil {
+			id = fmt.Sprintf("%s (%s %s)", id, ref.Kind, ref.Name)
+		}
+	}
+	return id
+}
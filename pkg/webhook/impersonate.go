@@ -0,0 +1,110 @@
+package webhook
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"k8s.io/client-go/rest"
+)
+
+// The features of the server that access the cluster, each is enabled on its own and can act as its own
+// service account
+const (
+	ClusterFeatureConfig         = "config"
+	ClusterFeatureInventory      = "inventory"
+	ClusterFeatureOwnerMarkers   = "ownerMarkers"
+	ClusterFeatureFileConfigMaps = "fileConfigMaps"
+	ClusterFeatureNodeTopology   = "nodeTopology"
+
+	// impersonateAll is the feature key of the service account for the features without their own
+	impersonateAll = "*"
+)
+
+var clusterFeatures = []string{
+	ClusterFeatureConfig,
+	ClusterFeatureInventory,
+	ClusterFeatureOwnerMarkers,
+	ClusterFeatureFileConfigMaps,
+	ClusterFeatureNodeTopology,
+}
+
+// Impersonation maps cluster features to the service account, as <namespace>/<name>, their requests are
+// made as. The webhook's own service account then only needs permission to impersonate them, and each
+// feature is granted just what it needs on its account, so features can be reviewed and approved one at a
+// time. Features without an account, and without a * entry, use the webhook's own account.
+type Impersonation map[string]string
+
+// ParseImpersonation parses a comma separated list of <feature>=<namespace>/<name>, e.g.
+// inventory=simple-sidecar/pod-reader,*=simple-sidecar/sidecar-reader. The features are config (the crd,
+// configmap and secret config sources), inventory, ownerMarkers, fileConfigMaps, nodeTopology and * for the
+// features not listed.
+func ParseImpersonation(s string) (Impersonation, error) {
+	imp := Impersonation{}
+	for _, entry := range strings.Split(s, ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid impersonation %q, expected <feature>=<namespace>/<name>", entry)
+		}
+		feature, account := strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
+		if !isClusterFeature(feature) {
+			return nil, fmt.Errorf("unknown cluster feature %q, expected * or one of %s", feature, strings.Join(clusterFeatures, ", "))
+		}
+		ns := strings.SplitN(account, "/", 2)
+		if len(ns) != 2 || ns[0] == "" || ns[1] == "" {
+			return nil, fmt.Errorf("invalid service account %q for %s, expected <namespace>/<name>", account, feature)
+		}
+		if _, ok := imp[feature]; ok {
+			return nil, fmt.Errorf("cluster feature %s is impersonated twice", feature)
+		}
+		imp[feature] = account
+	}
+	return imp, nil
+}
+
+// isClusterFeature returns whether the feature can be impersonated
+func isClusterFeature(feature string) bool {
+	if feature == impersonateAll {
+		return true
+	}
+	for _, f := range clusterFeatures {
+		if f == feature {
+			return true
+		}
+	}
+	return false
+}
+
+// ServiceAccount returns the service account the feature acts as, empty for the webhook's own.
+func (i Impersonation) ServiceAccount(feature string) string {
+	if account, ok := i[feature]; ok {
+		return account
+	}
+	return i[impersonateAll]
+}
+
+// String returns the impersonation in the form ParseImpersonation reads.
+func (i Impersonation) String() string {
+	entries := make([]string, 0, len(i))
+	for feature, account := range i {
+		entries = append(entries, feature+"="+account)
+	}
+	sort.Strings(entries)
+	return strings.Join(entries, ",")
+}
+
+// restConfig returns the in-cluster config of the feature, impersonating its service account if it has one
+func (i Impersonation) restConfig(feature string) (*rest.Config, error) {
+	restConfig, err := rest.InClusterConfig()
+	if err != nil {
+		return nil, err
+	}
+	if account := i.ServiceAccount(feature); account != "" {
+		ns := strings.SplitN(account, "/", 2)
+		restConfig.Impersonate = rest.ImpersonationConfig{UserName: "system:serviceaccount:" + ns[0] + ":" + ns[1]}
+	}
+	return restConfig, nil
+}
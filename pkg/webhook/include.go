@@ -0,0 +1,156 @@
+package webhook
+
+import (
+	"fmt"
+	"sort"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// configTemplatesKey is the top-level key of a config file holding the snippets its configs include, it
+// can't name a config
+const configTemplatesKey = "templates"
+
+// ConfigTemplates are the snippets the configs of a file share, configs include them by name. They're
+// written like the lists of a config so the file decodes as a whole.
+type ConfigTemplates struct {
+	// Containers - containers and initContainers.
+	Containers []corev1.Container
+
+	// Volumes - volumes.
+	Volumes []corev1.Volume
+
+	// VolumeMounts - volume mounts of the pre-existing containers, included by the name of their volume.
+	VolumeMounts []corev1.VolumeMount
+
+	// EnvVars - env vars of the pre-existing containers.
+	EnvVars []corev1.EnvVar
+}
+
+// IncludeConfig names the templates of the config file a config adds to its own entries. The config's
+// entries replace included ones with the same name, or mountPath for volumeMounts.
+type IncludeConfig struct {
+	// InitContainers - container templates added to initContainers.
+	InitContainers []string
+
+	// Containers - container templates added to containers.
+	Containers []string
+
+	// Volumes - volume templates added to volumes.
+	Volumes []string
+
+	// VolumeMounts - volume mount templates added to volumeMounts.
+	VolumeMounts []string
+
+	// EnvVars - env var templates added to envVars.
+	EnvVars []string
+}
+
+// splitConfigTemplates removes the templates section from the decoded config file and returns it, nil if
+// the file has none
+func splitConfigTemplates(configs MultiConfig) *ConfigTemplates {
+	section, ok := configs[configTemplatesKey]
+	if !ok {
+		return nil
+	}
+	delete(configs, configTemplatesKey)
+	return &ConfigTemplates{
+		Containers:   section.Containers,
+		Volumes:      section.Volumes,
+		VolumeMounts: section.VolumeMounts,
+		EnvVars:      section.EnvVars,
+	}
+}
+
+// includeTemplates adds the templates every config includes to its entries
+func includeTemplates(configs MultiConfig, templates *ConfigTemplates) error {
+	if templates == nil {
+		templates = &ConfigTemplates{}
+	}
+	containers, err := templatesByName(templates.Containers, "containers", func(c corev1.Container) string { return c.Name })
+	if err != nil {
+		return err
+	}
+	volumes, err := templatesByName(templates.Volumes, "volumes", func(v corev1.Volume) string { return v.Name })
+	if err != nil {
+		return err
+	}
+	volumeMounts, err := templatesByName(templates.VolumeMounts, "volumeMounts", func(vm corev1.VolumeMount) string { return vm.Name })
+	if err != nil {
+		return err
+	}
+	envVars, err := templatesByName(templates.EnvVars, "envVars", func(e corev1.EnvVar) string { return e.Name })
+	if err != nil {
+		return err
+	}
+	names := make([]string, 0, len(configs))
+	for name := range configs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		config := configs[name]
+		include := config.Include
+		if include == nil {
+			continue
+		}
+		includedInitContainers, err := lookupTemplates(containers, include.InitContainers, "include.initContainers")
+		if err != nil {
+			return fmt.Errorf("config %s: %v", name, err)
+		}
+		includedContainers, err := lookupTemplates(containers, include.Containers, "include.containers")
+		if err != nil {
+			return fmt.Errorf("config %s: %v", name, err)
+		}
+		includedVolumes, err := lookupTemplates(volumes, include.Volumes, "include.volumes")
+		if err != nil {
+			return fmt.Errorf("config %s: %v", name, err)
+		}
+		includedVolumeMounts, err := lookupTemplates(volumeMounts, include.VolumeMounts, "include.volumeMounts")
+		if err != nil {
+			return fmt.Errorf("config %s: %v", name, err)
+		}
+		includedEnvVars, err := lookupTemplates(envVars, include.EnvVars, "include.envVars")
+		if err != nil {
+			return fmt.Errorf("config %s: %v", name, err)
+		}
+
+		config.InitContainers = mergeByKey(includedInitContainers, config.InitContainers, func(c corev1.Container) string { return c.Name })
+		config.Containers = mergeByKey(includedContainers, config.Containers, func(c corev1.Container) string { return c.Name })
+		config.Volumes = mergeByKey(includedVolumes, config.Volumes, func(v corev1.Volume) string { return v.Name })
+		config.VolumeMounts = mergeByKey(includedVolumeMounts, config.VolumeMounts, func(vm corev1.VolumeMount) string { return vm.MountPath })
+		config.EnvVars = mergeByKey(includedEnvVars, config.EnvVars, func(e corev1.EnvVar) string { return e.Name })
+		configs[name] = config
+	}
+	return nil
+}
+
+// templatesByName indexes the templates of a list by name, names must be set and unique
+func templatesByName[T any](list []T, path string, name func(T) string) (map[string]T, error) {
+	byName := map[string]T{}
+	for i, t := range list {
+		n := name(t)
+		if n == "" {
+			return nil, fmt.Errorf("%s.%s[%d]: a template needs a name", configTemplatesKey, path, i)
+		}
+		if _, ok := byName[n]; ok {
+			return nil, fmt.Errorf("%s.%s[%d]: duplicate template %q", configTemplatesKey, path, i, n)
+		}
+		byName[n] = t
+	}
+	return byName, nil
+}
+
+// lookupTemplates returns the named templates in order, path is used in errors
+func lookupTemplates[T any](templates map[string]T, names []string, path string) ([]T, error) {
+	var found []T
+	for i, name := range names {
+		t, ok := templates[name]
+		if !ok {
+			return nil, fmt.Errorf("%s[%d]: template %q doesn't exist", path, i, name)
+		}
+		found = append(found, t)
+	}
+	return found, nil
+}
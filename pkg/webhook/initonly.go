@@ -0,0 +1,129 @@
+package webhook
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	statusInjected          = "injected"
+	statusInitInjected      = "init-injected"
+	statusPartiallyInjected = "partially-injected"
+	statusOrphaned          = "orphaned"
+
+	initCheckContainerName = "simple-sidecar-init-check"
+	defaultInitCheckImage  = "busybox:1.36"
+	initCheckMountPath     = "/simple-sidecar/outputs"
+)
+
+// RequiredOutput is a file an init-only config's initContainers must write to a shared volume.
+type RequiredOutput struct {
+	// Volume - the name of the volume, it must be declared by the config.
+	Volume string
+
+	// Path - the path of the file relative to the root of the volume.
+	Path string
+}
+
+// isInjectedStatus returns true if the status annotation value marks a pod as already injected, orphaned
+// pods were injected with a config that no longer exists and partially injected pods with only its static
+// part
+func isInjectedStatus(status string) bool {
+	switch strings.ToLower(status) {
+	case statusInjected, statusInitInjected, statusPartiallyInjected, statusOrphaned:
+		return true
+	}
+	return false
+}
+
+// injectedStatus returns the status annotation value recorded on pods injected with the config
+func (c Config) injectedStatus() string {
+	if c.InitOnly {
+		return statusInitInjected
+	}
+	return statusInjected
+}
+
+// validateInitOnly checks an init-only config only injects initContainers and that every required
+// output is written by one of them to a volume the pre-existing containers can read
+func (c Config) validateInitOnly() error {
+	if !c.InitOnly {
+		if len(c.RequiredOutputs) > 0 {
+			return fmt.Errorf("requiredOutputs is only supported by initOnly configs")
+		}
+		return nil
+	}
+	if len(c.Containers) > 0 || c.Vault != nil || c.OTelCollector != nil {
+		return fmt.Errorf("initOnly configs may only inject initContainers")
+	}
+	if len(c.InitContainers) == 0 {
+		return fmt.Errorf("initOnly configs must inject at least one initContainer")
+	}
+
+	volumes := map[string]bool{}
+	for _, v := range c.Volumes {
+		volumes[v.Name] = true
+	}
+	mounted := map[string]bool{}
+	for _, vm := range c.VolumeMounts {
+		mounted[vm.Name] = true
+	}
+	for _, output := range c.RequiredOutputs {
+		if !volumes[output.Volume] {
+			return fmt.Errorf("required output %s: volume %q is not declared", output.Path, output.Volume)
+		}
+		if output.Path == "" || path.IsAbs(output.Path) || strings.HasPrefix(path.Clean(output.Path), "..") {
+			return fmt.Errorf("required output %q must be a path relative to volume %q", output.Path, output.Volume)
+		}
+		if !mounted[output.Volume] {
+			return fmt.Errorf("required output %s: volume %q is not mounted into the pre-existing containers", output.Path, output.Volume)
+		}
+		written := false
+		for _, ic := range c.InitContainers {
+			for _, vm := range ic.VolumeMounts {
+				if vm.Name == output.Volume && !vm.ReadOnly {
+					written = true
+				}
+			}
+		}
+		if !written {
+			return fmt.Errorf("required output %s: no initContainer mounts volume %q writable", output.Path, output.Volume)
+		}
+	}
+	return nil
+}
+
+// addInitCheck returns a copy of the config with a final initContainer that fails the pod's startup if
+// any required output is missing or empty, it runs after the config's other initContainers
+func addInitCheck(config Config) Config {
+	if len(config.RequiredOutputs) == 0 {
+		return config
+	}
+
+	var tests []string
+	mounts := map[string]bool{}
+	check := corev1.Container{
+		Name:    initCheckContainerName,
+		Image:   defaultInitCheckImage,
+		Command: []string{"/bin/sh", "-ec"},
+	}
+	for _, output := range config.RequiredOutputs {
+		file := path.Join(initCheckMountPath, output.Volume, output.Path)
+		tests = append(tests, fmt.Sprintf(`test -s %q || { echo "required output %s is missing"; exit 1; }`, file, file))
+		if !mounts[output.Volume] {
+			mounts[output.Volume] = true
+			check.VolumeMounts = append(check.VolumeMounts, corev1.VolumeMount{
+				Name:      output.Volume,
+				MountPath: path.Join(initCheckMountPath, output.Volume),
+				ReadOnly:  true,
+			})
+		}
+	}
+	check.Args = []string{strings.Join(tests, "\n")}
+
+	config.InitContainers = append(append([]corev1.Container{}, config.InitContainers...), check)
+	return config
+}
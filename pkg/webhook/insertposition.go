@@ -0,0 +1,182 @@
+package webhook
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	// insertPositionKey is the key of the containers of a config that sets where they're injected
+	insertPositionKey = "insertPosition"
+
+	// InsertFirst injects a container before the pod's containers.
+	InsertFirst InsertPosition = "first"
+
+	// InsertLast injects a container after the pod's containers, the default.
+	InsertLast InsertPosition = "last"
+)
+
+// InsertPosition is where an injected container goes in the pod's containers: first, last or the index of
+// the pod's container it's injected before, e.g. 1 to inject it after the first one.
+type InsertPosition string
+
+// UnmarshalJSON reads the position from a string or an index.
+func (p *InsertPosition) UnmarshalJSON(data []byte) error {
+	var index int
+	if err := json.Unmarshal(data, &index); err == nil {
+		*p = InsertPosition(strconv.Itoa(index))
+		return nil
+	}
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("insert position %s: must be first, last or an index", string(data))
+	}
+	*p = InsertPosition(s)
+	return nil
+}
+
+// index returns the index of the pod's container the injected container goes before, -1 for last
+func (p InsertPosition) index() (int, error) {
+	switch p {
+	case InsertFirst:
+		return 0, nil
+	case InsertLast, "":
+		return -1, nil
+	}
+	index, err := strconv.Atoi(string(p))
+	if err != nil || index < 0 {
+		return 0, fmt.Errorf("unsupported position %q, expected first, last or an index", string(p))
+	}
+	return index, nil
+}
+
+// moveInsertPositions removes the insert positions from the containers of the decoded config and adds
+// them to its insertPositions, moved is whether there were any
+func moveInsertPositions(config map[string]interface{}) (moved bool, err error) {
+	if initContainers, ok := config["initContainers"].([]interface{}); ok {
+		for i, item := range initContainers {
+			if container, ok := item.(map[string]interface{}); ok {
+				if _, ok := container[insertPositionKey]; ok {
+					return false, fmt.Errorf("initContainers[%d].%s: initContainers are ordered with startup.order", i, insertPositionKey)
+				}
+			}
+		}
+	}
+	containers, ok := config["containers"].([]interface{})
+	if !ok {
+		return false, nil
+	}
+	positions := map[string]interface{}{}
+	for i, item := range containers {
+		container, ok := item.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		position, ok := container[insertPositionKey]
+		if !ok {
+			continue
+		}
+		delete(container, insertPositionKey)
+		moved = true
+		switch position.(type) {
+		case string, json.Number, int64, float64:
+		default:
+			return false, fmt.Errorf("containers[%d].%s: must be first, last or an index", i, insertPositionKey)
+		}
+		if name, ok := container["name"].(string); ok {
+			positions[name] = position
+		}
+	}
+	if len(positions) == 0 {
+		return moved, nil
+	}
+
+	if config["insertPositions"] == nil {
+		config["insertPositions"] = map[string]interface{}{}
+	}
+	listed, ok := config["insertPositions"].(map[string]interface{})
+	if !ok {
+		// decoding the config reports the error
+		return moved, nil
+	}
+	for name, position := range positions {
+		listed[name] = position
+	}
+	return moved, nil
+}
+
+// insertContainers adds the config's containers to the pod's at their insert positions. Containers at the
+// same position keep the config's order.
+func (whs *WebhookServer) insertContainers(target, added []corev1.Container, positions map[string]InsertPosition) []patchOperation {
+	var ops []patchOperation
+	position := 0
+	for _, containers := range insertionPoints(target, added, positions) {
+		for _, container := range containers {
+			ops = append(ops, patchOperation{Op: "add", Path: fmt.Sprintf("/spec/containers/%d", position), Value: container})
+			position++
+		}
+		position++
+	}
+	return ops
+}
+
+// withInsertedContainers returns the pod's containers with the config's containers at their insert
+// positions, like insertContainers
+func withInsertedContainers(target, added []corev1.Container, positions map[string]InsertPosition) []corev1.Container {
+	containers := make([]corev1.Container, 0, len(target)+len(added))
+	for i, inserted := range insertionPoints(target, added, positions) {
+		containers = append(containers, inserted...)
+		if i < len(target) {
+			containers = append(containers, target[i])
+		}
+	}
+	return containers
+}
+
+// insertionPoints returns the added containers inserted before each of the target's containers, the last
+// are appended after them
+func insertionPoints(target, added []corev1.Container, positions map[string]InsertPosition) [][]corev1.Container {
+	before := make([][]corev1.Container, len(target)+1)
+	for _, container := range added {
+		index, err := positions[container.Name].index()
+		if err != nil || index < 0 || index > len(target) {
+			// validation rejects bad positions, indexes past the pod's containers append
+			index = len(target)
+		}
+		before[index] = append(before[index], container)
+	}
+	return before
+}
+
+// validateInsertPositions checks the positions and that they're of containers the config injects into the
+// pod's containers
+func (c Config) validateInsertPositions() error {
+	if len(c.InsertPositions) == 0 {
+		return nil
+	}
+	containers := map[string]bool{}
+	for _, container := range c.Containers {
+		containers[container.Name] = true
+	}
+	if c.Vault != nil {
+		containers["vault-agent"] = true
+	}
+	if c.OTelCollector != nil {
+		containers["otel-collector"] = true
+	}
+	for _, name := range sortedKeys(c.InsertPositions) {
+		if _, err := c.InsertPositions[name].index(); err != nil {
+			return fmt.Errorf("insertPositions.%s: %v", name, err)
+		}
+		if !containers[name] {
+			return fmt.Errorf("insertPositions.%s: container %q isn't injected by the config", name, name)
+		}
+		if c.NativeSidecar || (c.Startup != nil && contains(c.Startup.Sidecars, name)) {
+			return fmt.Errorf("insertPositions.%s: container %q is injected as a native sidecar, order it with startup.order", name, name)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,213 @@
+package webhook
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/metadata"
+	"k8s.io/client-go/metadata/metadatainformer"
+	"k8s.io/client-go/tools/cache"
+)
+
+const (
+	adminInventoryPath = "/admin/inventory"
+
+	inventoryResync = 10 * time.Minute
+)
+
+// currentInventory is the running inventory, injectedPods and partiallyInjectedPods report it
+var currentInventory atomic.Pointer[Inventory]
+
+var injectedPods = newGaugeCollector("injected_pods", "Pods carrying the injected status annotation by tenant, config and release.", func() []gaugeSample {
+	inventory := currentInventory.Load()
+	if inventory == nil {
+		return nil
+	}
+	var samples []gaugeSample
+	for _, entry := range inventory.Entries() {
+		samples = append(samples, gaugeSample{
+			labelValues: []string{entry.Tenant, entry.Config, entry.Release},
+			value:       float64(entry.Pods),
+		})
+	}
+	return samples
+}, "tenant", "config", "release")
+
+var partiallyInjectedPods = newGaugeCollector("partially_injected_pods", "Pods only injected with the static part of their config because the latency budget ran out, by tenant, config and release.", func() []gaugeSample {
+	inventory := currentInventory.Load()
+	if inventory == nil {
+		return nil
+	}
+	var samples []gaugeSample
+	for _, entry := range inventory.Entries() {
+		if entry.Partial > 0 {
+			samples = append(samples, gaugeSample{
+				labelValues: []string{entry.Tenant, entry.Config, entry.Release},
+				value:       float64(entry.Partial),
+			})
+		}
+	}
+	return samples
+}, "tenant", "config", "release")
+
+// InventoryEntry is the number of live pods injected with a config release.
+type InventoryEntry struct {
+	Tenant  string `json:"tenant"`
+	Config  string `json:"config"`
+	Release string `json:"release"`
+	Pods    int    `json:"pods"`
+
+	// Partial - how many of the pods were only injected with the static part of the config.
+	Partial int `json:"partial"`
+}
+
+// inventoryKey groups injected pods
+type inventoryKey struct {
+	tenant, config, release string
+}
+
+// inventoryPod is how a domain injected a pod
+type inventoryPod struct {
+	key     inventoryKey
+	partial bool
+}
+
+// inventoryDomain is a tenant and the annotations it marks injected pods with
+type inventoryDomain struct {
+	tenant      string
+	annotations annotationKeys
+}
+
+// Inventory maintains a live count of the pods carrying our status annotation, grouped by tenant, config
+// and release. It watches pod metadata only, so it's cheap even in large clusters.
+type Inventory struct {
+	informer cache.SharedIndexInformer
+	domains  []inventoryDomain
+
+	mu   sync.RWMutex
+	pods map[string][]inventoryPod
+}
+
+// newInventory creates an inventory of the pods injected by the server and its tenants
+func (whs *WebhookServer) newInventory(client metadata.Interface) *Inventory {
+	inventory := &Inventory{
+		pods: map[string][]inventoryPod{},
+	}
+	for _, server := range append([]*WebhookServer{whs}, whs.tenants...) {
+		inventory.domains = append(inventory.domains, inventoryDomain{tenant: server.name, annotations: server.annotations})
+	}
+
+	factory := metadatainformer.NewSharedInformerFactory(client, inventoryResync)
+	inventory.informer = factory.ForResource(corev1.SchemeGroupVersion.WithResource("pods")).Informer()
+	inventory.informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    inventory.update,
+		UpdateFunc: func(_, obj interface{}) { inventory.update(obj) },
+		DeleteFunc: inventory.delete,
+	})
+	return inventory
+}
+
+// Run runs the informer until stop is closed.
+func (inv *Inventory) Run(stop <-chan struct{}) {
+	currentInventory.Store(inv)
+	inv.informer.Run(stop)
+}
+
+// update records which domains injected the pod
+func (inv *Inventory) update(obj interface{}) {
+	meta, ok := obj.(*metav1.PartialObjectMetadata)
+	if !ok {
+		return
+	}
+	key, err := cache.MetaNamespaceKeyFunc(meta)
+	if err != nil {
+		return
+	}
+
+	var keys []inventoryPod
+	annotations := meta.GetAnnotations()
+	for _, domain := range inv.domains {
+		status := annotations[domain.annotations.status]
+		if !isInjectedStatus(status) {
+			continue
+		}
+		keys = append(keys, inventoryPod{
+			key: inventoryKey{
+				tenant:  domain.tenant,
+				config:  annotations[domain.annotations.config],
+				release: annotations[domain.annotations.release],
+			},
+			partial: strings.EqualFold(status, statusPartiallyInjected),
+		})
+	}
+
+	inv.mu.Lock()
+	defer inv.mu.Unlock()
+	if len(keys) == 0 {
+		delete(inv.pods, key)
+		return
+	}
+	inv.pods[key] = keys
+}
+
+// delete forgets the pod
+func (inv *Inventory) delete(obj interface{}) {
+	key, err := cache.DeletionHandlingMetaNamespaceKeyFunc(obj)
+	if err != nil {
+		return
+	}
+	inv.mu.Lock()
+	defer inv.mu.Unlock()
+	delete(inv.pods, key)
+}
+
+// Entries returns the number of injected pods per tenant, config and release.
+func (inv *Inventory) Entries() []InventoryEntry {
+	counts := map[inventoryKey]*InventoryEntry{}
+	inv.mu.RLock()
+	for _, pods := range inv.pods {
+		for _, pod := range pods {
+			entry, ok := counts[pod.key]
+			if !ok {
+				entry = &InventoryEntry{Tenant: pod.key.tenant, Config: pod.key.config, Release: pod.key.release}
+				counts[pod.key] = entry
+			}
+			entry.Pods++
+			if pod.partial {
+				entry.Partial++
+			}
+		}
+	}
+	inv.mu.RUnlock()
+
+	entries := make([]InventoryEntry, 0, len(counts))
+	for _, entry := range counts {
+		entries = append(entries, *entry)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		a, b := entries[i], entries[j]
+		if a.Tenant != b.Tenant {
+			return a.Tenant < b.Tenant
+		}
+		if a.Config != b.Config {
+			return a.Config < b.Config
+		}
+		return a.Release < b.Release
+	})
+	return entries
+}
+
+// serveInventory serves the injected-pod inventory
+func (whs *WebhookServer) serveInventory(w http.ResponseWriter, r *http.Request) {
+	if whs.inventory == nil {
+		http.Error(w, "inventory is not enabled", http.StatusNotFound)
+		return
+	}
+	whs.writeJSON(w, whs.inventory.Entries())
+}
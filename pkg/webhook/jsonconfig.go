@@ -0,0 +1,55 @@
+package webhook
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path/filepath"
+
+	"sigs.k8s.io/yaml"
+)
+
+// isJSONConfigName returns whether the file or ConfigMap key holds JSON configs, e.g. generated by jsonnet
+// or terraform
+func isJSONConfigName(name string) bool {
+	return filepath.Ext(name) == ".json"
+}
+
+// checkJSONConfig returns an error with the line and column of the first syntax error of a config file or
+// key named *.json. YAML would read most broken JSON too and report something confusing.
+func checkJSONConfig(name string, data []byte) error {
+	if !isJSONConfigName(name) {
+		return nil
+	}
+	var v interface{}
+	err := json.Unmarshal(data, &v)
+	var syntaxErr *json.SyntaxError
+	if errors.As(err, &syntaxErr) {
+		line, column := offsetPosition(data, syntaxErr.Offset)
+		return fmt.Errorf("invalid JSON at line %d, column %d: %v", line, column, err)
+	}
+	if err != nil {
+		return fmt.Errorf("invalid JSON: %v", err)
+	}
+	return nil
+}
+
+// offsetPosition returns the 1-based line and column of the byte offset in data
+func offsetPosition(data []byte, offset int64) (line, column int) {
+	if offset > int64(len(data)) {
+		offset = int64(len(data))
+	}
+	before := data[:offset]
+	line = bytes.Count(before, []byte("\n")) + 1
+	column = int(offset) - (bytes.LastIndexByte(before, '\n') + 1)
+	return line, column
+}
+
+// unmarshalConfigs decodes a config file, JSON documents are decoded as JSON and everything else as YAML
+func unmarshalConfigs(data []byte, cfg *MultiConfig) error {
+	if json.Valid(data) {
+		return json.Unmarshal(data, cfg)
+	}
+	return yaml.Unmarshal(data, cfg)
+}
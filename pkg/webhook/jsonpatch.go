@@ -0,0 +1,82 @@
+package webhook
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	jsonpatch "github.com/evanphx/json-patch"
+	"sigs.k8s.io/yaml"
+)
+
+// loadJSONPatches loads and validates the RFC 6902 patch files referenced by the config, relative paths
+// are resolved against dir. The operations are kept on the config and appended to every patch it generates.
+func (c *Config) loadJSONPatches(dir string) error {
+	c.jsonPatches = nil
+	for _, file := range c.JSONPatches {
+		if !filepath.IsAbs(file) {
+			file = filepath.Join(dir, file)
+		}
+		ops, err := loadJSONPatchFile(file)
+		if err != nil {
+			return fmt.Errorf("json patch %s: %v", file, err)
+		}
+		c.jsonPatches = append(c.jsonPatches, ops...)
+	}
+	return nil
+}
+
+// loadJSONPatchFile reads a YAML or JSON list of RFC 6902 operations, the format of kustomize's
+// patchesJson6902 files
+func loadJSONPatchFile(file string) ([]patchOperation, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var ops []patchOperation
+	if err := yaml.Unmarshal(data, &ops); err != nil {
+		return nil, err
+	}
+	if err := validateJSONPatch(ops); err != nil {
+		return nil, err
+	}
+	return ops, nil
+}
+
+// validateJSONPatch checks every operation is well formed, it can't check the paths exist since that
+// depends on the pod
+func validateJSONPatch(ops []patchOperation) error {
+	raw, err := json.Marshal(ops)
+	if err != nil {
+		return err
+	}
+	decoded, err := jsonpatch.DecodePatch(raw)
+	if err != nil {
+		return err
+	}
+	for i, op := range decoded {
+		path, err := op.Path()
+		if err != nil {
+			return fmt.Errorf("operation %d: %v", i, err)
+		}
+		if !strings.HasPrefix(path, "/") {
+			return fmt.Errorf("operation %d: path %q must start with /", i, path)
+		}
+		switch op.Kind() {
+		case "add", "replace", "test":
+			if ops[i].Value == nil {
+				return fmt.Errorf("operation %d: %s requires a value", i, op.Kind())
+			}
+		case "move", "copy":
+			if ops[i].From == "" {
+				return fmt.Errorf("operation %d: %s requires from", i, op.Kind())
+			}
+		case "remove":
+		default:
+			return fmt.Errorf("operation %d: unknown op %q", i, op.Kind())
+		}
+	}
+	return nil
+}
@@ -0,0 +1,88 @@
+package webhook
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"syscall"
+)
+
+// ListenerConfig is an address the webhook accepts connections on. Several listeners serve the same
+// webhook, e.g. separate IPv4 and IPv6 sockets in a dual-stack cluster, or the old and new port during a
+// port migration.
+type ListenerConfig struct {
+	// Network - tcp (the default, dual-stack for wildcard addresses), tcp4 or tcp6.
+	Network string
+
+	// Address - the host:port to bind, e.g. 0.0.0.0:8443 or [::]:8443.
+	Address string
+
+	// ReusePort - set SO_REUSEPORT so several processes can bind the same port, e.g. the old and new
+	// webhook during a blue/green rollout.
+	ReusePort bool
+}
+
+// ParseListeners parses a comma separated list of addresses, each optionally prefixed with its network,
+// e.g. "tcp4://0.0.0.0:8443,tcp6://[::]:8443".
+func ParseListeners(value string, reusePort bool) ([]ListenerConfig, error) {
+	var listeners []ListenerConfig
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		l := ListenerConfig{Network: "tcp", Address: entry, ReusePort: reusePort}
+		if network, address, ok := strings.Cut(entry, "://"); ok {
+			l.Network, l.Address = network, address
+		}
+		switch l.Network {
+		case "tcp", "tcp4", "tcp6":
+		default:
+			return nil, fmt.Errorf("listener %q: unsupported network %q", entry, l.Network)
+		}
+		if _, _, err := net.SplitHostPort(l.Address); err != nil {
+			return nil, fmt.Errorf("listener %q: %v", entry, err)
+		}
+		listeners = append(listeners, l)
+	}
+	return listeners, nil
+}
+
+// listen binds the listener
+func (l ListenerConfig) listen() (net.Listener, error) {
+	network := l.Network
+	if network == "" {
+		network = "tcp"
+	}
+	lc := net.ListenConfig{}
+	if l.ReusePort {
+		lc.Control = func(network, address string, c syscall.RawConn) error {
+			var sockErr error
+			if err := c.Control(func(fd uintptr) { sockErr = setReusePort(fd) }); err != nil {
+				return err
+			}
+			return sockErr
+		}
+	}
+	return lc.Listen(context.Background(), network, l.Address)
+}
+
+// listen binds all the listeners, nothing is left bound if any of them fails
+func (whs *WebhookServer) listen() ([]net.Listener, error) {
+	var listeners []net.Listener
+	for _, lc := range whs.listeners {
+		l, err := lc.listen()
+		if err != nil {
+			for _, bound := range listeners {
+				bound.Close()
+			}
+			return nil, fmt.Errorf("failed to listen on %s %s: %v", lc.Network, lc.Address, err)
+		}
+		if whs.transport.DisableNoDelay || whs.transport.WriteBufferSize > 0 {
+			l = transportListener{Listener: l, transport: whs.transport}
+		}
+		listeners = append(listeners, l)
+	}
+	return listeners, nil
+}
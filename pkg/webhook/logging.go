@@ -0,0 +1,49 @@
+package webhook
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"unicode/utf8"
+)
+
+var (
+	truncatedLogLines = newCounter("log_truncations_total", "Log lines truncated because they exceeded the log size limit.")
+	truncatedLogBytes = newCounter("log_truncated_bytes_total", "Bytes dropped from truncated log lines.")
+)
+
+// truncatingWriter cuts every write beyond limit bytes and marks how much was dropped. The log package
+// issues one write per line, so this bounds the size of each logged pod, config or patch.
+type truncatingWriter struct {
+	w     io.Writer
+	limit int
+}
+
+func (t *truncatingWriter) Write(p []byte) (int, error) {
+	if len(p) <= t.limit {
+		return t.w.Write(p)
+	}
+	// don't cut a multi-byte character in half
+	cut := t.limit
+	for cut > 0 && !utf8.RuneStart(p[cut]) {
+		cut--
+	}
+	dropped := len(p) - cut
+	truncatedLogLines.Inc()
+	truncatedLogBytes.Add(float64(dropped))
+
+	line := append(append([]byte{}, p[:cut]...), fmt.Sprintf("...truncated (%d bytes)\n", dropped)...)
+	if _, err := t.w.Write(line); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// limitLogger returns a logger writing to the same output as l with lines longer than limit bytes
+// truncated, limit 0 returns l as is
+func limitLogger(l *log.Logger, limit int) *log.Logger {
+	if l == nil || limit <= 0 {
+		return l
+	}
+	return log.New(&truncatingWriter{w: l.Writer(), limit: limit}, l.Prefix(), l.Flags())
+}
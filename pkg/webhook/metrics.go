@@ -0,0 +1,80 @@
+package webhook
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const (
+	adminMetricsPath = "/metrics"
+	metricsNamespace = "simple_sidecar"
+)
+
+// metricsRegistry holds every metric exposed by the package, metrics register themselves when created.
+// The Go runtime and process metrics are exposed alongside them.
+var metricsRegistry = func() *prometheus.Registry {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(collectors.NewGoCollector(), collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
+	return registry
+}()
+
+// serveMetrics serves the metrics in the Prometheus exposition format
+var serveMetrics = promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{})
+
+// newCounter returns a registered counter named after the package
+func newCounter(name, help string) prometheus.Counter {
+	c := prometheus.NewCounter(prometheus.CounterOpts{Namespace: metricsNamespace, Name: name, Help: help})
+	metricsRegistry.MustRegister(c)
+	return c
+}
+
+// newCounterVec returns a registered counter partitioned by labels
+func newCounterVec(name, help string, labels ...string) *prometheus.CounterVec {
+	c := prometheus.NewCounterVec(prometheus.CounterOpts{Namespace: metricsNamespace, Name: name, Help: help}, labels)
+	metricsRegistry.MustRegister(c)
+	return c
+}
+
+// defaultBuckets are the histogram buckets in seconds, admission stages are expected to take well under
+// a millisecond so they start small
+var defaultBuckets = []float64{0.00001, 0.00005, 0.0001, 0.00025, 0.0005, 0.001, 0.0025, 0.005, 0.01, 0.05, 0.1}
+
+// newHistogramVec returns a registered histogram partitioned by labels
+func newHistogramVec(name, help string, buckets []float64, labels ...string) *prometheus.HistogramVec {
+	h := prometheus.NewHistogramVec(prometheus.HistogramOpts{Namespace: metricsNamespace, Name: name, Help: help, Buckets: buckets}, labels)
+	metricsRegistry.MustRegister(h)
+	return h
+}
+
+// gaugeSample is the value of a gauge for a set of label values
+type gaugeSample struct {
+	labelValues []string
+	value       float64
+}
+
+// gaugeCollector is a gauge whose samples are collected when the metrics are scraped
+type gaugeCollector struct {
+	desc    *prometheus.Desc
+	collect func() []gaugeSample
+}
+
+// newGaugeCollector returns a registered gauge whose samples collect returns on every scrape
+func newGaugeCollector(name, help string, collect func() []gaugeSample, labels ...string) *gaugeCollector {
+	g := &gaugeCollector{
+		desc:    prometheus.NewDesc(prometheus.BuildFQName(metricsNamespace, "", name), help, labels, nil),
+		collect: collect,
+	}
+	metricsRegistry.MustRegister(g)
+	return g
+}
+
+func (g *gaugeCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- g.desc
+}
+
+func (g *gaugeCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, s := range g.collect() {
+		ch <- prometheus.MustNewConstMetric(g.desc, prometheus.GaugeValue, s.value, s.labelValues...)
+	}
+}
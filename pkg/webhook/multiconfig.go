@@ -0,0 +1,290 @@
+package webhook
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/centml/simple-sidecar/pkg/patch"
+)
+
+// configNameSeparator separates the configs of a pod injected with several, in the inject annotation and
+// the config annotation
+const configNameSeparator = ","
+
+// splitConfigNames returns the config names of a comma separated list in order, without blanks and
+// duplicates. An entry of "true" is the default config.
+func splitConfigNames(value string) []string {
+	var names []string
+	for _, name := range strings.Split(value, configNameSeparator) {
+		name = strings.TrimSpace(name)
+		if name == "true" {
+			name = defaultConfigName
+		}
+		if name != "" && !contains(names, name) {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// selectedConfig is one of the configs a pod requesting several is injected with
+type selectedConfig struct {
+	name       string
+	config     Config
+	experiment bool
+}
+
+// mutateMultiple injects a pod requesting several configs. Each config goes through the checks of a single
+// one, configs that are missing or whose preconditions are skipped are left out. The patches are generated
+// one after another in the order the configs are listed, each against the pod as the previous ones left it,
+// and concatenated. The config annotation records the set injected and the patch is cached like the patch
+// of a single config. The patches aren't bounded by the latency budget, a set has no static part to fall
+// back to, and the set isn't recorded on the pod's owner, whose marker holds a single config.
+func (whs *WebhookServer) mutateMultiple(req *admissionv1.AdmissionRequest, st *serverState, pod *corev1.Pod, id string, names []string, enforced *EnforcedNamespace) *admissionv1.AdmissionResponse {
+	var selected []selectedConfig
+	for _, name := range names {
+		name = st.configName(name)
+		if st.freeze.frozen(name) {
+			return whs.frozenResponse(enforced, req.Namespace, name, id)
+		}
+		config, ok := st.sidecarConfigs[name]
+		if enforced != nil && (!ok || !enforced.allows(name)) {
+			return whs.denyUninjected(enforced, req.Namespace, id, fmt.Sprintf("config %q is missing or not accepted", name))
+		}
+		if !ok {
+			whs.warningLogger.Printf("Leaving config %s out of the injection of %s, it doesn't exist", name, id)
+			continue
+		}
+		if err := config.Scope.checkScope(req.Namespace, pod); err != nil {
+			whs.warningLogger.Printf("Refusing mutation %s for %s: %v", name, id, err)
+			st.onError(whs.injectionEvent(req, pod, name), err)
+			return &admissionv1.AdmissionResponse{
+				Result: &metav1.Status{
+					Message: fmt.Sprintf("simple-sidecar config %q may not be applied to this pod: %v", name, err),
+				},
+			}
+		}
+		if unmet := config.Preconditions.unmet(pod); len(unmet) > 0 {
+			if response := whs.preconditionsUnmet(config, name, enforced, req.Namespace, id, unmet); !response.Allowed {
+				return response
+			}
+			continue
+		}
+
+		injected := selectedConfig{name: name, experiment: config.Experiment != nil}
+		if injected.experiment {
+			injected.name, config = whs.experimentVariant(st, req.Namespace, pod, name, config)
+			if st.freeze.frozen(injected.name) {
+				return whs.frozenResponse(enforced, req.Namespace, injected.name, id)
+			}
+		}
+		injected.config = config.forNamespace(req.Namespace)
+		selected = append(selected, injected)
+	}
+
+	injectedNames := make([]string, len(selected))
+	for i, s := range selected {
+		injectedNames[i] = s.name
+	}
+	set := strings.Join(injectedNames, configNameSeparator)
+	if response := st.onDecision(whs.injectionEvent(req, pod, set)); response != nil {
+		return response
+	}
+	if len(selected) == 0 {
+		whs.infoLogger.Printf("Skipping mutation for %s, none of the configs %s is injected", id, strings.Join(names, configNameSeparator))
+		return &admissionv1.AdmissionResponse{
+			Allowed: true,
+		}
+	}
+
+	patchBytes, err := whs.multiplePatchFor(st, req, pod, selected, set)
+	if err != nil {
+		st.onError(whs.injectionEvent(req, pod, set), err)
+		return whs.patchFailed(selected[len(selected)-1].config, set, enforced, id, err)
+	}
+	event := whs.injectionEvent(req, pod, set)
+	event.Patch = patchBytes
+	if response := st.onPatchGenerated(event); response != nil {
+		return response
+	}
+	for _, s := range selected {
+		if err := whs.storeFiles(pod, s.config, req.DryRun != nil && *req.DryRun); err != nil {
+			st.onError(whs.injectionEvent(req, pod, s.name), err)
+			return whs.patchFailed(s.config, s.name, enforced, id, err)
+		}
+	}
+
+	whs.infoLogger.Printf("AdmissionResponse: patch=%v\n", string(patchBytes))
+	var warnings []string
+	for _, s := range selected {
+		warnings = append(warnings, whs.overrideWarnings(pod, s.config, s.name)...)
+	}
+	pt := admissionv1.PatchTypeJSONPatch
+	return &admissionv1.AdmissionResponse{
+		Allowed:   true,
+		Patch:     patchBytes,
+		PatchType: &pt,
+		Warnings:  warnings,
+	}
+}
+
+// multiplePatchFor returns the patch injecting the selected configs into the pod with the injected
+// annotation, from the patch cache if it's enabled. It's keyed on the set and the hashes of its configs.
+func (whs *WebhookServer) multiplePatchFor(st *serverState, req *admissionv1.AdmissionRequest, pod *corev1.Pod, selected []selectedConfig, set string) ([]byte, error) {
+	annotations := whs.multipleAnnotations(selected, set)
+	generate := func() ([]byte, error) {
+		patchBytes, err := whs.multiplePatch(pod, selected, annotations)
+		if err != nil {
+			return nil, err
+		}
+		return whs.recordInjection(pod, patchBytes)
+	}
+	if whs.patchCache == nil {
+		return generate()
+	}
+
+	hashes := make([]string, len(selected))
+	withName := false
+	var nodeLabels map[string]string
+	for i, s := range selected {
+		hash, ok := st.configHashes[s.name]
+		if !ok {
+			return generate()
+		}
+		hashes[i] = hash
+		withName = withName || s.config.RenderTemplates || len(s.config.Files) > 0
+		if s.config.Topology != nil && len(s.config.Topology.Labels) > 0 && whs.nodes != nil && nodeLabels == nil {
+			nodeLabels, _ = whs.nodes.labels(podNode(pod))
+		}
+	}
+	key, err := patchCacheKey(req, pod, withName, whs.name, set, strings.Join(hashes, configNameSeparator), false, annotations, nodeLabels)
+	if err != nil {
+		return nil, err
+	}
+	return whs.cachedPatch(key, generate)
+}
+
+// multiplePatch returns the patches of the configs concatenated. The patch of each config is generated
+// against the pod as the patches before it leave it, so the operations apply in sequence, but configs
+// only inject into and remove the pod's own containers, never the sidecars of the configs before them.
+// The annotations are added by the last one.
+func (whs *WebhookServer) multiplePatch(pod *corev1.Pod, selected []selectedConfig, annotations map[string]string) ([]byte, error) {
+	if err := checkMultipleFiles(selected); err != nil {
+		return nil, err
+	}
+	own := podContainerNames(pod)
+	var ops []patchOperation
+	current := pod
+	withFiles := 0
+	for i, s := range selected {
+		var added map[string]string
+		if i == len(selected)-1 {
+			added = annotations
+		}
+		config := s.config
+		var injected []string
+		for name := range podContainerNames(current) {
+			if !own[name] {
+				injected = append(injected, name)
+			}
+		}
+		if len(injected) > 0 {
+			sort.Strings(injected)
+			config.ExcludeContainers = append(append([]string{}, config.ExcludeContainers...), injected...)
+			var removed []string
+			for _, name := range config.RemoveContainers {
+				if own[name] {
+					removed = append(removed, name)
+				}
+			}
+			config.RemoveContainers = removed
+		}
+		if len(config.Files) > 0 {
+			// the first config's files keep the volume of a single config
+			if withFiles > 0 {
+				config.filesVolume = fmt.Sprintf("%s-%d", filesVolumeName, withFiles+1)
+			}
+			withFiles++
+		}
+		patchBytes, err := whs.createPatch(current, config, added)
+		if err == nil && s.experiment {
+			patchBytes, err = whs.labelVariant(patchBytes, current, s.name, s.config.Labels)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("config %s: %v", s.name, err)
+		}
+		var configOps []patchOperation
+		if err := json.Unmarshal(patchBytes, &configOps); err != nil {
+			return nil, fmt.Errorf("config %s: %v", s.name, err)
+		}
+		if current, err = applyPatch(current, patchBytes); err != nil {
+			return nil, fmt.Errorf("config %s: %v", s.name, err)
+		}
+		ops = append(ops, configOps...)
+	}
+	return patch.Marshal(ops)
+}
+
+// checkMultipleFiles returns an error if configs storing their files in annotations have files of the same
+// name, they'd be stored in the same annotation
+func checkMultipleFiles(selected []selectedConfig) error {
+	stored := map[string]string{}
+	for _, s := range selected {
+		if s.config.FileStore == fileStoreConfigMap {
+			continue
+		}
+		for _, f := range s.config.Files {
+			if other, ok := stored[f.Name]; ok {
+				return fmt.Errorf("configs %s and %s both have a file %s stored in the pod's annotations", other, s.name, f.Name)
+			}
+			stored[f.Name] = s.name
+		}
+	}
+	return nil
+}
+
+// podContainerNames returns the names of the pod's containers and initContainers
+func podContainerNames(pod *corev1.Pod) map[string]bool {
+	names := map[string]bool{}
+	for _, c := range append(append([]corev1.Container{}, pod.Spec.InitContainers...), pod.Spec.Containers...) {
+		names[c.Name] = true
+	}
+	return names
+}
+
+// multipleAnnotations returns the annotations recorded on pods injected with several configs. The config
+// annotation is the set, the release and hash annotations list those of the configs in the same order,
+// the status is init-injected only if every config is init-only.
+func (whs *WebhookServer) multipleAnnotations(selected []selectedConfig, set string) map[string]string {
+	status := statusInitInjected
+	var releases, hashes []string
+	for _, s := range selected {
+		if s.config.injectedStatus() != statusInitInjected {
+			status = statusInjected
+		}
+		releases = append(releases, s.config.Release)
+		if hash, err := configHash(s.config); err == nil {
+			hashes = append(hashes, hash)
+		} else {
+			whs.warningLogger.Printf("Can't hash config %s, its pods won't record the hash: %v", s.name, err)
+		}
+	}
+
+	annotations := map[string]string{
+		whs.annotations.status: status,
+		whs.annotations.config: set,
+	}
+	if release := strings.Join(releases, configNameSeparator); strings.Trim(release, configNameSeparator) != "" {
+		annotations[whs.annotations.release] = release
+	}
+	if len(hashes) == len(selected) {
+		annotations[whs.annotations.hash] = strings.Join(hashes, configNameSeparator)
+	}
+	return annotations
+}
@@ -0,0 +1,153 @@
+package webhook
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"reflect"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+const multipleConfigs = `
+proxy:
+  containers:
+  - name: proxy
+    image: registry.example.com/proxy:1.0
+  envVars:
+  - name: PROXY_ADDR
+    value: localhost:15001
+  files:
+  - name: proxy.yaml
+    mountPath: /etc/proxy/proxy.yaml
+    template: "namespace: {{ .Pod.Namespace }}"
+agent:
+  containers:
+  - name: agent
+    image: registry.example.com/agent:1.0
+  envVars:
+  - name: AGENT_ADDR
+    value: localhost:4317
+  removeContainers: [proxy, legacy-agent]
+  files:
+  - name: agent.yaml
+    mountPath: /etc/agent/agent.yaml
+    template: "namespace: {{ .Pod.Namespace }}"
+`
+
+const multiplePod = `{
+  "apiVersion": "v1",
+  "kind": "Pod",
+  "metadata": {"name": "app", "namespace": "default", "annotations": {"simple-sidecar.centml.ai/inject": "proxy,agent"}},
+  "spec": {
+    "containers": [
+      {"name": "app", "image": "registry.example.com/app:1.0"},
+      {"name": "legacy-agent", "image": "registry.example.com/legacy-agent:1.0"}
+    ]
+  }
+}`
+
+// multipleServer returns a server with the multiple configs and the cache
+func multipleServer(t *testing.T, cache PatchCache) *WebhookServer {
+	t.Helper()
+	configs, err := LoadConfigFromBytes([]byte(multipleConfigs))
+	if err != nil {
+		t.Fatal(err)
+	}
+	discard := log.New(io.Discard, "", 0)
+	return NewWebhookServer(&WebhookServerConfig{SidecarConfigs: configs, PatchCache: cache, InfoLogger: discard, WarnLogger: discard, ErrorLogger: discard})
+}
+
+// injectMultiple returns the pod injected with proxy and agent
+func injectMultiple(t *testing.T, whs *WebhookServer) *corev1.Pod {
+	t.Helper()
+	var pod corev1.Pod
+	if err := json.Unmarshal(admitRaw(t, whs, []byte(multiplePod)), &pod); err != nil {
+		t.Fatal(err)
+	}
+	return &pod
+}
+
+// countingCache is a patch cache counting its hits
+type countingCache struct {
+	PatchCache
+	hits int
+}
+
+func (c *countingCache) Get(key string) ([]byte, bool) {
+	patch, ok := c.PatchCache.Get(key)
+	if ok {
+		c.hits++
+	}
+	return patch, ok
+}
+
+func TestMultipleConfigsOnlyInjectThePodsContainers(t *testing.T) {
+	pod := injectMultiple(t, multipleServer(t, nil))
+
+	var names []string
+	env := map[string][]string{}
+	for _, c := range pod.Spec.Containers {
+		names = append(names, c.Name)
+		for _, e := range c.Env {
+			env[c.Name] = append(env[c.Name], e.Name)
+		}
+	}
+	// legacy-agent is the pod's own, proxy was injected by the config before
+	if want := []string{"app", "proxy", "agent"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("containers = %v, want %v", names, want)
+	}
+	if want := []string{"PROXY_ADDR", "AGENT_ADDR"}; !reflect.DeepEqual(env["app"], want) {
+		t.Errorf("env of app = %v, want %v", env["app"], want)
+	}
+	if len(env["proxy"]) > 0 || len(env["agent"]) > 0 {
+		t.Errorf("env of the sidecars = %v and %v, want none", env["proxy"], env["agent"])
+	}
+
+	mounts := map[string]string{}
+	for _, c := range pod.Spec.Containers {
+		for _, m := range c.VolumeMounts {
+			mounts[m.MountPath] = m.Name
+		}
+	}
+	if mounts["/etc/proxy/proxy.yaml"] != "simple-sidecar-files" || mounts["/etc/agent/agent.yaml"] != "simple-sidecar-files-2" {
+		t.Errorf("files are mounted from %v, want a volume for each config", mounts)
+	}
+	var volumes []string
+	for _, v := range pod.Spec.Volumes {
+		volumes = append(volumes, v.Name)
+	}
+	if want := []string{"simple-sidecar-files", "simple-sidecar-files-2"}; !reflect.DeepEqual(volumes, want) {
+		t.Errorf("volumes = %v, want %v", volumes, want)
+	}
+}
+
+func TestMultipleConfigsAreCached(t *testing.T) {
+	cache := &countingCache{PatchCache: NewTTLPatchCache(time.Hour, 10)}
+	whs := multipleServer(t, cache)
+	want := injectMultiple(t, multipleServer(t, nil))
+	for i := 0; i < 2; i++ {
+		if got := injectMultiple(t, whs); !reflect.DeepEqual(got, want) {
+			t.Errorf("injection %d = %v, want %v", i, got, want)
+		}
+	}
+	if cache.hits != 1 {
+		t.Errorf("cache hits = %d, want 1", cache.hits)
+	}
+}
+
+func TestMultipleConfigsWithTheSameFileAnnotation(t *testing.T) {
+	selected := []selectedConfig{
+		{name: "a", config: Config{Files: []ConfigFile{{Name: "app.yaml"}}}},
+		{name: "b", config: Config{Files: []ConfigFile{{Name: "app.yaml"}}, FileStore: fileStoreConfigMap}},
+	}
+	if err := checkMultipleFiles(selected); err != nil {
+		t.Errorf("checkMultipleFiles() = %v, a file in a ConfigMap has no annotation", err)
+	}
+	selected = append(selected, selectedConfig{name: "c", config: Config{Files: []ConfigFile{{Name: "app.yaml"}}}})
+	if err := checkMultipleFiles(selected); err == nil {
+		t.Error("checkMultipleFiles() succeeded with two files in the same annotation")
+	}
+}
@@ -0,0 +1,115 @@
+package webhook
+
+import (
+	"fmt"
+	"path"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// NamespaceOverride changes a config for the pods of some namespaces, e.g. a different image tag or more
+// resources in prod-* namespaces.
+type NamespaceOverride struct {
+	// Namespaces - the namespaces the override applies in, shell patterns such as prod-* are supported.
+	Namespaces []string
+
+	// Containers - changes to the config's containers and initContainers, matched by name.
+	Containers []ContainerOverride
+
+	// EnvVars - env vars replacing the config's envVars with the same name or added to them.
+	EnvVars []corev1.EnvVar
+}
+
+// ContainerOverride changes one container of a config. Fields that aren't set are left as configured.
+type ContainerOverride struct {
+	// Name - the name of the container or initContainer.
+	Name string
+
+	// Image - replaces the image.
+	Image string
+
+	// Resources - replaces the resources.
+	Resources *corev1.ResourceRequirements
+
+	// Env - env vars replacing the container's env vars with the same name or added to them.
+	Env []corev1.EnvVar
+}
+
+// matches returns whether the override applies in the namespace
+func (o NamespaceOverride) matches(namespace string) bool {
+	for _, pattern := range o.Namespaces {
+		if ok, _ := path.Match(pattern, namespace); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// validateNamespaceOverrides checks the patterns of the overrides and that the containers they change are
+// injected by the config
+func (c Config) validateNamespaceOverrides() error {
+	containers := map[string]bool{}
+	for _, container := range append(append([]corev1.Container{}, c.InitContainers...), c.Containers...) {
+		containers[container.Name] = true
+	}
+	for i, o := range c.NamespaceOverrides {
+		if len(o.Namespaces) == 0 {
+			return fmt.Errorf("namespaceOverrides[%d].namespaces must not be empty", i)
+		}
+		for j, pattern := range o.Namespaces {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("namespaceOverrides[%d].namespaces[%d]: invalid pattern %q", i, j, pattern)
+			}
+		}
+		for j, co := range o.Containers {
+			if !containers[co.Name] {
+				return fmt.Errorf("namespaceOverrides[%d].containers[%d]: container %q isn't injected by the config", i, j, co.Name)
+			}
+		}
+	}
+	return nil
+}
+
+// forNamespace returns a copy of the config with the first of its overrides matching the namespace
+// applied, or the config itself if none does
+func (c Config) forNamespace(namespace string) Config {
+	for _, o := range c.NamespaceOverrides {
+		if o.matches(namespace) {
+			return c.applyOverride(o)
+		}
+	}
+	return c
+}
+
+// applyOverride returns a copy of the config changed by the override, the shared config is never modified
+func (c Config) applyOverride(o NamespaceOverride) Config {
+	overrides := map[string]ContainerOverride{}
+	for _, co := range o.Containers {
+		overrides[co.Name] = co
+	}
+	override := func(list []corev1.Container) []corev1.Container {
+		if len(overrides) == 0 {
+			return list
+		}
+		changed := make([]corev1.Container, len(list))
+		for i := range list {
+			list[i].DeepCopyInto(&changed[i])
+			co, ok := overrides[changed[i].Name]
+			if !ok {
+				continue
+			}
+			if co.Image != "" {
+				changed[i].Image = co.Image
+			}
+			if co.Resources != nil {
+				changed[i].Resources = *co.Resources.DeepCopy()
+			}
+			changed[i].Env = mergeByKey(changed[i].Env, co.Env, func(e corev1.EnvVar) string { return e.Name })
+		}
+		return changed
+	}
+	c.InitContainers = override(c.InitContainers)
+	c.Containers = override(c.Containers)
+	c.EnvVars = mergeByKey(c.EnvVars, o.EnvVars, func(e corev1.EnvVar) string { return e.Name })
+	return c
+}
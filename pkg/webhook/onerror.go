@@ -0,0 +1,44 @@
+package webhook
+
+import (
+	"fmt"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	onErrorAllow = "allow"
+	onErrorDeny  = "deny"
+)
+
+var patchFailures = newCounterVec("patch_failures_total", "Pods whose patch could not be generated by config and the action taken (allow or deny).", "config", "action")
+
+// validateOnError checks the config's failure semantics
+func (c Config) validateOnError() error {
+	switch c.OnError {
+	case "", onErrorAllow, onErrorDeny:
+		return nil
+	}
+	return fmt.Errorf("onError must be %q or %q, got %q", onErrorAllow, onErrorDeny, c.OnError)
+}
+
+// patchFailed responds to a pod whose patch couldn't be generated. Configs with onError: allow admit the
+// pod without injection unless the namespace enforces injection, everything else is denied.
+func (whs *WebhookServer) patchFailed(config Config, configName string, enforced *EnforcedNamespace, pod string, err error) *admissionv1.AdmissionResponse {
+	if config.OnError == onErrorAllow && enforced == nil {
+		patchFailures.WithLabelValues(configName, onErrorAllow).Inc()
+		whs.warningLogger.Printf("Admitting %s without config %s, the patch failed: %v", pod, configName, err)
+		return &admissionv1.AdmissionResponse{
+			Allowed:  true,
+			Warnings: []string{fmt.Sprintf("simple-sidecar config %q was not injected: %v", configName, err)},
+		}
+	}
+	patchFailures.WithLabelValues(configName, onErrorDeny).Inc()
+	whs.warningLogger.Printf("Denying %s, config %s failed: %v", pod, configName, err)
+	return &admissionv1.AdmissionResponse{
+		Result: &metav1.Status{
+			Message: err.Error(),
+		},
+	}
+}
@@ -0,0 +1,58 @@
+package webhook
+
+import (
+	"fmt"
+	"strings"
+
+	admissionv1 "k8s.io/api/admission/v1"
+)
+
+// operationAuditKey is the audit annotation admission responses carry the operation in
+const operationAuditKey = "operation"
+
+var admissions = newCounterVec("admissions_total", "Admissions by operation (CREATE, UPDATE, DELETE or CONNECT) and result (injected, admitted or denied).", "operation", "result")
+
+// defaultInjectOperations are the operations pods are injected on when none are configured, the containers
+// of existing pods can't be changed so updates are admitted as they are
+var defaultInjectOperations = []admissionv1.Operation{admissionv1.Create}
+
+// ParseOperations parses a comma separated list of the operations pods are injected on, CREATE and UPDATE.
+func ParseOperations(value string) ([]admissionv1.Operation, error) {
+	var operations []admissionv1.Operation
+	for _, op := range strings.Split(value, ",") {
+		op = strings.ToUpper(strings.TrimSpace(op))
+		switch admissionv1.Operation(op) {
+		case "":
+		case admissionv1.Create, admissionv1.Update:
+			operations = append(operations, admissionv1.Operation(op))
+		default:
+			return nil, fmt.Errorf("pods can't be injected on %s, only on %s and %s", op, admissionv1.Create, admissionv1.Update)
+		}
+	}
+	return operations, nil
+}
+
+// injectsOn returns whether pods are injected on the operation
+func (whs *WebhookServer) injectsOn(op admissionv1.Operation) bool {
+	operations := whs.injectOps
+	if len(operations) == 0 {
+		operations = defaultInjectOperations
+	}
+	for _, o := range operations {
+		if o == op {
+			return true
+		}
+	}
+	return false
+}
+
+// admissionResult returns how an admission ended for the admissions metric
+func admissionResult(response *admissionv1.AdmissionResponse) string {
+	switch {
+	case response == nil || !response.Allowed:
+		return "denied"
+	case len(response.Patch) > 0:
+		return "injected"
+	}
+	return "admitted"
+}
@@ -0,0 +1,493 @@
+package webhook
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/metadata"
+)
+
+const (
+	// ConfigSourceFile reads the sidecar configs from a file or directory.
+	ConfigSourceFile = "file"
+
+	// ConfigSourceCRD watches SidecarConfig resources.
+	ConfigSourceCRD = "crd"
+
+	// ConfigSourceConfigMapPrefix starts sources watching a ConfigMap key, see ParseConfigMapSource.
+	ConfigSourceConfigMapPrefix = "configmap://"
+
+	// ConfigSourceSecretPrefix starts sources watching a Secret key, see ParseConfigMapSource.
+	ConfigSourceSecretPrefix = "secret://"
+)
+
+// ServerOptions are the settings of the simple-sidecar binary as plain values, programs embedding the
+// webhook can fill them in however they like and turn them into a WebhookServerConfig.
+type ServerOptions struct {
+	// Port - the HTTPS port of the webhook.
+	Port int
+
+	// ListenAddresses - optional addresses replacing Port, see ParseListeners.
+	ListenAddresses string
+
+	// ReusePort - set SO_REUSEPORT on the webhook's listeners.
+	ReusePort bool
+
+	// AdminPort - the plain HTTP port of the admin API, 0 disables it.
+	AdminPort int
+
+	// AdminTokenFile - a file holding the bearer token changes through the admin API need, the admin API is
+	// read-only without it.
+	AdminTokenFile string
+
+	// ConfigSource - where the sidecar configs come from: "file" (the default) reads ConfigFile, "crd"
+	// watches SidecarConfig resources, "configmap://<namespace>/<name>#<key>" watches a ConfigMap key and
+	// "secret://<namespace>/<name>#<key>" a Secret key, all with the in-cluster config.
+	ConfigSource string
+
+	// ConfigFile - the sidecar configs, a file or a directory of config files.
+	ConfigFile string
+
+	// ConfigNamespace - the namespace SidecarConfig resources are watched in, all namespaces if empty.
+	ConfigNamespace string
+
+	// WatchConfig - reload ConfigFile when it changes.
+	WatchConfig bool
+
+	// StrictConfig - reject configs with unknown fields or duplicate keys, e.g. a misspelled initContainers.
+	StrictConfig bool
+
+	// ExpandConfigEnv - replace ${NAME} in the string fields of configs with environment variables.
+	ExpandConfigEnv bool
+
+	// SOPSDecrypt - decrypt config files encrypted with SOPS, see ConfigLoadOptions.SOPS.
+	SOPSDecrypt bool
+
+	// SOPSBinary - the sops binary, sops in PATH by default.
+	SOPSBinary string
+
+	// ConfigProfile - the profile of the config file applied to its configs, e.g. prod.
+	ConfigProfile string
+
+	// CertFile - the serving certificate, it's reloaded when it changes.
+	CertFile string
+
+	// KeyFile - the key of the serving certificate.
+	KeyFile string
+
+	// TenantsFile - optional tenants, see LoadTenants.
+	TenantsFile string
+
+	// EnforcedNamespaces - optional deny-by-default namespaces, see ParseEnforcedNamespaces.
+	EnforcedNamespaces string
+
+	// PatchCacheTTL - how long generated patches are cached, 0 disables the cache.
+	PatchCacheTTL time.Duration
+
+	// PatchCacheSize - the maximum number of cached patches.
+	PatchCacheSize int
+
+	// TemplateCacheSize - the maximum number of configs rendered for pods that are cached, 0 disables the
+	// cache.
+	TemplateCacheSize int
+
+	// InventoryEnabled - watch pods with the in-cluster config and keep an inventory of injected ones.
+	InventoryEnabled bool
+
+	// OwnerMarkers - record the config injected into the pods of a ReplicaSet or Job on the owner, with
+	// the in-cluster config, and reuse it for the owner's later pods.
+	OwnerMarkers bool
+
+	// FileConfigMaps - create the ConfigMaps storing the files of configs with the configmap file store,
+	// with the in-cluster config.
+	FileConfigMaps bool
+
+	// NodeTopology - watch nodes with the in-cluster config so topology env is set from the labels of the
+	// node a pod is bound to at admission.
+	NodeTopology bool
+
+	// Impersonate - the service accounts cluster features act as, see ParseImpersonation.
+	Impersonate string
+
+	// WarmUp - render configs and admit a sample pod before reporting ready.
+	WarmUp bool
+
+	// DecisionURL - an external decision service selecting the config of each pod instead of the inject
+	// annotation, see DecisionResolver.
+	DecisionURL string
+
+	// DecisionTimeout - how long a decision may take, 3s by default.
+	DecisionTimeout time.Duration
+
+	// DecisionFailOpen - admit pods without injection when the decision service fails.
+	DecisionFailOpen bool
+
+	// DecisionCAFile - the CA of the decision service's certificate, the system roots by default.
+	DecisionCAFile string
+
+	// ImageDigestPolicy - warn or deny when configs inject images that aren't pinned to a digest, see
+	// ParseImageDigestPolicy.
+	ImageDigestPolicy string
+
+	// ResolveImageDigests - pin the images of configs to the digests of their tags when they're loaded.
+	ResolveImageDigests bool
+
+	// RegistryCredentials - a Docker config file with the credentials for resolving image digests.
+	RegistryCredentials string
+
+	// DigestCacheTTL - how long resolved image digests are reused, 10m by default.
+	DigestCacheTTL time.Duration
+
+	// LatencyBudget - how long a patch may take before only the static part of the config is injected,
+	// 0 disables partial injection.
+	LatencyBudget time.Duration
+
+	// MarkOrphaned - rewrite the status annotation of injected pods to orphaned when they're updated and
+	// their config no longer exists.
+	MarkOrphaned bool
+
+	// InjectOperations - the operations pods are injected on, see ParseOperations. CREATE if empty.
+	InjectOperations string
+
+	// PatchEngine - how injection patches are produced, see ParsePatchEngine. operations if empty.
+	PatchEngine string
+
+	// Freeze - the configs injection is frozen for at startup, see ParseFreeze.
+	Freeze string
+
+	// RequireConfig - fail to start, and reject reloads, without any configs.
+	RequireConfig bool
+
+	// RequiredConfigs - comma separated configs that must exist, implies RequireConfig.
+	RequiredConfigs string
+
+	// LogMaxBytes - log lines longer than this are truncated, 0 disables the limit.
+	LogMaxBytes int
+
+	// ResponseCompression - gzip admission responses when the client accepts it.
+	ResponseCompression bool
+
+	// SecondPath - an additional path serving the webhook with SecondPathCompression, e.g. /inject-plain.
+	SecondPath string
+
+	// SecondPathCompression - gzip admission responses on SecondPath when the client accepts it.
+	SecondPathCompression bool
+
+	// TCPNoDelay - set TCP_NODELAY on accepted connections.
+	TCPNoDelay bool
+
+	// WriteBufferSize - the socket send buffer size of accepted connections, 0 keeps the system default.
+	WriteBufferSize int
+
+	// MaxRequestBytes - the largest admission review accepted, after decompressing it, 0 is 16MiB.
+	MaxRequestBytes int
+
+	// ChaosMode - allow Chaos, so it can't be turned on by setting it alone.
+	ChaosMode bool
+
+	// Chaos - failures injected into admissions in chaos mode, see ParseChaos. Only for test clusters.
+	Chaos string
+}
+
+// DefaultServerOptions returns the options used for anything that isn't set.
+func DefaultServerOptions() ServerOptions {
+	return ServerOptions{
+		Port:           8443,
+		ConfigSource:   ConfigSourceFile,
+		ConfigFile:     "/etc/webhook/config/sidecarconfig.yaml",
+		WatchConfig:    true,
+		StrictConfig:   true,
+		CertFile:       "/etc/webhook/certs/tls.crt",
+		KeyFile:        "/etc/webhook/certs/tls.key",
+		PatchCacheSize: 10000,
+		LogMaxBytes:    16384,
+		TCPNoDelay:     true,
+	}
+}
+
+// LoadServerConfigFromEnv returns the default options overridden by the environment variables the
+// simple-sidecar binary reads, e.g. PORT, CONFIG_FILE and PATCH_CACHE_TTL. It has no global state.
+func LoadServerConfigFromEnv() (ServerOptions, error) {
+	opts := DefaultServerOptions()
+	var err error
+	setString := func(key string, v *string) {
+		if value, ok := os.LookupEnv(key); ok {
+			*v = value
+		}
+	}
+	setInt := func(key string, v *int) {
+		if value, ok := os.LookupEnv(key); ok && err == nil {
+			if *v, err = strconv.Atoi(value); err != nil {
+				err = fmt.Errorf("%s: %v", key, err)
+			}
+		}
+	}
+	setInt("PORT", &opts.Port)
+	setString("LISTEN_ADDRESSES", &opts.ListenAddresses)
+	setInt("ADMIN_PORT", &opts.AdminPort)
+	setString("ADMIN_TOKEN_FILE", &opts.AdminTokenFile)
+	setString("CONFIG_SOURCE", &opts.ConfigSource)
+	setString("CONFIG_FILE", &opts.ConfigFile)
+	setString("CONFIG_NAMESPACE", &opts.ConfigNamespace)
+	setString("SOPS_BINARY", &opts.SOPSBinary)
+	setString("CONFIG_PROFILE", &opts.ConfigProfile)
+	setString("CERT_FILE", &opts.CertFile)
+	setString("KEY_FILE", &opts.KeyFile)
+	setString("TENANTS_FILE", &opts.TenantsFile)
+	setString("ENFORCED_NAMESPACES", &opts.EnforcedNamespaces)
+	setString("FREEZE", &opts.Freeze)
+	setString("INJECT_OPERATIONS", &opts.InjectOperations)
+	setString("PATCH_ENGINE", &opts.PatchEngine)
+	setString("REQUIRED_CONFIGS", &opts.RequiredConfigs)
+	setString("IMPERSONATE", &opts.Impersonate)
+	setInt("PATCH_CACHE_SIZE", &opts.PatchCacheSize)
+	setInt("TEMPLATE_CACHE_SIZE", &opts.TemplateCacheSize)
+	setInt("LOG_MAX_BYTES", &opts.LogMaxBytes)
+	setString("SECOND_PATH", &opts.SecondPath)
+	setString("DECISION_URL", &opts.DecisionURL)
+	setString("DECISION_CA_FILE", &opts.DecisionCAFile)
+	setString("IMAGE_DIGEST_POLICY", &opts.ImageDigestPolicy)
+	setString("REGISTRY_CREDENTIALS_FILE", &opts.RegistryCredentials)
+	setString("CHAOS", &opts.Chaos)
+	setInt("WRITE_BUFFER_SIZE", &opts.WriteBufferSize)
+	setInt("MAX_REQUEST_BYTES", &opts.MaxRequestBytes)
+	setDuration := func(key string, v *time.Duration) {
+		if value, ok := os.LookupEnv(key); ok && err == nil {
+			if *v, err = time.ParseDuration(value); err != nil {
+				err = fmt.Errorf("%s: %v", key, err)
+			}
+		}
+	}
+	setDuration("PATCH_CACHE_TTL", &opts.PatchCacheTTL)
+	setDuration("LATENCY_BUDGET", &opts.LatencyBudget)
+	setDuration("DECISION_TIMEOUT", &opts.DecisionTimeout)
+	setDuration("DIGEST_CACHE_TTL", &opts.DigestCacheTTL)
+	setBool := func(key string, v *bool) {
+		if value, ok := os.LookupEnv(key); ok && err == nil {
+			if *v, err = strconv.ParseBool(value); err != nil {
+				err = fmt.Errorf("%s: %v", key, err)
+			}
+		}
+	}
+	setBool("LISTEN_REUSEPORT", &opts.ReusePort)
+	setBool("INVENTORY_ENABLED", &opts.InventoryEnabled)
+	setBool("OWNER_MARKERS", &opts.OwnerMarkers)
+	setBool("NODE_TOPOLOGY", &opts.NodeTopology)
+	setBool("FILE_CONFIGMAPS", &opts.FileConfigMaps)
+	setBool("WARM_UP", &opts.WarmUp)
+	setBool("MARK_ORPHANED", &opts.MarkOrphaned)
+	setBool("REQUIRE_CONFIG", &opts.RequireConfig)
+	setBool("WATCH_CONFIG", &opts.WatchConfig)
+	setBool("STRICT_CONFIG", &opts.StrictConfig)
+	setBool("EXPAND_CONFIG_ENV", &opts.ExpandConfigEnv)
+	setBool("SOPS_DECRYPT", &opts.SOPSDecrypt)
+	setBool("RESPONSE_COMPRESSION", &opts.ResponseCompression)
+	setBool("SECOND_PATH_COMPRESSION", &opts.SecondPathCompression)
+	setBool("TCP_NODELAY", &opts.TCPNoDelay)
+	setBool("DECISION_FAIL_OPEN", &opts.DecisionFailOpen)
+	setBool("RESOLVE_IMAGE_DIGESTS", &opts.ResolveImageDigests)
+	setBool("CHAOS_MODE", &opts.ChaosMode)
+	return opts, err
+}
+
+// WebhookServerConfig loads the configs and tenants the options point to and returns the config for
+// NewWebhookServer.
+func (o ServerOptions) WebhookServerConfig(infoLogger, warnLogger, errorLogger *log.Logger) (*WebhookServerConfig, error) {
+	var sidecarConfigs MultiConfig
+	var configClient dynamic.Interface
+	var configMap *ConfigMapSource
+	load, err := o.ConfigLoadOptions(infoLogger)
+	if err != nil {
+		return nil, err
+	}
+	imp, err := ParseImpersonation(o.Impersonate)
+	if err != nil {
+		return nil, err
+	}
+	if len(imp) > 0 {
+		infoLogger.Printf("Impersonating service accounts for cluster access: %s", imp)
+	}
+	switch {
+	case o.ConfigSource == ConfigSourceFile || o.ConfigSource == "":
+		if sidecarConfigs, err = loadConfig(o.ConfigFile, load); err != nil {
+			return nil, fmt.Errorf("failed to load configuration: %v", err)
+		}
+	case o.ConfigSource == ConfigSourceCRD || strings.HasPrefix(o.ConfigSource, ConfigSourceConfigMapPrefix) ||
+		strings.HasPrefix(o.ConfigSource, ConfigSourceSecretPrefix):
+		if o.ConfigSource != ConfigSourceCRD {
+			source, err := ParseConfigMapSource(o.ConfigSource)
+			if err != nil {
+				return nil, err
+			}
+			configMap = &source
+		}
+		restConfig, err := imp.restConfig(ClusterFeatureConfig)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load in-cluster config for %s: %v", o.ConfigSource, err)
+		}
+		if configClient, err = dynamic.NewForConfig(restConfig); err != nil {
+			return nil, fmt.Errorf("failed to create config client: %v", err)
+		}
+	default:
+		return nil, fmt.Errorf("unknown config source %q, expected %q, %q, %s<namespace>/<name>#<key> or %s<namespace>/<name>#<key>",
+			o.ConfigSource, ConfigSourceFile, ConfigSourceCRD, ConfigSourceConfigMapPrefix, ConfigSourceSecretPrefix)
+	}
+
+	cfg := &WebhookServerConfig{
+		Port:               o.Port,
+		AdminPort:          o.AdminPort,
+		CertPEM:            o.CertFile,
+		KeyPEM:             o.KeyFile,
+		SidecarConfigs:     sidecarConfigs,
+		ConfigClient:       configClient,
+		ConfigNamespace:    o.ConfigNamespace,
+		ConfigMap:          configMap,
+		WatchConfig:        o.WatchConfig,
+		ConfigLoad:         load,
+		EnforcedNamespaces: ParseEnforcedNamespaces(o.EnforcedNamespaces),
+		MaxLogBytes:        o.LogMaxBytes,
+		TemplateCacheSize:  o.TemplateCacheSize,
+		WarmUp:             o.WarmUp,
+		LatencyBudget:      o.LatencyBudget,
+		MarkOrphaned:       o.MarkOrphaned,
+		Freeze:             ParseFreeze(o.Freeze),
+		InfoLogger:         infoLogger,
+		WarnLogger:         warnLogger,
+		ErrorLogger:        errorLogger,
+	}
+	if configClient == nil {
+		cfg.ConfigFile = o.ConfigFile
+	}
+	cfg.Transport = TransportConfig{
+		Compression:           o.ResponseCompression,
+		SecondPath:            o.SecondPath,
+		SecondPathCompression: o.SecondPathCompression,
+		DisableNoDelay:        !o.TCPNoDelay,
+		WriteBufferSize:       o.WriteBufferSize,
+		MaxRequestBytes:       o.MaxRequestBytes,
+	}
+	if o.AdminTokenFile != "" {
+		if cfg.AdminToken, err = readAdminToken(o.AdminTokenFile); err != nil {
+			return nil, err
+		}
+	}
+	if o.SecondPath != "" && (!strings.HasPrefix(o.SecondPath, "/") || o.SecondPath == webhookInjectPath) {
+		return nil, fmt.Errorf("second path %q must start with / and differ from %s", o.SecondPath, webhookInjectPath)
+	}
+	listen := o.ListenAddresses
+	if listen == "" && o.ReusePort {
+		listen = fmt.Sprintf(":%d", o.Port)
+	}
+	if listen != "" {
+		if cfg.Listeners, err = ParseListeners(listen, o.ReusePort); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.InjectOperations, err = ParseOperations(o.InjectOperations); err != nil {
+		return nil, fmt.Errorf("inject operations: %v", err)
+	}
+	if cfg.PatchEngine, err = ParsePatchEngine(o.PatchEngine); err != nil {
+		return nil, err
+	}
+	if o.Chaos != "" && !o.ChaosMode {
+		warnLogger.Printf("Ignoring chaos %q, chaos mode isn't enabled", o.Chaos)
+	} else if o.Chaos != "" {
+		if cfg.Chaos, err = ParseChaos(o.Chaos); err != nil {
+			return nil, err
+		}
+		warnLogger.Printf("Chaos mode: injecting %s into admissions", cfg.Chaos)
+	}
+	if o.RequireConfig || o.RequiredConfigs != "" {
+		cfg.RequireConfigs = &ConfigRequirement{Names: ParseRequiredConfigs(o.RequiredConfigs)}
+	}
+	if o.TenantsFile != "" {
+		if cfg.Tenants, err = loadTenants(o.TenantsFile, load); err != nil {
+			return nil, fmt.Errorf("failed to load tenants: %v", err)
+		}
+	}
+	if o.DecisionURL != "" {
+		client, err := NewDecisionClient(o.DecisionCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create decision client: %v", err)
+		}
+		cfg.Resolver = &DecisionResolver{URL: o.DecisionURL, Timeout: o.DecisionTimeout, FailOpen: o.DecisionFailOpen, Client: client, Logger: warnLogger}
+	}
+	if o.PatchCacheTTL > 0 {
+		cfg.PatchCache = NewTTLPatchCache(o.PatchCacheTTL, o.PatchCacheSize)
+	}
+	if o.InventoryEnabled {
+		if cfg.InventoryClient, err = inClusterMetadataClient(imp, ClusterFeatureInventory); err != nil {
+			return nil, fmt.Errorf("failed to create inventory client: %v", err)
+		}
+	}
+	if o.OwnerMarkers {
+		if cfg.OwnerClient, err = inClusterMetadataClient(imp, ClusterFeatureOwnerMarkers); err != nil {
+			return nil, fmt.Errorf("failed to create owner marker client: %v", err)
+		}
+	}
+	if o.FileConfigMaps {
+		restConfig, err := imp.restConfig(ClusterFeatureFileConfigMaps)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load in-cluster config for file ConfigMaps: %v", err)
+		}
+		if cfg.FilesClient, err = dynamic.NewForConfig(restConfig); err != nil {
+			return nil, fmt.Errorf("failed to create file ConfigMap client: %v", err)
+		}
+	}
+	if o.NodeTopology {
+		if cfg.NodeClient, err = inClusterMetadataClient(imp, ClusterFeatureNodeTopology); err != nil {
+			return nil, fmt.Errorf("failed to create node client: %v", err)
+		}
+	}
+	return cfg, nil
+}
+
+// ConfigLoadOptions returns how the options say config files are decoded, e.g. for tools loading the
+// same files as the server. Warnings and profile changes are logged to logger.
+func (o ServerOptions) ConfigLoadOptions(logger *log.Logger) (ConfigLoadOptions, error) {
+	load := ConfigLoadOptions{
+		Lenient:    !o.StrictConfig,
+		ExpandEnv:  o.ExpandConfigEnv,
+		SOPS:       o.SOPSDecrypt,
+		SOPSBinary: o.SOPSBinary,
+		Profile:    o.ConfigProfile,
+		Logger:     logger,
+	}
+	var err error
+	if load.ImageDigests, err = ParseImageDigestPolicy(o.ImageDigestPolicy); err != nil {
+		return load, err
+	}
+	if o.ResolveImageDigests {
+		if load.DigestResolver, err = NewDigestResolver(o.RegistryCredentials, o.DigestCacheTTL); err != nil {
+			return load, fmt.Errorf("failed to create image digest resolver: %v", err)
+		}
+	}
+	return load, nil
+}
+
+// readAdminToken reads the admin token from the file, surrounding whitespace is ignored
+func readAdminToken(file string) (string, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return "", fmt.Errorf("failed to read the admin token: %v", err)
+	}
+	token := strings.TrimSpace(string(data))
+	if token == "" {
+		return "", fmt.Errorf("the admin token file %s is empty", file)
+	}
+	return token, nil
+}
+
+// inClusterMetadataClient returns a metadata client using the in-cluster config of the feature
+func inClusterMetadataClient(imp Impersonation, feature string) (metadata.Interface, error) {
+	restConfig, err := imp.restConfig(feature)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load in-cluster config: %v", err)
+	}
+	return metadata.NewForConfig(restConfig)
+}
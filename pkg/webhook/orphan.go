@@ -0,0 +1,53 @@
+package webhook
+
+import (
+	"strings"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/centml/simple-sidecar/pkg/patch"
+)
+
+var orphanedPods = newCounterVec("orphaned_pods_total", "Pods marked orphaned on update because the config recorded on them no longer exists, by config.", "config")
+
+// orphanedStatus returns the response marking an injected pod orphaned when the config recorded on it no
+// longer exists, e.g. because it was retired, or nil if the pod isn't orphaned. The pod keeps its sidecars,
+// the status is a signal for cleaning it up.
+func (whs *WebhookServer) orphanedStatus(st *serverState, pod *corev1.Pod, id string) *admissionv1.AdmissionResponse {
+	annotations := pod.GetAnnotations()
+	switch strings.ToLower(annotations[whs.annotations.status]) {
+	case statusInjected, statusInitInjected, statusPartiallyInjected:
+	default:
+		return nil
+	}
+	// pods injected before the config was recorded can't be matched, and no configs at all more likely
+	// means they aren't loaded yet than that every config was retired
+	configName := annotations[whs.annotations.config]
+	if configName == "" || len(st.sidecarConfigs) == 0 {
+		return nil
+	}
+	missing := false
+	for _, name := range splitConfigNames(configName) {
+		if _, ok := st.sidecarConfigs[name]; !ok {
+			missing = true
+		}
+	}
+	if !missing {
+		return nil
+	}
+
+	patchBytes, err := patch.Marshal(whs.updateAnnotation(annotations, map[string]string{whs.annotations.status: statusOrphaned}))
+	if err != nil {
+		whs.warningLogger.Printf("Can't mark %s orphaned: %v", id, err)
+		return nil
+	}
+	orphanedPods.WithLabelValues(configName).Inc()
+	whs.warningLogger.Printf("Marking %s orphaned, its config %s no longer exists", id, configName)
+	pt := admissionv1.PatchTypeJSONPatch
+	return &admissionv1.AdmissionResponse{
+		Allowed:   true,
+		Patch:     patchBytes,
+		PatchType: &pt,
+	}
+}
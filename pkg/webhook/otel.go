@@ -0,0 +1,177 @@
+package webhook
+
+import (
+	"bytes"
+	"fmt"
+	"text/template"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	defaultOTelImage            = "otel/opentelemetry-collector-contrib:0.96.0"
+	defaultOTelBootstrapImage   = "busybox:1.36"
+	defaultOTelServiceNameLabel = "app.kubernetes.io/name"
+
+	otelConfigVolumeName = "otel-collector-config"
+	otelConfigPath       = "/etc/otel"
+)
+
+// defaultOTelCollectorTemplate receives OTLP from the pod and forwards everything to the configured
+// endpoint, tagging it with the service name and namespace of the pod.
+const defaultOTelCollectorTemplate = `receivers:
+  otlp:
+    protocols:
+      grpc:
+        endpoint: localhost:4317
+      http:
+        endpoint: localhost:4318
+processors:
+  batch: {}
+  resource:
+    attributes:
+    - key: service.name
+      value: {{ printf "%q" .ServiceName }}
+      action: upsert
+    - key: k8s.namespace.name
+      value: {{ printf "%q" .Namespace }}
+      action: upsert
+exporters:
+  otlp:
+    endpoint: {{ printf "%q" .Endpoint }}
+service:
+  pipelines:
+    traces:
+      receivers: [otlp]
+      processors: [resource, batch]
+      exporters: [otlp]
+    metrics:
+      receivers: [otlp]
+      processors: [resource, batch]
+      exporters: [otlp]
+    logs:
+      receivers: [otlp]
+      processors: [resource, batch]
+      exporters: [otlp]
+`
+
+// OTelCollectorConfig is a preset for injecting an OpenTelemetry collector sidecar. The collector
+// configuration is rendered per pod from a Go template and written to an emptyDir by a small
+// bootstrap init container, the collector then reads it from there.
+type OTelCollectorConfig struct {
+	// Image - the collector image, defaults to otel/opentelemetry-collector-contrib.
+	Image string
+
+	// BootstrapImage - the image used to write the rendered config, it needs /bin/sh. Defaults to busybox.
+	BootstrapImage string
+
+	// Endpoint - the OTLP endpoint the collector exports to.
+	Endpoint string
+
+	// ServiceNameLabel - the pod label used for service.name, defaults to app.kubernetes.io/name.
+	// If the pod doesn't have the label the app label, then the pod name are used.
+	ServiceNameLabel string
+
+	// Template - the collector config as a Go template, rendered with .ServiceName, .Namespace,
+	// .PodName, .Labels and .Endpoint. Defaults to an OTLP in, OTLP out pipeline.
+	Template string
+
+	// Resources - resources for the collector container.
+	Resources corev1.ResourceRequirements
+}
+
+// otelTemplateData is the data the collector config template is rendered with
+type otelTemplateData struct {
+	ServiceName string
+	Namespace   string
+	PodName     string
+	Labels      map[string]string
+	Endpoint    string
+}
+
+// otelServiceName determines service.name for the pod
+func otelServiceName(pod *corev1.Pod, label string) string {
+	labels := pod.GetLabels()
+	if name := labels[label]; name != "" {
+		return name
+	}
+	if name := labels["app"]; name != "" {
+		return name
+	}
+	if pod.Name != "" {
+		return pod.Name
+	}
+	return pod.GenerateName
+}
+
+// expandOTelCollector returns a copy of the config with the OTel collector preset expanded for the given pod
+func expandOTelCollector(pod *corev1.Pod, config Config) (Config, error) {
+	otel := config.OTelCollector
+	if otel == nil {
+		return config, nil
+	}
+
+	image := otel.Image
+	if image == "" {
+		image = defaultOTelImage
+	}
+	bootstrapImage := otel.BootstrapImage
+	if bootstrapImage == "" {
+		bootstrapImage = defaultOTelBootstrapImage
+	}
+	label := otel.ServiceNameLabel
+	if label == "" {
+		label = defaultOTelServiceNameLabel
+	}
+	text := otel.Template
+	if text == "" {
+		text = defaultOTelCollectorTemplate
+	}
+
+	tmpl, err := template.New("otel-collector").Option("missingkey=zero").Parse(text)
+	if err != nil {
+		return config, fmt.Errorf("could not parse otel collector template: %v", err)
+	}
+	data := otelTemplateData{
+		ServiceName: otelServiceName(pod, label),
+		Namespace:   pod.Namespace,
+		PodName:     pod.Name,
+		Labels:      pod.GetLabels(),
+		Endpoint:    otel.Endpoint,
+	}
+	var rendered bytes.Buffer
+	if err := tmpl.Execute(&rendered, data); err != nil {
+		return config, fmt.Errorf("could not render otel collector template: %v", err)
+	}
+
+	mount := corev1.VolumeMount{Name: otelConfigVolumeName, MountPath: otelConfigPath}
+	bootstrap := corev1.Container{
+		Name:         "otel-collector-bootstrap",
+		Image:        bootstrapImage,
+		Command:      []string{"/bin/sh", "-ec"},
+		Args:         []string{fmt.Sprintf(`echo "$OTEL_COLLECTOR_CONFIG" > %s/config.yaml`, otelConfigPath)},
+		Env:          []corev1.EnvVar{{Name: "OTEL_COLLECTOR_CONFIG", Value: rendered.String()}},
+		VolumeMounts: []corev1.VolumeMount{mount},
+	}
+	collector := corev1.Container{
+		Name:         "otel-collector",
+		Image:        image,
+		Args:         []string{fmt.Sprintf("--config=%s/config.yaml", otelConfigPath)},
+		Resources:    otel.Resources,
+		VolumeMounts: []corev1.VolumeMount{mount},
+	}
+
+	// copy the slices so the shared config is never modified
+	config.InitContainers = append(append([]corev1.Container{}, config.InitContainers...), bootstrap)
+	config.Containers = append(append([]corev1.Container{}, config.Containers...), collector)
+	config.Volumes = append(append([]corev1.Volume{}, config.Volumes...), corev1.Volume{
+		Name:         otelConfigVolumeName,
+		VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{}},
+	})
+	config.EnvVars = append(append([]corev1.EnvVar{}, config.EnvVars...),
+		corev1.EnvVar{Name: "OTEL_EXPORTER_OTLP_ENDPOINT", Value: "http://localhost:4317"},
+		corev1.EnvVar{Name: "OTEL_SERVICE_NAME", Value: data.ServiceName},
+	)
+	config.OTelCollector = nil
+	return config, nil
+}
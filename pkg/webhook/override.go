@@ -0,0 +1,217 @@
+package webhook
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+var rejectedOverrides = newCounterVec("rejected_overrides_total", "Override annotations rejected by config and reason (not-overridable or unpinned-image).", "config", "reason")
+
+// overridableFields are the fields Config.Overridable may let pods override, resources and env stand for
+// every resource and var
+var overridableFields = []string{"image", "imagePullPolicy", "resources", "env"}
+
+// override is an override annotation of a container the config injects
+type override struct {
+	key       string
+	container string
+	field     string
+	value     string
+}
+
+// overrideWarning is a warning about an override, reason is set if it was rejected
+type overrideWarning struct {
+	reason  string
+	message string
+}
+
+// applyOverrides returns a copy of the config with the override annotations of the pod applied to the
+// containers it injects. The annotations are <override prefix><container>.<field>, the fields are image,
+// imagePullPolicy, resources.limits.<resource>, resources.requests.<resource> and env.<name>. Overrides of
+// containers the config doesn't inject are left for the other configs of the pod, overrides the config
+// doesn't allow are skipped, see overrideWarnings.
+func (whs *WebhookServer) applyOverrides(pod *corev1.Pod, config Config) (Config, error) {
+	overrides, _, err := whs.podOverrides(pod, config)
+	if err != nil || len(overrides) == 0 {
+		return config, err
+	}
+
+	// copy the containers so the shared config is never modified
+	config.InitContainers = append([]corev1.Container{}, config.InitContainers...)
+	config.Containers = append([]corev1.Container{}, config.Containers...)
+	for _, o := range overrides {
+		container := overriddenContainer(&config, o.container)
+		if err := overrideField(container, o.field, o.value); err != nil {
+			return config, fmt.Errorf("override annotation %s: %v", o.key, err)
+		}
+	}
+	return config, nil
+}
+
+// overrideWarnings returns the warnings about the pod's overrides of the config's containers that are
+// rejected, because the config doesn't allow the field or the image isn't pinned to a digest under the
+// deny policy, or applied with an unpinned image under the warn policy. They're logged and counted.
+func (whs *WebhookServer) overrideWarnings(pod *corev1.Pod, config Config, configName string) []string {
+	_, warnings, err := whs.podOverrides(pod, config)
+	if err != nil || len(warnings) == 0 {
+		// the patch failed on errors already
+		return nil
+	}
+	messages := make([]string, len(warnings))
+	for i, w := range warnings {
+		whs.warningLogger.Printf("Config %s: %s", configName, w.message)
+		if w.reason != "" {
+			rejectedOverrides.WithLabelValues(configName, w.reason).Inc()
+		}
+		messages[i] = fmt.Sprintf("simple-sidecar config %q: %s", configName, w.message)
+	}
+	return messages
+}
+
+// podOverrides returns the pod's override annotations of the config's containers that the config allows,
+// in the order of their keys, and the warnings about the others. Malformed annotations and unknown fields
+// are errors.
+func (whs *WebhookServer) podOverrides(pod *corev1.Pod, config Config) ([]override, []overrideWarning, error) {
+	prefix := whs.annotations.override
+	annotations := pod.GetAnnotations()
+	keys := make([]string, 0, len(annotations))
+	for key := range annotations {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	var overrides []override
+	var warnings []overrideWarning
+	for _, key := range keys {
+		parts := strings.SplitN(strings.TrimPrefix(key, prefix), ".", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, nil, fmt.Errorf("override annotation %s: expected %s<container>.<field>", key, prefix)
+		}
+		if !injectsContainer(config, parts[0]) {
+			continue
+		}
+		field := overridableField(parts[1])
+		if field == "" {
+			return nil, nil, fmt.Errorf("override annotation %s: unknown field %q, expected image, imagePullPolicy, resources.limits.<resource>, resources.requests.<resource> or env.<name>", key, parts[1])
+		}
+		o := override{key: key, container: parts[0], field: parts[1], value: annotations[key]}
+		if !contains(config.Overridable, field) {
+			warnings = append(warnings, overrideWarning{"not-overridable", fmt.Sprintf("override annotation %s is ignored, the config doesn't allow overriding %s", key, field)})
+			continue
+		}
+		if field == "image" && !strings.Contains(o.value, "@") {
+			switch whs.configLoad.ImageDigests {
+			case ImageDigestsDeny:
+				warnings = append(warnings, overrideWarning{"unpinned-image", fmt.Sprintf("override annotation %s is ignored, image %q isn't pinned to a digest", key, o.value)})
+				continue
+			case ImageDigestsWarn:
+				warnings = append(warnings, overrideWarning{"", fmt.Sprintf("override annotation %s: image %q isn't pinned to a digest", key, o.value)})
+			}
+		}
+		overrides = append(overrides, o)
+	}
+	return overrides, warnings, nil
+}
+
+// overridableField returns the field of Config.Overridable an override field belongs to, empty if it's
+// unknown
+func overridableField(field string) string {
+	switch {
+	case field == "image", field == "imagePullPolicy":
+		return field
+	case strings.HasPrefix(field, "resources.limits."), strings.HasPrefix(field, "resources.requests."):
+		return "resources"
+	case strings.HasPrefix(field, "env."):
+		return "env"
+	}
+	return ""
+}
+
+// injectsContainer returns whether the config injects a container or initContainer named name
+func injectsContainer(config Config, name string) bool {
+	for _, containers := range [][]corev1.Container{config.InitContainers, config.Containers} {
+		for _, c := range containers {
+			if c.Name == name {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// validateOverridable checks the fields the config lets pods override
+func (c Config) validateOverridable() error {
+	for i, field := range c.Overridable {
+		if !contains(overridableFields, field) {
+			return fmt.Errorf("overridable[%d]: unknown field %q, expected %s", i, field, strings.Join(overridableFields, ", "))
+		}
+	}
+	return nil
+}
+
+// overriddenContainer returns the injected container named name, copied so it can be modified, or nil if
+// the config doesn't inject it
+func overriddenContainer(config *Config, name string) *corev1.Container {
+	for _, containers := range [][]corev1.Container{config.InitContainers, config.Containers} {
+		for i := range containers {
+			if containers[i].Name == name {
+				containers[i] = *containers[i].DeepCopy()
+				return &containers[i]
+			}
+		}
+	}
+	return nil
+}
+
+// overrideField sets the field of the container to value
+func overrideField(container *corev1.Container, field, value string) error {
+	switch {
+	case field == "image":
+		if value == "" {
+			return fmt.Errorf("the image must not be empty")
+		}
+		container.Image = value
+	case field == "imagePullPolicy":
+		switch policy := corev1.PullPolicy(value); policy {
+		case corev1.PullAlways, corev1.PullIfNotPresent, corev1.PullNever:
+			container.ImagePullPolicy = policy
+		default:
+			return fmt.Errorf("imagePullPolicy must be %s, %s or %s, got %q", corev1.PullAlways, corev1.PullIfNotPresent, corev1.PullNever, value)
+		}
+	case strings.HasPrefix(field, "resources.limits."), strings.HasPrefix(field, "resources.requests."):
+		parts := strings.SplitN(field, ".", 3)
+		if parts[2] == "" {
+			return fmt.Errorf("the resource name must not be empty")
+		}
+		q, err := resource.ParseQuantity(value)
+		if err != nil {
+			return fmt.Errorf("invalid quantity %q: %v", value, err)
+		}
+		list := &container.Resources.Requests
+		if parts[1] == "limits" {
+			list = &container.Resources.Limits
+		}
+		if *list == nil {
+			*list = corev1.ResourceList{}
+		}
+		(*list)[corev1.ResourceName(parts[2])] = q
+	case strings.HasPrefix(field, "env."):
+		name := strings.TrimPrefix(field, "env.")
+		for i := range container.Env {
+			if container.Env[i].Name == name {
+				container.Env[i] = corev1.EnvVar{Name: name, Value: value}
+				return nil
+			}
+		}
+		container.Env = append(container.Env, corev1.EnvVar{Name: name, Value: value})
+	default:
+		return fmt.Errorf("unknown field %q, expected image, imagePullPolicy, resources.limits.<resource>, resources.requests.<resource> or env.<name>", field)
+	}
+	return nil
+}
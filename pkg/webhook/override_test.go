@@ -0,0 +1,182 @@
+package webhook
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"reflect"
+	"strings"
+	"testing"
+
+	jsonpatch "github.com/evanphx/json-patch"
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+const overrideConfigs = `
+closed:
+  containers:
+  - name: agent
+    image: registry.example.com/agent:1.0@sha256:0000000000000000000000000000000000000000000000000000000000000000
+open:
+  overridable: [image, env]
+  containers:
+  - name: agent
+    image: registry.example.com/agent:1.0@sha256:0000000000000000000000000000000000000000000000000000000000000000
+`
+
+const pinnedImage = "registry.example.com/agent:2.0@sha256:1111111111111111111111111111111111111111111111111111111111111111"
+
+// admitOverrides injects the config into a pod with the override annotations of the agent container and
+// returns the agent container and the response's warnings
+func admitOverrides(t *testing.T, policy ImageDigestPolicy, config string, overrides map[string]string) (corev1.Container, []string) {
+	t.Helper()
+	configs, err := LoadConfigFromBytes([]byte(overrideConfigs))
+	if err != nil {
+		t.Fatal(err)
+	}
+	discard := log.New(io.Discard, "", 0)
+	whs := NewWebhookServer(&WebhookServerConfig{
+		SidecarConfigs: configs,
+		ConfigLoad:     ConfigLoadOptions{ImageDigests: policy},
+		InfoLogger:     discard,
+		WarnLogger:     discard,
+		ErrorLogger:    discard,
+	})
+
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "app",
+			Namespace:   "default",
+			Annotations: map[string]string{"simple-sidecar.centml.ai/inject": config},
+		},
+		Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "app", Image: "registry.example.com/app:1.0"}}},
+	}
+	for field, value := range overrides {
+		pod.Annotations["simple-sidecar.centml.ai/override.agent."+field] = value
+	}
+	raw, err := json.Marshal(pod)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ar := &admissionv1.AdmissionReview{
+		Request: &admissionv1.AdmissionRequest{
+			UID:       "test",
+			Kind:      metav1.GroupVersionKind{Version: "v1", Kind: "Pod"},
+			Resource:  metav1.GroupVersionResource{Version: "v1", Resource: "pods"},
+			Namespace: "default",
+			Operation: admissionv1.Create,
+			Object:    runtime.RawExtension{Raw: raw},
+		},
+	}
+	response := whs.mutate(ar, whs.state())
+	if !response.Allowed {
+		t.Fatalf("pod denied: %s", response.Result.Message)
+	}
+	p, err := jsonpatch.DecodePatch(response.Patch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	patched, err := p.Apply(raw)
+	if err != nil {
+		t.Fatalf("applying %s: %v", response.Patch, err)
+	}
+	var injected corev1.Pod
+	if err := json.Unmarshal(patched, &injected); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range injected.Spec.Containers {
+		if c.Name == "agent" {
+			return c, response.Warnings
+		}
+	}
+	t.Fatalf("agent isn't injected into %s", patched)
+	return corev1.Container{}, nil
+}
+
+func TestOverrides(t *testing.T) {
+	configured := "registry.example.com/agent:1.0@sha256:0000000000000000000000000000000000000000000000000000000000000000"
+	tests := []struct {
+		name      string
+		policy    ImageDigestPolicy
+		config    string
+		overrides map[string]string
+		image     string
+		env       []corev1.EnvVar
+		warnings  []string
+	}{
+		{
+			name:      "nothing is overridable by default",
+			config:    "closed",
+			overrides: map[string]string{"image": pinnedImage, "env.LOG_LEVEL": "debug"},
+			image:     configured,
+			warnings: []string{
+				`simple-sidecar config "closed": override annotation simple-sidecar.centml.ai/override.agent.env.LOG_LEVEL is ignored, the config doesn't allow overriding env`,
+				`simple-sidecar config "closed": override annotation simple-sidecar.centml.ai/override.agent.image is ignored, the config doesn't allow overriding image`,
+			},
+		},
+		{
+			name:      "only the allowed fields are overridden",
+			config:    "open",
+			overrides: map[string]string{"image": pinnedImage, "env.LOG_LEVEL": "debug", "resources.limits.cpu": "1"},
+			image:     pinnedImage,
+			env:       []corev1.EnvVar{{Name: "LOG_LEVEL", Value: "debug"}},
+			warnings: []string{
+				`simple-sidecar config "open": override annotation simple-sidecar.centml.ai/override.agent.resources.limits.cpu is ignored, the config doesn't allow overriding resources`,
+			},
+		},
+		{
+			name:      "images without a digest are rejected under the deny policy",
+			policy:    ImageDigestsDeny,
+			config:    "open",
+			overrides: map[string]string{"image": "registry.example.com/agent:2.0"},
+			image:     configured,
+			warnings: []string{
+				`simple-sidecar config "open": override annotation simple-sidecar.centml.ai/override.agent.image is ignored, image "registry.example.com/agent:2.0" isn't pinned to a digest`,
+			},
+		},
+		{
+			name:      "images with a digest are overridden under the deny policy",
+			policy:    ImageDigestsDeny,
+			config:    "open",
+			overrides: map[string]string{"image": pinnedImage},
+			image:     pinnedImage,
+		},
+		{
+			name:      "images without a digest are overridden with a warning under the warn policy",
+			policy:    ImageDigestsWarn,
+			config:    "open",
+			overrides: map[string]string{"image": "registry.example.com/agent:2.0"},
+			image:     "registry.example.com/agent:2.0",
+			warnings: []string{
+				`simple-sidecar config "open": override annotation simple-sidecar.centml.ai/override.agent.image: image "registry.example.com/agent:2.0" isn't pinned to a digest`,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			agent, warnings := admitOverrides(t, tt.policy, tt.config, tt.overrides)
+			if agent.Image != tt.image {
+				t.Errorf("image = %s, want %s", agent.Image, tt.image)
+			}
+			if !reflect.DeepEqual(agent.Env, tt.env) {
+				t.Errorf("env = %v, want %v", agent.Env, tt.env)
+			}
+			if !reflect.DeepEqual(warnings, tt.warnings) {
+				t.Errorf("warnings = %q, want %q", warnings, tt.warnings)
+			}
+		})
+	}
+}
+
+func TestValidateOverridable(t *testing.T) {
+	if err := (Config{Overridable: overridableFields}).validateOverridable(); err != nil {
+		t.Errorf("validateOverridable() = %v", err)
+	}
+	err := (Config{Overridable: []string{"image", "command"}}).validateOverridable()
+	if err == nil || !strings.HasPrefix(err.Error(), "overridable[1]:") {
+		t.Errorf("validateOverridable() = %v, want an error about overridable[1]", err)
+	}
+}
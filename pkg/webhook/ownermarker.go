@@ -0,0 +1,197 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/metadata"
+)
+
+const (
+	// ownerMarkerTimeout bounds the owner lookup during an admission and the writeback after it
+	ownerMarkerTimeout = 2 * time.Second
+
+	// ownerMarkerCacheSize is the number of owners whose marker is kept in memory
+	ownerMarkerCacheSize = 10000
+)
+
+var ownerMarkerResults = newCounterVec("owner_markers_total", "Owner marker lookups and writebacks by result (hit, miss, stale, recorded or error).", "result")
+
+// ownerMarkerResources are the owners markers are recorded on, the controllers recreating pods from the
+// same template
+var ownerMarkerResources = map[schema.GroupKind]schema.GroupVersionResource{
+	{Group: "apps", Kind: "ReplicaSet"}: {Group: "apps", Version: "v1", Resource: "replicasets"},
+	{Group: "batch", Kind: "Job"}:       {Group: "batch", Version: "v1", Resource: "jobs"},
+}
+
+// ownerMarker is the config a pod owner's pods were injected with, the config hash makes sure later pods
+// only reuse it while the config is unchanged
+type ownerMarker struct {
+	Config string `json:"config"`
+	Hash   string `json:"hash"`
+}
+
+// ownerMarkers records the config injected into the pods of a ReplicaSet or Job on the owner itself, so
+// the owner's later pods, e.g. recreated during a node drain, get the same config without the resolver
+// being consulted again. Lookups are cached in memory and writebacks happen after the admission.
+type ownerMarkers struct {
+	client metadata.Interface
+	key    string
+
+	mu    sync.Mutex
+	cache map[types.UID]ownerMarker
+}
+
+// newOwnerMarkers returns owner markers stored in the key annotation of the owners
+func newOwnerMarkers(client metadata.Interface, key string) *ownerMarkers {
+	return &ownerMarkers{
+		client: client,
+		key:    key,
+		cache:  map[types.UID]ownerMarker{},
+	}
+}
+
+// podOwner returns the pod's controller and its resource if markers can be recorded on it
+func podOwner(pod *corev1.Pod) (*metav1.OwnerReference, schema.GroupVersionResource, bool) {
+	ref := metav1.GetControllerOf(pod)
+	if ref == nil {
+		return nil, schema.GroupVersionResource{}, false
+	}
+	gv, err := schema.ParseGroupVersion(ref.APIVersion)
+	if err != nil {
+		return nil, schema.GroupVersionResource{}, false
+	}
+	gvr, ok := ownerMarkerResources[schema.GroupKind{Group: gv.Group, Kind: ref.Kind}]
+	return ref, gvr, ok
+}
+
+// lookup returns the marker of the pod's owner, an empty marker if the owner has none
+func (m *ownerMarkers) lookup(namespace string, pod *corev1.Pod) (ownerMarker, bool) {
+	ref, gvr, ok := podOwner(pod)
+	if !ok {
+		return ownerMarker{}, false
+	}
+	if marker, ok := m.cached(ref.UID); ok {
+		return marker, true
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), ownerMarkerTimeout)
+	defer cancel()
+	owner, err := m.client.Resource(gvr).Namespace(namespace).Get(ctx, ref.Name, metav1.GetOptions{})
+	if err != nil || owner.UID != ref.UID {
+		ownerMarkerResults.WithLabelValues("error").Inc()
+		return ownerMarker{}, false
+	}
+
+	// owners without a marker are cached too so their pods don't look them up again
+	var marker ownerMarker
+	if value, ok := owner.Annotations[m.key]; ok {
+		if err := json.Unmarshal([]byte(value), &marker); err != nil {
+			marker = ownerMarker{}
+		}
+	}
+	m.store(ref.UID, marker)
+	return marker, true
+}
+
+// record writes the marker to the pod's owner in the background, unless the owner already has it
+func (m *ownerMarkers) record(namespace string, pod *corev1.Pod, marker ownerMarker, logger *log.Logger) {
+	ref, gvr, ok := podOwner(pod)
+	if !ok {
+		return
+	}
+	if cached, ok := m.cached(ref.UID); ok && cached == marker {
+		return
+	}
+	m.store(ref.UID, marker)
+
+	go func() {
+		value, err := json.Marshal(marker)
+		if err == nil {
+			var data []byte
+			data, err = json.Marshal(map[string]interface{}{
+				"metadata": map[string]interface{}{
+					"uid":         ref.UID,
+					"annotations": map[string]string{m.key: string(value)},
+				},
+			})
+			if err == nil {
+				ctx, cancel := context.WithTimeout(context.Background(), ownerMarkerTimeout)
+				defer cancel()
+				_, err = m.client.Resource(gvr).Namespace(namespace).Patch(ctx, ref.Name, types.MergePatchType, data, metav1.PatchOptions{})
+			}
+		}
+		if err != nil {
+			ownerMarkerResults.WithLabelValues("error").Inc()
+			logger.Printf("Can't record config %s on %s %s/%s: %v", marker.Config, ref.Kind, namespace, ref.Name, err)
+			m.forget(ref.UID)
+			return
+		}
+		ownerMarkerResults.WithLabelValues("recorded").Inc()
+	}()
+}
+
+func (m *ownerMarkers) cached(uid types.UID) (ownerMarker, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	marker, ok := m.cache[uid]
+	return marker, ok
+}
+
+func (m *ownerMarkers) store(uid types.UID, marker ownerMarker) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.cache[uid]; !ok && len(m.cache) >= ownerMarkerCacheSize {
+		for k := range m.cache {
+			delete(m.cache, k)
+			break
+		}
+	}
+	m.cache[uid] = marker
+}
+
+func (m *ownerMarkers) forget(uid types.UID) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.cache, uid)
+}
+
+// ownerConfig returns the config recorded on the pod's owner if it's still the config the server has
+func (whs *WebhookServer) ownerConfig(st *serverState, namespace string, pod *corev1.Pod) (string, bool) {
+	if whs.owners == nil {
+		return "", false
+	}
+	if _, _, ok := podOwner(pod); !ok {
+		return "", false
+	}
+	marker, ok := whs.owners.lookup(namespace, pod)
+	if !ok || marker.Config == "" {
+		ownerMarkerResults.WithLabelValues("miss").Inc()
+		return "", false
+	}
+	if hash, ok := st.configHashes[marker.Config]; !ok || hash != marker.Hash {
+		ownerMarkerResults.WithLabelValues("stale").Inc()
+		return "", false
+	}
+	ownerMarkerResults.WithLabelValues("hit").Inc()
+	return marker.Config, true
+}
+
+// recordOwnerConfig records the config the pod was injected with on its owner
+func (whs *WebhookServer) recordOwnerConfig(st *serverState, namespace string, pod *corev1.Pod, configName string) {
+	if whs.owners == nil {
+		return
+	}
+	hash, ok := st.configHashes[configName]
+	if !ok {
+		return
+	}
+	whs.owners.record(namespace, pod, ownerMarker{Config: configName, Hash: hash}, whs.warningLogger)
+}
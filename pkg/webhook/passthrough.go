@@ -0,0 +1,39 @@
+package webhook
+
+import (
+	admissionv1 "k8s.io/api/admission/v1"
+)
+
+var unexpectedAdmissions = newCounterVec("unexpected_admissions_total", "Admissions admitted untouched because they aren't for a pod, e.g. a subresource such as pods/eviction or pods/binding routed to the webhook by a too broad rule, by kind and subresource.", "kind", "subresource")
+
+// passthroughReason returns why the request isn't a pod the webhook can inject, or "" if it is. Only
+// pods themselves are injected: subresources such as pods/eviction, pods/binding or pods/status carry
+// other kinds, and deletes carry no object at all.
+func passthroughReason(req *admissionv1.AdmissionRequest) string {
+	switch {
+	case req.SubResource != "":
+		return "it's for the " + req.SubResource + " subresource"
+	case req.Kind.Group != "" || req.Kind.Kind != "Pod":
+		return "it's a " + admissionKind(req) + ", not a pod"
+	case len(req.Object.Raw) == 0:
+		return "it has no object"
+	}
+	return ""
+}
+
+// passthrough returns the response admitting a request the webhook doesn't inject untouched
+func (whs *WebhookServer) passthrough(req *admissionv1.AdmissionRequest, reason string) *admissionv1.AdmissionResponse {
+	unexpectedAdmissions.WithLabelValues(admissionKind(req), req.SubResource).Inc()
+	whs.infoLogger.Printf("Admitting %s %s/%s untouched, %s", req.Operation, req.Namespace, req.Name, reason)
+	return &admissionv1.AdmissionResponse{
+		Allowed: true,
+	}
+}
+
+// admissionKind formats the kind of the request's object, e.g. Pod or policy/Eviction
+func admissionKind(req *admissionv1.AdmissionRequest) string {
+	if req.Kind.Group == "" {
+		return req.Kind.Kind
+	}
+	return req.Kind.Group + "/" + req.Kind.Kind
+}
@@ -0,0 +1,104 @@
+package webhook
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/centml/simple-sidecar/pkg/patch"
+)
+
+// PatchEngine is how the patch sent to the API server is produced.
+type PatchEngine string
+
+const (
+	// PatchEngineOperations - the patch mutators generate the operations of the patch themselves, by
+	// index into the admitted pod, the default.
+	PatchEngineOperations PatchEngine = "operations"
+
+	// PatchEngineDiff - the patch mutators make their changes to a copy of the pod, and the patch sent is
+	// the diff between the admitted pod and the mutated one. Lists are patched at explicit indexes with
+	// only what changed, so there are no appends to lists the pod doesn't have.
+	PatchEngineDiff PatchEngine = "diff"
+)
+
+// ParsePatchEngine parses the name of a patch engine, operations if it's empty.
+func ParsePatchEngine(value string) (PatchEngine, error) {
+	switch engine := PatchEngine(value); engine {
+	case "":
+		return PatchEngineOperations, nil
+	case PatchEngineOperations, PatchEngineDiff:
+		return engine, nil
+	}
+	return "", fmt.Errorf("unknown patch engine %q, expected %s or %s", value, PatchEngineOperations, PatchEngineDiff)
+}
+
+// patchOperations returns the operations of the patch for the input, generated by the server's engine
+func (whs *WebhookServer) patchOperations(in *patchInput) ([]patchOperation, error) {
+	if whs.patchEngine == PatchEngineDiff {
+		return whs.diffPatch(in)
+	}
+	return whs.runPatchMutators(in), nil
+}
+
+// diffPatch runs the patch mutators over a copy of the pod without the containers the config removes and
+// returns the diff between the admitted pod and the result, followed by the config's JSON patches
+func (whs *WebhookServer) diffPatch(in *patchInput) ([]patchOperation, error) {
+	mutated := in.pod.DeepCopy()
+	for _, m := range patchMutators {
+		if m.mutate == nil {
+			continue
+		}
+		start := time.Now()
+		m.mutate(whs, in, mutated)
+		observeStage(m.name, start)
+	}
+
+	start := time.Now()
+	defer observeStage("diff", start)
+	original, err := json.Marshal(in.admitted)
+	if err != nil {
+		return nil, fmt.Errorf("could not encode pod: %v", err)
+	}
+	modified, err := json.Marshal(newDiffDocument(mutated, nativeSidecars(in.config)))
+	if err != nil {
+		return nil, fmt.Errorf("could not encode mutated pod: %v", err)
+	}
+	ops, err := patch.Diff(original, modified)
+	if err != nil {
+		return nil, fmt.Errorf("could not diff the mutated pod: %v", err)
+	}
+	return append(ops, in.config.jsonPatches...), nil
+}
+
+// diffDocument is the pod as it's diffed, with the restartPolicy of the native sidecars among its
+// initContainers
+type diffDocument struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+	Spec              diffSpec         `json:"spec,omitempty"`
+	Status            corev1.PodStatus `json:"status,omitempty"`
+}
+
+// diffSpec is the pod's spec with initContainers that can be native sidecars
+type diffSpec struct {
+	corev1.PodSpec
+	InitContainers []startupContainer `json:"initContainers,omitempty"`
+}
+
+// newDiffDocument returns the document of the pod, the initContainers named in sidecars are native
+// sidecars
+func newDiffDocument(pod *corev1.Pod, sidecars map[string]bool) diffDocument {
+	doc := diffDocument{TypeMeta: pod.TypeMeta, ObjectMeta: pod.ObjectMeta, Spec: diffSpec{PodSpec: pod.Spec}, Status: pod.Status}
+	for _, container := range pod.Spec.InitContainers {
+		c := startupContainer{Container: container}
+		if sidecars[container.Name] {
+			c.RestartPolicy = restartPolicyAlways
+		}
+		doc.Spec.InitContainers = append(doc.Spec.InitContainers, c)
+	}
+	return doc
+}
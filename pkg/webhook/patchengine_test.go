@@ -0,0 +1,172 @@
+package webhook
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"reflect"
+	"testing"
+
+	jsonpatch "github.com/evanphx/json-patch"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// engineConfigs exercise what the patch mutators do to existing lists: insert positions, native sidecars,
+// env conflicts and reordering, volumes if missing and removed containers
+const engineConfigs = `
+mesh:
+  initContainers:
+  - name: fetch
+    image: registry.example.com/fetch:1.0
+  containers:
+  - name: proxy
+    image: registry.example.com/proxy:1.0
+    nativeSidecar: true
+  - name: first
+    image: registry.example.com/first:1.0
+    insertPosition: first
+  - name: second
+    image: registry.example.com/second:1.0
+    insertPosition: 1
+  - name: last
+    image: registry.example.com/last:1.0
+  envVars:
+  - name: A
+    value: "1"
+  - name: B
+    value: "2"
+  volumeMounts:
+  - name: shared
+    mountPath: /shared
+  volumes:
+  - name: shared
+    emptyDir: {}
+  labels:
+    mesh: "on"
+  tolerations:
+  - key: gpu
+    operator: Exists
+  minTerminationGracePeriodSeconds: 60
+  shareProcessNamespace: true
+replace:
+  containers:
+  - name: side
+    image: registry.example.com/side:1.0
+  envVars:
+  - name: A
+    value: "9"
+  envConflictPolicy: override
+  reorderExistingEnv: true
+  volumesIfMissing:
+  - name: data
+    emptyDir: {}
+  - name: extra
+    emptyDir: {}
+  removeContainers: [old]
+`
+
+// enginePods are the pods the engines are compared on besides the benchmark fixtures
+func enginePods() []*corev1.Pod {
+	pod := func(containers ...corev1.Container) *corev1.Pod {
+		return &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        "app",
+				Namespace:   "default",
+				Annotations: map[string]string{"simple-sidecar.centml.ai/vault-role": "app"},
+			},
+			Spec: corev1.PodSpec{Containers: containers},
+		}
+	}
+	withEverything := pod(
+		corev1.Container{Name: "app"},
+		corev1.Container{Name: "web", Env: []corev1.EnvVar{{Name: "Z", Value: "z"}, {Name: "A", Value: "0"}}},
+		corev1.Container{Name: "db", VolumeMounts: []corev1.VolumeMount{{Name: "data", MountPath: "/data"}}},
+	)
+	withEverything.Labels = map[string]string{"app": "app"}
+	withEverything.Annotations["example.com/a"] = "b"
+	withEverything.Spec.Volumes = []corev1.Volume{{Name: "data"}}
+	return []*corev1.Pod{
+		pod(corev1.Container{Name: "app"}),
+		withEverything,
+		pod(corev1.Container{Name: "old"}, corev1.Container{Name: "app", Env: []corev1.EnvVar{{Name: "A", Value: "0"}}}),
+	}
+}
+
+// TestPatchEnginesInjectTheSamePod checks the diff engine's patch makes the same pod as the operations of
+// the patch mutators
+func TestPatchEnginesInjectTheSamePod(t *testing.T) {
+	configs, err := LoadConfigFromBytes([]byte(engineConfigs))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, config := range configFixtures {
+		configs[name] = config
+	}
+	pods := enginePods()
+	for _, fixture := range podFixtures {
+		pods = append(pods, fixture.pod(""))
+	}
+
+	discard := log.New(io.Discard, "", 0)
+	servers := map[PatchEngine]*WebhookServer{}
+	for _, engine := range []PatchEngine{PatchEngineOperations, PatchEngineDiff} {
+		servers[engine] = NewWebhookServer(&WebhookServerConfig{
+			SidecarConfigs: configs,
+			PatchEngine:    engine,
+			InfoLogger:     discard,
+			WarnLogger:     discard,
+			ErrorLogger:    discard,
+		})
+	}
+	for name := range configs {
+		for i, pod := range pods {
+			raw, err := json.Marshal(pod)
+			if err != nil {
+				t.Fatal(err)
+			}
+			injected := map[PatchEngine]interface{}{}
+			for engine, whs := range servers {
+				config := whs.state().sidecarConfigs[name]
+				patchBytes, err := whs.createPatch(pod, config, whs.injectionAnnotations(config, name))
+				if err != nil {
+					t.Fatalf("config %s, pod %d, %s engine: %v", name, i, engine, err)
+				}
+				p, err := jsonpatch.DecodePatch(patchBytes)
+				if err != nil {
+					t.Fatal(err)
+				}
+				patched, err := p.Apply(raw)
+				if err != nil {
+					t.Fatalf("config %s, pod %d, %s engine: applying %s: %v", name, i, engine, patchBytes, err)
+				}
+				var doc interface{}
+				if err := json.Unmarshal(patched, &doc); err != nil {
+					t.Fatal(err)
+				}
+				injected[engine] = doc
+			}
+			if !reflect.DeepEqual(injected[PatchEngineOperations], injected[PatchEngineDiff]) {
+				operations, _ := json.Marshal(injected[PatchEngineOperations])
+				diff, _ := json.Marshal(injected[PatchEngineDiff])
+				t.Errorf("config %s, pod %d: the engines inject different pods\noperations: %s\ndiff:       %s", name, i, operations, diff)
+			}
+		}
+	}
+}
+
+func TestParsePatchEngine(t *testing.T) {
+	tests := map[string]PatchEngine{
+		"":           PatchEngineOperations,
+		"operations": PatchEngineOperations,
+		"diff":       PatchEngineDiff,
+	}
+	for value, want := range tests {
+		if got, err := ParsePatchEngine(value); err != nil || got != want {
+			t.Errorf("ParsePatchEngine(%q) = %q, %v, want %q", value, got, err, want)
+		}
+	}
+	if _, err := ParsePatchEngine("merge"); err == nil {
+		t.Error("ParsePatchEngine(\"merge\") succeeded")
+	}
+}
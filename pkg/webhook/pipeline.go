@@ -0,0 +1,342 @@
+package webhook
+
+import (
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	// parallelPatchMinContainers is the number of containers and initContainers from which the patch
+	// stages run concurrently, below it the goroutines cost more than they save
+	parallelPatchMinContainers = 16
+)
+
+var mutatorDuration = newHistogramVec("mutator_duration_seconds", "Time spent in each stage of patch generation.", defaultBuckets, "stage")
+
+// configMutator transforms the config for a pod before any patch is generated, config mutators run in
+// order and each sees the result of the previous one
+type configMutator struct {
+	name   string
+	mutate func(whs *WebhookServer, pod *corev1.Pod, config Config) (Config, error)
+}
+
+// patchInput is everything the patch mutators read, they must not modify it
+type patchInput struct {
+	// admitted is the pod as it was admitted, pod is without the containers the config removes, which
+	// is what the operations after the removal patch
+	admitted    *corev1.Pod
+	pod         *corev1.Pod
+	config      Config
+	excluded    map[string]bool
+	annotations map[string]string
+}
+
+// patchMutator generates the operations for one part of the pod. Patch mutators are independent of each
+// other so they may run concurrently, their operations are always concatenated in chain order. mutate
+// makes the same change to the pod the diff engine builds, in chain order, it's nil for the mutators the
+// diff engine handles itself.
+type patchMutator struct {
+	name   string
+	patch  func(whs *WebhookServer, in *patchInput) []patchOperation
+	mutate func(whs *WebhookServer, in *patchInput, pod *corev1.Pod)
+}
+
+// configMutators render the config's templates, expand presets into plain containers and prepare the
+// config's env
+var configMutators = []configMutator{
+	{name: "templates", mutate: func(whs *WebhookServer, pod *corev1.Pod, config Config) (Config, error) {
+		return whs.renderTemplates(pod, config)
+	}},
+	{name: "files", mutate: func(whs *WebhookServer, pod *corev1.Pod, config Config) (Config, error) {
+		return whs.addFiles(pod, config)
+	}},
+	{name: "vault", mutate: func(_ *WebhookServer, pod *corev1.Pod, config Config) (Config, error) {
+		return expandVault(pod, config)
+	}},
+	{name: "otel-collector", mutate: func(_ *WebhookServer, pod *corev1.Pod, config Config) (Config, error) {
+		return expandOTelCollector(pod, config)
+	}},
+	{name: "sizing", mutate: func(_ *WebhookServer, pod *corev1.Pod, config Config) (Config, error) {
+		return sizeContainers(pod, config), nil
+	}},
+	{name: "topology", mutate: func(whs *WebhookServer, pod *corev1.Pod, config Config) (Config, error) {
+		return whs.addTopologyEnv(pod, config), nil
+	}},
+	{name: "downward-api", mutate: func(_ *WebhookServer, _ *corev1.Pod, config Config) (Config, error) {
+		return expandDownwardAPI(config), nil
+	}},
+	{name: "overrides", mutate: func(whs *WebhookServer, pod *corev1.Pod, config Config) (Config, error) {
+		return whs.applyOverrides(pod, config)
+	}},
+	{name: "startup", mutate: func(_ *WebhookServer, _ *corev1.Pod, config Config) (Config, error) {
+		return orderStartup(config)
+	}},
+	{name: "init-check", mutate: func(_ *WebhookServer, _ *corev1.Pod, config Config) (Config, error) {
+		return addInitCheck(config), nil
+	}},
+	{name: "env-order", mutate: func(_ *WebhookServer, _ *corev1.Pod, config Config) (Config, error) {
+		// injected vars referencing each other must be defined after the vars they reference
+		envVars, err := orderEnvVars(config.EnvVars)
+		config.EnvVars = envVars
+		return config, err
+	}},
+	{name: "env-conflicts", mutate: func(whs *WebhookServer, pod *corev1.Pod, config Config) (Config, error) {
+		return config, whs.checkEnvConflicts(pod, config)
+	}},
+	{name: "volume-conflicts", mutate: func(whs *WebhookServer, pod *corev1.Pod, config Config) (Config, error) {
+		return config, whs.checkVolumeConflicts(pod, config)
+	}},
+}
+
+// patchMutators generate the patch, the order is the order of the operations in the patch
+var patchMutators = []patchMutator{
+	// removals go first, by index into the pod as it was admitted. The diff engine starts from the pod
+	// without the removed containers.
+	{name: "remove-containers", patch: func(_ *WebhookServer, in *patchInput) []patchOperation {
+		return removeContainers(in.admitted, in.config.RemoveContainers)
+	}},
+	{name: "service-account-token", patch: func(_ *WebhookServer, in *patchInput) []patchOperation {
+		if !in.config.removesServiceAccountToken() {
+			return nil
+		}
+		return removeServiceAccountToken(in.pod)
+	}, mutate: func(_ *WebhookServer, in *patchInput, pod *corev1.Pod) {
+		if in.config.removesServiceAccountToken() {
+			stripServiceAccountToken(pod)
+		}
+	}},
+	{name: "automount-service-account-token", patch: func(_ *WebhookServer, in *patchInput) []patchOperation {
+		return setAutomountServiceAccountToken(in.pod, in.config.AutomountServiceAccountToken)
+	}, mutate: func(_ *WebhookServer, in *patchInput, pod *corev1.Pod) {
+		if automount := in.config.AutomountServiceAccountToken; automount != nil {
+			automount := *automount
+			pod.Spec.AutomountServiceAccountToken = &automount
+		}
+	}},
+	{name: "service-account", patch: func(_ *WebhookServer, in *patchInput) []patchOperation {
+		return setServiceAccount(in.pod, in.config)
+	}, mutate: func(_ *WebhookServer, in *patchInput, pod *corev1.Pod) {
+		if name, ok := serviceAccountFor(in.pod, in.config); ok {
+			pod.Spec.ServiceAccountName = name
+			if pod.Spec.DeprecatedServiceAccount != "" {
+				pod.Spec.DeprecatedServiceAccount = name
+			}
+		}
+	}},
+	{name: "volume-mounts", patch: func(whs *WebhookServer, in *patchInput) []patchOperation {
+		return whs.addVolumeMounts(in.pod, in.config.ExistingContainerConfig, in.excluded)
+	}, mutate: func(whs *WebhookServer, in *patchInput, pod *corev1.Pod) {
+		whs.mergeVolumeMounts(pod, in.config.ExistingContainerConfig, in.excluded)
+	}},
+	{name: "env", patch: func(whs *WebhookServer, in *patchInput) []patchOperation {
+		return whs.addEnvVars(in.pod, in.config.ExistingContainerConfig, in.excluded)
+	}, mutate: func(whs *WebhookServer, in *patchInput, pod *corev1.Pod) {
+		whs.mergeEnvVars(pod, in.config.ExistingContainerConfig, in.excluded)
+	}},
+	{name: "env-from", patch: func(whs *WebhookServer, in *patchInput) []patchOperation {
+		return whs.addEnvFrom(in.pod, in.config.EnvFrom, in.config.ApplyToInitContainers, in.excluded)
+	}, mutate: func(_ *WebhookServer, in *patchInput, pod *corev1.Pod) {
+		if len(in.config.EnvFrom) == 0 {
+			return
+		}
+		for _, container := range existingContainerRefs(pod, in.config.ApplyToInitContainers, in.excluded) {
+			container.EnvFrom = appendMissing(container.EnvFrom, in.config.EnvFrom)
+		}
+	}},
+	{name: "container-security-context", patch: func(whs *WebhookServer, in *patchInput) []patchOperation {
+		return whs.addContainerSecurityContext(in.pod, in.config.SecurityContext, in.excluded)
+	}, mutate: func(_ *WebhookServer, in *patchInput, pod *corev1.Pod) {
+		if in.config.SecurityContext == nil {
+			return
+		}
+		for _, container := range existingContainerRefs(pod, false, in.excluded) {
+			if container.SecurityContext == nil {
+				container.SecurityContext = in.config.SecurityContext.DeepCopy()
+			}
+		}
+	}},
+	{name: "default-resources", patch: func(whs *WebhookServer, in *patchInput) []patchOperation {
+		return whs.addDefaultResources(in.pod, in.config.DefaultResources, in.excluded)
+	}, mutate: func(_ *WebhookServer, in *patchInput, pod *corev1.Pod) {
+		if in.config.DefaultResources == nil {
+			return
+		}
+		for _, container := range existingContainerRefs(pod, false, in.excluded) {
+			container.Resources, _ = withDefaultResources(container.Resources, *in.config.DefaultResources)
+		}
+	}},
+	// the diff engine adds the restartPolicy of native sidecars when it encodes the pod
+	{name: "init-containers", patch: func(whs *WebhookServer, in *patchInput) []patchOperation {
+		return whs.addInitContainers(in.pod, in.config)
+	}, mutate: func(_ *WebhookServer, in *patchInput, pod *corev1.Pod) {
+		pod.Spec.InitContainers = append(pod.Spec.InitContainers, copyContainers(in.config.InitContainers)...)
+	}},
+	{name: "containers", patch: func(whs *WebhookServer, in *patchInput) []patchOperation {
+		if len(in.config.InsertPositions) > 0 {
+			return whs.insertContainers(in.pod.Spec.Containers, in.config.Containers, in.config.InsertPositions)
+		}
+		return whs.addContainer(in.pod.Spec.Containers, in.config.Containers, "/spec/containers")
+	}, mutate: func(_ *WebhookServer, in *patchInput, pod *corev1.Pod) {
+		pod.Spec.Containers = withInsertedContainers(pod.Spec.Containers, copyContainers(in.config.Containers), in.config.InsertPositions)
+	}},
+	{name: "volumes", patch: func(whs *WebhookServer, in *patchInput) []patchOperation {
+		volumes := append(append([]corev1.Volume{}, in.config.Volumes...), volumesIfMissing(in.pod.Spec.Volumes, in.config)...)
+		return whs.addVolumes(in.pod.Spec.Volumes, volumes, in.config.VolumeConflictPolicy)
+	}, mutate: func(_ *WebhookServer, in *patchInput, pod *corev1.Pod) {
+		volumes := append(append([]corev1.Volume{}, in.config.Volumes...), volumesIfMissing(pod.Spec.Volumes, in.config)...)
+		pod.Spec.Volumes = withVolumes(pod.Spec.Volumes, volumes, in.config.VolumeConflictPolicy)
+	}},
+	{name: "annotations", patch: func(whs *WebhookServer, in *patchInput) []patchOperation {
+		return whs.updateAnnotation(in.pod.Annotations, in.podAnnotations())
+	}, mutate: func(_ *WebhookServer, in *patchInput, pod *corev1.Pod) {
+		pod.Annotations = withEntries(pod.Annotations, in.podAnnotations())
+	}},
+	{name: "tolerations", patch: func(whs *WebhookServer, in *patchInput) []patchOperation {
+		return whs.addTolerations(in.pod.Spec.Tolerations, in.config.Tolerations)
+	}, mutate: func(_ *WebhookServer, in *patchInput, pod *corev1.Pod) {
+		for _, toleration := range in.config.Tolerations {
+			if !hasToleration(pod.Spec.Tolerations, toleration) {
+				pod.Spec.Tolerations = append(pod.Spec.Tolerations, toleration)
+			}
+		}
+	}},
+	{name: "affinity", patch: func(whs *WebhookServer, in *patchInput) []patchOperation {
+		return whs.addAffinity(in.pod.Spec.Affinity, in.config.Affinity)
+	}, mutate: func(_ *WebhookServer, in *patchInput, pod *corev1.Pod) {
+		switch {
+		case in.config.Affinity == nil:
+		case pod.Spec.Affinity == nil:
+			pod.Spec.Affinity = in.config.Affinity.DeepCopy()
+		default:
+			pod.Spec.Affinity = mergeAffinity(pod.Spec.Affinity, in.config.Affinity)
+		}
+	}},
+	{name: "security-context", patch: func(whs *WebhookServer, in *patchInput) []patchOperation {
+		return whs.addPodSecurityContext(in.pod.Spec.SecurityContext, in.config.PodSecurityContext)
+	}, mutate: func(_ *WebhookServer, in *patchInput, pod *corev1.Pod) {
+		switch {
+		case in.config.PodSecurityContext == nil:
+		case pod.Spec.SecurityContext == nil:
+			pod.Spec.SecurityContext = in.config.PodSecurityContext.DeepCopy()
+		default:
+			pod.Spec.SecurityContext = mergePodSecurityContext(pod.Spec.SecurityContext, in.config.PodSecurityContext)
+		}
+	}},
+	{name: "share-process-namespace", patch: func(whs *WebhookServer, in *patchInput) []patchOperation {
+		return whs.setShareProcessNamespace(in.pod, in.config.ShareProcessNamespace)
+	}, mutate: func(_ *WebhookServer, in *patchInput, pod *corev1.Pod) {
+		if share := in.config.ShareProcessNamespace; share != nil {
+			share := *share
+			pod.Spec.ShareProcessNamespace = &share
+		}
+	}},
+	{name: "termination-grace-period", patch: func(whs *WebhookServer, in *patchInput) []patchOperation {
+		return whs.extendTerminationGracePeriod(in.pod, in.config.MinTerminationGracePeriodSeconds)
+	}, mutate: func(_ *WebhookServer, in *patchInput, pod *corev1.Pod) {
+		if period := in.config.MinTerminationGracePeriodSeconds; extendsGracePeriod(pod, period) {
+			pod.Spec.TerminationGracePeriodSeconds = &period
+		}
+	}},
+	{name: "labels", patch: func(whs *WebhookServer, in *patchInput) []patchOperation {
+		return whs.addLabels(in.pod.Labels, in.config.Labels)
+	}, mutate: func(_ *WebhookServer, in *patchInput, pod *corev1.Pod) {
+		pod.Labels = withEntries(pod.Labels, in.config.Labels)
+	}},
+	// the diff engine appends the config's JSON patches to the diff, they're written against the pod
+	// the webhook's operations leave
+	{name: "json-patches", patch: func(_ *WebhookServer, in *patchInput) []patchOperation {
+		return in.config.jsonPatches
+	}},
+}
+
+// podAnnotations returns the annotations the patch sets on the pod: the config's file annotations and the
+// injection annotations
+func (in *patchInput) podAnnotations() map[string]string {
+	if len(in.config.fileAnnotations) == 0 {
+		return in.annotations
+	}
+	annotations := make(map[string]string, len(in.annotations)+len(in.config.fileAnnotations))
+	for k, v := range in.config.fileAnnotations {
+		annotations[k] = v
+	}
+	for k, v := range in.annotations {
+		annotations[k] = v
+	}
+	return annotations
+}
+
+// withEntries returns the map with the added entries set, it's created if it's nil and there are any
+func withEntries(m, added map[string]string) map[string]string {
+	if len(added) == 0 {
+		return m
+	}
+	if m == nil {
+		m = make(map[string]string, len(added))
+	}
+	for k, v := range added {
+		m[k] = v
+	}
+	return m
+}
+
+// copyContainers returns deep copies of the containers, so the pod built doesn't share the config's
+func copyContainers(containers []corev1.Container) []corev1.Container {
+	copied := make([]corev1.Container, len(containers))
+	for i := range containers {
+		containers[i].DeepCopyInto(&copied[i])
+	}
+	return copied
+}
+
+// observeStage records how long a stage took since start
+func observeStage(name string, start time.Time) {
+	mutatorDuration.WithLabelValues(name).Observe(time.Since(start).Seconds())
+}
+
+// mutateConfig runs the config mutators over the config
+func (whs *WebhookServer) mutateConfig(pod *corev1.Pod, config Config) (Config, error) {
+	for _, m := range configMutators {
+		start := time.Now()
+		var err error
+		config, err = m.mutate(whs, pod, config)
+		observeStage(m.name, start)
+		if err != nil {
+			return config, err
+		}
+	}
+	return config, nil
+}
+
+// runPatchMutators runs the patch mutators, concurrently for large pods, and concatenates their operations
+func (whs *WebhookServer) runPatchMutators(in *patchInput) []patchOperation {
+	results := make([][]patchOperation, len(patchMutators))
+	run := func(i int) {
+		start := time.Now()
+		results[i] = patchMutators[i].patch(whs, in)
+		observeStage(patchMutators[i].name, start)
+	}
+
+	if len(in.pod.Spec.Containers)+len(in.pod.Spec.InitContainers) >= parallelPatchMinContainers {
+		var wg sync.WaitGroup
+		for i := range patchMutators {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				run(i)
+			}(i)
+		}
+		wg.Wait()
+	} else {
+		for i := range patchMutators {
+			run(i)
+		}
+	}
+
+	var patch []patchOperation
+	for _, ops := range results {
+		patch = append(patch, ops...)
+	}
+	return patch
+}
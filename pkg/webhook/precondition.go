@@ -0,0 +1,114 @@
+package webhook
+
+import (
+	"fmt"
+	"strings"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+const (
+	unmetSkip = "skip"
+	unmetDeny = "deny"
+)
+
+var unmetPreconditions = newCounterVec("unmet_preconditions_total", "Pods requesting a config whose preconditions they don't meet by config and the action taken (skip or deny).", "config", "action")
+
+// PreconditionsConfig is what a pod must look like for the config's sidecars to work in it, e.g. a
+// proxy that needs a container named app. Unlike the scope, preconditions describe the pod rather than
+// who may use the config.
+type PreconditionsConfig struct {
+	// Labels - label keys the pod must have.
+	Labels []string
+
+	// Containers - names of containers the pod must have.
+	Containers []string
+
+	// HostNetwork - when set, whether the pod must use the host network, false rejects pods that do.
+	HostNetwork *bool
+
+	// Unmet - what happens to a pod that doesn't meet the preconditions: deny (the default) rejects it,
+	// skip admits it without injection. Pods in enforced namespaces are always denied.
+	Unmet string
+}
+
+// validatePreconditions checks the label keys, container names and action of the preconditions
+func (c Config) validatePreconditions() error {
+	p := c.Preconditions
+	if p == nil {
+		return nil
+	}
+	for i, key := range p.Labels {
+		if errs := validation.IsQualifiedName(key); len(errs) > 0 {
+			return fmt.Errorf("preconditions.labels[%d]: %s", i, strings.Join(errs, ", "))
+		}
+	}
+	for i, name := range p.Containers {
+		if errs := validation.IsDNS1123Label(name); len(errs) > 0 {
+			return fmt.Errorf("preconditions.containers[%d]: %s", i, strings.Join(errs, ", "))
+		}
+	}
+	switch p.Unmet {
+	case "", unmetSkip, unmetDeny:
+		return nil
+	}
+	return fmt.Errorf("preconditions.unmet must be %q or %q, got %q", unmetSkip, unmetDeny, p.Unmet)
+}
+
+// unmet returns every precondition the pod doesn't meet, empty if it meets them all
+func (p *PreconditionsConfig) unmet(pod *corev1.Pod) []string {
+	if p == nil {
+		return nil
+	}
+	var unmet []string
+	for _, key := range p.Labels {
+		if _, ok := pod.Labels[key]; !ok {
+			unmet = append(unmet, fmt.Sprintf("label %s is missing", key))
+		}
+	}
+	containers := map[string]bool{}
+	for _, container := range pod.Spec.Containers {
+		containers[container.Name] = true
+	}
+	for _, name := range p.Containers {
+		if !containers[name] {
+			unmet = append(unmet, fmt.Sprintf("container %s is missing", name))
+		}
+	}
+	if p.HostNetwork != nil && pod.Spec.HostNetwork != *p.HostNetwork {
+		if pod.Spec.HostNetwork {
+			unmet = append(unmet, "the pod uses the host network")
+		} else {
+			unmet = append(unmet, "the pod doesn't use the host network")
+		}
+	}
+	return unmet
+}
+
+// preconditionsUnmet responds to a pod that doesn't meet the preconditions of its config. Configs with
+// unmet: skip admit the pod without injection unless the namespace enforces injection, everything else is
+// denied.
+func (whs *WebhookServer) preconditionsUnmet(config Config, configName string, enforced *EnforcedNamespace, namespace, pod string, unmet []string) *admissionv1.AdmissionResponse {
+	reason := fmt.Sprintf("pod doesn't meet the preconditions of simple-sidecar config %q: %s", configName, strings.Join(unmet, ", "))
+	if config.Preconditions.Unmet == unmetSkip {
+		if enforced != nil {
+			unmetPreconditions.WithLabelValues(configName, unmetDeny).Inc()
+			return whs.denyUninjected(enforced, namespace, pod, reason)
+		}
+		unmetPreconditions.WithLabelValues(configName, unmetSkip).Inc()
+		whs.infoLogger.Printf("Skipping mutation for %s, %s", pod, reason)
+		return &admissionv1.AdmissionResponse{
+			Allowed: true,
+		}
+	}
+	unmetPreconditions.WithLabelValues(configName, unmetDeny).Inc()
+	whs.warningLogger.Printf("Denying %s, %s", pod, reason)
+	return &admissionv1.AdmissionResponse{
+		Result: &metav1.Status{
+			Message: reason,
+		},
+	}
+}
@@ -0,0 +1,145 @@
+package webhook
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"reflect"
+	"sort"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// configProfilesKey is the top-level key of a config file holding its profiles, it can't name a config
+const configProfilesKey = "profiles"
+
+// ConfigProfile changes a config in one environment, e.g. the image tags and resources of prod. It's
+// written under profiles.<profile>.<config> and applied to the config when the profile is selected.
+type ConfigProfile struct {
+	// Containers - changes to the config's containers and initContainers, matched by name.
+	Containers []ContainerOverride
+
+	// EnvVars - env vars replacing the config's envVars with the same name or added to them.
+	EnvVars []corev1.EnvVar
+}
+
+// configProfiles are the profiles of a config file by profile and config name
+type configProfiles map[string]map[string]ConfigProfile
+
+// decodeConfigProfiles returns the profiles section of the config file, nil if it has none
+func decodeConfigProfiles(data []byte) (configProfiles, error) {
+	doc, ok := decodeConfigFile(data)
+	if !ok {
+		return nil, nil
+	}
+	section, ok := doc[configProfilesKey]
+	if !ok {
+		return nil, nil
+	}
+	raw, err := json.Marshal(section)
+	if err != nil {
+		return nil, err
+	}
+	var profiles configProfiles
+	if err := json.Unmarshal(raw, &profiles); err != nil {
+		return nil, fmt.Errorf("%s: must be a map of profiles to configs: %v", configProfilesKey, err)
+	}
+	return profiles, nil
+}
+
+// checkUnknownProfileFields returns an error with the profile, config and path of the first field of the
+// decoded profiles section that doesn't exist
+func checkUnknownProfileFields(value interface{}) error {
+	section, ok := value.(map[string]interface{})
+	if !ok {
+		// decoding the profiles reports the error
+		return nil
+	}
+	for _, profile := range sortedKeys(section) {
+		configs, ok := section[profile].(map[string]interface{})
+		if !ok {
+			continue
+		}
+		for _, name := range sortedKeys(configs) {
+			if err := checkUnknownFields(configs[name], reflect.TypeOf(ConfigProfile{})); err != nil {
+				return fmt.Errorf("%s.%s.%s: %v", configProfilesKey, profile, name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// sortedKeys returns the keys of the map in order
+func sortedKeys[K ~string, V any](m map[K]V) []K {
+	keys := make([]K, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+	return keys
+}
+
+// expandEnv expands the environment references of every profile
+func (p configProfiles) expandEnv(lookup func(string) (string, bool)) error {
+	for _, profile := range sortedKeys(p) {
+		for _, name := range sortedKeys(p[profile]) {
+			config := p[profile][name]
+			err := rewriteStrings(reflect.ValueOf(&config).Elem(), "", func(s string) (string, error) {
+				return expandEnv(s, lookup)
+			})
+			if err != nil {
+				return fmt.Errorf("%s.%s.%s: %v", configProfilesKey, profile, name, err)
+			}
+			p[profile][name] = config
+		}
+	}
+	return nil
+}
+
+// validate returns an error for the first profile changing a config or container that doesn't exist.
+// Every profile is checked, not only the selected one, so a mistake in prod's shows up in dev already.
+func (p configProfiles) validate(configs MultiConfig) error {
+	for _, profile := range sortedKeys(p) {
+		for _, name := range sortedKeys(p[profile]) {
+			config, ok := configs[name]
+			if !ok {
+				return fmt.Errorf("%s.%s: config %s doesn't exist", configProfilesKey, profile, name)
+			}
+			containers := map[string]bool{}
+			for _, container := range append(append([]corev1.Container{}, config.InitContainers...), config.Containers...) {
+				containers[container.Name] = true
+			}
+			for i, co := range p[profile][name].Containers {
+				if !containers[co.Name] {
+					return fmt.Errorf("%s.%s.%s.containers[%d]: container %q isn't injected by the config", configProfilesKey, profile, name, i, co.Name)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// apply changes the configs as the selected profile says. No profile, or one the file doesn't have,
+// leaves them as they are.
+func (p configProfiles) apply(configs MultiConfig, selected string, logger *log.Logger) {
+	if selected == "" {
+		return
+	}
+	if logger == nil {
+		logger = log.Default()
+	}
+	profile, ok := p[selected]
+	if !ok {
+		if len(p) > 0 {
+			logger.Printf("Config profile %s isn't defined, the configs are used as they are", selected)
+		}
+		return
+	}
+	for _, name := range sortedKeys(profile) {
+		configs[name] = configs[name].applyOverride(NamespaceOverride{
+			Containers: profile[name].Containers,
+			EnvVars:    profile[name].EnvVars,
+		})
+	}
+	logger.Printf("Applied config profile %s to %d configs", selected, len(profile))
+}
@@ -0,0 +1,134 @@
+package webhook
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// configReloadDelay is how long the config file has to be quiet before it's reloaded, editors and
+// ConfigMap updates change several files in a row
+const configReloadDelay = 200 * time.Millisecond
+
+var configReloads = newCounterVec("config_reloads_total", "Reloads of the sidecar config file by result (success or failure).", "result")
+
+// watchConfig reloads the configs from file whenever it or, for a config list, any of its files changes
+// until stop is closed. The files a config file includes when it's watched are watched too.
+func (whs *WebhookServer) watchConfig(file string, stop <-chan struct{}) error {
+	for _, path := range configPaths(file) {
+		if err := whs.watchConfigPath(path, file, stop); err != nil {
+			return err
+		}
+		for _, included := range includedConfigFiles(path, whs.configLoad) {
+			if err := whs.watchConfigPath(included, file, stop); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// watchConfigPath reloads the configs from file whenever path changes until stop is closed. The directory
+// is watched rather than the file so ConfigMap updates, which swap the ..data symlink, are seen too. When
+// path is a config directory any change in it reloads the configs.
+func (whs *WebhookServer) watchConfigPath(path, file string, stop <-chan struct{}) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	dir := filepath.Dir(path)
+	if info.IsDir() {
+		dir = path
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	if err := watcher.Add(dir); err != nil {
+		watcher.Close()
+		return err
+	}
+
+	go func() {
+		defer watcher.Close()
+		target, _ := filepath.EvalSymlinks(path)
+		var reload <-chan time.Time
+		for {
+			select {
+			case <-stop:
+				return
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				// the file itself changed or the symlinks leading to it now point somewhere else
+				current, _ := filepath.EvalSymlinks(path)
+				if info.IsDir() || filepath.Clean(event.Name) == filepath.Clean(path) || current != target {
+					target = current
+					reload = time.After(configReloadDelay)
+				}
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				whs.warningLogger.Printf("Config watcher error: %v", err)
+			case <-reload:
+				reload = nil
+				// failures are logged by reloadConfig
+				_ = whs.reloadConfig(file)
+			}
+		}
+	}()
+	return nil
+}
+
+// ReloadConfig reloads the configs from the file they were loaded from, e.g. on SIGHUP. Invalid configs
+// are rejected and the current ones are kept.
+func (whs *WebhookServer) ReloadConfig() error {
+	if whs.configFile == "" {
+		return fmt.Errorf("the configs weren't loaded from a file")
+	}
+	return whs.reloadConfig(whs.configFile)
+}
+
+// reloadConfig loads and validates the configs in file and swaps them in, admissions in flight finish
+// with the configs they started with. Invalid configs are logged and the current ones are kept.
+func (whs *WebhookServer) reloadConfig(file string) error {
+	configs, err := loadConfig(file, whs.configLoad)
+	if err == nil {
+		err = checkConfigTests(configs)
+	}
+	if err == nil {
+		err = whs.required.check(configs)
+	}
+	if err != nil {
+		configReloads.WithLabelValues("failure").Inc()
+		whs.errorLogger.Printf("Can't reload %s, keeping the current configs: %v", file, err)
+		return err
+	}
+
+	whs.UpdateConfigs(configs)
+	configReloads.WithLabelValues("success").Inc()
+	whs.infoLogger.Printf("Reloaded %d configs from %s", len(configs), file)
+	whs.logConfigReports()
+	return nil
+}
+
+// checkConfigTests runs the tests declared by the configs and returns an error listing the failed ones
+func checkConfigTests(configs MultiConfig) error {
+	var failed []string
+	for _, result := range RunConfigTests(configs) {
+		if !result.Passed() {
+			failed = append(failed, fmt.Sprintf("%s/%s: %s", result.Config, result.Test, strings.Join(result.Errors, ", ")))
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("config tests failed: %s", strings.Join(failed, "; "))
+	}
+	return nil
+}
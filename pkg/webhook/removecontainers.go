@@ -0,0 +1,93 @@
+package webhook
+
+import (
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/centml/simple-sidecar/pkg/patch"
+)
+
+// removeContainers returns the operations removing the pod's containers and initContainers named in
+// removed, and the volumes only they mount
+func removeContainers(pod *corev1.Pod, removed []string) []patchOperation {
+	if len(removed) == 0 {
+		return nil
+	}
+	var ops []patchOperation
+	for _, list := range []struct {
+		path       string
+		containers []corev1.Container
+	}{{"/spec/initContainers", pod.Spec.InitContainers}, {"/spec/containers", pod.Spec.Containers}} {
+		var indexes []int
+		for i, container := range list.containers {
+			if contains(removed, container.Name) {
+				indexes = append(indexes, i)
+			}
+		}
+		ops = append(ops, patch.RemoveFromList(list.path, indexes)...)
+	}
+
+	exclusive := exclusiveVolumes(pod, removed)
+	var indexes []int
+	for i, volume := range pod.Spec.Volumes {
+		if exclusive[volume.Name] {
+			indexes = append(indexes, i)
+		}
+	}
+	return append(ops, patch.RemoveFromList("/spec/volumes", indexes)...)
+}
+
+// withoutContainers returns a copy of the pod without the containers and initContainers named in removed
+// and the volumes only they mount, the pod the removal operations leave
+func withoutContainers(pod *corev1.Pod, removed []string) *corev1.Pod {
+	if len(removed) == 0 {
+		return pod
+	}
+	names := map[string]bool{}
+	for _, name := range removed {
+		names[name] = true
+	}
+	stripped := pod.DeepCopy()
+	stripped.Spec.InitContainers = removeByKey(stripped.Spec.InitContainers, names, func(c corev1.Container) string { return c.Name })
+	stripped.Spec.Containers = removeByKey(stripped.Spec.Containers, names, func(c corev1.Container) string { return c.Name })
+	stripped.Spec.Volumes = removeByKey(stripped.Spec.Volumes, exclusiveVolumes(pod, removed), func(v corev1.Volume) string { return v.Name })
+	return stripped
+}
+
+// exclusiveVolumes returns the names of the volumes mounted by the removed containers and by none of the
+// containers that are kept
+func exclusiveVolumes(pod *corev1.Pod, removed []string) map[string]bool {
+	mounted := map[string]bool{}
+	kept := map[string]bool{}
+	for _, container := range append(append([]corev1.Container{}, pod.Spec.InitContainers...), pod.Spec.Containers...) {
+		for _, vm := range container.VolumeMounts {
+			if contains(removed, container.Name) {
+				mounted[vm.Name] = true
+			} else {
+				kept[vm.Name] = true
+			}
+		}
+		for _, device := range container.VolumeDevices {
+			if !contains(removed, container.Name) {
+				kept[device.Name] = true
+			}
+		}
+	}
+	exclusive := map[string]bool{}
+	for name := range mounted {
+		if !kept[name] {
+			exclusive[name] = true
+		}
+	}
+	return exclusive
+}
+
+// removeByKey returns the entries of list whose key isn't in removed, nil if none is left
+func removeByKey[T any](list []T, removed map[string]bool, key func(T) string) []T {
+	var kept []T
+	for _, entry := range list {
+		if !removed[key(entry)] {
+			kept = append(kept, entry)
+		}
+	}
+	return kept
+}
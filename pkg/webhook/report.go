@@ -0,0 +1,153 @@
+package webhook
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// ConfigReport is a summary of a single named Config, used to spot obviously wrong configs before
+// the first pod is mutated.
+type ConfigReport struct {
+	Tenant         string        `json:"tenant"`
+	Name           string        `json:"name"`
+	Hash           string        `json:"hash,omitempty"`
+	Aliases        []string      `json:"aliases,omitempty"`
+	InitContainers int           `json:"initContainers"`
+	Containers     int           `json:"containers"`
+	Volumes        int           `json:"volumes"`
+	VolumeMounts   int           `json:"volumeMounts"`
+	EnvVars        int           `json:"envVars"`
+	Presets        []string      `json:"presets,omitempty"`
+	Privileged     []string      `json:"privileged,omitempty"`
+	Images         []ImageReport `json:"images,omitempty"`
+	Warnings       []string      `json:"warnings,omitempty"`
+}
+
+// ImageReport is an image referenced by a Config and the registry it's pulled from.
+type ImageReport struct {
+	Container string `json:"container"`
+	Image     string `json:"image"`
+	Registry  string `json:"registry"`
+}
+
+// BuildConfigReports returns a report for each config, ordered by name.
+func BuildConfigReports(configs MultiConfig) []ConfigReport {
+	names := make([]string, 0, len(configs))
+	for name := range configs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	reports := make([]ConfigReport, 0, len(names))
+	for _, name := range names {
+		reports = append(reports, buildConfigReport(name, configs[name]))
+	}
+	return reports
+}
+
+// buildConfigReport summarises a single config
+func buildConfigReport(name string, config Config) ConfigReport {
+	report := ConfigReport{
+		Name:           name,
+		InitContainers: len(config.InitContainers),
+		Containers:     len(config.Containers),
+		Volumes:        len(config.Volumes),
+		VolumeMounts:   len(config.VolumeMounts),
+		EnvVars:        len(config.EnvVars),
+		Aliases:        config.Aliases,
+	}
+	if hash, err := configHash(config); err == nil {
+		report.Hash = hash
+	}
+	if config.Vault != nil {
+		report.Presets = append(report.Presets, "vault")
+	}
+	if config.OTelCollector != nil {
+		report.Presets = append(report.Presets, "otelCollector")
+	}
+
+	volumes := map[string]bool{}
+	for _, v := range append(append([]corev1.Volume{}, config.Volumes...), config.VolumesIfMissing...) {
+		volumes[v.Name] = true
+	}
+
+	seen := map[string]bool{}
+	containers := append(append([]corev1.Container{}, config.InitContainers...), config.Containers...)
+	for _, c := range containers {
+		if c.Name == "" {
+			report.Warnings = append(report.Warnings, "container without a name")
+		} else if seen[c.Name] {
+			report.Warnings = append(report.Warnings, fmt.Sprintf("duplicate container name %q", c.Name))
+		}
+		seen[c.Name] = true
+
+		if c.Image == "" {
+			report.Warnings = append(report.Warnings, fmt.Sprintf("container %q has no image", c.Name))
+		} else {
+			report.Images = append(report.Images, ImageReport{Container: c.Name, Image: c.Image, Registry: imageRegistry(c.Image)})
+			if !strings.Contains(c.Image, "@") && (imageTag(c.Image) == "" || imageTag(c.Image) == "latest") {
+				report.Warnings = append(report.Warnings, fmt.Sprintf("container %q uses a floating image %q", c.Name, c.Image))
+			}
+		}
+
+		if sc := c.SecurityContext; sc != nil {
+			if sc.Privileged != nil && *sc.Privileged {
+				report.Privileged = append(report.Privileged, fmt.Sprintf("container %q is privileged", c.Name))
+			}
+			if sc.Capabilities != nil && len(sc.Capabilities.Add) > 0 {
+				report.Privileged = append(report.Privileged, fmt.Sprintf("container %q adds capabilities %v", c.Name, sc.Capabilities.Add))
+			}
+			if sc.RunAsUser != nil && *sc.RunAsUser == 0 {
+				report.Privileged = append(report.Privileged, fmt.Sprintf("container %q runs as root", c.Name))
+			}
+		}
+
+		for _, vm := range c.VolumeMounts {
+			if !volumes[vm.Name] {
+				report.Warnings = append(report.Warnings, fmt.Sprintf("container %q mounts volume %q which the config doesn't declare", c.Name, vm.Name))
+			}
+		}
+	}
+
+	for _, v := range config.Volumes {
+		if v.HostPath != nil {
+			report.Privileged = append(report.Privileged, fmt.Sprintf("volume %q mounts host path %q", v.Name, v.HostPath.Path))
+		}
+	}
+	for _, vm := range config.VolumeMounts {
+		if !volumes[vm.Name] {
+			report.Warnings = append(report.Warnings, fmt.Sprintf("volumeMount %q references a volume the config doesn't declare", vm.Name))
+		}
+	}
+
+	if len(containers) == 0 && len(config.Volumes) == 0 && len(config.VolumeMounts) == 0 && len(config.EnvVars) == 0 && len(report.Presets) == 0 {
+		report.Warnings = append(report.Warnings, "config injects nothing")
+	}
+	return report
+}
+
+// imageRegistry returns the registry host of an image reference, defaulting to docker.io
+func imageRegistry(image string) string {
+	i := strings.Index(image, "/")
+	if i < 0 {
+		return "docker.io"
+	}
+	host := image[:i]
+	if strings.ContainsAny(host, ".:") || host == "localhost" {
+		return host
+	}
+	return "docker.io"
+}
+
+// imageTag returns the tag of an image reference, or an empty string if it has none
+func imageTag(image string) string {
+	image = strings.SplitN(image, "@", 2)[0]
+	i := strings.LastIndex(image, ":")
+	if i < 0 || strings.Contains(image[i:], "/") {
+		return ""
+	}
+	return image[i+1:]
+}
@@ -0,0 +1,46 @@
+package webhook
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// ConfigRequirement makes the server refuse to run without its configs, so a bad rollout of a config file or
+// ConfigMap can't leave a webhook that silently injects nothing.
+type ConfigRequirement struct {
+	// Names - the configs that must exist, any config will do if empty.
+	Names []string
+}
+
+// ParseRequiredConfigs parses a comma separated list of config names, e.g. vault,otel.
+func ParseRequiredConfigs(s string) []string {
+	var names []string
+	for _, name := range strings.Split(s, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// check returns an error if the configs don't meet the requirement, a nil requirement is always met
+func (r *ConfigRequirement) check(configs MultiConfig) error {
+	if r == nil {
+		return nil
+	}
+	if len(configs) == 0 {
+		return fmt.Errorf("there are no configs but configs are required, see REQUIRE_CONFIG")
+	}
+	var missing []string
+	for _, name := range r.Names {
+		if _, ok := configs[name]; !ok {
+			missing = append(missing, name)
+		}
+	}
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		return fmt.Errorf("required configs %s are missing, see REQUIRED_CONFIGS", strings.Join(missing, ", "))
+	}
+	return nil
+}
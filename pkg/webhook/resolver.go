@@ -0,0 +1,62 @@
+package webhook
+
+import (
+	corev1 "k8s.io/api/core/v1"
+)
+
+// defaultConfigName is the reserved config injected when the inject annotation is empty or "true",
+// istio-style opt-in
+const defaultConfigName = "default"
+
+// Resolver selects the config to inject into a pod. The default resolver reads the inject annotation,
+// embedders can replace it, e.g. to look configs up in an external service. Pods that are already
+// injected or in ignored namespaces never reach the resolver. Implementations must be safe for
+// concurrent use.
+type Resolver interface {
+	// Resolve returns the name of the config requested for the pod and whether injection was requested
+	// at all. An error denies the pod.
+	Resolve(namespace string, pod *corev1.Pod) (config string, ok bool, err error)
+}
+
+// PolicyDenial is returned by resolvers that deny a pod by policy rather than failing to resolve its
+// config, the pod is denied with Message.
+type PolicyDenial struct {
+	Message string
+}
+
+func (d *PolicyDenial) Error() string {
+	return d.Message
+}
+
+// AnnotationResolver selects the config named by the first of Keys present on the pod, the default config
+// when its value is empty or "true" and none when it's "false" or "disabled". Listing legacy annotation
+// keys after the current one keeps old workloads injected during a migration.
+type AnnotationResolver struct {
+	// Keys - the annotation keys holding the config name, in order of precedence.
+	Keys []string
+}
+
+// Resolve returns the value of the first annotation key present on the pod.
+func (r AnnotationResolver) Resolve(namespace string, pod *corev1.Pod) (string, bool, error) {
+	annotations := pod.GetAnnotations()
+	for _, key := range r.Keys {
+		if config, ok := annotations[key]; ok {
+			if config == "" || config == "true" {
+				config = defaultConfigName
+			}
+			if injectionDisabled(config) {
+				return "", false, nil
+			}
+			return config, true, nil
+		}
+	}
+	return "", false, nil
+}
+
+// resolver returns the server's resolver, the inject annotation unless one was configured
+func (whs *WebhookServer) resolver() Resolver {
+	if whs.configResolver != nil {
+		return whs.configResolver
+	}
+	return AnnotationResolver{Keys: []string{whs.annotations.inject}}
+}
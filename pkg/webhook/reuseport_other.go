@@ -0,0 +1,10 @@
+//go:build !(linux || darwin || dragonfly || freebsd || netbsd || openbsd)
+
+package webhook
+
+import "fmt"
+
+// setReusePort fails, SO_REUSEPORT isn't available on this platform
+func setReusePort(fd uintptr) error {
+	return fmt.Errorf("SO_REUSEPORT is not supported on this platform")
+}
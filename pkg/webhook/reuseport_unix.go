@@ -0,0 +1,10 @@
+//go:build linux || darwin || dragonfly || freebsd || netbsd || openbsd
+
+package webhook
+
+import "golang.org/x/sys/unix"
+
+// setReusePort sets SO_REUSEPORT on the socket
+func setReusePort(fd uintptr) error {
+	return unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+}
@@ -0,0 +1,137 @@
+package webhook
+
+import (
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/centml/simple-sidecar/pkg/patch"
+)
+
+const (
+	// serviceAccountTokenPath is where the ServiceAccount admission plugin mounts the token
+	serviceAccountTokenPath = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+	// defaultServiceAccount is the service account the ServiceAccount admission plugin sets on pods that
+	// don't name one
+	defaultServiceAccount = "default"
+)
+
+// removeServiceAccountToken returns the operations removing the auto-mounted service account token: every
+// volume mounted at the token path and every mount of those volumes in the pod's containers, e.g. when the
+// injected credential sidecar replaces it. The pod is left as it is if the token isn't mounted.
+func removeServiceAccountToken(pod *corev1.Pod) []patchOperation {
+	tokenVolumes := serviceAccountTokenVolumes(pod)
+	if len(tokenVolumes) == 0 {
+		return nil
+	}
+
+	var ops []patchOperation
+	removeMounts := func(containers []corev1.Container, basePath string) {
+		for i, container := range containers {
+			var indexes []int
+			for j, mount := range container.VolumeMounts {
+				if tokenVolumes[mount.Name] {
+					indexes = append(indexes, j)
+				}
+			}
+			ops = append(ops, patch.RemoveFromList(fmt.Sprintf("%s/%d/volumeMounts", basePath, i), indexes)...)
+		}
+	}
+	removeMounts(pod.Spec.InitContainers, "/spec/initContainers")
+	removeMounts(pod.Spec.Containers, "/spec/containers")
+
+	var indexes []int
+	for i, volume := range pod.Spec.Volumes {
+		if tokenVolumes[volume.Name] {
+			indexes = append(indexes, i)
+		}
+	}
+	return append(ops, patch.RemoveFromList("/spec/volumes", indexes)...)
+}
+
+// stripServiceAccountToken removes the auto-mounted service account token from the pod like
+// removeServiceAccountToken
+func stripServiceAccountToken(pod *corev1.Pod) {
+	tokenVolumes := serviceAccountTokenVolumes(pod)
+	if len(tokenVolumes) == 0 {
+		return
+	}
+	for _, containers := range [][]corev1.Container{pod.Spec.InitContainers, pod.Spec.Containers} {
+		for i := range containers {
+			containers[i].VolumeMounts = removeByKey(containers[i].VolumeMounts, tokenVolumes, func(vm corev1.VolumeMount) string { return vm.Name })
+		}
+	}
+	pod.Spec.Volumes = removeByKey(pod.Spec.Volumes, tokenVolumes, func(v corev1.Volume) string { return v.Name })
+}
+
+// serviceAccountTokenVolumes returns the names of the volumes mounted at the token path
+func serviceAccountTokenVolumes(pod *corev1.Pod) map[string]bool {
+	tokenVolumes := map[string]bool{}
+	for _, containers := range [][]corev1.Container{pod.Spec.InitContainers, pod.Spec.Containers} {
+		for _, container := range containers {
+			for _, mount := range container.VolumeMounts {
+				if mount.MountPath == serviceAccountTokenPath {
+					tokenVolumes[mount.Name] = true
+				}
+			}
+		}
+	}
+	return tokenVolumes
+}
+
+// removesServiceAccountToken returns whether the config removes the auto-mounted service account token
+func (c Config) removesServiceAccountToken() bool {
+	return c.RemoveServiceAccountToken || (c.AutomountServiceAccountToken != nil && !*c.AutomountServiceAccountToken)
+}
+
+// setAutomountServiceAccountToken returns the operations setting the pod's automountServiceAccountToken
+// to the config's
+func setAutomountServiceAccountToken(pod *corev1.Pod, automount *bool) []patchOperation {
+	if automount == nil {
+		return nil
+	}
+	current := pod.Spec.AutomountServiceAccountToken
+	if current != nil && *current == *automount {
+		return nil
+	}
+	op := "add"
+	if current != nil {
+		op = "replace"
+	}
+	return []patchOperation{{Op: op, Path: "/spec/automountServiceAccountToken", Value: *automount}}
+}
+
+// setServiceAccount returns the operations setting the pod's service account to the one serviceAccountFor
+// returns
+func setServiceAccount(pod *corev1.Pod, config Config) []patchOperation {
+	name, ok := serviceAccountFor(pod, config)
+	if !ok {
+		return nil
+	}
+	op := "add"
+	if pod.Spec.ServiceAccountName != "" {
+		op = "replace"
+	}
+	ops := []patchOperation{{Op: op, Path: "/spec/serviceAccountName", Value: name}}
+	// the deprecated field is set by the ServiceAccount admission plugin and must agree
+	if pod.Spec.DeprecatedServiceAccount != "" {
+		ops = append(ops, patch.Replace("/spec/serviceAccount", name))
+	}
+	return ops
+}
+
+// serviceAccountFor returns the service account the config sets on the pod and whether it changes it.
+// Pods that name a service account other than the default keep it unless the config overrides existing
+// ones.
+func serviceAccountFor(pod *corev1.Pod, config Config) (string, bool) {
+	name := config.ServiceAccountName
+	current := pod.Spec.ServiceAccountName
+	if name == "" || name == current {
+		return "", false
+	}
+	if current != "" && current != defaultServiceAccount && !config.OverrideExistingServiceAccount {
+		return "", false
+	}
+	return name, true
+}
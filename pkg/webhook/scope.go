@@ -0,0 +1,48 @@
+package webhook
+
+import (
+	"fmt"
+	"path"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// ScopeConfig pins a Config to the namespaces and pods it may be applied to. It's enforced by the
+// server regardless of annotations, so a privileged config referenced from the wrong place is refused.
+type ScopeConfig struct {
+	// AllowedNamespaces - namespaces the config may be applied in, shell patterns such as prod-* are
+	// supported. Empty allows every namespace.
+	AllowedNamespaces []string
+
+	// PodSelector - pods must match this selector for the config to be applied. Empty allows every pod.
+	PodSelector *metav1.LabelSelector
+}
+
+// checkScope returns an error describing why the config may not be applied to the pod in the namespace
+func (s ScopeConfig) checkScope(namespace string, pod *corev1.Pod) error {
+	if len(s.AllowedNamespaces) > 0 {
+		allowed := false
+		for _, pattern := range s.AllowedNamespaces {
+			if ok, _ := path.Match(pattern, namespace); ok {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return fmt.Errorf("namespace %q is not in the allowed namespaces %v", namespace, s.AllowedNamespaces)
+		}
+	}
+
+	if s.PodSelector != nil {
+		selector, err := metav1.LabelSelectorAsSelector(s.PodSelector)
+		if err != nil {
+			return fmt.Errorf("invalid pod selector: %v", err)
+		}
+		if !selector.Matches(labels.Set(pod.GetLabels())) {
+			return fmt.Errorf("pod labels do not match the pod selector %q", selector.String())
+		}
+	}
+	return nil
+}
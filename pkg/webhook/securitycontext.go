@@ -0,0 +1,174 @@
+package webhook
+
+import (
+	"fmt"
+	"reflect"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// addPodSecurityContext sets the settings of the config's pod securityContext the pod doesn't set itself.
+// The patch replaces the pod's securityContext with the merged one, or adds it if the pod has none.
+func (whs *WebhookServer) addPodSecurityContext(target, added *corev1.PodSecurityContext) []patchOperation {
+	if added == nil {
+		return nil
+	}
+	if target == nil {
+		return []patchOperation{{Op: "add", Path: "/spec/securityContext", Value: added}}
+	}
+	merged := mergePodSecurityContext(target, added)
+	if reflect.DeepEqual(merged, target) {
+		return nil
+	}
+	return []patchOperation{{Op: "replace", Path: "/spec/securityContext", Value: merged}}
+}
+
+// setShareProcessNamespace sets the pod's shareProcessNamespace to the config's
+func (whs *WebhookServer) setShareProcessNamespace(pod *corev1.Pod, share *bool) []patchOperation {
+	if share == nil {
+		return nil
+	}
+	current := pod.Spec.ShareProcessNamespace
+	if current != nil && *current == *share {
+		return nil
+	}
+	op := "add"
+	if current != nil {
+		op = "replace"
+	}
+	return []patchOperation{{Op: op, Path: "/spec/shareProcessNamespace", Value: *share}}
+}
+
+// extendTerminationGracePeriod raises the pod's terminationGracePeriodSeconds to min if it's lower, the
+// pod's is the API server's default if it has none
+func (whs *WebhookServer) extendTerminationGracePeriod(pod *corev1.Pod, min int64) []patchOperation {
+	if !extendsGracePeriod(pod, min) {
+		return nil
+	}
+	if pod.Spec.TerminationGracePeriodSeconds == nil {
+		return []patchOperation{{Op: "add", Path: "/spec/terminationGracePeriodSeconds", Value: min}}
+	}
+	return []patchOperation{{Op: "replace", Path: "/spec/terminationGracePeriodSeconds", Value: min}}
+}
+
+// extendsGracePeriod returns whether the pod's terminationGracePeriodSeconds is lower than min
+func extendsGracePeriod(pod *corev1.Pod, min int64) bool {
+	current := pod.Spec.TerminationGracePeriodSeconds
+	if current == nil {
+		return min > corev1.DefaultTerminationGracePeriodSeconds
+	}
+	return *current < min
+}
+
+// mergePodSecurityContext returns the pod's securityContext with the added settings it doesn't have.
+// Supplemental groups and sysctls are appended unless the pod has them.
+func mergePodSecurityContext(pod, added *corev1.PodSecurityContext) *corev1.PodSecurityContext {
+	merged := pod.DeepCopy()
+	added = added.DeepCopy()
+	if merged.SELinuxOptions == nil {
+		merged.SELinuxOptions = added.SELinuxOptions
+	}
+	if merged.WindowsOptions == nil {
+		merged.WindowsOptions = added.WindowsOptions
+	}
+	if merged.RunAsUser == nil {
+		merged.RunAsUser = added.RunAsUser
+	}
+	if merged.RunAsGroup == nil {
+		merged.RunAsGroup = added.RunAsGroup
+	}
+	if merged.RunAsNonRoot == nil {
+		merged.RunAsNonRoot = added.RunAsNonRoot
+	}
+	if merged.FSGroup == nil {
+		merged.FSGroup = added.FSGroup
+	}
+	if merged.FSGroupChangePolicy == nil {
+		merged.FSGroupChangePolicy = added.FSGroupChangePolicy
+	}
+	if merged.SeccompProfile == nil {
+		merged.SeccompProfile = added.SeccompProfile
+	}
+	merged.SupplementalGroups = appendMissing(merged.SupplementalGroups, added.SupplementalGroups)
+	sysctls := map[string]bool{}
+	for _, s := range merged.Sysctls {
+		sysctls[s.Name] = true
+	}
+	for _, s := range added.Sysctls {
+		if !sysctls[s.Name] {
+			merged.Sysctls = append(merged.Sysctls, s)
+		}
+	}
+	return merged
+}
+
+// validatePodSecurityContext checks the IDs, the fsGroup change policy and the seccomp profile
+func (c Config) validatePodSecurityContext() error {
+	sc := c.PodSecurityContext
+	if sc == nil {
+		return nil
+	}
+	for _, id := range []struct {
+		field string
+		value *int64
+	}{{"runAsUser", sc.RunAsUser}, {"runAsGroup", sc.RunAsGroup}, {"fsGroup", sc.FSGroup}} {
+		if id.value != nil && *id.value < 0 {
+			return fmt.Errorf("podSecurityContext.%s: must not be negative", id.field)
+		}
+	}
+	if sc.RunAsNonRoot != nil && *sc.RunAsNonRoot && sc.RunAsUser != nil && *sc.RunAsUser == 0 {
+		return fmt.Errorf("podSecurityContext.runAsUser: must not be 0 with runAsNonRoot")
+	}
+	if p := sc.FSGroupChangePolicy; p != nil && *p != corev1.FSGroupChangeOnRootMismatch && *p != corev1.FSGroupChangeAlways {
+		return fmt.Errorf("podSecurityContext.fsGroupChangePolicy: unsupported policy %q, expected OnRootMismatch or Always", *p)
+	}
+	if sc.SeccompProfile != nil {
+		return validateSeccompProfile("podSecurityContext.seccompProfile", sc.SeccompProfile)
+	}
+	return nil
+}
+
+// validateContainerSecurityContext checks the IDs and the seccomp profile of the existing containers'
+// securityContext and that it doesn't both allow and deny privileges
+func (c Config) validateContainerSecurityContext() error {
+	sc := c.SecurityContext
+	if sc == nil {
+		return nil
+	}
+	for _, id := range []struct {
+		field string
+		value *int64
+	}{{"runAsUser", sc.RunAsUser}, {"runAsGroup", sc.RunAsGroup}} {
+		if id.value != nil && *id.value < 0 {
+			return fmt.Errorf("securityContext.%s: must not be negative", id.field)
+		}
+	}
+	if sc.RunAsNonRoot != nil && *sc.RunAsNonRoot && sc.RunAsUser != nil && *sc.RunAsUser == 0 {
+		return fmt.Errorf("securityContext.runAsUser: must not be 0 with runAsNonRoot")
+	}
+	if sc.Privileged != nil && *sc.Privileged && sc.AllowPrivilegeEscalation != nil && !*sc.AllowPrivilegeEscalation {
+		return fmt.Errorf("securityContext.allowPrivilegeEscalation: must not be false when privileged")
+	}
+	if sc.SeccompProfile != nil {
+		return validateSeccompProfile("securityContext.seccompProfile", sc.SeccompProfile)
+	}
+	return nil
+}
+
+// validateSeccompProfile checks the type of the seccomp profile at path and that only Localhost profiles
+// name a profile file
+func validateSeccompProfile(path string, p *corev1.SeccompProfile) error {
+	switch p.Type {
+	case corev1.SeccompProfileTypeRuntimeDefault, corev1.SeccompProfileTypeUnconfined:
+		if p.LocalhostProfile != nil {
+			return fmt.Errorf("%s.localhostProfile: is only supported with the Localhost type", path)
+		}
+	case corev1.SeccompProfileTypeLocalhost:
+		if p.LocalhostProfile == nil || *p.LocalhostProfile == "" {
+			return fmt.Errorf("%s.localhostProfile: must be set with the Localhost type", path)
+		}
+	default:
+		return fmt.Errorf("%s.type: unsupported type %q, expected RuntimeDefault, Unconfined or Localhost", path, p.Type)
+	}
+	return nil
+}
@@ -0,0 +1,266 @@
+package webhook
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+// SimulationOutcome is what a config change does to a pod the next time it's admitted.
+type SimulationOutcome string
+
+const (
+	// SimulationUnchanged - the pod is admitted as before the change.
+	SimulationUnchanged SimulationOutcome = "unchanged"
+
+	// SimulationInjected - the pod wasn't injected before the change and is after it.
+	SimulationInjected SimulationOutcome = "injected"
+
+	// SimulationReinjected - the pod is injected before and after the change but ends up different, e.g.
+	// with another image or config.
+	SimulationReinjected SimulationOutcome = "reinjected"
+
+	// SimulationRemoved - the pod was injected before the change and isn't after it.
+	SimulationRemoved SimulationOutcome = "removed"
+
+	// SimulationConflicted - after the change the pod is denied, its patch can't be generated or applied,
+	// or it injects containers or volumes the pod already has.
+	SimulationConflicted SimulationOutcome = "conflicted"
+)
+
+// SimulatedPod is the outcome of a config change for one pod.
+type SimulatedPod struct {
+	Namespace string            `json:"namespace"`
+	Name      string            `json:"name"`
+	Config    string            `json:"config,omitempty"`
+	Outcome   SimulationOutcome `json:"outcome"`
+	Reason    string            `json:"reason,omitempty"`
+}
+
+// ConfigSimulation counts the outcomes of the pods requesting a config.
+type ConfigSimulation struct {
+	Config     string `json:"config"`
+	Injected   int    `json:"injected"`
+	Reinjected int    `json:"reinjected"`
+	Removed    int    `json:"removed"`
+	Conflicted int    `json:"conflicted"`
+	Unchanged  int    `json:"unchanged"`
+}
+
+// SimulationReport is the blast radius of a config change over a set of pods.
+type SimulationReport struct {
+	Pods []SimulatedPod `json:"pods"`
+}
+
+// simulatedAdmission is how a server admits a pod
+type simulatedAdmission struct {
+	config  string
+	pod     *corev1.Pod
+	problem string
+}
+
+// Simulate admits every pod with the configs of base, before the change, and of head, after it, and
+// reports what the change does to each. Nothing leaves the process: the admissions are dry runs and the
+// servers shouldn't have cluster features enabled. Pods that are already injected, such as pods exported
+// from a cluster, are first stripped of what their injected annotation records, so they're admitted as
+// they were created.
+func Simulate(base, head *WebhookServer, pods []corev1.Pod) SimulationReport {
+	var report SimulationReport
+	for i := range pods {
+		pod, err := base.uninjected(&pods[i])
+		if err != nil {
+			// pods injected before their injection was recorded are admitted as they are
+			pod = pods[i].DeepCopy()
+			if pod.Namespace == "" {
+				pod.Namespace = metav1.NamespaceDefault
+			}
+		}
+		before := base.simulateAdmission(pod)
+		after := head.simulateAdmission(pod)
+
+		simulated := SimulatedPod{Namespace: pod.Namespace, Name: pod.Name, Config: after.config}
+		if simulated.Name == "" {
+			simulated.Name = pod.GenerateName
+		}
+		if simulated.Config == "" {
+			simulated.Config = before.config
+		}
+		switch {
+		case after.problem != "":
+			simulated.Outcome, simulated.Reason = SimulationConflicted, after.problem
+		case before.config == "" && after.config == "":
+			simulated.Outcome = SimulationUnchanged
+		case before.config == "" || before.problem != "":
+			simulated.Outcome = SimulationInjected
+		case after.config == "":
+			simulated.Outcome = SimulationRemoved
+		case !reflect.DeepEqual(before.pod, after.pod):
+			simulated.Outcome = SimulationReinjected
+			if before.config != after.config {
+				simulated.Reason = fmt.Sprintf("config %s instead of %s", after.config, before.config)
+			}
+		default:
+			simulated.Outcome = SimulationUnchanged
+		}
+		report.Pods = append(report.Pods, simulated)
+	}
+	report.sortPods()
+	return report
+}
+
+// ByConfig returns the outcomes counted by config, ordered by name. Pods without a config aren't counted.
+func (r SimulationReport) ByConfig() []ConfigSimulation {
+	counts := map[string]*ConfigSimulation{}
+	for _, pod := range r.Pods {
+		if pod.Config == "" {
+			continue
+		}
+		c, ok := counts[pod.Config]
+		if !ok {
+			c = &ConfigSimulation{Config: pod.Config}
+			counts[pod.Config] = c
+		}
+		switch pod.Outcome {
+		case SimulationInjected:
+			c.Injected++
+		case SimulationReinjected:
+			c.Reinjected++
+		case SimulationRemoved:
+			c.Removed++
+		case SimulationConflicted:
+			c.Conflicted++
+		default:
+			c.Unchanged++
+		}
+	}
+	configs := make([]ConfigSimulation, 0, len(counts))
+	for _, name := range sortedKeys(counts) {
+		configs = append(configs, *counts[name])
+	}
+	return configs
+}
+
+// Changed returns whether the change does anything to any of the pods.
+func (r SimulationReport) Changed() bool {
+	for _, pod := range r.Pods {
+		if pod.Outcome != SimulationUnchanged {
+			return true
+		}
+	}
+	return false
+}
+
+// simulateAdmission admits the pod in a dry run and returns the config it's injected with and the
+// injected pod, or why it can't be
+func (whs *WebhookServer) simulateAdmission(pod *corev1.Pod) simulatedAdmission {
+	raw, err := json.Marshal(pod)
+	if err != nil {
+		return simulatedAdmission{problem: err.Error()}
+	}
+	dryRun := true
+	response := whs.mutate(&admissionv1.AdmissionReview{
+		Request: &admissionv1.AdmissionRequest{
+			UID:       "simulation",
+			Kind:      metav1.GroupVersionKind{Version: "v1", Kind: "Pod"},
+			Resource:  metav1.GroupVersionResource{Version: "v1", Resource: "pods"},
+			Name:      pod.Name,
+			Namespace: pod.Namespace,
+			Operation: admissionv1.Create,
+			Object:    runtime.RawExtension{Raw: raw},
+			DryRun:    &dryRun,
+		},
+	}, whs.state())
+	if !response.Allowed {
+		problem := "denied"
+		if response.Result != nil && response.Result.Message != "" {
+			problem = "denied: " + response.Result.Message
+		}
+		return simulatedAdmission{problem: problem}
+	}
+	if len(response.Patch) == 0 {
+		return simulatedAdmission{}
+	}
+
+	injected, err := applyPatch(pod, response.Patch)
+	if err != nil {
+		return simulatedAdmission{problem: err.Error()}
+	}
+	admission := simulatedAdmission{config: injected.Annotations[whs.annotations.config], pod: injected}
+	if problem := duplicateNames(injected); problem != "" {
+		admission.problem = problem
+	}
+	return admission
+}
+
+// duplicateNames returns which container or volume of the injected pod has the name of another, empty if
+// none has
+func duplicateNames(pod *corev1.Pod) string {
+	containers := map[string]bool{}
+	for _, container := range append(append([]corev1.Container{}, pod.Spec.InitContainers...), pod.Spec.Containers...) {
+		if containers[container.Name] {
+			return fmt.Sprintf("container %s is injected but the pod already has one", container.Name)
+		}
+		containers[container.Name] = true
+	}
+	volumes := map[string]bool{}
+	for _, volume := range pod.Spec.Volumes {
+		if volumes[volume.Name] {
+			return fmt.Sprintf("volume %s is injected but the pod already has one", volume.Name)
+		}
+		volumes[volume.Name] = true
+	}
+	return ""
+}
+
+// simulationOutcomes are the outcomes in the order they're reported
+var simulationOutcomes = []SimulationOutcome{SimulationInjected, SimulationReinjected, SimulationRemoved, SimulationConflicted, SimulationUnchanged}
+
+// Count returns the number of pods with the outcome.
+func (r SimulationReport) Count(outcome SimulationOutcome) int {
+	n := 0
+	for _, pod := range r.Pods {
+		if pod.Outcome == outcome {
+			n++
+		}
+	}
+	return n
+}
+
+// Summary returns the number of pods with each outcome, e.g. "3 injected, 0 reinjected, ...".
+func (r SimulationReport) Summary() string {
+	summary := ""
+	for i, outcome := range simulationOutcomes {
+		if i > 0 {
+			summary += ", "
+		}
+		summary += fmt.Sprintf("%d %s", r.Count(outcome), outcome)
+	}
+	return summary
+}
+
+// sortPods orders the pods by outcome, config, namespace and name
+func (r SimulationReport) sortPods() {
+	rank := map[SimulationOutcome]int{}
+	for i, outcome := range simulationOutcomes {
+		rank[outcome] = i
+	}
+	sort.SliceStable(r.Pods, func(i, j int) bool {
+		a, b := r.Pods[i], r.Pods[j]
+		if rank[a.Outcome] != rank[b.Outcome] {
+			return rank[a.Outcome] < rank[b.Outcome]
+		}
+		if a.Config != b.Config {
+			return a.Config < b.Config
+		}
+		if a.Namespace != b.Namespace {
+			return a.Namespace < b.Namespace
+		}
+		return a.Name < b.Name
+	})
+}
@@ -0,0 +1,148 @@
+package webhook
+
+import (
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+// SizingConfig sizes the config's containers in proportion to the pod they're injected into, so one config
+// fits both tiny and huge pods. The requests of a sized container are a fraction of the sum of the
+// requests of the pod's containers, and so are its limits when every container of the pod has a limit.
+type SizingConfig struct {
+	// Containers - the injected containers that are sized, all of them by default.
+	Containers []string
+
+	// CPU - how cpu is sized, it's left as configured if unset.
+	CPU *SizingRule
+
+	// Memory - how memory is sized, it's left as configured if unset.
+	Memory *SizingRule
+}
+
+// SizingRule is how one resource of the sized containers is computed.
+type SizingRule struct {
+	// Fraction - the share of the pod's total the sidecar gets, e.g. 0.1.
+	Fraction float64
+
+	// Min - the least the sidecar gets, e.g. 50m, optional.
+	Min *resource.Quantity
+
+	// Max - the most the sidecar gets, e.g. 2, optional.
+	Max *resource.Quantity
+}
+
+// validateSizing checks the sizing rules and that the sized containers are injected by the config
+func (c Config) validateSizing() error {
+	if c.Sizing == nil {
+		return nil
+	}
+	for _, r := range []struct {
+		name string
+		rule *SizingRule
+	}{{"cpu", c.Sizing.CPU}, {"memory", c.Sizing.Memory}} {
+		if r.rule == nil {
+			continue
+		}
+		if r.rule.Fraction < 0 {
+			return fmt.Errorf("sizing.%s.fraction must not be negative, got %v", r.name, r.rule.Fraction)
+		}
+		if r.rule.Min != nil && r.rule.Max != nil && r.rule.Max.Cmp(*r.rule.Min) < 0 {
+			return fmt.Errorf("sizing.%s.max %s is less than min %s", r.name, r.rule.Max, r.rule.Min)
+		}
+	}
+	injected := map[string]bool{}
+	for _, container := range c.Containers {
+		injected[container.Name] = true
+	}
+	// the sidecars the presets add are sized too
+	if c.Vault != nil {
+		injected["vault-agent"] = true
+	}
+	if c.OTelCollector != nil {
+		injected["otel-collector"] = true
+	}
+	for i, name := range c.Sizing.Containers {
+		if !injected[name] {
+			return fmt.Errorf("sizing.containers[%d]: container %q isn't injected by the config", i, name)
+		}
+	}
+	return nil
+}
+
+// sizeContainers returns a copy of the config with its containers sized for the pod
+func sizeContainers(pod *corev1.Pod, config Config) Config {
+	sizing := config.Sizing
+	if sizing == nil {
+		return config
+	}
+	sized := map[string]bool{}
+	for _, name := range sizing.Containers {
+		sized[name] = true
+	}
+
+	// copy the containers so the shared config is never modified
+	config.Containers = append([]corev1.Container{}, config.Containers...)
+	for i := range config.Containers {
+		container := &config.Containers[i]
+		if len(sized) > 0 && !sized[container.Name] {
+			continue
+		}
+		container.Resources = *container.Resources.DeepCopy()
+		sizeResource(pod, &container.Resources, corev1.ResourceCPU, sizing.CPU, resource.DecimalSI)
+		sizeResource(pod, &container.Resources, corev1.ResourceMemory, sizing.Memory, resource.BinarySI)
+	}
+	return config
+}
+
+// sizeResource sets the request, and the limit if every container of the pod has one, of the resource
+func sizeResource(pod *corev1.Pod, resources *corev1.ResourceRequirements, name corev1.ResourceName, rule *SizingRule, format resource.Format) {
+	if rule == nil {
+		return
+	}
+	var requests, limits int64
+	limited := len(pod.Spec.Containers) > 0
+	for _, container := range pod.Spec.Containers {
+		if q, ok := container.Resources.Requests[name]; ok {
+			requests += q.MilliValue()
+		}
+		if q, ok := container.Resources.Limits[name]; ok {
+			limits += q.MilliValue()
+		} else {
+			limited = false
+		}
+	}
+
+	if resources.Requests == nil {
+		resources.Requests = corev1.ResourceList{}
+	}
+	request := rule.size(requests, format)
+	if limited {
+		if resources.Limits == nil {
+			resources.Limits = corev1.ResourceList{}
+		}
+		resources.Limits[name] = rule.size(limits, format)
+	}
+	// a request above the limit would get the pod rejected
+	if limit, ok := resources.Limits[name]; ok && request.Cmp(limit) > 0 {
+		request = limit
+	}
+	resources.Requests[name] = request
+}
+
+// size returns the fraction of total, in thousandths of the unit, clamped to the rule's bounds
+func (r *SizingRule) size(total int64, format resource.Format) resource.Quantity {
+	milli := int64(float64(total) * r.Fraction)
+	if r.Min != nil && milli < r.Min.MilliValue() {
+		milli = r.Min.MilliValue()
+	}
+	if r.Max != nil && milli > r.Max.MilliValue() {
+		milli = r.Max.MilliValue()
+	}
+	if format == resource.BinarySI {
+		// whole bytes, a fraction of a byte reads oddly
+		return *resource.NewQuantity((milli+999)/1000, format)
+	}
+	return *resource.NewMilliQuantity(milli, format)
+}
@@ -0,0 +1,63 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	// defaultSOPSBinary is the sops binary run when ConfigLoadOptions.SOPSBinary is empty, looked up in PATH
+	defaultSOPSBinary = "sops"
+
+	// sopsTimeout bounds a decryption, KMS keys are fetched over the network
+	sopsTimeout = 30 * time.Second
+)
+
+// isSOPSEncrypted returns whether the config file was encrypted with SOPS, which adds its metadata under a
+// top-level sops key
+func isSOPSEncrypted(data []byte) bool {
+	var doc map[string]interface{}
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return false
+	}
+	metadata, ok := doc["sops"].(map[string]interface{})
+	if !ok {
+		return false
+	}
+	_, ok = metadata["mac"]
+	return ok
+}
+
+// decryptSOPS decrypts a config file encrypted with SOPS by running the sops binary, which finds its age
+// or KMS keys the usual way, e.g. SOPS_AGE_KEY_FILE or the AWS credentials of the server
+func decryptSOPS(data []byte, binary string) ([]byte, error) {
+	if binary == "" {
+		binary = defaultSOPSBinary
+	}
+	format := "yaml"
+	if json.Valid(data) {
+		format = "json"
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), sopsTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, binary, "--decrypt", "--input-type", format, "--output-type", format, "/dev/stdin")
+	cmd.Stdin = bytes.NewReader(data)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	decrypted, err := cmd.Output()
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return nil, fmt.Errorf("sops can't decrypt the configs: %v: %s", err, msg)
+		}
+		return nil, fmt.Errorf("sops can't decrypt the configs: %v", err)
+	}
+	return decrypted, nil
+}
@@ -0,0 +1,341 @@
+package webhook
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/centml/simple-sidecar/pkg/patch"
+)
+
+const (
+	// restartPolicyAlways is the restartPolicy of native sidecars, initContainers that keep running
+	restartPolicyAlways = "Always"
+
+	// nativeSidecarKey is the key of the containers of a config that injects them as native sidecars
+	nativeSidecarKey = "nativeSidecar"
+)
+
+// StartupConfig declares how the config's initContainers and native sidecars start, so the order holds
+// however the config is composed with extends or include rather than falling out of the order of lists.
+type StartupConfig struct {
+	// Sidecars - injected containers started as native sidecars: they're injected as initContainers with
+	// restartPolicy Always, so they're running before the initContainers after them and the pod's
+	// containers start. Needs Kubernetes 1.29 or later.
+	Sidecars []string
+
+	// Order - which injected initContainers and sidecars must start before which.
+	Order []StartupDependency
+}
+
+// StartupDependency is one ordering constraint, "Container before each of Before".
+type StartupDependency struct {
+	// Container - the name of an injected initContainer or sidecar.
+	Container string
+
+	// Before - the injected initContainers and sidecars that start after Container.
+	Before []string
+}
+
+// startupContainer is an injected initContainer with the restartPolicy of native sidecars, which the
+// vendored API types predate
+type startupContainer struct {
+	corev1.Container
+	RestartPolicy string `json:"restartPolicy,omitempty"`
+}
+
+// validateStartup checks the sidecars are injected by the config and the order is between injected
+// initContainers and sidecars without cycles
+func (c Config) validateStartup() error {
+	if c.Startup == nil {
+		return nil
+	}
+	containers := map[string]bool{}
+	for _, container := range c.Containers {
+		containers[container.Name] = true
+	}
+	ordered := map[string]bool{}
+	for _, container := range c.InitContainers {
+		ordered[container.Name] = true
+	}
+	// the containers the presets add may be ordered too
+	if c.Vault != nil {
+		containers["vault-agent"] = true
+		ordered["vault-agent-init"] = true
+	}
+	if c.OTelCollector != nil {
+		containers["otel-collector"] = true
+		ordered["otel-collector-bootstrap"] = true
+	}
+	for i, name := range c.Startup.Sidecars {
+		if !containers[name] {
+			return fmt.Errorf("startup.sidecars[%d]: container %q isn't injected by the config", i, name)
+		}
+		ordered[name] = true
+	}
+	for i, dep := range c.Startup.Order {
+		if !ordered[dep.Container] {
+			return fmt.Errorf("startup.order[%d].container: %q isn't an injected initContainer or sidecar", i, dep.Container)
+		}
+		for j, name := range dep.Before {
+			if !ordered[name] {
+				return fmt.Errorf("startup.order[%d].before[%d]: %q isn't an injected initContainer or sidecar", i, j, name)
+			}
+		}
+	}
+
+	names := make([]string, 0, len(ordered))
+	for name := range ordered {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	_, err := startupOrder(names, c.Startup.Order)
+	return err
+}
+
+// containerFlags moves the nativeSidecar flags and insert positions of the containers of a config file to
+// the fields of their configs they're read as
+func containerFlags(data []byte, opts ConfigLoadOptions) ([]byte, error) {
+	doc, ok := decodeConfigFile(data)
+	if !ok {
+		return data, nil
+	}
+	moved := false
+	for _, name := range sortedKeys(doc) {
+		switch name {
+		case configTemplatesKey, configProfilesKey, configVersionKey, configIncludeKey:
+			continue
+		}
+		config, ok := doc[name].(map[string]interface{})
+		if !ok {
+			continue
+		}
+		m, err := moveContainerFlags(config)
+		if err != nil {
+			return nil, fmt.Errorf("config %s: %v", name, err)
+		}
+		moved = moved || m
+	}
+	if !moved {
+		return data, nil
+	}
+	return encodeConfigFile(data, doc, opts)
+}
+
+// moveContainerFlags moves the flags of the containers of the decoded config to the config, moved is
+// whether there were any
+func moveContainerFlags(config map[string]interface{}) (moved bool, err error) {
+	sidecars, err := moveNativeSidecarFlags(config)
+	if err != nil {
+		return false, err
+	}
+	positions, err := moveInsertPositions(config)
+	return sidecars || positions, err
+}
+
+// moveNativeSidecarFlags removes the nativeSidecar flags from the containers of the decoded config and
+// adds the containers that set it to its startup sidecars, moved is whether there were any
+func moveNativeSidecarFlags(config map[string]interface{}) (moved bool, err error) {
+	if initContainers, ok := config["initContainers"].([]interface{}); ok {
+		for i, item := range initContainers {
+			if container, ok := item.(map[string]interface{}); ok {
+				if _, ok := container[nativeSidecarKey]; ok {
+					return false, fmt.Errorf("initContainers[%d].%s: native sidecars are injected from containers, move the container there", i, nativeSidecarKey)
+				}
+			}
+		}
+	}
+	containers, ok := config["containers"].([]interface{})
+	if !ok {
+		return false, nil
+	}
+	var sidecars []interface{}
+	for i, item := range containers {
+		container, ok := item.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		flag, ok := container[nativeSidecarKey]
+		if !ok {
+			continue
+		}
+		delete(container, nativeSidecarKey)
+		moved = true
+		native, ok := flag.(bool)
+		if !ok {
+			return false, fmt.Errorf("containers[%d].%s: must be true or false", i, nativeSidecarKey)
+		}
+		if native {
+			sidecars = append(sidecars, container["name"])
+		}
+	}
+	if len(sidecars) == 0 {
+		return moved, nil
+	}
+
+	if config["startup"] == nil {
+		config["startup"] = map[string]interface{}{}
+	}
+	startup, ok := config["startup"].(map[string]interface{})
+	if !ok {
+		// decoding the config reports the error
+		return moved, nil
+	}
+	listed, _ := startup["sidecars"].([]interface{})
+	for _, name := range sidecars {
+		if !containsValue(listed, name) {
+			listed = append(listed, name)
+		}
+	}
+	startup["sidecars"] = listed
+	return moved, nil
+}
+
+// containsValue returns whether the decoded list contains the value
+func containsValue(list []interface{}, value interface{}) bool {
+	for _, v := range list {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// orderStartup returns a copy of the config with its sidecars moved to the initContainers and the
+// initContainers sorted by the startup order
+func orderStartup(config Config) (Config, error) {
+	startup := config.Startup
+	if config.NativeSidecar {
+		// every container is a sidecar, including those the presets added
+		all := StartupConfig{}
+		if startup != nil {
+			all = *startup
+		}
+		all.Sidecars = append([]string{}, all.Sidecars...)
+		for _, container := range config.Containers {
+			all.Sidecars = append(all.Sidecars, container.Name)
+		}
+		startup = &all
+		config.Startup = startup
+	}
+	if startup == nil {
+		return config, nil
+	}
+	sidecars := map[string]bool{}
+	for _, name := range startup.Sidecars {
+		sidecars[name] = true
+	}
+
+	// copy the lists so the shared config is never modified
+	sequence := append([]corev1.Container{}, config.InitContainers...)
+	var containers []corev1.Container
+	for _, container := range config.Containers {
+		if sidecars[container.Name] {
+			sequence = append(sequence, container)
+			continue
+		}
+		containers = append(containers, container)
+	}
+
+	names := make([]string, len(sequence))
+	byName := make(map[string]corev1.Container, len(sequence))
+	for i, container := range sequence {
+		names[i] = container.Name
+		byName[container.Name] = container
+	}
+	order, err := startupOrder(names, startup.Order)
+	if err != nil {
+		return config, err
+	}
+	config.InitContainers = make([]corev1.Container, 0, len(order))
+	for _, name := range order {
+		config.InitContainers = append(config.InitContainers, byName[name])
+	}
+	config.Containers = containers
+	return config, nil
+}
+
+// startupOrder sorts names so every dependency holds, names that aren't constrained keep their order.
+// Dependencies on names that aren't in the list are ignored.
+func startupOrder(names []string, deps []StartupDependency) ([]string, error) {
+	index := map[string]int{}
+	for i, name := range names {
+		index[name] = i
+	}
+	after := make([][]int, len(names))
+	waiting := make([]int, len(names))
+	for _, dep := range deps {
+		from, ok := index[dep.Container]
+		if !ok {
+			continue
+		}
+		for _, name := range dep.Before {
+			to, ok := index[name]
+			if !ok {
+				continue
+			}
+			after[from] = append(after[from], to)
+			waiting[to]++
+		}
+	}
+
+	// repeatedly start the first name that waits for nothing
+	order := make([]string, 0, len(names))
+	started := make([]bool, len(names))
+	for len(order) < len(names) {
+		next := -1
+		for i := range names {
+			if !started[i] && waiting[i] == 0 {
+				next = i
+				break
+			}
+		}
+		if next < 0 {
+			var cycle []string
+			for i, name := range names {
+				if !started[i] {
+					cycle = append(cycle, name)
+				}
+			}
+			return nil, fmt.Errorf("startup.order has a cycle between %s", strings.Join(cycle, ", "))
+		}
+		started[next] = true
+		order = append(order, names[next])
+		for _, to := range after[next] {
+			waiting[to]--
+		}
+	}
+	return order, nil
+}
+
+// addInitContainers adds the config's initContainers to the pod, its native sidecars with restartPolicy
+// Always
+func (whs *WebhookServer) addInitContainers(pod *corev1.Pod, config Config) []patchOperation {
+	if config.Startup == nil || len(config.Startup.Sidecars) == 0 {
+		return whs.addContainer(pod.Spec.InitContainers, config.InitContainers, "/spec/initContainers")
+	}
+	sidecars := nativeSidecars(config)
+	added := make([]startupContainer, len(config.InitContainers))
+	for i, container := range config.InitContainers {
+		added[i].Container = container
+		if sidecars[container.Name] {
+			added[i].RestartPolicy = restartPolicyAlways
+		}
+	}
+	existing := make([]startupContainer, len(pod.Spec.InitContainers))
+	return patch.AddToList(existing, added, "/spec/initContainers")
+}
+
+// nativeSidecars returns the names of the config's initContainers injected as native sidecars
+func nativeSidecars(config Config) map[string]bool {
+	if config.Startup == nil {
+		return nil
+	}
+	sidecars := map[string]bool{}
+	for _, name := range config.Startup.Sidecars {
+		sidecars[name] = true
+	}
+	return sidecars
+}
@@ -0,0 +1,94 @@
+package webhook
+
+import (
+	"crypto/tls"
+	"os"
+	"time"
+)
+
+// serverState is an immutable snapshot of everything an admission depends on: the sidecar configs,
+// the policy applied to them and the TLS material. Each request takes a snapshot up front and reloads
+// swap in a whole new snapshot, so a single admission never sees half-old/half-new state.
+type serverState struct {
+	sidecarConfigs     MultiConfig
+	configHashes       map[string]string
+	configNames        map[string]string
+	staticConfigs      map[string]Config
+	ignoredNamespaces  []string
+	enforcedNamespaces []EnforcedNamespace
+	hooks              []Hooks
+	freeze             Freeze
+
+	cert        *tls.Certificate
+	certModTime time.Time
+	keyModTime  time.Time
+}
+
+// state returns the current snapshot, it must not be modified
+func (whs *WebhookServer) state() *serverState {
+	return whs.current.Load()
+}
+
+// updateState copies the current snapshot, applies update to the copy and swaps it in. Writers are
+// serialized so concurrent updates of different parts of the state don't undo each other.
+func (whs *WebhookServer) updateState(update func(next *serverState)) {
+	whs.stateMu.Lock()
+	defer whs.stateMu.Unlock()
+	next := &serverState{}
+	if current := whs.current.Load(); current != nil {
+		*next = *current
+	}
+	update(next)
+	whs.current.Store(next)
+}
+
+// UpdateConfigs atomically replaces the sidecar configurations. Admissions in flight finish with the
+// configs they started with.
+func (whs *WebhookServer) UpdateConfigs(configs MultiConfig) {
+	hashes := map[string]string{}
+	for name, config := range configs {
+		hash, err := configHash(config)
+		if err != nil {
+			whs.warningLogger.Printf("Can't hash config %s, its patches won't be cached: %v", name, err)
+			continue
+		}
+		hashes[name] = hash
+	}
+	static := whs.staticConfigs(configs)
+	whs.updateState(func(next *serverState) {
+		next.sidecarConfigs = configs
+		next.configHashes = hashes
+		next.configNames = configNameIndex(configs)
+		next.staticConfigs = static
+	})
+}
+
+// getCertificate returns the serving certificate, it's reloaded from disk when the certificate or key
+// files change so rotated certs are picked up without a restart
+func (whs *WebhookServer) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	certInfo, err := os.Stat(whs.certFile)
+	if err != nil {
+		return nil, err
+	}
+	keyInfo, err := os.Stat(whs.keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	st := whs.state()
+	if st.cert != nil && certInfo.ModTime().Equal(st.certModTime) && keyInfo.ModTime().Equal(st.keyModTime) {
+		return st.cert, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(whs.certFile, whs.keyFile)
+	if err != nil {
+		return nil, err
+	}
+	whs.infoLogger.Printf("Loaded TLS certificate %s", whs.certFile)
+	whs.updateState(func(next *serverState) {
+		next.cert = &cert
+		next.certModTime = certInfo.ModTime()
+		next.keyModTime = keyInfo.ModTime()
+	})
+	return &cert, nil
+}
@@ -0,0 +1,156 @@
+package webhook
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"sigs.k8s.io/yaml"
+)
+
+var jsonUnmarshalerType = reflect.TypeOf((*json.Unmarshaler)(nil)).Elem()
+
+// checkUnknownConfigFields returns an error naming the config and the path of the first field that
+// doesn't exist, e.g. config ubuntu: unknown field "containers[0].imagePullPolicyy". Duplicate keys are
+// errors too.
+func checkUnknownConfigFields(data []byte) error {
+	jsonData, err := yaml.YAMLToJSONStrict(data)
+	if err != nil {
+		return err
+	}
+	var raw map[string]interface{}
+	if err := json.Unmarshal(jsonData, &raw); err != nil {
+		// not a map of configs, decoding it reports the error
+		return nil
+	}
+	names := make([]string, 0, len(raw))
+	for name := range raw {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if name == configTemplatesKey {
+			if err := checkUnknownFields(raw[name], reflect.TypeOf(ConfigTemplates{})); err != nil {
+				return fmt.Errorf("%s: %v", configTemplatesKey, err)
+			}
+			continue
+		}
+		if name == configProfilesKey {
+			if err := checkUnknownProfileFields(raw[name]); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := checkUnknownFields(raw[name], reflect.TypeOf(Config{})); err != nil {
+			return fmt.Errorf("config %s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// checkUnknownFields returns an error with the path of the first field of the decoded JSON value that
+// doesn't exist in t
+func checkUnknownFields(value interface{}, t reflect.Type) error {
+	if paths := unknownFields(value, t, ""); len(paths) > 0 {
+		sort.Strings(paths)
+		return fmt.Errorf("unknown field %q", paths[0])
+	}
+	return nil
+}
+
+// unknownFields returns the paths of the fields of the decoded JSON value that don't exist in t. Names
+// are matched case-insensitively like encoding/json does, and types decoding themselves aren't looked into.
+func unknownFields(value interface{}, t reflect.Type, path string) []string {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if reflect.PtrTo(t).Implements(jsonUnmarshalerType) {
+		return nil
+	}
+
+	var unknown []string
+	switch t.Kind() {
+	case reflect.Struct:
+		obj, ok := value.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		fields := jsonFields(t)
+		for key, v := range obj {
+			fieldPath := key
+			if path != "" {
+				fieldPath = path + "." + key
+			}
+			f, ok := fields[strings.ToLower(key)]
+			if !ok {
+				unknown = append(unknown, fieldPath)
+				continue
+			}
+			unknown = append(unknown, unknownFields(v, f.typ, fieldPath)...)
+		}
+	case reflect.Slice, reflect.Array:
+		items, ok := value.([]interface{})
+		if !ok {
+			return nil
+		}
+		for i, item := range items {
+			unknown = append(unknown, unknownFields(item, t.Elem(), fmt.Sprintf("%s[%d]", path, i))...)
+		}
+	case reflect.Map:
+		obj, ok := value.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		for key, v := range obj {
+			unknown = append(unknown, unknownFields(v, t.Elem(), path+"."+key)...)
+		}
+	}
+	return unknown
+}
+
+// jsonField is a field encoding/json decodes into
+type jsonField struct {
+	// name is the name of the field, from its json tag if it has one
+	name   string
+	tagged bool
+	typ    reflect.Type
+}
+
+// jsonFields returns the fields encoding/json decodes into t by lowercased name, including the fields of
+// embedded structs
+func jsonFields(t reflect.Type) map[string]jsonField {
+	fields := map[string]jsonField{}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, _, _ := strings.Cut(tag, ",")
+		if f.Anonymous && name == "" {
+			ft := f.Type
+			if ft.Kind() == reflect.Ptr {
+				ft = ft.Elem()
+			}
+			if ft.Kind() == reflect.Struct {
+				for embedded, et := range jsonFields(ft) {
+					if _, ok := fields[embedded]; !ok {
+						fields[embedded] = et
+					}
+				}
+				continue
+			}
+		}
+		if !f.IsExported() {
+			continue
+		}
+		field := jsonField{name: name, tagged: name != "", typ: f.Type}
+		if name == "" {
+			field.name = f.Name
+		}
+		fields[strings.ToLower(field.name)] = field
+	}
+	return fields
+}
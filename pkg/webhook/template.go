@@ -0,0 +1,170 @@
+package webhook
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"strings"
+	"text/template"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// configTemplateData is what the templates of a config with RenderTemplates are rendered with
+type configTemplateData struct {
+	Pod configTemplatePod
+}
+
+// configTemplatePod is the pod as templates see it
+type configTemplatePod struct {
+	Name               string
+	GenerateName       string
+	Namespace          string
+	ServiceAccountName string
+	Labels             map[string]string
+	Annotations        map[string]string
+	Owner              configTemplateOwner
+}
+
+// configTemplateOwner is the controller of the pod, it's empty for pods without one
+type configTemplateOwner struct {
+	Kind string
+	Name string
+}
+
+// Labels returns the pod label key, e.g. {{ .Labels "app.kubernetes.io/name" }}, which can't be written
+// as a field of .Pod.Labels
+func (d configTemplateData) Labels(key string) string {
+	return d.Pod.Labels[key]
+}
+
+// Annotations returns the pod annotation key, e.g. {{ .Annotations "example.com/team" }}
+func (d configTemplateData) Annotations(key string) string {
+	return d.Pod.Annotations[key]
+}
+
+// newConfigTemplateData returns the template data for the pod
+func newConfigTemplateData(pod *corev1.Pod) configTemplateData {
+	data := configTemplateData{Pod: configTemplatePod{
+		Name:               pod.Name,
+		GenerateName:       pod.GenerateName,
+		Namespace:          pod.Namespace,
+		ServiceAccountName: pod.Spec.ServiceAccountName,
+		Labels:             pod.Labels,
+		Annotations:        pod.Annotations,
+	}}
+	if ref := metav1.GetControllerOf(pod); ref != nil {
+		data.Pod.Owner = configTemplateOwner{Kind: ref.Kind, Name: ref.Name}
+	}
+	return data
+}
+
+// templated reports whether s contains a template action
+func templated(s string) bool {
+	return strings.Contains(s, "{{")
+}
+
+// parseConfigTemplate parses s as a config template, missing labels and annotations render empty
+func parseConfigTemplate(s string) (*template.Template, error) {
+	return template.New("config").Option("missingkey=zero").Parse(s)
+}
+
+// renderConfigTemplate renders s with data, strings without template actions are returned as they are
+func renderConfigTemplate(s string, data configTemplateData) (string, error) {
+	if !templated(s) {
+		return s, nil
+	}
+	tmpl, err := parseConfigTemplate(s)
+	if err != nil {
+		return "", err
+	}
+	var rendered bytes.Buffer
+	if err := tmpl.Execute(&rendered, data); err != nil {
+		return "", err
+	}
+	return rendered.String(), nil
+}
+
+// templateField is a part of a config that's rendered
+type templateField struct {
+	name  string
+	value reflect.Value
+}
+
+// templateFields returns the parts of the config that are rendered. Presets aren't rendered: the OTel
+// collector has its own template and Vault templates use the same syntax.
+func (c *Config) templateFields() []templateField {
+	return []templateField{
+		{"initContainers", reflect.ValueOf(&c.InitContainers).Elem()},
+		{"containers", reflect.ValueOf(&c.Containers).Elem()},
+		{"volumes", reflect.ValueOf(&c.Volumes).Elem()},
+		{"volumesIfMissing", reflect.ValueOf(&c.VolumesIfMissing).Elem()},
+		{"envVars", reflect.ValueOf(&c.EnvVars).Elem()},
+		{"envFrom", reflect.ValueOf(&c.EnvFrom).Elem()},
+		{"volumeMounts", reflect.ValueOf(&c.VolumeMounts).Elem()},
+	}
+}
+
+// deepCopyList returns a deep copy of the list
+func deepCopyList[T any, PT interface {
+	*T
+	DeepCopyInto(*T)
+}](list []T) []T {
+	if list == nil {
+		return nil
+	}
+	copied := make([]T, len(list))
+	for i := range list {
+		PT(&list[i]).DeepCopyInto(&copied[i])
+	}
+	return copied
+}
+
+// validateTemplates returns an error for the first template of the config that doesn't parse
+func (c Config) validateTemplates() error {
+	if !c.RenderTemplates {
+		return nil
+	}
+	parse := func(s string) (string, error) {
+		if templated(s) {
+			if _, err := parseConfigTemplate(s); err != nil {
+				return s, err
+			}
+		}
+		return s, nil
+	}
+	for _, f := range c.templateFields() {
+		if err := rewriteStrings(f.value, f.name, parse); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// renderTemplates returns a copy of the config with the templates in its strings rendered for the pod
+func renderTemplates(pod *corev1.Pod, config Config) (Config, error) {
+	if !config.RenderTemplates {
+		return config, nil
+	}
+
+	// copy what's rendered so the shared config is never modified
+	config.InitContainers = deepCopyList(config.InitContainers)
+	config.Containers = deepCopyList(config.Containers)
+	config.Volumes = deepCopyList(config.Volumes)
+	config.VolumesIfMissing = deepCopyList(config.VolumesIfMissing)
+	config.EnvVars = deepCopyList(config.EnvVars)
+	config.EnvFrom = deepCopyList(config.EnvFrom)
+	config.VolumeMounts = deepCopyList(config.VolumeMounts)
+
+	data := newConfigTemplateData(pod)
+	render := func(s string) (string, error) {
+		return renderConfigTemplate(s, data)
+	}
+	for _, f := range config.templateFields() {
+		if err := rewriteStrings(f.value, f.name, render); err != nil {
+			return config, fmt.Errorf("could not render template: %v", err)
+		}
+	}
+	return config, nil
+}
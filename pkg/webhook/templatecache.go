@@ -0,0 +1,314 @@
+package webhook
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"sync"
+	"text/template/parse"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+var templateCacheRequests = newCounterVec("template_cache_requests_total", "Rendered template cache lookups by result (hit or miss).", "result")
+
+// templateCache is an in-memory LRU of rendered configs. Entries are keyed by a hash of the config's
+// templates and of the parts of the pod they read, so the pods of a workload, which only differ by name,
+// share an entry unless the templates read the name. It's safe for concurrent use.
+type templateCache struct {
+	maxEntries int
+
+	mu      sync.Mutex
+	order   *list.List
+	entries map[string]*list.Element
+}
+
+type templateCacheEntry struct {
+	key   string
+	value interface{}
+}
+
+// renderedTemplates are the parts of a config that are rendered, as rendered for a pod
+type renderedTemplates struct {
+	initContainers   []corev1.Container
+	containers       []corev1.Container
+	volumes          []corev1.Volume
+	volumesIfMissing []corev1.Volume
+	envVars          []corev1.EnvVar
+	envFrom          []corev1.EnvFromSource
+	volumeMounts     []corev1.VolumeMount
+}
+
+// newTemplateCache returns a templateCache holding at most maxEntries entries
+func newTemplateCache(maxEntries int) *templateCache {
+	return &templateCache{
+		maxEntries: maxEntries,
+		order:      list.New(),
+		entries:    map[string]*list.Element{},
+	}
+}
+
+// get returns the value cached for the key and makes it the most recently used
+func (c *templateCache) get(key string) (interface{}, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	c.order.MoveToFront(e)
+	return e.Value.(*templateCacheEntry).value, true
+}
+
+// add caches the value for the key, evicting the least recently used entry when the cache is full
+func (c *templateCache) add(key string, value interface{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.entries[key]; ok {
+		e.Value.(*templateCacheEntry).value = value
+		c.order.MoveToFront(e)
+		return
+	}
+	for c.order.Len() >= c.maxEntries && c.order.Len() > 0 {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*templateCacheEntry).key)
+	}
+	c.entries[key] = c.order.PushFront(&templateCacheEntry{key: key, value: value})
+}
+
+// renderTemplates is renderTemplates with the rendered parts of the config cached when the server has a
+// template cache
+func (whs *WebhookServer) renderTemplates(pod *corev1.Pod, config Config) (Config, error) {
+	if whs.templateCache == nil || !config.RenderTemplates {
+		return renderTemplates(pod, config)
+	}
+	key, err := whs.templateCache.key(pod, config)
+	if err != nil {
+		return renderTemplates(pod, config)
+	}
+	if cached, ok := whs.templateCache.get(key); ok {
+		templateCacheRequests.WithLabelValues("hit").Inc()
+		cached.(renderedTemplates).copyInto(&config)
+		return config, nil
+	}
+	templateCacheRequests.WithLabelValues("miss").Inc()
+
+	rendered, err := renderTemplates(pod, config)
+	if err != nil {
+		return rendered, err
+	}
+	var entry renderedTemplates
+	entry.copyFrom(rendered)
+	whs.templateCache.add(key, entry)
+	return rendered, nil
+}
+
+// copyFrom keeps copies of the rendered parts of the config
+func (r *renderedTemplates) copyFrom(config Config) {
+	r.initContainers = deepCopyList(config.InitContainers)
+	r.containers = deepCopyList(config.Containers)
+	r.volumes = deepCopyList(config.Volumes)
+	r.volumesIfMissing = deepCopyList(config.VolumesIfMissing)
+	r.envVars = deepCopyList(config.EnvVars)
+	r.envFrom = deepCopyList(config.EnvFrom)
+	r.volumeMounts = deepCopyList(config.VolumeMounts)
+}
+
+// copyInto sets copies of the rendered parts on the config, so mutators can't change the cached ones
+func (r renderedTemplates) copyInto(config *Config) {
+	config.InitContainers = deepCopyList(r.initContainers)
+	config.Containers = deepCopyList(r.containers)
+	config.Volumes = deepCopyList(r.volumes)
+	config.VolumesIfMissing = deepCopyList(r.volumesIfMissing)
+	config.EnvVars = deepCopyList(r.envVars)
+	config.EnvFrom = deepCopyList(r.envFrom)
+	config.VolumeMounts = deepCopyList(r.volumeMounts)
+}
+
+// key returns the cache key of the config rendered for the pod: the hash of its templates and of the
+// template data they read. What the templates read is worked out once per config and cached too.
+func (c *templateCache) key(pod *corev1.Pod, config Config) (string, error) {
+	data, err := json.Marshal(struct {
+		InitContainers   []corev1.Container
+		Containers       []corev1.Container
+		Volumes          []corev1.Volume
+		VolumesIfMissing []corev1.Volume
+		EnvVars          []corev1.EnvVar
+		EnvFrom          []corev1.EnvFromSource
+		VolumeMounts     []corev1.VolumeMount
+	}{config.InitContainers, config.Containers, config.Volumes, config.VolumesIfMissing, config.EnvVars, config.EnvFrom, config.VolumeMounts})
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	hash := hex.EncodeToString(sum[:])
+
+	var refs *templateRefs
+	if cached, ok := c.get("refs/" + hash); ok {
+		refs = cached.(*templateRefs)
+	} else {
+		refs = configTemplateRefs(config)
+		c.add("refs/"+hash, refs)
+	}
+
+	read, err := json.Marshal(refs.read(newConfigTemplateData(pod)))
+	if err != nil {
+		return "", err
+	}
+	sum = sha256.Sum256(append([]byte(hash), read...))
+	return "rendered/" + hex.EncodeToString(sum[:]), nil
+}
+
+// templateRefs are the parts of the template data the templates of a config read. With all set they
+// read something that isn't worked out, such as the whole of the data, and every part counts.
+type templateRefs struct {
+	all         bool
+	fields      map[string]bool
+	labels      map[string]bool
+	annotations map[string]bool
+}
+
+// configTemplateRefs returns what the templates of the config read
+func configTemplateRefs(config Config) *templateRefs {
+	refs := &templateRefs{fields: map[string]bool{}, labels: map[string]bool{}, annotations: map[string]bool{}}
+	collect := func(s string) (string, error) {
+		if !templated(s) {
+			return s, nil
+		}
+		tmpl, err := parseConfigTemplate(s)
+		if err != nil || tmpl.Tree == nil {
+			refs.all = true
+			return s, nil
+		}
+		refs.node(tmpl.Tree.Root)
+		return s, nil
+	}
+	for _, f := range config.templateFields() {
+		if err := rewriteStrings(f.value, f.name, collect); err != nil {
+			refs.all = true
+		}
+	}
+	return refs
+}
+
+// read returns the parts of the data the templates read
+func (r *templateRefs) read(data configTemplateData) interface{} {
+	if r.all {
+		return data
+	}
+	pod := data.Pod
+	read := map[string]interface{}{}
+	for field := range r.fields {
+		switch field {
+		case "Name":
+			read[field] = pod.Name
+		case "GenerateName":
+			read[field] = pod.GenerateName
+		case "Namespace":
+			read[field] = pod.Namespace
+		case "ServiceAccountName":
+			read[field] = pod.ServiceAccountName
+		case "Owner":
+			read[field] = pod.Owner
+		case "Labels":
+			read[field] = pod.Labels
+		case "Annotations":
+			read[field] = pod.Annotations
+		}
+	}
+	labels := map[string]string{}
+	for key := range r.labels {
+		labels[key] = pod.Labels[key]
+	}
+	annotations := map[string]string{}
+	for key := range r.annotations {
+		annotations[key] = pod.Annotations[key]
+	}
+	read["label"] = labels
+	read["annotation"] = annotations
+	return read
+}
+
+// node records what a node of a template's parse tree reads. Anything that changes or captures the dot,
+// such as range, with and variables, reads everything.
+func (r *templateRefs) node(n parse.Node) {
+	switch n := n.(type) {
+	case nil, *parse.TextNode, *parse.CommentNode:
+	case *parse.ListNode:
+		if n == nil {
+			return
+		}
+		for _, child := range n.Nodes {
+			r.node(child)
+		}
+	case *parse.ActionNode:
+		r.pipe(n.Pipe)
+	case *parse.IfNode:
+		r.pipe(n.Pipe)
+		r.node(n.List)
+		r.node(n.ElseList)
+	default:
+		r.all = true
+	}
+}
+
+// pipe records what a pipeline reads
+func (r *templateRefs) pipe(p *parse.PipeNode) {
+	if p == nil {
+		return
+	}
+	if len(p.Decl) > 0 {
+		r.all = true
+	}
+	for _, cmd := range p.Cmds {
+		// .Labels "key" and .Annotations "key" read one key
+		if len(cmd.Args) == 2 {
+			if field, ok := cmd.Args[0].(*parse.FieldNode); ok && len(field.Ident) == 1 {
+				if key, ok := cmd.Args[1].(*parse.StringNode); ok {
+					switch field.Ident[0] {
+					case "Labels":
+						r.labels[key.Text] = true
+						continue
+					case "Annotations":
+						r.annotations[key.Text] = true
+						continue
+					}
+				}
+			}
+		}
+		for _, arg := range cmd.Args {
+			r.arg(arg)
+		}
+	}
+}
+
+// arg records what an argument of a command reads
+func (r *templateRefs) arg(arg parse.Node) {
+	switch arg := arg.(type) {
+	case *parse.FieldNode:
+		r.field(arg.Ident)
+	case *parse.PipeNode:
+		r.pipe(arg)
+	case *parse.StringNode, *parse.NumberNode, *parse.BoolNode, *parse.NilNode, *parse.IdentifierNode:
+	default:
+		r.all = true
+	}
+}
+
+// field records what a field chain of the data reads, e.g. .Pod.Namespace or .Pod.Labels.app
+func (r *templateRefs) field(ident []string) {
+	switch {
+	case len(ident) == 1 && (ident[0] == "Labels" || ident[0] == "Annotations"):
+		r.fields[ident[0]] = true
+	case len(ident) < 2 || ident[0] != "Pod":
+		r.all = true
+	case ident[1] == "Labels" && len(ident) > 2:
+		r.labels[ident[2]] = true
+	case ident[1] == "Annotations" && len(ident) > 2:
+		r.annotations[ident[2]] = true
+	default:
+		r.fields[ident[1]] = true
+	}
+}
@@ -0,0 +1,163 @@
+package webhook
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"sigs.k8s.io/yaml"
+)
+
+// TenantConfig defines an additional, independent injection domain served by the same listener as
+// the default one. Each tenant has its own path, configs, annotations and ignored namespaces so, for
+// example, platform and security teams can operate separate webhooks without separate Deployments.
+type TenantConfig struct {
+	// Name - identifies the tenant in logs and reports.
+	Name string
+
+	// Path - the path the tenant's MutatingWebhookConfiguration calls, e.g. /security/inject.
+	Path string
+
+	// AnnotationDomain - the domain of the tenant's annotations, e.g. security.example.com results in the
+	// security.example.com/inject and security.example.com/status annotations.
+	AnnotationDomain string
+
+	// SidecarConfigs - the configs the tenant injects.
+	SidecarConfigs MultiConfig
+
+	// IgnoredNamespaces - namespaces the tenant never mutates, defaults to kube-system and kube-public.
+	IgnoredNamespaces []string
+
+	// EnforcedNamespaces - namespaces where pods are denied unless the tenant injects them.
+	EnforcedNamespaces []EnforcedNamespace
+
+	// Resolver - selects the config of a pod, defaults to the tenant's inject annotation.
+	Resolver Resolver
+}
+
+// newTenant creates the WebhookServer handling a tenant, it shares the loggers and patch cache of the
+// parent but has its own state and annotations. It doesn't own a listener.
+func (whs *WebhookServer) newTenant(tc TenantConfig) (*WebhookServer, error) {
+	if tc.Name == "" || tc.Path == "" || tc.AnnotationDomain == "" {
+		return nil, fmt.Errorf("tenant %q requires a name, path and annotation domain", tc.Name)
+	}
+	if !strings.HasPrefix(tc.Path, "/") {
+		return nil, fmt.Errorf("tenant %q path %q must start with /", tc.Name, tc.Path)
+	}
+
+	tenant := &WebhookServer{
+		name:           tc.Name,
+		annotations:    domainAnnotationKeys(tc.AnnotationDomain),
+		configResolver: tc.Resolver,
+		patchCache:     whs.patchCache,
+		templateCache:  whs.templateCache,
+		latencyBudget:  whs.latencyBudget,
+		budgetSlots:    whs.budgetSlots,
+		chaos:          whs.chaos,
+		transport:      whs.transport,
+		markOrphaned:   whs.markOrphaned,
+		fileConfigMaps: whs.fileConfigMaps,
+		injectOps:      whs.injectOps,
+		patchEngine:    whs.patchEngine,
+		configLoad:     whs.configLoad,
+		nodes:          whs.nodes,
+		infoLogger:     whs.infoLogger,
+		warningLogger:  whs.warningLogger,
+		errorLogger:    whs.errorLogger,
+	}
+	if whs.owners != nil {
+		tenant.owners = newOwnerMarkers(whs.owners.client, tenant.annotations.owner)
+	}
+	ignored := tc.IgnoredNamespaces
+	if ignored == nil {
+		ignored = ignoredNamespaces
+	}
+	tenant.updateState(func(next *serverState) {
+		next.ignoredNamespaces = ignored
+		next.enforcedNamespaces = tc.EnforcedNamespaces
+		// the freeze is server wide
+		next.freeze = whs.state().freeze
+	})
+	tenant.UpdateConfigs(tc.SidecarConfigs)
+	return tenant, nil
+}
+
+// addTenants creates a WebhookServer for each tenant and registers its path on the mux
+func (whs *WebhookServer) addTenants(mux *http.ServeMux, tenants []TenantConfig) error {
+	paths := map[string]string{webhookInjectPath: "default"}
+	if whs.transport.SecondPath != "" {
+		paths[whs.transport.SecondPath] = "default"
+	}
+	for _, tc := range tenants {
+		if other, ok := paths[tc.Path]; ok {
+			return fmt.Errorf("tenant %q path %q is already used by %q", tc.Name, tc.Path, other)
+		}
+		tenant, err := whs.newTenant(tc)
+		if err != nil {
+			return err
+		}
+		paths[tc.Path] = tc.Name
+		mux.HandleFunc(tc.Path, tenant.Serve)
+		whs.tenants = append(whs.tenants, tenant)
+		whs.infoLogger.Printf("Serving tenant %s on %s with annotation %s", tc.Name, tc.Path, tenant.annotations.inject)
+	}
+	return nil
+}
+
+// Tenant returns the WebhookServer handling the named tenant, e.g. to update its configs, or nil if
+// there is no such tenant.
+func (whs *WebhookServer) Tenant(name string) *WebhookServer {
+	for _, tenant := range whs.tenants {
+		if tenant.name == name {
+			return tenant
+		}
+	}
+	return nil
+}
+
+// tenantFileEntry is a tenant as declared in a tenants file, its configs are loaded from ConfigFile
+type tenantFileEntry struct {
+	Name               string
+	Path               string
+	AnnotationDomain   string
+	ConfigFile         string
+	IgnoredNamespaces  []string
+	EnforcedNamespaces []EnforcedNamespace
+}
+
+// LoadTenants loads the tenants declared in the given YAML file along with each tenant's configs, which
+// are loaded like LoadConfig does.
+func LoadTenants(tenantsFile string) ([]TenantConfig, error) {
+	return loadTenants(tenantsFile, ConfigLoadOptions{})
+}
+
+// loadTenants loads the tenants file, the tenants' configs are decoded as opts says
+func loadTenants(tenantsFile string, opts ConfigLoadOptions) ([]TenantConfig, error) {
+	data, err := os.ReadFile(tenantsFile)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []tenantFileEntry
+	if err := yaml.Unmarshal(data, &entries); err != nil {
+		return nil, err
+	}
+
+	tenants := make([]TenantConfig, 0, len(entries))
+	for _, entry := range entries {
+		sidecarConfigs, err := loadConfig(entry.ConfigFile, opts)
+		if err != nil {
+			return nil, fmt.Errorf("tenant %s: %v", entry.Name, err)
+		}
+		tenants = append(tenants, TenantConfig{
+			Name:               entry.Name,
+			Path:               entry.Path,
+			AnnotationDomain:   entry.AnnotationDomain,
+			SidecarConfigs:     sidecarConfigs,
+			IgnoredNamespaces:  entry.IgnoredNamespaces,
+			EnforcedNamespaces: entry.EnforcedNamespaces,
+		})
+	}
+	return tenants, nil
+}
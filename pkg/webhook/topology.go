@@ -0,0 +1,172 @@
+package webhook
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/metadata"
+	"k8s.io/client-go/metadata/metadatainformer"
+	"k8s.io/client-go/tools/cache"
+)
+
+const nodeTopologyResync = 30 * time.Minute
+
+// downwardTopologyLabels are the node labels the PodTopologyLabels admission plugin copies to pods when
+// they're bound to a node, the Downward API can read them from the pod
+var downwardTopologyLabels = map[string]bool{
+	"topology.kubernetes.io/zone":   true,
+	"topology.kubernetes.io/region": true,
+}
+
+var topologyLookups = newCounterVec("topology_lookups_total", "Node label lookups for topology env by result (hit, miss or unscheduled).", "result")
+
+// TopologyConfig injects the topology of the pod's node into the env of the config's containers, e.g. for
+// sidecars that prefer local replicas. Node labels are set from the node when the pod is already bound to
+// one at admission, otherwise zone and region are read through the Downward API from the pod labels the
+// PodTopologyLabels admission plugin sets, and other labels are left out.
+type TopologyConfig struct {
+	// NodeName - the env var the name of the node is injected as, e.g. NODE_NAME.
+	NodeName string
+
+	// Labels - env vars set from node labels, e.g. ZONE: topology.kubernetes.io/zone.
+	Labels map[string]string
+
+	// Containers - the injected containers and initContainers that get the env, all of them by default.
+	Containers []string
+}
+
+// nodeTopology keeps the labels of the cluster's nodes
+type nodeTopology struct {
+	informer cache.SharedIndexInformer
+}
+
+// newNodeTopology creates the node label lookup, it has to run before it returns anything
+func newNodeTopology(client metadata.Interface) *nodeTopology {
+	factory := metadatainformer.NewSharedInformerFactory(client, nodeTopologyResync)
+	return &nodeTopology{
+		informer: factory.ForResource(corev1.SchemeGroupVersion.WithResource("nodes")).Informer(),
+	}
+}
+
+// Run runs the informer until stop is closed
+func (n *nodeTopology) Run(stop <-chan struct{}) {
+	n.informer.Run(stop)
+}
+
+// labels returns the labels of the node
+func (n *nodeTopology) labels(node string) (map[string]string, bool) {
+	obj, ok, err := n.informer.GetStore().GetByKey(node)
+	if err != nil || !ok {
+		return nil, false
+	}
+	meta, ok := obj.(*metav1.PartialObjectMetadata)
+	if !ok {
+		return nil, false
+	}
+	if meta.Labels == nil {
+		return map[string]string{}, true
+	}
+	return meta.Labels, true
+}
+
+// podNode returns the node the pod is bound to at admission: its nodeName, or the single node a
+// DaemonSet pod's node affinity selects
+func podNode(pod *corev1.Pod) string {
+	if pod.Spec.NodeName != "" {
+		return pod.Spec.NodeName
+	}
+	affinity := pod.Spec.Affinity
+	if affinity == nil || affinity.NodeAffinity == nil || affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution == nil {
+		return ""
+	}
+	terms := affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution.NodeSelectorTerms
+	if len(terms) != 1 {
+		return ""
+	}
+	for _, field := range terms[0].MatchFields {
+		if field.Key == "metadata.name" && field.Operator == corev1.NodeSelectorOpIn && len(field.Values) == 1 {
+			return field.Values[0]
+		}
+	}
+	return ""
+}
+
+// addTopologyEnv returns a copy of the config with the topology env added to its containers, with the
+// labels of the pod's node if it's known
+func (whs *WebhookServer) addTopologyEnv(pod *corev1.Pod, config Config) Config {
+	if config.Topology == nil || len(config.Topology.Labels) == 0 {
+		return topologyEnv(config, nil)
+	}
+
+	node := podNode(pod)
+	if node == "" || whs.nodes == nil {
+		topologyLookups.WithLabelValues("unscheduled").Inc()
+		return topologyEnv(config, nil)
+	}
+	labels, ok := whs.nodes.labels(node)
+	if !ok {
+		topologyLookups.WithLabelValues("miss").Inc()
+		whs.warningLogger.Printf("Node %s of %s isn't known yet, its topology env falls back to the Downward API", node, podIdentity("", pod))
+		return topologyEnv(config, nil)
+	}
+	topologyLookups.WithLabelValues("hit").Inc()
+	return topologyEnv(config, labels)
+}
+
+// topologyEnv returns a copy of the config with the topology env added to its containers. Labels are set
+// from nodeLabels when it's not nil, otherwise from the Downward API where possible.
+func topologyEnv(config Config, nodeLabels map[string]string) Config {
+	topology := config.Topology
+	if topology == nil {
+		return config
+	}
+
+	var env []corev1.EnvVar
+	if topology.NodeName != "" {
+		env = append(env, corev1.EnvVar{
+			Name:      topology.NodeName,
+			ValueFrom: &corev1.EnvVarSource{FieldRef: &corev1.ObjectFieldSelector{FieldPath: "spec.nodeName"}},
+		})
+	}
+	names := make([]string, 0, len(topology.Labels))
+	for name := range topology.Labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		label := topology.Labels[name]
+		switch {
+		case nodeLabels != nil:
+			env = append(env, corev1.EnvVar{Name: name, Value: nodeLabels[label]})
+		case downwardTopologyLabels[label]:
+			env = append(env, corev1.EnvVar{
+				Name:      name,
+				ValueFrom: &corev1.EnvVarSource{FieldRef: &corev1.ObjectFieldSelector{FieldPath: fmt.Sprintf("metadata.labels['%s']", label)}},
+			})
+		}
+	}
+	if len(env) == 0 {
+		return config
+	}
+
+	selected := map[string]bool{}
+	for _, name := range topology.Containers {
+		selected[name] = true
+	}
+	addEnv := func(containers []corev1.Container) []corev1.Container {
+		out := make([]corev1.Container, len(containers))
+		for i, container := range containers {
+			if len(selected) == 0 || selected[container.Name] {
+				container.Env = append(append([]corev1.EnvVar{}, container.Env...), env...)
+			}
+			out[i] = container
+		}
+		return out
+	}
+	config.InitContainers = addEnv(config.InitContainers)
+	config.Containers = addEnv(config.Containers)
+	return config
+}
@@ -0,0 +1,131 @@
+package webhook
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// defaultMaxRequestBytes bounds admission reviews when MaxRequestBytes isn't set. Objects are at most
+// 1.5MiB in etcd and a review of an update carries the object and the old one.
+const defaultMaxRequestBytes = 16 << 20
+
+// errUnsupportedEncoding is returned for request bodies encoded with something other than gzip
+var errUnsupportedEncoding = errors.New("unsupported Content-Encoding")
+
+// TransportConfig tunes how admission reviews travel between the API server and the webhook, e.g. to work
+// around a proxy between them that compresses requests or mishandles chunked or compressed responses.
+// Responses always have a Content-Length so they're never chunked.
+type TransportConfig struct {
+	// Compression - gzip responses when the client accepts it.
+	Compression bool
+
+	// SecondPath - an additional path serving the webhook, e.g. /inject-plain, so the path the API server
+	// uses can pick the compression, the main path is /inject.
+	SecondPath string
+
+	// SecondPathCompression - gzip responses on SecondPath when the client accepts it.
+	SecondPathCompression bool
+
+	// DisableNoDelay - clear TCP_NODELAY on accepted connections so small writes are coalesced, Go sets
+	// it by default.
+	DisableNoDelay bool
+
+	// WriteBufferSize - the socket send buffer size of accepted connections, 0 keeps the system default.
+	WriteBufferSize int
+
+	// MaxRequestBytes - the largest admission review accepted, after decompressing it, 0 is 16MiB.
+	MaxRequestBytes int
+}
+
+// requestBody returns the body of an admission review, decompressed if it's gzip encoded. At most maxBytes
+// are read, of the body and of what it decompresses to, so a small compressed body can't expand without
+// bound.
+func requestBody(w http.ResponseWriter, r *http.Request, maxBytes int) (io.Reader, error) {
+	if maxBytes <= 0 {
+		maxBytes = defaultMaxRequestBytes
+	}
+	if r.Body == nil {
+		return http.NoBody, nil
+	}
+	body := http.MaxBytesReader(w, r.Body, int64(maxBytes))
+	switch encoding := strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding"))); encoding {
+	case "", "identity":
+		return body, nil
+	case "gzip", "x-gzip":
+		zr, err := gzip.NewReader(body)
+		if err == io.EOF {
+			return http.NoBody, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("can't decompress the gzip body: %w", err)
+		}
+		return http.MaxBytesReader(w, zr, int64(maxBytes)), nil
+	default:
+		return nil, fmt.Errorf("%w %s, expect gzip", errUnsupportedEncoding, encoding)
+	}
+}
+
+// acceptsGzip returns whether the client accepts gzip encoded responses
+func acceptsGzip(r *http.Request) bool {
+	for _, encoding := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(encoding), ";")
+		if strings.EqualFold(strings.TrimSpace(name), "gzip") && strings.ReplaceAll(params, " ", "") != "q=0" {
+			return true
+		}
+	}
+	return false
+}
+
+// writeResponse writes the encoded admission review with a Content-Length, gzipped if compress is set and
+// the client accepts it
+func writeResponse(w http.ResponseWriter, r *http.Request, body []byte, compress bool) error {
+	w.Header().Set("Content-Type", "application/json")
+	if compress {
+		w.Header().Add("Vary", "Accept-Encoding")
+		if acceptsGzip(r) {
+			var buf bytes.Buffer
+			zw := gzip.NewWriter(&buf)
+			if _, err := zw.Write(body); err != nil {
+				return err
+			}
+			if err := zw.Close(); err != nil {
+				return err
+			}
+			body = buf.Bytes()
+			w.Header().Set("Content-Encoding", "gzip")
+		}
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	_, err := w.Write(body)
+	return err
+}
+
+// transportListener applies the socket options of the transport config to accepted connections
+type transportListener struct {
+	net.Listener
+	transport TransportConfig
+}
+
+// Accept waits for the next connection and sets its socket options, failing to set them isn't fatal
+func (l transportListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if tcp, ok := conn.(*net.TCPConn); ok {
+		if l.transport.DisableNoDelay {
+			_ = tcp.SetNoDelay(false)
+		}
+		if l.transport.WriteBufferSize > 0 {
+			_ = tcp.SetWriteBuffer(l.transport.WriteBufferSize)
+		}
+	}
+	return conn, nil
+}
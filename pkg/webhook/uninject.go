@@ -0,0 +1,481 @@
+package webhook
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/centml/simple-sidecar/pkg/patch"
+)
+
+// the inject annotation values that opt a pod out of injection
+const (
+	injectFalse    = "false"
+	injectDisabled = "disabled"
+)
+
+var uninjectedPods = newCounterVec("uninjected_pods_total", "Injected pods whose injection was removed because their inject annotation disables it, by config.", "config")
+
+// injectionDisabled returns whether the inject annotation value opts the pod out of injection
+func injectionDisabled(value string) bool {
+	switch strings.ToLower(value) {
+	case injectFalse, injectDisabled:
+		return true
+	}
+	return false
+}
+
+// uninject returns the response to a pod whose inject annotation disables injection. Pods created from a
+// template that was injected upstream, e.g. a copy of an injected pod, carry the status and injected
+// annotations: what the injected annotation records is removed along with them. Other pods are admitted
+// as they are.
+func (whs *WebhookServer) uninject(pod *corev1.Pod, id string) *admissionv1.AdmissionResponse {
+	annotations := pod.GetAnnotations()
+	if !isInjectedStatus(annotations[whs.annotations.status]) {
+		whs.infoLogger.Printf("Skipping mutation for %s, injection is disabled", id)
+		return &admissionv1.AdmissionResponse{Allowed: true}
+	}
+	configName := annotations[whs.annotations.config]
+	uninjected, err := whs.uninjected(pod)
+	if err != nil {
+		whs.warningLogger.Printf("Can't remove the injection of %s: %v", id, err)
+		return &admissionv1.AdmissionResponse{
+			Allowed:  true,
+			Warnings: []string{"simple-sidecar can't remove the injected containers, the pod doesn't record what was injected"},
+		}
+	}
+
+	ops, err := uninjectionPatch(pod, uninjected)
+	var patchBytes []byte
+	if err == nil {
+		patchBytes, err = patch.Marshal(ops)
+	}
+	if err != nil {
+		whs.warningLogger.Printf("Can't remove the injection of %s: %v", id, err)
+		return &admissionv1.AdmissionResponse{Allowed: true}
+	}
+	uninjectedPods.WithLabelValues(configName).Inc()
+	whs.infoLogger.Printf("Removing the injection of config %s from %s, injection is disabled", configName, id)
+	pt := admissionv1.PatchTypeJSONPatch
+	return &admissionv1.AdmissionResponse{
+		Allowed:   true,
+		Patch:     patchBytes,
+		PatchType: &pt,
+	}
+}
+
+// uninjectionPatch returns the operations turning the pod into the uninjected one: the spec is patched
+// where it differs, the annotations and labels are set to the uninjected ones. The spec is never replaced
+// as a whole, it has fields the pod was decoded without, e.g. the restartPolicy of native sidecars.
+func uninjectionPatch(pod, uninjected *corev1.Pod) ([]patchOperation, error) {
+	var ops []patchOperation
+	if !reflect.DeepEqual(pod.Spec, uninjected.Spec) {
+		type document struct {
+			Spec corev1.PodSpec `json:"spec"`
+		}
+		original, err := json.Marshal(document{pod.Spec})
+		if err != nil {
+			return nil, err
+		}
+		modified, err := json.Marshal(document{uninjected.Spec})
+		if err != nil {
+			return nil, err
+		}
+		if ops, err = patch.Diff(original, modified); err != nil {
+			return nil, err
+		}
+	}
+	for _, m := range []struct {
+		path         string
+		before, kept map[string]string
+	}{{"/metadata/annotations", pod.Annotations, uninjected.Annotations}, {"/metadata/labels", pod.Labels, uninjected.Labels}} {
+		// the pod had none before the injection
+		if len(m.kept) == 0 && len(m.before) > 0 {
+			ops = append(ops, patchOperation{Op: "remove", Path: m.path})
+			continue
+		}
+		for _, key := range sortedKeys(m.before) {
+			if _, ok := m.kept[key]; !ok {
+				ops = append(ops, patchOperation{Op: "remove", Path: m.path + "/" + patch.EscapeJSONPointer(key)})
+			}
+		}
+		changed := map[string]string{}
+		for key, value := range m.kept {
+			if before, ok := m.before[key]; ok && before != value {
+				changed[key] = value
+			}
+		}
+		ops = append(ops, patch.SetMapEntries(m.before, changed, m.path)...)
+	}
+	return ops, nil
+}
+
+// uninjected returns a copy of the pod as it was created, without what its injected annotation records.
+// Pods that aren't injected are returned as they are, injected pods without the annotation can't be.
+func (whs *WebhookServer) uninjected(pod *corev1.Pod) (*corev1.Pod, error) {
+	pod = pod.DeepCopy()
+	if pod.Namespace == "" {
+		pod.Namespace = metav1.NamespaceDefault
+	}
+	if !isInjectedStatus(pod.Annotations[whs.annotations.status]) {
+		return pod, nil
+	}
+	value, ok := pod.Annotations[whs.annotations.injected]
+	if !ok {
+		return nil, fmt.Errorf("annotation %s is missing", whs.annotations.injected)
+	}
+	var record injectionRecord
+	if err := json.Unmarshal([]byte(value), &record); err != nil {
+		return nil, fmt.Errorf("annotation %s: %v", whs.annotations.injected, err)
+	}
+	if err := record.remove(pod); err != nil {
+		return nil, err
+	}
+	for _, key := range []string{whs.annotations.status, whs.annotations.config, whs.annotations.release, whs.annotations.hash, whs.annotations.injected} {
+		delete(pod.Annotations, key)
+	}
+	return pod, nil
+}
+
+// recordInjection adds the injected annotation to the patch, recording what it adds to the pod and what
+// it replaces
+func (whs *WebhookServer) recordInjection(pod *corev1.Pod, patchBytes []byte) ([]byte, error) {
+	injected, err := applyPatch(pod, patchBytes)
+	if err != nil {
+		return nil, err
+	}
+	record, err := json.Marshal(newInjectionRecord(pod, injected))
+	if err != nil {
+		return nil, err
+	}
+	var ops []patchOperation
+	if err := json.Unmarshal(patchBytes, &ops); err != nil {
+		return nil, err
+	}
+	ops = append(ops, whs.updateAnnotation(injected.Annotations, map[string]string{whs.annotations.injected: string(record)})...)
+	return patch.Marshal(ops)
+}
+
+// injectionRecord is what an injection added to a pod and replaced on it. Lists record the keys of the
+// entries added and the entries replaced as they were, fields record their value before the injection,
+// null if the injection set them.
+type injectionRecord struct {
+	InitContainers []string                   `json:"initContainers,omitempty"`
+	Containers     []string                   `json:"containers,omitempty"`
+	Volumes        *listRecord[corev1.Volume] `json:"volumes,omitempty"`
+	Tolerations    []corev1.Toleration        `json:"tolerations,omitempty"`
+	Annotations    map[string]*string         `json:"annotations,omitempty"`
+	Labels         map[string]*string         `json:"labels,omitempty"`
+
+	// Spec are the other fields of the pod spec, e.g. the service account or the security context
+	Spec map[string]json.RawMessage `json:"spec,omitempty"`
+
+	// Changed are the pod's own containers and initContainers the injection changed, by name
+	Changed map[string]containerRecord `json:"changed,omitempty"`
+}
+
+// containerRecord is what an injection added to a container of the pod and replaced on it
+type containerRecord struct {
+	Env          *listRecord[corev1.EnvVar]        `json:"env,omitempty"`
+	EnvFrom      *listRecord[corev1.EnvFromSource] `json:"envFrom,omitempty"`
+	VolumeMounts *listRecord[corev1.VolumeMount]   `json:"volumeMounts,omitempty"`
+
+	// Fields are the container's other fields, e.g. the resources or the security context
+	Fields map[string]json.RawMessage `json:"fields,omitempty"`
+}
+
+// listRecord is what an injection did to a list whose entries have a key: the keys of the entries it
+// added and the entries it replaced, as they were
+type listRecord[T any] struct {
+	Added    []string `json:"added,omitempty"`
+	Replaced []T      `json:"replaced,omitempty"`
+}
+
+// the keys of the list entries, a container's volume mounts are keyed by path
+var (
+	volumeKey      = func(v corev1.Volume) string { return v.Name }
+	envVarKey      = func(e corev1.EnvVar) string { return e.Name }
+	volumeMountKey = func(vm corev1.VolumeMount) string { return vm.MountPath }
+)
+
+// the pod spec and container fields recorded as lists rather than values
+var (
+	specLists      = []string{"initContainers", "containers", "ephemeralContainers", "volumes", "tolerations"}
+	containerLists = []string{"name", "env", "envFrom", "volumeMounts"}
+)
+
+// newInjectionRecord returns what was injected into the admitted pod to get the injected one
+func newInjectionRecord(admitted, injected *corev1.Pod) injectionRecord {
+	record := injectionRecord{
+		Volumes:     diffList(admitted.Spec.Volumes, injected.Spec.Volumes, volumeKey),
+		Annotations: diffMap(admitted.Annotations, injected.Annotations),
+		Labels:      diffMap(admitted.Labels, injected.Labels),
+		Spec:        diffFields(admitted.Spec, injected.Spec, specLists),
+	}
+	for _, toleration := range injected.Spec.Tolerations {
+		if !hasToleration(admitted.Spec.Tolerations, toleration) {
+			record.Tolerations = append(record.Tolerations, toleration)
+		}
+	}
+
+	own := map[string]corev1.Container{}
+	for _, container := range append(append([]corev1.Container{}, admitted.Spec.InitContainers...), admitted.Spec.Containers...) {
+		own[container.Name] = container
+	}
+	containers := func(list []corev1.Container) []string {
+		var added []string
+		for _, container := range list {
+			before, ok := own[container.Name]
+			if !ok {
+				added = append(added, container.Name)
+				continue
+			}
+			changed := containerRecord{
+				Env:          diffList(before.Env, container.Env, envVarKey),
+				EnvFrom:      diffList(before.EnvFrom, container.EnvFrom, envFromKey),
+				VolumeMounts: diffList(before.VolumeMounts, container.VolumeMounts, volumeMountKey),
+				Fields:       diffFields(before, container, containerLists),
+			}
+			if !reflect.DeepEqual(changed, containerRecord{}) {
+				if record.Changed == nil {
+					record.Changed = map[string]containerRecord{}
+				}
+				record.Changed[container.Name] = changed
+			}
+		}
+		return added
+	}
+	record.InitContainers = containers(injected.Spec.InitContainers)
+	record.Containers = containers(injected.Spec.Containers)
+	return record
+}
+
+// remove removes what the record holds from the pod
+func (r injectionRecord) remove(pod *corev1.Pod) error {
+	spec, err := restoreFields(pod.Spec, r.Spec)
+	if err != nil {
+		return fmt.Errorf("pod spec: %v", err)
+	}
+	pod.Spec = spec
+
+	containerNames := map[string]bool{}
+	for _, name := range append(append([]string{}, r.InitContainers...), r.Containers...) {
+		containerNames[name] = true
+	}
+	containers := func(list []corev1.Container) ([]corev1.Container, error) {
+		var kept []corev1.Container
+		for _, container := range list {
+			if containerNames[container.Name] {
+				continue
+			}
+			if changed, ok := r.Changed[container.Name]; ok {
+				restored, err := restoreFields(container, changed.Fields)
+				if err != nil {
+					return nil, fmt.Errorf("container %s: %v", container.Name, err)
+				}
+				container = restored
+				container.Env = changed.Env.remove(container.Env, envVarKey)
+				container.EnvFrom = changed.EnvFrom.remove(container.EnvFrom, envFromKey)
+				container.VolumeMounts = changed.VolumeMounts.remove(container.VolumeMounts, volumeMountKey)
+			}
+			kept = append(kept, container)
+		}
+		return kept, nil
+	}
+	if pod.Spec.InitContainers, err = containers(pod.Spec.InitContainers); err != nil {
+		return err
+	}
+	if pod.Spec.Containers, err = containers(pod.Spec.Containers); err != nil {
+		return err
+	}
+	pod.Spec.Volumes = r.Volumes.remove(pod.Spec.Volumes, volumeKey)
+
+	var tolerations []corev1.Toleration
+	for _, toleration := range pod.Spec.Tolerations {
+		if !hasToleration(r.Tolerations, toleration) {
+			tolerations = append(tolerations, toleration)
+		}
+	}
+	pod.Spec.Tolerations = tolerations
+
+	pod.Annotations = restoreMap(pod.Annotations, r.Annotations)
+	pod.Labels = restoreMap(pod.Labels, r.Labels)
+	return nil
+}
+
+// diffList returns the entries of after added to before and the entries of before after replaced, nil
+// if there are none
+func diffList[T any](before, after []T, key func(T) string) *listRecord[T] {
+	index := map[string]T{}
+	for _, entry := range before {
+		index[key(entry)] = entry
+	}
+	var record listRecord[T]
+	for _, entry := range after {
+		previous, ok := index[key(entry)]
+		switch {
+		case !ok:
+			record.Added = append(record.Added, key(entry))
+		case !reflect.DeepEqual(previous, entry):
+			record.Replaced = append(record.Replaced, previous)
+		}
+	}
+	if len(record.Added) == 0 && len(record.Replaced) == 0 {
+		return nil
+	}
+	return &record
+}
+
+// remove returns the list without the entries the record added and with the ones it replaced restored,
+// nil if none is left
+func (r *listRecord[T]) remove(list []T, key func(T) string) []T {
+	if r == nil {
+		return list
+	}
+	added := map[string]bool{}
+	for _, k := range r.Added {
+		added[k] = true
+	}
+	replaced := map[string]T{}
+	for _, entry := range r.Replaced {
+		replaced[key(entry)] = entry
+	}
+	var kept []T
+	for _, entry := range list {
+		if previous, ok := replaced[key(entry)]; ok {
+			entry = previous
+		} else if added[key(entry)] {
+			continue
+		}
+		kept = append(kept, entry)
+	}
+	return kept
+}
+
+// diffMap returns the keys after sets mapped to their value in before, nil if before doesn't have them
+func diffMap(before, after map[string]string) map[string]*string {
+	var changed map[string]*string
+	for key, value := range after {
+		previous, ok := before[key]
+		if ok && previous == value {
+			continue
+		}
+		if changed == nil {
+			changed = map[string]*string{}
+		}
+		if ok {
+			changed[key] = &previous
+		} else {
+			changed[key] = nil
+		}
+	}
+	return changed
+}
+
+// restoreMap returns the map with the keys of changed set back to their values, removed if they had none
+func restoreMap(m map[string]string, changed map[string]*string) map[string]string {
+	for key, previous := range changed {
+		if previous == nil {
+			delete(m, key)
+		} else if m != nil {
+			m[key] = *previous
+		}
+	}
+	if len(m) == 0 {
+		return nil
+	}
+	return m
+}
+
+// diffFields returns the JSON fields of before whose value after changed, except the skipped ones. The
+// fields after sets that before doesn't have are null.
+func diffFields(before, after interface{}, skipped []string) map[string]json.RawMessage {
+	beforeFields, err := objectFields(before)
+	if err != nil {
+		return nil
+	}
+	afterFields, err := objectFields(after)
+	if err != nil {
+		return nil
+	}
+	for _, name := range skipped {
+		delete(beforeFields, name)
+		delete(afterFields, name)
+	}
+	var changed map[string]json.RawMessage
+	for name, value := range afterFields {
+		previous, ok := beforeFields[name]
+		if ok && string(previous) == string(value) {
+			continue
+		}
+		if !ok {
+			previous = json.RawMessage("null")
+		}
+		if changed == nil {
+			changed = map[string]json.RawMessage{}
+		}
+		changed[name] = previous
+	}
+	for name, previous := range beforeFields {
+		if _, ok := afterFields[name]; !ok {
+			if changed == nil {
+				changed = map[string]json.RawMessage{}
+			}
+			changed[name] = previous
+		}
+	}
+	return changed
+}
+
+// restoreFields returns a copy of v with the fields set back to their recorded values
+func restoreFields[T any](v T, fields map[string]json.RawMessage) (T, error) {
+	if len(fields) == 0 {
+		return v, nil
+	}
+	current, err := objectFields(v)
+	if err != nil {
+		return v, err
+	}
+	for name, previous := range fields {
+		if string(previous) == "null" {
+			delete(current, name)
+		} else {
+			current[name] = previous
+		}
+	}
+	raw, err := json.Marshal(current)
+	if err != nil {
+		return v, err
+	}
+	var restored T
+	if err := json.Unmarshal(raw, &restored); err != nil {
+		return v, err
+	}
+	return restored, nil
+}
+
+// objectFields returns the fields of v's JSON object
+func objectFields(v interface{}) (map[string]json.RawMessage, error) {
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var fields map[string]json.RawMessage
+	return fields, json.Unmarshal(raw, &fields)
+}
+
+// envFromKey identifies an env source by its kind, name and prefix
+func envFromKey(source corev1.EnvFromSource) string {
+	switch {
+	case source.ConfigMapRef != nil:
+		return "configMap/" + source.ConfigMapRef.Name + "/" + source.Prefix
+	case source.SecretRef != nil:
+		return "secret/" + source.SecretRef.Name + "/" + source.Prefix
+	}
+	return ""
+}
@@ -0,0 +1,118 @@
+package webhook
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"reflect"
+	"testing"
+
+	jsonpatch "github.com/evanphx/json-patch"
+	admissionv1 "k8s.io/api/admission/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+// unknownFieldsPod has spec fields k8s.io/api doesn't decode: a native sidecar of its own, scheduling
+// gates and hostUsers
+const unknownFieldsPod = `{
+  "apiVersion": "v1",
+  "kind": "Pod",
+  "metadata": {"name": "app", "namespace": "default", "annotations": {"simple-sidecar.centml.ai/inject": "agent"}},
+  "spec": {
+    "hostUsers": false,
+    "schedulingGates": [{"name": "example.com/quota"}],
+    "initContainers": [{"name": "proxy", "image": "registry.example.com/proxy:1.0", "restartPolicy": "Always"}],
+    "containers": [{"name": "app", "image": "registry.example.com/app:1.0", "env": [{"name": "LOG_LEVEL", "value": "info"}]}]
+  }
+}`
+
+const uninjectConfigs = `
+agent:
+  initContainers:
+  - name: fetch
+    image: registry.example.com/fetch:1.0
+  containers:
+  - name: agent
+    image: registry.example.com/agent:1.0
+  envVars:
+  - name: AGENT_ADDR
+    value: localhost:4317
+  volumeMounts:
+  - name: agent-data
+    mountPath: /agent
+  volumes:
+  - name: agent-data
+    emptyDir: {}
+  labels:
+    agent: "true"
+`
+
+// admitRaw admits the raw pod with the operation and returns it with the response's patch applied
+func admitRaw(t *testing.T, whs *WebhookServer, raw []byte) []byte {
+	t.Helper()
+	ar := &admissionv1.AdmissionReview{
+		Request: &admissionv1.AdmissionRequest{
+			UID:       "test",
+			Kind:      metav1.GroupVersionKind{Version: "v1", Kind: "Pod"},
+			Resource:  metav1.GroupVersionResource{Version: "v1", Resource: "pods"},
+			Namespace: "default",
+			Operation: admissionv1.Create,
+			Object:    runtime.RawExtension{Raw: raw},
+		},
+	}
+	response := whs.mutate(ar, whs.state())
+	if !response.Allowed {
+		t.Fatalf("pod denied: %s", response.Result.Message)
+	}
+	if response.Patch == nil {
+		t.Fatalf("pod admitted without a patch, warnings %v", response.Warnings)
+	}
+	p, err := jsonpatch.DecodePatch(response.Patch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	patched, err := p.Apply(raw)
+	if err != nil {
+		t.Fatalf("applying %s: %v", response.Patch, err)
+	}
+	return patched
+}
+
+// setInject returns the raw pod with its inject annotation set to value
+func setInject(t *testing.T, raw []byte, value string) []byte {
+	t.Helper()
+	var pod map[string]interface{}
+	if err := json.Unmarshal(raw, &pod); err != nil {
+		t.Fatal(err)
+	}
+	pod["metadata"].(map[string]interface{})["annotations"].(map[string]interface{})["simple-sidecar.centml.ai/inject"] = value
+	data, err := json.Marshal(pod)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestUninjectKeepsUnknownSpecFields(t *testing.T) {
+	configs, err := LoadConfigFromBytes([]byte(uninjectConfigs))
+	if err != nil {
+		t.Fatal(err)
+	}
+	discard := log.New(io.Discard, "", 0)
+	whs := NewWebhookServer(&WebhookServerConfig{SidecarConfigs: configs, InfoLogger: discard, WarnLogger: discard, ErrorLogger: discard})
+
+	injected := admitRaw(t, whs, []byte(unknownFieldsPod))
+	uninjected := admitRaw(t, whs, setInject(t, injected, injectFalse))
+
+	var got, want interface{}
+	if err := json.Unmarshal(uninjected, &got); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(setInject(t, []byte(unknownFieldsPod), injectFalse), &want); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("uninjected pod = %s\nwant %s", uninjected, setInject(t, []byte(unknownFieldsPod), injectFalse))
+	}
+}
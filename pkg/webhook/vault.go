@@ -0,0 +1,205 @@
+package webhook
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	admissionWebhookAnnotationVaultRoleKey        = "simple-sidecar.centml.ai/vault-role"
+	admissionWebhookAnnotationVaultTemplatePrefix = "simple-sidecar.centml.ai/vault-template-"
+
+	defaultVaultImage       = "hashicorp/vault:1.15.4"
+	defaultVaultAuthPath    = "auth/kubernetes"
+	defaultVaultSecretsPath = "/vault/secrets"
+
+	vaultSecretsVolumeName = "vault-secrets"
+	vaultHomeVolumeName    = "vault-home"
+	vaultHomePath          = "/home/vault"
+)
+
+// VaultAgentConfig is a preset for injecting Vault Agent. It expands into an init container that
+// renders secrets before the application starts, a sidecar that keeps them up to date, and the
+// shared volume the secrets are written to.
+//
+// The role and templates can be set per pod with the simple-sidecar.centml.ai/vault-role and
+// simple-sidecar.centml.ai/vault-template-<file> annotations, which take precedence over the config.
+type VaultAgentConfig struct {
+	// Image - the Vault image to run the agent from, defaults to hashicorp/vault.
+	Image string
+
+	// Address - the address of the Vault server.
+	Address string
+
+	// Role - the Vault kubernetes auth role to log in with.
+	Role string
+
+	// AuthPath - the mount path of the kubernetes auth method, defaults to auth/kubernetes.
+	AuthPath string
+
+	// SecretsPath - where rendered secrets are mounted in every container, defaults to /vault/secrets.
+	SecretsPath string
+
+	// Templates - consul-template contents keyed by the file name they are rendered to.
+	Templates map[string]string
+
+	// Resources - resources for the agent containers.
+	Resources corev1.ResourceRequirements
+}
+
+// vaultAgentConfig mirrors the parts of the Vault Agent JSON configuration that we render
+type vaultAgentConfig struct {
+	AutoAuth      vaultAutoAuth   `json:"auto_auth"`
+	ExitAfterAuth bool            `json:"exit_after_auth"`
+	PidFile       string          `json:"pid_file"`
+	Vault         vaultServer     `json:"vault"`
+	Template      []vaultTemplate `json:"template,omitempty"`
+}
+
+type vaultAutoAuth struct {
+	Method []vaultAuthMethod `json:"method"`
+	Sink   []vaultSink       `json:"sink"`
+}
+
+type vaultAuthMethod struct {
+	Type      string            `json:"type"`
+	MountPath string            `json:"mount_path"`
+	Config    map[string]string `json:"config"`
+}
+
+type vaultSink struct {
+	Type   string            `json:"type"`
+	Config map[string]string `json:"config"`
+}
+
+type vaultServer struct {
+	Address string `json:"address"`
+}
+
+type vaultTemplate struct {
+	Destination string `json:"destination"`
+	Contents    string `json:"contents"`
+}
+
+// expandVault returns a copy of the config with the Vault Agent preset expanded for the given pod
+func expandVault(pod *corev1.Pod, config Config) (Config, error) {
+	vault := config.Vault
+	if vault == nil {
+		return config, nil
+	}
+
+	annotations := pod.GetAnnotations()
+	role := vault.Role
+	if r, ok := annotations[admissionWebhookAnnotationVaultRoleKey]; ok {
+		role = r
+	}
+	if role == "" {
+		return config, fmt.Errorf("vault role is required, set it in the config or with the %s annotation", admissionWebhookAnnotationVaultRoleKey)
+	}
+
+	image := vault.Image
+	if image == "" {
+		image = defaultVaultImage
+	}
+	authPath := vault.AuthPath
+	if authPath == "" {
+		authPath = defaultVaultAuthPath
+	}
+	secretsPath := vault.SecretsPath
+	if secretsPath == "" {
+		secretsPath = defaultVaultSecretsPath
+	}
+
+	// annotations override templates of the same name from the config
+	templates := map[string]string{}
+	for name, contents := range vault.Templates {
+		templates[name] = contents
+	}
+	for key, contents := range annotations {
+		if strings.HasPrefix(key, admissionWebhookAnnotationVaultTemplatePrefix) {
+			templates[strings.TrimPrefix(key, admissionWebhookAnnotationVaultTemplatePrefix)] = contents
+		}
+	}
+	names := make([]string, 0, len(templates))
+	for name := range templates {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	agentConfig := vaultAgentConfig{
+		AutoAuth: vaultAutoAuth{
+			Method: []vaultAuthMethod{{
+				Type:      "kubernetes",
+				MountPath: authPath,
+				Config:    map[string]string{"role": role},
+			}},
+			Sink: []vaultSink{{
+				Type:   "file",
+				Config: map[string]string{"path": path.Join(vaultHomePath, ".vault-token")},
+			}},
+		},
+		PidFile: path.Join(vaultHomePath, ".pid"),
+		Vault:   vaultServer{Address: vault.Address},
+	}
+	for _, name := range names {
+		agentConfig.Template = append(agentConfig.Template, vaultTemplate{
+			Destination: path.Join(secretsPath, name),
+			Contents:    templates[name],
+		})
+	}
+
+	sidecarConfig, err := json.Marshal(agentConfig)
+	if err != nil {
+		return config, err
+	}
+	agentConfig.ExitAfterAuth = true
+	initConfig, err := json.Marshal(agentConfig)
+	if err != nil {
+		return config, err
+	}
+
+	mounts := []corev1.VolumeMount{
+		{Name: vaultSecretsVolumeName, MountPath: secretsPath},
+		{Name: vaultHomeVolumeName, MountPath: vaultHomePath},
+	}
+	agent := func(name string, agentConfig []byte) corev1.Container {
+		return corev1.Container{
+			Name:    name,
+			Image:   image,
+			Command: []string{"/bin/sh", "-ec"},
+			Args: []string{
+				fmt.Sprintf(`echo "$VAULT_CONFIG" > %s/config.json && vault agent -config=%s/config.json`, vaultHomePath, vaultHomePath),
+			},
+			Env: []corev1.EnvVar{
+				{Name: "VAULT_ADDR", Value: vault.Address},
+				{Name: "VAULT_CONFIG", Value: string(agentConfig)},
+			},
+			Resources:    vault.Resources,
+			VolumeMounts: mounts,
+		}
+	}
+
+	// copy the slices so the shared config is never modified
+	config.InitContainers = append(append([]corev1.Container{}, config.InitContainers...), agent("vault-agent-init", initConfig))
+	config.Containers = append(append([]corev1.Container{}, config.Containers...), agent("vault-agent", sidecarConfig))
+	config.Volumes = append(append([]corev1.Volume{}, config.Volumes...),
+		corev1.Volume{
+			Name:         vaultSecretsVolumeName,
+			VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{Medium: corev1.StorageMediumMemory}},
+		},
+		corev1.Volume{
+			Name:         vaultHomeVolumeName,
+			VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{Medium: corev1.StorageMediumMemory}},
+		},
+	)
+	config.VolumeMounts = append(append([]corev1.VolumeMount{}, config.VolumeMounts...),
+		corev1.VolumeMount{Name: vaultSecretsVolumeName, MountPath: secretsPath, ReadOnly: true},
+	)
+	config.Vault = nil
+	return config, nil
+}
@@ -0,0 +1,138 @@
+package webhook
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"time"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+const (
+	adminReadyPath = "/readyz"
+
+	warmUpNamespace = "simple-sidecar-warm-up"
+	warmUpTimeout   = 10 * time.Second
+)
+
+// serveReady reports whether the server is ready for admissions, with warm-up enabled it only
+// becomes ready once the warm-up is done
+func (whs *WebhookServer) serveReady(w http.ResponseWriter, r *http.Request) {
+	if !whs.ready.Load() {
+		http.Error(w, "not ready", http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
+
+// warmUpPod returns the sample pod configs are rendered against during warm-up
+func warmUpPod(annotations map[string]string) *corev1.Pod {
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "warm-up",
+			Namespace:   warmUpNamespace,
+			Labels:      map[string]string{"app": "warm-up"},
+			Annotations: annotations,
+		},
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{{Name: "warm-up", Image: "warm-up"}},
+		},
+	}
+}
+
+// warmUp loads the certificate, renders every config against a sample pod and sends one admission
+// through addr so the first real admission doesn't pay for any of it, then marks the server ready.
+// Failures are logged and don't keep the server from becoming ready.
+func (whs *WebhookServer) warmUp(addr net.Addr) {
+	start := time.Now()
+	if _, err := whs.getCertificate(nil); err != nil {
+		whs.warningLogger.Printf("Warm-up: can't load the certificate: %v", err)
+	}
+
+	for _, server := range append([]*WebhookServer{whs}, whs.tenants...) {
+		configs := server.state().sidecarConfigs
+		names := make([]string, 0, len(configs))
+		for name := range configs {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			annotations := map[string]string{server.annotations.status: statusInjected}
+			if _, err := server.createPatch(warmUpPod(nil), configs[name], annotations); err != nil {
+				whs.warningLogger.Printf("Warm-up: config %s/%s doesn't render for the sample pod: %v", server.name, name, err)
+			}
+		}
+	}
+
+	if err := whs.selfAdmit(addr); err != nil {
+		whs.warningLogger.Printf("Warm-up: self admission failed: %v", err)
+	}
+
+	whs.ready.Store(true)
+	whs.infoLogger.Printf("Warm-up done in %v, ready", time.Since(start))
+}
+
+// selfAdmit sends an admission review for the sample pod to the webhook listening on addr, the pod
+// doesn't request injection so it exercises the TLS handshake and decoding without side effects
+func (whs *WebhookServer) selfAdmit(addr net.Addr) error {
+	host, port, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return err
+	}
+	// wildcard listeners are reached through loopback
+	if ip := net.ParseIP(host); ip == nil || ip.IsUnspecified() {
+		host = "127.0.0.1"
+		if ip != nil && ip.To4() == nil {
+			host = "::1"
+		}
+	}
+
+	raw, err := json.Marshal(warmUpPod(nil))
+	if err != nil {
+		return err
+	}
+	body, err := json.Marshal(admissionv1.AdmissionReview{
+		TypeMeta: metav1.TypeMeta{APIVersion: "admission.k8s.io/v1", Kind: "AdmissionReview"},
+		Request: &admissionv1.AdmissionRequest{
+			UID:       "warm-up",
+			Kind:      metav1.GroupVersionKind{Version: "v1", Kind: "Pod"},
+			Resource:  metav1.GroupVersionResource{Version: "v1", Resource: "pods"},
+			Namespace: warmUpNamespace,
+			Operation: admissionv1.Create,
+			Object:    runtime.RawExtension{Raw: raw},
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	// the request never leaves the host and only exercises our own certificate
+	client := &http.Client{
+		Timeout:   warmUpTimeout,
+		Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}},
+	}
+	resp, err := client.Post(fmt.Sprintf("https://%s%s", net.JoinHostPort(host, port), webhookInjectPath), "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	var review admissionv1.AdmissionReview
+	if err := json.NewDecoder(resp.Body).Decode(&review); err != nil {
+		return err
+	}
+	if review.Response == nil {
+		return fmt.Errorf("empty admission response")
+	}
+	return nil
+}
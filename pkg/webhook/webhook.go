@@ -4,25 +4,30 @@ import (
 	"context"
 	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"net"
 	"net/http"
 	"os"
+	"path/filepath"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	admissionv1 "k8s.io/api/admission/v1"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"k8s.io/apimachinery/pkg/runtime"
-	"k8s.io/apimachinery/pkg/runtime/serializer"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/metadata"
 	"sigs.k8s.io/yaml"
+
+	"github.com/centml/simple-sidecar/pkg/patch"
 )
 
 var (
-	runtimeScheme     = runtime.NewScheme()
-	codecs            = serializer.NewCodecFactory(runtimeScheme)
-	deserializer      = codecs.UniversalDeserializer()
 	webhookInjectPath = "/inject"
 )
 
@@ -32,14 +37,94 @@ var ignoredNamespaces = []string{
 }
 
 const (
-	admissionWebhookAnnotationInjectKey = "simple-sidecar.centml.ai/inject"
-	admissionWebhookAnnotationStatusKey = "simple-sidecar.cemtml.ai/status"
+	admissionWebhookAnnotationInjectKey      = "simple-sidecar.centml.ai/inject"
+	admissionWebhookAnnotationStatusKey      = "simple-sidecar.cemtml.ai/status"
+	admissionWebhookAnnotationExcludeKey     = "simple-sidecar.centml.ai/exclude-containers"
+	admissionWebhookAnnotationConfigKey      = "simple-sidecar.centml.ai/config"
+	admissionWebhookAnnotationReleaseKey     = "simple-sidecar.centml.ai/release"
+	admissionWebhookAnnotationHashKey        = "simple-sidecar.centml.ai/config-hash"
+	admissionWebhookAnnotationOwnerKey       = "simple-sidecar.centml.ai/owner-injection"
+	admissionWebhookLabelVariantKey          = "simple-sidecar.centml.ai/variant"
+	admissionWebhookAnnotationFilePrefix     = "simple-sidecar.centml.ai/file-"
+	admissionWebhookAnnotationOverridePrefix = "simple-sidecar.centml.ai/override."
+	admissionWebhookAnnotationDebugKey       = "simple-sidecar.centml.ai/debug"
+	admissionWebhookAnnotationInjectedKey    = "simple-sidecar.centml.ai/injected"
 )
 
+// annotationKeys are the pod annotations a WebhookServer reads and writes, and the variant label
+type annotationKeys struct {
+	inject  string
+	status  string
+	exclude string
+	config  string
+	release string
+	hash    string
+	owner   string
+	variant string
+
+	// file is the prefix of the annotations rendered files are stored in, followed by the file name
+	file string
+
+	// override is the prefix of the annotations overriding fields of injected containers, followed by
+	// the container and the field
+	override string
+
+	// debug names the configs whose ephemeral containers are added to the running pod
+	debug string
+
+	// injected records what the injection added to the pod and replaced on it, so it can be removed
+	injected string
+}
+
+// defaultAnnotationKeys are the annotations of the default injection domain
+var defaultAnnotationKeys = annotationKeys{
+	inject:   admissionWebhookAnnotationInjectKey,
+	status:   admissionWebhookAnnotationStatusKey,
+	exclude:  admissionWebhookAnnotationExcludeKey,
+	config:   admissionWebhookAnnotationConfigKey,
+	release:  admissionWebhookAnnotationReleaseKey,
+	hash:     admissionWebhookAnnotationHashKey,
+	owner:    admissionWebhookAnnotationOwnerKey,
+	variant:  admissionWebhookLabelVariantKey,
+	file:     admissionWebhookAnnotationFilePrefix,
+	override: admissionWebhookAnnotationOverridePrefix,
+	debug:    admissionWebhookAnnotationDebugKey,
+	injected: admissionWebhookAnnotationInjectedKey,
+}
+
+// domainAnnotationKeys returns the annotations for a tenant's annotation domain
+func domainAnnotationKeys(domain string) annotationKeys {
+	return annotationKeys{
+		inject:   domain + "/inject",
+		status:   domain + "/status",
+		exclude:  domain + "/exclude-containers",
+		config:   domain + "/config",
+		release:  domain + "/release",
+		hash:     domain + "/config-hash",
+		owner:    domain + "/owner-injection",
+		variant:  domain + "/variant",
+		file:     domain + "/file-",
+		override: domain + "/override.",
+		debug:    domain + "/debug",
+		injected: domain + "/injected",
+	}
+}
+
 // Config is the struct used to parse injection config items for Simple Sidecar. The InitContainers,
 // Containers, Volumes, and EnvVars fields are arrays of Kubernetes objects that will be added to
 // the pod spec.
 type Config struct {
+	// Extends - the name of a config in the same file this one is based on. Fields this config doesn't set
+	// are inherited, containers, initContainers, volumes, envVars and files are merged by name and
+	// volumeMounts by mountPath with this config's entries replacing the base's. Tests and Experiment aren't inherited.
+	Extends string
+
+	// Aliases - other names pods may request the config by, e.g. telemetry-v2 for telemetry. Names and
+	// aliases are matched case-insensitively. Aliases aren't inherited by configs extending this one.
+	Aliases []string
+
+	// Include - add snippets from the templates section of the config file, see IncludeConfig.
+	Include *IncludeConfig
 
 	// InitContainers - inject one or more initContainers into the pod spec.
 	InitContainers []corev1.Container
@@ -47,8 +132,152 @@ type Config struct {
 	// Containers - inject one or more containers into the pod spec.
 	Containers []corev1.Container
 
+	// EphemeralContainers - ephemeral containers added on demand to running pods whose debug annotation
+	// names the config, e.g. debuggers or profilers. They're added when the pod's ephemeral containers are
+	// updated through the pods/ephemeralcontainers subresource, e.g. by kubectl debug.
+	EphemeralContainers []corev1.EphemeralContainer
+
 	// ExistingContainerConfig - configuration for injecting into the pre-existing containers.
 	ExistingContainerConfig
+
+	// Release - a free-form release of the config, e.g. the version of the sidecar it injects. It's
+	// recorded on injected pods along with the config name and groups the injected-pod inventory.
+	Release string
+
+	// Labels - labels added to injected pods, e.g. to select them in NetworkPolicies or for Prometheus
+	// service discovery. A label the pod already has is replaced.
+	Labels map[string]string
+
+	// Tolerations - tolerations added to injected pods, e.g. so pods with a GPU sidecar can be scheduled
+	// onto tainted GPU nodes. Tolerations the pod already has aren't added again.
+	Tolerations []corev1.Toleration
+
+	// Affinity - node affinity and pod (anti-)affinity rules merged into the pod's affinity, e.g. to keep
+	// pods with a sidecar away from each other. The pod's own rules are kept.
+	Affinity *corev1.Affinity
+
+	// PodSecurityContext - pod securityContext settings set on injected pods that don't set them, e.g.
+	// runAsNonRoot, fsGroup or a seccompProfile, to enforce baseline security settings.
+	PodSecurityContext *corev1.PodSecurityContext
+
+	// ShareProcessNamespace - set shareProcessNamespace on injected pods, e.g. for a debugger or profiler
+	// sidecar that needs to see the processes of the app containers. It replaces the pod's own setting.
+	ShareProcessNamespace *bool
+
+	// MinTerminationGracePeriodSeconds - the least terminationGracePeriodSeconds of injected pods, e.g. so
+	// a sidecar flushing its buffers on shutdown gets the time it needs. Pods with a longer grace period
+	// keep it, pods without one have the API server's default of 30 seconds.
+	MinTerminationGracePeriodSeconds int64
+
+	// InitOnly - the config only injects initContainers, e.g. a one-shot credential fetcher. Injected
+	// pods are marked init-injected rather than injected.
+	InitOnly bool
+
+	// RequiredOutputs - files the initContainers of an InitOnly config must produce. They're checked
+	// when the config is loaded and, at runtime, by an extra initContainer that runs last.
+	RequiredOutputs []RequiredOutput
+
+	// Scope - restrict the namespaces and pods this config may be applied to.
+	Scope ScopeConfig
+
+	// Preconditions - what a pod must look like for the config to work in it, see PreconditionsConfig.
+	Preconditions *PreconditionsConfig
+
+	// Vault - inject Vault Agent as an init container and sidecar, see VaultAgentConfig.
+	Vault *VaultAgentConfig
+
+	// OTelCollector - inject an OpenTelemetry collector sidecar, see OTelCollectorConfig.
+	OTelCollector *OTelCollectorConfig
+
+	// RenderTemplates - render the strings of initContainers, containers, volumes, envVars and volumeMounts
+	// as Go templates with the pod they're injected into, e.g. {{ .Pod.Namespace }}, {{ .Pod.Labels.app }}
+	// or {{ .Annotations "example.com/team" }}.
+	RenderTemplates bool
+
+	// Files - configuration files rendered per pod and mounted into the injected containers, see
+	// ConfigFile.
+	Files []ConfigFile
+
+	// FileStore - where the rendered files are stored: annotation (the default) stores them in
+	// annotations of the pod projected by the Downward API, configmap in a ConfigMap the webhook creates in
+	// the pod's namespace, for files that are large or that the pod's annotations shouldn't show.
+	FileStore string
+
+	// Sizing - size the injected containers in proportion to the pod's containers, see SizingConfig.
+	Sizing *SizingConfig
+
+	// NamespaceOverrides - change the config for the pods of some namespaces, the first override
+	// matching the pod's namespace applies, see NamespaceOverride.
+	NamespaceOverrides []NamespaceOverride
+
+	// Startup - start the initContainers and native sidecars in a declared order, see StartupConfig.
+	Startup *StartupConfig
+
+	// NativeSidecar - inject all of the config's containers, including those of its presets, as native
+	// sidecars, see StartupConfig.Sidecars. A single container is injected as one with nativeSidecar: true.
+	NativeSidecar bool
+
+	// InsertPositions - where the containers go in the pod's containers by name, see InsertPosition.
+	// Containers are appended by default, sidecars that must start before the app on clusters without
+	// native sidecars go first. Also set with insertPosition on the container's entry.
+	InsertPositions map[string]InsertPosition
+
+	// Experiment - give a share of the pods requesting this config a variant of it instead, see
+	// ExperimentConfig.
+	Experiment *ExperimentConfig
+
+	// RemoveServiceAccountToken - remove the auto-mounted service account token volume and its mounts
+	// from the pod, e.g. when an injected credential sidecar replaces it.
+	RemoveServiceAccountToken bool
+
+	// AutomountServiceAccountToken - set automountServiceAccountToken on injected pods, replacing the pod's
+	// own setting. The ServiceAccount admission plugin mounts the token before the webhook runs, so false
+	// removes the mounted token like RemoveServiceAccountToken, and true can't mount a token the pod opted
+	// out of.
+	AutomountServiceAccountToken *bool
+
+	// RemoveContainers - names of the pod's containers and initContainers removed from injected pods, with
+	// the volumes only they mount, e.g. to replace an old version of a sidecar or strip a vendor agent.
+	RemoveContainers []string
+
+	// ServiceAccountName - the service account injected pods run as, e.g. one bound to the IAM role or RBAC
+	// permissions the sidecar needs. It's only set on pods that run as the default service account unless
+	// OverrideExistingServiceAccount is set.
+	ServiceAccountName string
+
+	// OverrideExistingServiceAccount - set ServiceAccountName on pods that name another service account too.
+	OverrideExistingServiceAccount bool
+
+	// Topology - inject the topology of the pod's node into the env of the containers, see TopologyConfig.
+	Topology *TopologyConfig
+
+	// Overridable - the fields of the injected containers pods may override with override annotations:
+	// image, imagePullPolicy, resources and env. Pods can't override anything by default, overrides of
+	// other fields are ignored with a warning.
+	Overridable []string
+
+	// OnError - what happens to a pod when its patch can't be generated, e.g. a template fails to
+	// render: deny (the default) rejects the pod, allow admits it without injection. Use allow for
+	// optional sidecars. Pods in enforced namespaces are always denied.
+	OnError string
+
+	// JSONPatches - RFC 6902 patch files, such as kustomize patchesJson6902 files, appended to the
+	// generated patch. Relative paths are resolved against the directory of the config file.
+	JSONPatches []string
+
+	// Tests - sample pods and the state they are expected to be in after injection. These are
+	// executed by `simple-sidecar validate` and ignored by the webhook server.
+	Tests []ConfigTest
+
+	// jsonPatches - the operations loaded from JSONPatches.
+	jsonPatches []patchOperation
+
+	// fileAnnotations - the files rendered for the pod with the annotation store, by annotation.
+	fileAnnotations map[string]string
+
+	// filesVolume - the name of the volume the files are mounted from, filesVolumeName if empty. Pods
+	// injected with several configs with files have one volume for each.
+	filesVolume string
 }
 
 // ExistingContainerConfig provides configuration for injecting into the pre-existing containers.
@@ -57,12 +286,60 @@ type ExistingContainerConfig struct {
 	// Volumes - inject one or more volumes into pre-existing pod specs.
 	Volumes []corev1.Volume
 
+	// VolumesIfMissing - volumes only added to pods that don't have a volume of the same name, e.g. a
+	// scratch emptyDir shared with the app. They're never a conflict, whatever the VolumeConflictPolicy.
+	VolumesIfMissing []corev1.Volume
+
 	// EnvVars - inject one or more environment variables into pre-existing pod specs.
 	EnvVars []corev1.EnvVar
 
+	// EnvFrom - inject one or more ConfigMaps or Secrets as env into pre-existing pod specs, without
+	// listing each var.
+	EnvFrom []corev1.EnvFromSource
+
+	// InjectDownwardAPI - shorthands for env vars set from fields of the pod through the Downward API,
+	// added to EnvVars: podName (POD_NAME), namespace (POD_NAMESPACE), podUID (POD_UID), nodeName
+	// (NODE_NAME), serviceAccountName (SERVICE_ACCOUNT_NAME), podIP (POD_IP) and hostIP (HOST_IP).
+	InjectDownwardAPI []string
+
 	// VolumeMounts - inject one or more volume mounts into pre-existing pod specs.
 	// BEFORE sidecar injection.
 	VolumeMounts []corev1.VolumeMount
+
+	// ReorderExistingEnv - when env vars of pre-existing containers reference injected env vars with
+	// $(VAR), rewrite the container's env in dependency order so the references expand. Otherwise
+	// injected env vars are always appended.
+	ReorderExistingEnv bool
+
+	// EnvConflictPolicy - what's done with injected env vars a pre-existing container already has: append
+	// (the default, the injected var comes later and wins), skip (the container's value is kept), override
+	// (the container's var is replaced) or error (the patch fails, see Config.OnError).
+	EnvConflictPolicy string
+
+	// VolumeConflictPolicy - what's done with injected volumes the pod already has by name, and volume
+	// mounts a pre-existing container already has by mountPath: skip (the default, the pod's own is kept),
+	// override (the pod's own is replaced) or error (the patch fails, see Config.OnError).
+	VolumeConflictPolicy string
+
+	// ApplyToInitContainers - inject the env vars, env sources and volume mounts into the pre-existing
+	// initContainers as well, e.g. for init steps that need the injected credentials.
+	ApplyToInitContainers bool
+
+	// TargetContainers - the names of the pre-existing containers injected into, every container if
+	// empty, e.g. so only the app container of a pod gets the credentials.
+	TargetContainers []string
+
+	// ExcludeContainers - the names of the pre-existing containers never injected into, e.g. istio-proxy.
+	// Pods can exclude more with the exclude-containers annotation.
+	ExcludeContainers []string
+
+	// SecurityContext - the securityContext of pre-existing containers that don't set one, e.g. to drop
+	// capabilities or make the root filesystem read-only cluster-wide.
+	SecurityContext *corev1.SecurityContext
+
+	// DefaultResources - requests and limits set on pre-existing containers that are missing them, e.g. so
+	// every injected pod can be scheduled and billed by its requests.
+	DefaultResources *corev1.ResourceRequirements
 }
 
 // MultiConfig is a map of Config objects. This allows for multiple named configurations
@@ -70,20 +347,158 @@ type ExistingContainerConfig struct {
 // it is used to determine which configuration to use when injecting sidecars.
 type MultiConfig map[string]Config
 
-type patchOperation struct {
-	Op    string      `json:"op"`
-	Path  string      `json:"path"`
-	Value interface{} `json:"value,omitempty"`
-}
+// patchOperation is a JSON patch operation, see the patch package for the helpers building them
+type patchOperation = patch.Operation
 
-// LoadConfig loads the configuration from the specified file and returns a MultiConfig object.
+// LoadConfig loads the configuration from the specified file and returns a MultiConfig object. The
+// file may also be a directory of config files, see loadConfigDir, or a comma separated list of files and
+// directories merged in order, see loadConfigList. Unknown fields, e.g. a misspelled initContainers, and
+// duplicate keys are errors.
 func LoadConfig(configFile string) (cfg MultiConfig, err error) {
+	return loadConfig(configFile, ConfigLoadOptions{})
+}
+
+// LoadConfigLenient loads the configuration like LoadConfig but ignores unknown fields and duplicate keys.
+func LoadConfigLenient(configFile string) (cfg MultiConfig, err error) {
+	return loadConfig(configFile, ConfigLoadOptions{Lenient: true})
+}
+
+// LoadConfigFromBytes loads the configuration like LoadConfig from the contents of a YAML or JSON config
+// file, e.g. one embedded in a program or built by a test. jsonPatches files aren't supported since there's
+// no directory to resolve them against.
+func LoadConfigFromBytes(data []byte) (MultiConfig, error) {
+	cfg, err := parseConfigs(data, ConfigLoadOptions{})
+	if err != nil {
+		return nil, err
+	}
+	for name, config := range cfg {
+		if len(config.JSONPatches) > 0 {
+			return nil, fmt.Errorf("config %s: jsonPatches files aren't supported in configs loaded from bytes", name)
+		}
+	}
+	return cfg, nil
+}
+
+// LoadConfigFromReader loads the configuration like LoadConfigFromBytes from everything read from r.
+func LoadConfigFromReader(r io.Reader) (MultiConfig, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	return LoadConfigFromBytes(data)
+}
+
+// loadConfig loads the configs in a file, directory or comma separated list of them
+func loadConfig(configFile string, opts ConfigLoadOptions) (MultiConfig, error) {
+	if paths := configPaths(configFile); len(paths) > 1 {
+		return loadConfigList(paths, opts)
+	}
+	return loadConfigPath(strings.TrimSpace(configFile), opts)
+}
+
+// loadConfigPath loads the configs in a file or directory
+func loadConfigPath(configFile string, opts ConfigLoadOptions) (MultiConfig, error) {
+	info, err := os.Stat(configFile)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		return loadConfigDir(configFile, opts)
+	}
+	return loadConfigFile(configFile, opts)
+}
+
+// loadConfigFile loads and validates the configs in a single file and the files it includes
+func loadConfigFile(configFile string, opts ConfigLoadOptions) (cfg MultiConfig, err error) {
 	data, err := os.ReadFile(configFile)
 	if err != nil {
 		return nil, err
 	}
+	if data, _, err = includeConfigFiles(configFile, data, opts); err != nil {
+		return nil, err
+	}
+
+	if cfg, err = parseConfigs(data, opts); err != nil {
+		return nil, err
+	}
+
+	for name, config := range cfg {
+		if err := config.loadJSONPatches(filepath.Dir(configFile)); err != nil {
+			return nil, fmt.Errorf("config %s: %v", name, err)
+		}
+		cfg[name] = config
+	}
+
+	return cfg, nil
+}
+
+// prepareConfigFile decrypts a config file, migrates it to the current version and renames the fields it
+// spells differently from ours
+func prepareConfigFile(data []byte, opts ConfigLoadOptions) (_ []byte, err error) {
+	if isSOPSEncrypted(data) {
+		if !opts.SOPS {
+			return nil, fmt.Errorf("the configs are encrypted with SOPS, enable SOPS decryption to load them")
+		}
+		if data, err = decryptSOPS(data, opts.SOPSBinary); err != nil {
+			return nil, err
+		}
+	}
+	if data, err = migrateConfigFile(data, opts); err != nil {
+		return nil, err
+	}
+	if data, err = compatConfigFile(data, opts); err != nil {
+		return nil, err
+	}
+	return containerFlags(data, opts)
+}
+
+// parseConfigs parses the configs of a config file, adds the templates they include, expands and resolves
+// them and validates them
+func parseConfigs(data []byte, opts ConfigLoadOptions) (cfg MultiConfig, err error) {
+	if data, err = prepareConfigFile(data, opts); err != nil {
+		return nil, err
+	}
+	if doc, ok := decodeConfigFile(data); ok {
+		if _, ok := doc[configIncludeKey]; ok {
+			return nil, fmt.Errorf("%s is only supported in config files, these configs weren't read from one", configIncludeKey)
+		}
+	}
+	if !opts.Lenient {
+		if err := checkUnknownConfigFields(data); err != nil {
+			return nil, err
+		}
+	}
+	profiles, err := decodeConfigProfiles(data)
+	if err != nil {
+		return nil, err
+	}
+	if err := unmarshalConfigs(data, &cfg); err != nil {
+		return nil, err
+	}
+	delete(cfg, configProfilesKey)
+	if err := includeTemplates(cfg, splitConfigTemplates(cfg)); err != nil {
+		return nil, err
+	}
+	if opts.ExpandEnv {
+		if err := expandConfigsEnv(cfg, os.LookupEnv); err != nil {
+			return nil, err
+		}
+		if err := profiles.expandEnv(os.LookupEnv); err != nil {
+			return nil, err
+		}
+	}
+	if err := resolveExtends(cfg, configKeys(data)); err != nil {
+		return nil, err
+	}
+	if err := profiles.validate(cfg); err != nil {
+		return nil, err
+	}
+	profiles.apply(cfg, opts.Profile, opts.Logger)
+	if err := pinImages(cfg, opts); err != nil {
+		return nil, err
+	}
 
-	if err := yaml.Unmarshal(data, &cfg); err != nil {
+	if err := validateConfigs(cfg); err != nil {
 		return nil, err
 	}
 
@@ -93,252 +508,788 @@ func LoadConfig(configFile string) (cfg MultiConfig, err error) {
 // WebhookServer contains the configuration for the webhook server. It's used as a receiver for various
 // methods such as Start and Stop.
 type WebhookServer struct {
-	sidecarConfigs  MultiConfig
+	name            string
+	annotations     annotationKeys
+	configResolver  Resolver
+	tenants         []*WebhookServer
+	initErr         error
+	current         atomic.Pointer[serverState]
+	stateMu         sync.Mutex
+	patchCache      PatchCache
+	templateCache   *templateCache
 	server          *http.Server
+	listeners       []ListenerConfig
+	warmUpEnabled   bool
+	ready           atomic.Bool
+	latencyBudget   time.Duration
+	budgetSlots     chan struct{}
+	chaos           *ChaosConfig
+	transport       TransportConfig
+	markOrphaned    bool
+	injectOps       []admissionv1.Operation
+	patchEngine     PatchEngine
+	configFile      string
+	configWatch     bool
+	configLoad      ConfigLoadOptions
+	required        *ConfigRequirement
+	adminServer     *http.Server
+	adminToken      string
+	inventory       *Inventory
+	owners          *ownerMarkers
+	fileConfigMaps  *fileConfigMaps
+	nodes           *nodeTopology
+	crdConfigs      *crdConfigs
+	configMap       *configMapConfigs
+	stop            chan struct{}
 	certPEM, keyPEM string
+	certFile        string
+	keyFile         string
 	infoLogger      *log.Logger
 	warningLogger   *log.Logger
 	errorLogger     *log.Logger
 }
 
-// WebhookServerConfig is the configuration for the webhook server. It contains the port to listen on,
-// the path to the certificate and key files, the MultiConfig object containing the sidecar configurations,
-// and the loggers for info, warning, and error messages.
+// WebhookServerConfig is the configuration for the webhook server.
 type WebhookServerConfig struct {
-	Port           int
-	CertPEM        string
-	KeyPEM         string
+	// Port - the port the webhook listens on.
+	Port int
+
+	// Listeners - replaces the single listener on Port, e.g. for dual-stack or SO_REUSEPORT.
+	Listeners []ListenerConfig
+
+	// AdminPort - the port of the plain HTTP admin API, disabled if 0.
+	AdminPort int
+
+	// AdminToken - the bearer token changes through the admin API need, e.g. to the freeze. The admin API
+	// is read-only without it.
+	AdminToken string
+
+	// CertPEM - the path of the TLS certificate.
+	CertPEM string
+
+	// KeyPEM - the path of the TLS key.
+	KeyPEM string
+
+	// SidecarConfigs - the configs injected.
 	SidecarConfigs MultiConfig
-	InfoLogger     *log.Logger
-	ErrorLogger    *log.Logger
-	WarnLogger     *log.Logger
+
+	// ConfigFile - the file SidecarConfigs were loaded from, ReloadConfig reloads it.
+	ConfigFile string
+
+	// WatchConfig - reload ConfigFile whenever it changes.
+	WatchConfig bool
+
+	// ConfigLoad - how configs that are reloaded or read from resources are decoded.
+	ConfigLoad ConfigLoadOptions
+
+	// PatchCache - reuses the patches generated for identical pods.
+	PatchCache PatchCache
+
+	// TemplateCacheSize - bounds an LRU of configs rendered for pods whose templates read the same data,
+	// disabled if 0.
+	TemplateCacheSize int
+
+	// Tenants - additional injection domains served by the same listener.
+	Tenants []TenantConfig
+
+	// EnforcedNamespaces - namespaces where pods are denied unless they're injected.
+	EnforcedNamespaces []EnforcedNamespace
+
+	// InventoryClient - watches pods to keep an inventory of the injected ones.
+	InventoryClient metadata.Interface
+
+	// OwnerClient - records the config injected into the pods of a ReplicaSet or Job on the owner, so its
+	// later pods get the same config without being resolved again.
+	OwnerClient metadata.Interface
+
+	// FilesClient - creates the ConfigMaps storing the files of configs with the configmap file store.
+	FilesClient dynamic.Interface
+
+	// NodeClient - watches nodes so topology env can be set from the labels of the node a pod is bound to.
+	NodeClient metadata.Interface
+
+	// ConfigClient - watches SidecarConfig resources, the configs are kept in sync with them instead of
+	// being read from SidecarConfigs.
+	ConfigClient dynamic.Interface
+
+	// ConfigNamespace - the namespace ConfigClient watches, all namespaces if empty.
+	ConfigNamespace string
+
+	// ConfigMap - the ConfigMap or Secret key ConfigClient watches instead of SidecarConfig resources.
+	ConfigMap *ConfigMapSource
+
+	// Resolver - replaces the inject annotation for selecting the config of a pod.
+	Resolver Resolver
+
+	// MaxLogBytes - truncates longer log lines so huge pods can't flood the logs, disabled if 0.
+	MaxLogBytes int
+
+	// WarmUp - only report ready once the configs were rendered and a self admission went through.
+	WarmUp bool
+
+	// LatencyBudget - how long a patch may take before only the static part of the config is injected, so
+	// a slow render degrades to a partial injection rather than an admission timeout. Disabled if 0.
+	LatencyBudget time.Duration
+
+	// Transport - tunes response compression and the socket options of accepted connections, and can
+	// serve the webhook on a second path.
+	Transport TransportConfig
+
+	// MarkOrphaned - rewrite the status annotation of injected pods whose config no longer exists to
+	// orphaned when they're updated.
+	MarkOrphaned bool
+
+	// InjectOperations - the operations pods are injected on, only CREATE if empty. Pods admitted with
+	// other operations are left as they are.
+	InjectOperations []admissionv1.Operation
+
+	// PatchEngine - how the patch sent for an injection is produced, the operations of the patch mutators
+	// if empty.
+	PatchEngine PatchEngine
+
+	// Freeze - the initial injection freeze, SetFreeze and the admin API change it at runtime.
+	Freeze Freeze
+
+	// RequireConfigs - makes Start fail if the configs don't meet it once they're loaded or listed, reloads
+	// and updates that don't meet it are rejected.
+	RequireConfigs *ConfigRequirement
+
+	// Chaos - makes admissions fail on purpose, only set it in test clusters.
+	Chaos *ChaosConfig
+
+	// InfoLogger - the logger of info messages.
+	InfoLogger *log.Logger
+
+	// ErrorLogger - the logger of error messages.
+	ErrorLogger *log.Logger
+
+	// WarnLogger - the logger of warnings.
+	WarnLogger *log.Logger
 }
 
 // NewWebhookServer creates a new WebhookServer object with the specified configuration.
 func NewWebhookServer(cfg *WebhookServerConfig) *WebhookServer {
 
 	whsvr := &WebhookServer{
-		sidecarConfigs: cfg.SidecarConfigs,
+		name:           "default",
+		annotations:    defaultAnnotationKeys,
+		configResolver: cfg.Resolver,
+		patchCache:     cfg.PatchCache,
 		server: &http.Server{
 			Addr: fmt.Sprintf(":%v", cfg.Port),
-			TLSConfig: &tls.Config{
-				// each request we retrieve the certs incase they have been rotated
-				// this could be a bit smarter and only reload the certs if they have changed
-				// for clusters without extreme churn this should be fine
-				GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
-					cert, err := tls.LoadX509KeyPair(cfg.CertPEM, cfg.KeyPEM)
-					if err != nil {
-						return nil, err
-					}
-					return &cert, nil
-				},
-			},
 		},
-		infoLogger:    cfg.InfoLogger,
-		warningLogger: cfg.WarnLogger,
-		errorLogger:   cfg.ErrorLogger,
+		listeners:     cfg.Listeners,
+		warmUpEnabled: cfg.WarmUp,
+		latencyBudget: cfg.LatencyBudget,
+		budgetSlots:   newBudgetSlots(),
+		chaos:         cfg.Chaos,
+		transport:     cfg.Transport,
+		markOrphaned:  cfg.MarkOrphaned,
+		injectOps:     cfg.InjectOperations,
+		patchEngine:   cfg.PatchEngine,
+		configFile:    cfg.ConfigFile,
+		configWatch:   cfg.WatchConfig,
+		configLoad:    cfg.ConfigLoad,
+		required:      cfg.RequireConfigs,
+		stop:          make(chan struct{}),
+		certFile:      cfg.CertPEM,
+		keyFile:       cfg.KeyPEM,
+		infoLogger:    limitLogger(cfg.InfoLogger, cfg.MaxLogBytes),
+		warningLogger: limitLogger(cfg.WarnLogger, cfg.MaxLogBytes),
+		errorLogger:   limitLogger(cfg.ErrorLogger, cfg.MaxLogBytes),
+	}
+	if len(whsvr.listeners) == 0 {
+		whsvr.listeners = []ListenerConfig{{Network: "tcp", Address: whsvr.server.Addr}}
+	}
+	whsvr.updateState(func(next *serverState) {
+		next.ignoredNamespaces = ignoredNamespaces
+		next.enforcedNamespaces = cfg.EnforcedNamespaces
+		next.freeze = cfg.Freeze
+	})
+	whsvr.UpdateConfigs(cfg.SidecarConfigs)
+
+	// the certificate is taken from the state snapshot and reloaded when the files change
+	whsvr.server.TLSConfig = &tls.Config{
+		GetCertificate: whsvr.getCertificate,
 	}
 
 	// define http server and server handler
 	mux := http.NewServeMux()
 	mux.HandleFunc(webhookInjectPath, whsvr.Serve)
+	if path := cfg.Transport.SecondPath; path != "" && path != webhookInjectPath {
+		mux.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+			whsvr.serve(w, r, cfg.Transport.SecondPathCompression)
+		})
+	}
+	if cfg.ConfigClient != nil && cfg.ConfigMap != nil {
+		whsvr.configMap = whsvr.newConfigMapConfigs(cfg.ConfigClient, *cfg.ConfigMap)
+	} else if cfg.ConfigClient != nil {
+		whsvr.crdConfigs = whsvr.newCRDConfigs(cfg.ConfigClient, cfg.ConfigNamespace)
+	}
+	if cfg.NodeClient != nil {
+		whsvr.nodes = newNodeTopology(cfg.NodeClient)
+	}
+	if cfg.OwnerClient != nil {
+		whsvr.owners = newOwnerMarkers(cfg.OwnerClient, whsvr.annotations.owner)
+	}
+	if cfg.FilesClient != nil {
+		whsvr.fileConfigMaps = newFileConfigMaps(cfg.FilesClient)
+	}
+	if cfg.TemplateCacheSize > 0 {
+		whsvr.templateCache = newTemplateCache(cfg.TemplateCacheSize)
+	}
+	whsvr.initErr = whsvr.addTenants(mux, cfg.Tenants)
+	if whsvr.initErr == nil && cfg.ConfigClient == nil {
+		// configs from resources are only checked once they're listed
+		whsvr.initErr = whsvr.required.check(cfg.SidecarConfigs)
+	}
 	whsvr.server.Handler = mux
 
+	if cfg.InventoryClient != nil {
+		whsvr.inventory = whsvr.newInventory(cfg.InventoryClient)
+	}
+
+	if cfg.AdminPort != 0 {
+		whsvr.adminServer = whsvr.newAdminServer(cfg.AdminPort)
+		whsvr.adminToken = cfg.AdminToken
+	}
+
 	return whsvr
 }
 
 // Start method for webhook server. It blocks until the server is stopped.
 func (whs *WebhookServer) Start() error {
-	whs.infoLogger.Printf("Starting webhook server...\n")
-	return whs.server.ListenAndServeTLS(whs.certPEM, whs.keyPEM)
+	if whs.initErr != nil {
+		return whs.initErr
+	}
+
+	listeners, err := whs.listen()
+	if err != nil {
+		return err
+	}
+
+	whs.logConfigReports()
+
+	if whs.configFile != "" && whs.configWatch {
+		if err := whs.watchConfig(whs.configFile, whs.stop); err != nil {
+			whs.warningLogger.Printf("Can't watch %s, config changes need a restart: %v", whs.configFile, err)
+		} else {
+			whs.infoLogger.Printf("Watching %s for config changes...\n", whs.configFile)
+		}
+	}
+
+	if whs.crdConfigs != nil {
+		whs.infoLogger.Printf("Starting SidecarConfig watch...\n")
+		go whs.crdConfigs.Run(whs.stop)
+	}
+
+	if whs.configMap != nil {
+		whs.infoLogger.Printf("Starting %s watch of %s...\n", whs.configMap.source.kind(), whs.configMap.source)
+		go whs.configMap.Run(whs.stop)
+	}
+
+	if whs.nodes != nil {
+		whs.infoLogger.Printf("Starting node topology lookup...\n")
+		go whs.nodes.Run(whs.stop)
+	}
+
+	if whs.inventory != nil {
+		whs.infoLogger.Printf("Starting injected pod inventory...\n")
+		go whs.inventory.Run(whs.stop)
+	}
+
+	if whs.adminServer != nil {
+		go func() {
+			whs.infoLogger.Printf("Starting admin server on %s...\n", whs.adminServer.Addr)
+			if err := whs.adminServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				whs.errorLogger.Printf("Admin server failed: %v", err)
+			}
+		}()
+	}
+
+	// every listener serves the same server, Stop closes them all
+	errs := make(chan error, len(listeners))
+	for _, l := range listeners {
+		whs.infoLogger.Printf("Starting webhook server on %s...\n", l.Addr())
+		go func(l net.Listener) {
+			errs <- whs.server.ServeTLS(l, whs.certPEM, whs.keyPEM)
+		}(l)
+	}
+	// configs from SidecarConfig resources or a ConfigMap or Secret have to be listed before the server can be ready
+	unmet := make(chan error, 1)
+	go func() {
+		if whs.crdConfigs != nil && !whs.crdConfigs.waitForSync(whs.stop) {
+			return
+		}
+		if whs.configMap != nil && !whs.configMap.waitForSync(whs.stop) {
+			return
+		}
+		if err := whs.required.check(whs.state().sidecarConfigs); err != nil {
+			unmet <- err
+			return
+		}
+		if whs.warmUpEnabled {
+			whs.warmUp(listeners[0].Addr())
+		} else {
+			whs.ready.Store(true)
+		}
+	}()
+
+	serving := len(listeners)
+	select {
+	case err = <-errs:
+		serving--
+	case err = <-unmet:
+		whs.server.Close()
+	}
+	for ; serving > 0; serving-- {
+		<-errs
+	}
+	return err
 }
 
 // Stop method for webhook server. It stops the server gracefully.
 func (whs *WebhookServer) Stop() {
+	close(whs.stop)
+	if whs.adminServer != nil {
+		whs.adminServer.Shutdown(context.Background())
+	}
 	whs.server.Shutdown(context.Background())
 }
 
-// mutationRequired determines whether a mutation is required for the specified pod and if so which mutation to use
-func (whs *WebhookServer) mutationRequired(ignoredList []string, metadata *metav1.ObjectMeta) (bool, string) {
+// mutationRequired determines whether a mutation is required for the specified pod and if so which mutation to use,
+// the mutation recorded on the pod's owner if any, otherwise the one selected by the server's resolver
+func (whs *WebhookServer) mutationRequired(st *serverState, namespace string, pod *corev1.Pod) (bool, string, error) {
+	id := podIdentity(namespace, pod)
 	// skip special kubernete system namespaces
-	for _, namespace := range ignoredList {
-		if metadata.Namespace == namespace {
-			whs.infoLogger.Printf("Skip mutation for %v for it's in special namespace:%v", metadata.Name, metadata.Namespace)
-			return false, ""
+	for _, ignored := range st.ignoredNamespaces {
+		if pod.Namespace == ignored {
+			whs.infoLogger.Printf("Skip mutation for %v for it's in special namespace:%v", id, pod.Namespace)
+			return false, "", nil
 		}
 	}
 
-	annotations := metadata.GetAnnotations()
-	if annotations == nil {
-		annotations = map[string]string{}
-	}
+	annotations := pod.GetAnnotations()
 	whs.infoLogger.Printf("Annotations: %v", annotations)
 
 	// check if mutation has already occurred
-	status := annotations[admissionWebhookAnnotationStatusKey]
+	if isInjectedStatus(annotations[whs.annotations.status]) {
+		whs.infoLogger.Printf("Mutation policy for %v: previously injected", id)
+		return false, "", nil
+	}
+
+	// pods of an owner whose pods were injected before get the same config
+	if mut, ok := whs.ownerConfig(st, namespace, pod); ok {
+		whs.infoLogger.Printf("Mutation policy for %v: config %s recorded on the owner", id, mut)
+		return true, mut, nil
+	}
 
-	required, prevInj, mut := false, false, ""
-	if strings.ToLower(status) == "injected" {
-		prevInj = true
-		required = false
-	} else if val, ok := annotations[admissionWebhookAnnotationInjectKey]; ok {
-		required = true
-		mut = val
+	mut, required, err := whs.resolver().Resolve(namespace, pod)
+	if err != nil {
+		return false, "", err
 	}
 
-	whs.infoLogger.Printf("Mutation policy for %v/%v: previously injected: %v required:%v, mutation: %s", metadata.Namespace, metadata.Name, prevInj, required, mut)
-	return required, mut
+	whs.infoLogger.Printf("Mutation policy for %v: previously injected: false required:%v, mutation: %s", id, required, mut)
+	return required, mut, nil
 }
 
 // addContainer adds the container to the target containers
-func (whs *WebhookServer) addContainer(target, added []corev1.Container, basePath string) (patch []patchOperation) {
-	first := len(target) == 0
-	var value interface{}
-	for _, add := range added {
-		value = add
-		path := basePath
-		if first {
-			first = false
-			value = []corev1.Container{add}
-		} else {
-			path = path + "/-"
+func (whs *WebhookServer) addContainer(target, added []corev1.Container, basePath string) []patchOperation {
+	return patch.AddToList(target, added, basePath)
+}
+
+// updateAnnotation updates/adds annotations. The annotations map is only created when the pod has none,
+// otherwise each key is added or replaced individually so existing annotations are preserved.
+func (whs *WebhookServer) updateAnnotation(target map[string]string, added map[string]string) []patchOperation {
+	return patch.SetMapEntries(target, added, "/metadata/annotations")
+}
+
+// addLabels updates/adds labels like updateAnnotation, the keys are escaped in the paths
+func (whs *WebhookServer) addLabels(target map[string]string, added map[string]string) []patchOperation {
+	return patch.SetMapEntries(target, added, "/metadata/labels")
+}
+
+// addTolerations adds the tolerations the pod doesn't have yet
+func (whs *WebhookServer) addTolerations(target, added []corev1.Toleration) []patchOperation {
+	var missing []corev1.Toleration
+	for _, toleration := range added {
+		if !hasToleration(target, toleration) {
+			missing = append(missing, toleration)
 		}
-		patch = append(patch, patchOperation{
-			Op:    "add",
-			Path:  path,
-			Value: value,
-		})
 	}
-	return patch
+	return patch.AddToList(target, missing, "/spec/tolerations")
 }
 
-// addVolume to the target list of volumes
-func (whs *WebhookServer) addVolume(target, added []corev1.Volume, basePath string) (patch []patchOperation) {
-	first := len(target) == 0
-	var value interface{}
-	for _, add := range added {
-		value = add
-		path := basePath
-		if first {
-			first = false
-			value = []corev1.Volume{add}
-		} else {
-			path = path + "/-"
+// hasToleration returns whether the tolerations contain one with the key, operator, value and effect of want
+func hasToleration(tolerations []corev1.Toleration, want corev1.Toleration) bool {
+	for _, t := range tolerations {
+		if t.MatchToleration(&want) {
+			return true
 		}
-		patch = append(patch, patchOperation{
-			Op:    "add",
-			Path:  path,
-			Value: value,
-		})
 	}
-	return patch
+	return false
 }
 
-// updateAnnotation updates/adds annotations
-func (whs *WebhookServer) updateAnnotation(target map[string]string, added map[string]string) (patch []patchOperation) {
-	for key, value := range added {
-		if target == nil || target[key] == "" {
-			target = map[string]string{}
-			patch = append(patch, patchOperation{
-				Op:   "add",
-				Path: "/metadata/annotations",
-				Value: map[string]string{
-					key: value,
-				},
-			})
-		} else {
-			patch = append(patch, patchOperation{
-				Op:    "replace",
-				Path:  "/metadata/annotations/" + key,
-				Value: value,
-			})
+// excludedContainers returns the names of the containers listed in the pod's exclude-containers annotation
+// and the config's excludeContainers and, when the config targets containers, of the pod's containers it
+// doesn't target
+func (whs *WebhookServer) excludedContainers(pod *corev1.Pod, config ExistingContainerConfig) map[string]bool {
+	excluded := map[string]bool{}
+	for _, name := range strings.Split(pod.GetAnnotations()[whs.annotations.exclude], ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			excluded[name] = true
+		}
+	}
+	for _, name := range config.ExcludeContainers {
+		excluded[name] = true
+	}
+	if len(config.TargetContainers) == 0 {
+		return excluded
+	}
+	for _, container := range append(append([]corev1.Container{}, pod.Spec.InitContainers...), pod.Spec.Containers...) {
+		if !contains(config.TargetContainers, container.Name) {
+			excluded[container.Name] = true
+		}
+	}
+	return excluded
+}
+
+// existingContainer is a container of the pod as it was admitted and the path of its patch operations
+type existingContainer struct {
+	path      string
+	container corev1.Container
+}
+
+// existingContainers returns the containers of the pod, and its initContainers if withInit is set, that
+// aren't excluded
+func existingContainers(pod *corev1.Pod, withInit bool, excluded map[string]bool) []existingContainer {
+	var containers []existingContainer
+	if withInit {
+		for i, container := range pod.Spec.InitContainers {
+			if !excluded[container.Name] {
+				containers = append(containers, existingContainer{fmt.Sprintf("/spec/initContainers/%d", i), container})
+			}
+		}
+	}
+	for i, container := range pod.Spec.Containers {
+		if !excluded[container.Name] {
+			containers = append(containers, existingContainer{fmt.Sprintf("/spec/containers/%d", i), container})
 		}
 	}
-	return patch
+	return containers
 }
 
-// addVolumeMounts adds volume mounts to the containers in the give pod
-func (whs *WebhookServer) addVolumeMounts(pod *corev1.Pod, vms []corev1.VolumeMount) (patch []patchOperation) {
+// existingContainerRefs returns the containers of the pod like existingContainers, to be modified in place
+func existingContainerRefs(pod *corev1.Pod, withInit bool, excluded map[string]bool) []*corev1.Container {
+	var containers []*corev1.Container
+	lists := [][]corev1.Container{pod.Spec.Containers}
+	if withInit {
+		lists = [][]corev1.Container{pod.Spec.InitContainers, pod.Spec.Containers}
+	}
+	for _, list := range lists {
+		for i := range list {
+			if !excluded[list[i].Name] {
+				containers = append(containers, &list[i])
+			}
+		}
+	}
+	return containers
+}
+
+// addVolumeMounts adds the config's volume mounts to the containers in the give pod, and to its
+// initContainers if ApplyToInitContainers is set, skipping excluded containers. Mounts at a path a container
+// already mounts are skipped or replaced as the VolumeConflictPolicy says.
+func (whs *WebhookServer) addVolumeMounts(pod *corev1.Pod, config ExistingContainerConfig, excluded map[string]bool) (ops []patchOperation) {
 	// add the volumeMount and for the existing containers
-	for i, _ := range pod.Spec.Containers {
-		for _, vm := range vms {
+	for _, existing := range existingContainers(pod, config.ApplyToInitContainers, excluded) {
+		path := existing.path + "/volumeMounts"
+		var missing []corev1.VolumeMount
+		for _, vm := range config.VolumeMounts {
+			i, ok := mountIndex(existing.container.VolumeMounts, vm.MountPath)
+			switch {
+			case !ok:
+				missing = append(missing, vm)
+			case config.VolumeConflictPolicy == conflictOverride:
+				ops = append(ops, patch.Replace(fmt.Sprintf("%s/%d", path, i), vm))
+			}
+		}
+		ops = append(ops, patch.AddToList(existing.container.VolumeMounts, missing, path)...)
+	}
+	return ops
+}
 
-			op := patchOperation{
-				Op:    "add",
-				Path:  fmt.Sprintf("/spec/containers/%d/volumeMounts/-", i),
-				Value: vm,
+// mergeVolumeMounts adds the config's volume mounts to the containers of the pod like addVolumeMounts
+func (whs *WebhookServer) mergeVolumeMounts(pod *corev1.Pod, config ExistingContainerConfig, excluded map[string]bool) {
+	for _, container := range existingContainerRefs(pod, config.ApplyToInitContainers, excluded) {
+		for _, vm := range config.VolumeMounts {
+			i, ok := mountIndex(container.VolumeMounts, vm.MountPath)
+			switch {
+			case !ok:
+				container.VolumeMounts = append(container.VolumeMounts, vm)
+			case config.VolumeConflictPolicy == conflictOverride:
+				container.VolumeMounts[i] = vm
 			}
-			patch = append(patch, op)
 		}
 	}
-	return patch
 }
 
-// addEnvVars adds environment variables to the containers in the given pod
-func (whs *WebhookServer) addEnvVars(pod *corev1.Pod, envVars []corev1.EnvVar) (patch []patchOperation) {
+// addContainerSecurityContext sets the securityContext of the containers in the given pod that don't have
+// one, skipping excluded containers
+func (whs *WebhookServer) addContainerSecurityContext(pod *corev1.Pod, sc *corev1.SecurityContext, excluded map[string]bool) (ops []patchOperation) {
+	if sc == nil {
+		return nil
+	}
+	for i, container := range pod.Spec.Containers {
+		if excluded[container.Name] || container.SecurityContext != nil {
+			continue
+		}
+		ops = append(ops, patchOperation{Op: "add", Path: fmt.Sprintf("/spec/containers/%d/securityContext", i), Value: sc})
+	}
+	return ops
+}
+
+// addEnvFrom adds the ConfigMap and Secret env sources the containers in the given pod don't have yet,
+// and the initContainers if withInit is set, skipping excluded containers
+func (whs *WebhookServer) addEnvFrom(pod *corev1.Pod, envFrom []corev1.EnvFromSource, withInit bool, excluded map[string]bool) (ops []patchOperation) {
+	if len(envFrom) == 0 {
+		return nil
+	}
+	for _, existing := range existingContainers(pod, withInit, excluded) {
+		container := existing.container
+		missing := appendMissing(append([]corev1.EnvFromSource{}, container.EnvFrom...), envFrom)[len(container.EnvFrom):]
+		ops = append(ops, patch.AddToList(container.EnvFrom, missing, existing.path+"/envFrom")...)
+	}
+	return ops
+}
 
+// addEnvVars adds the config's environment variables to the containers in the given pod, and to its
+// initContainers if ApplyToInitContainers is set, skipping excluded containers. Vars a container already has
+// are handled by the EnvConflictPolicy. When ReorderExistingEnv is set and a container's own env references
+// the injected vars, its whole env is rewritten in dependency order.
+func (whs *WebhookServer) addEnvVars(pod *corev1.Pod, config ExistingContainerConfig, excluded map[string]bool) (ops []patchOperation) {
 	// no env vars to add, short circuit
-	if len(envVars) == 0 {
-		return patch
+	if len(config.EnvVars) == 0 {
+		return ops
 	}
 
-	// add the volumeMount for the existing containers
-	for i, _ := range pod.Spec.Containers {
+	// add the env vars to the existing containers
+	for _, existing := range existingContainers(pod, config.ApplyToInitContainers, excluded) {
+		path := existing.path + "/env"
+		env := whs.injectEnv(existing.container, config)
+		if env.reordered != nil {
+			op := patch.Replace(path, env.reordered)
+			whs.infoLogger.Printf("addEnvVars: op=%v\n", op)
+			ops = append(ops, op)
+			continue
+		}
 
-		// Add an empty env field first if it doesn't exist
-		if pod.Spec.Containers[i].Env == nil {
-			op := patchOperation{
-				Op:    "add",
-				Path:  fmt.Sprintf("/spec/containers/%d/env", i),
-				Value: []corev1.EnvVar{},
-			}
-			patch = append(patch, op)
+		for _, i := range env.replaced {
+			ops = append(ops, patch.Replace(fmt.Sprintf("%s/%d", path, i), env.env[i]))
 		}
+		added := patch.AddToList(existing.container.Env, env.appended, path)
+		whs.infoLogger.Printf("addEnvVars: ops=%v\n", added)
+		ops = append(ops, added...)
+	}
 
-		// Add the env vars
-		for _, envVar := range envVars {
+	return ops
+}
 
-			op := patchOperation{
-				Op:    "add",
-				Path:  fmt.Sprintf("/spec/containers/%d/env/-", i),
-				Value: envVar,
+// mergeEnvVars adds the config's environment variables to the containers of the pod like addEnvVars
+func (whs *WebhookServer) mergeEnvVars(pod *corev1.Pod, config ExistingContainerConfig, excluded map[string]bool) {
+	if len(config.EnvVars) == 0 {
+		return
+	}
+	for _, container := range existingContainerRefs(pod, config.ApplyToInitContainers, excluded) {
+		env := whs.injectEnv(*container, config)
+		if env.reordered != nil {
+			container.Env = env.reordered
+			continue
+		}
+		container.Env = append(env.env, env.appended...)
+	}
+}
+
+// injectedEnv is a container's env with the config's env vars injected: the container's env with the vars
+// it already has replaced at the replaced indexes as the EnvConflictPolicy says and the vars appended to
+// it, or the whole env in dependency order if it's reordered
+type injectedEnv struct {
+	env, appended []corev1.EnvVar
+	replaced      []int
+	reordered     []corev1.EnvVar
+}
+
+// injectEnv returns the container's env with the config's env vars injected
+func (whs *WebhookServer) injectEnv(container corev1.Container, config ExistingContainerConfig) injectedEnv {
+	envVars := config.EnvVars
+	injected := map[string]bool{}
+	for _, envVar := range envVars {
+		injected[envVar.Name] = true
+	}
+
+	// the container's env with the vars it already has overridden, and the vars appended to it
+	result := injectedEnv{env: container.Env, appended: envVars}
+	if config.EnvConflictPolicy == conflictSkip || config.EnvConflictPolicy == conflictOverride {
+		index := map[string]int{}
+		for i, envVar := range container.Env {
+			index[envVar.Name] = i
+		}
+		result.env, result.appended = append([]corev1.EnvVar{}, container.Env...), nil
+		for _, envVar := range envVars {
+			i, ok := index[envVar.Name]
+			switch {
+			case !ok:
+				result.appended = append(result.appended, envVar)
+			case config.EnvConflictPolicy == conflictOverride:
+				result.env[i] = envVar
+				result.replaced = append(result.replaced, i)
 			}
-			whs.infoLogger.Printf("addEnvVars: op=%v\n", op)
-			patch = append(patch, op)
 		}
 	}
 
-	return patch
+	if config.ReorderExistingEnv && referencesAny(container.Env, injected) {
+		merged, err := orderEnvVars(append(append([]corev1.EnvVar{}, result.env...), result.appended...))
+		if err == nil {
+			result.reordered = merged
+			return result
+		}
+		whs.warningLogger.Printf("Can't reorder env of container %s, appending instead: %v", container.Name, err)
+	}
+	return result
 }
 
-// createPatch creates a JSON patch for the pod using the sidecar configuration and annotations
+// createPatch creates a JSON patch for the pod using the sidecar configuration and annotations. The config
+// mutators prepare the config for the pod and the patch mutators then generate the operations with the
+// server's patch engine.
 func (whs *WebhookServer) createPatch(pod *corev1.Pod, sidecarConfig Config, annotations map[string]string) ([]byte, error) {
 
+	sidecarConfig, err := whs.mutateConfig(pod, sidecarConfig)
+	if err != nil {
+		return nil, err
+	}
+
 	cbytes, err := yaml.Marshal(sidecarConfig)
 	if err != nil {
 		return nil, err
 	}
 	whs.infoLogger.Printf("createPatch: sidecarConfig=%s\n", string(cbytes))
-	var patch []patchOperation
 
-	patch = append(patch, whs.addVolumeMounts(pod, sidecarConfig.VolumeMounts)...)
-	patch = append(patch, whs.addEnvVars(pod, sidecarConfig.EnvVars)...)
-	patch = append(patch, whs.addContainer(pod.Spec.InitContainers, sidecarConfig.InitContainers, "/spec/initContainers")...)
-	patch = append(patch, whs.addContainer(pod.Spec.Containers, sidecarConfig.Containers, "/spec/containers")...)
-	patch = append(patch, whs.addVolume(pod.Spec.Volumes, sidecarConfig.Volumes, "/spec/volumes")...)
-	patch = append(patch, whs.updateAnnotation(pod.Annotations, annotations)...)
+	ops, err := whs.patchOperations(&patchInput{
+		admitted: pod,
+		pod:      withoutContainers(pod, sidecarConfig.RemoveContainers),
+		config:   sidecarConfig,
+		// workload owners can opt containers out of env and volumeMount injection, configs can target some
+		excluded:    whs.excludedContainers(pod, sidecarConfig.ExistingContainerConfig),
+		annotations: annotations,
+	})
+	if err != nil {
+		return nil, err
+	}
 
-	return json.Marshal(patch)
+	return patch.Marshal(ops)
+}
+
+// injectionAnnotations returns the annotations recorded on pods injected with the config. The hash is of
+// the config as resolved for the pod, its namespace override and experiment variant included, so pods
+// injected with different revisions of a config can be told apart.
+func (whs *WebhookServer) injectionAnnotations(config Config, configName string) map[string]string {
+	annotations := map[string]string{
+		whs.annotations.status: config.injectedStatus(),
+		whs.annotations.config: configName,
+	}
+	if config.Release != "" {
+		annotations[whs.annotations.release] = config.Release
+	}
+	if hash, err := configHash(config); err == nil {
+		annotations[whs.annotations.hash] = hash
+	} else {
+		whs.warningLogger.Printf("Can't hash config %s, its pods won't record the hash: %v", configName, err)
+	}
+	return annotations
+}
+
+// patchFor returns the patch for the pod, reusing a cached patch generated for an identical pod if possible.
+// variant is whether the config is the variant an experiment assigned the pod.
+func (whs *WebhookServer) patchFor(st *serverState, req *admissionv1.AdmissionRequest, pod *corev1.Pod, configName string, config Config, annotations map[string]string, variant bool) ([]byte, error) {
+	generate := func() ([]byte, error) {
+		patchBytes, err := whs.createPatch(pod, config, annotations)
+		if err != nil {
+			return nil, err
+		}
+		return whs.completePatch(pod, patchBytes, configName, config, variant)
+	}
+	hash, ok := st.configHashes[configName]
+	if whs.patchCache == nil || !ok {
+		return generate()
+	}
+
+	var nodeLabels map[string]string
+	if config.Topology != nil && len(config.Topology.Labels) > 0 && whs.nodes != nil {
+		nodeLabels, _ = whs.nodes.labels(podNode(pod))
+	}
+	key, err := patchCacheKey(req, pod, config.RenderTemplates || len(config.Files) > 0, whs.name, configName, hash, variant, annotations, nodeLabels)
+	if err != nil {
+		return nil, err
+	}
+	return whs.cachedPatch(key, generate)
+}
+
+// cachedPatch returns the patch cached under key, generating and caching it on a miss
+func (whs *WebhookServer) cachedPatch(key string, generate func() ([]byte, error)) ([]byte, error) {
+	if patch, ok := whs.patchCache.Get(key); ok {
+		patchCacheRequests.WithLabelValues("hit").Inc()
+		return patch, nil
+	}
+	patchCacheRequests.WithLabelValues("miss").Inc()
+
+	patch, err := generate()
+	if err != nil {
+		return nil, err
+	}
+	whs.patchCache.Add(key, patch)
+	return patch, nil
+}
+
+// completePatch adds the variant label of an experiment's variant and the injected annotation to the
+// patch of a config
+func (whs *WebhookServer) completePatch(pod *corev1.Pod, patchBytes []byte, configName string, config Config, variant bool) ([]byte, error) {
+	var err error
+	if variant {
+		if patchBytes, err = whs.labelVariant(patchBytes, pod, configName, config.Labels); err != nil {
+			return nil, err
+		}
+	}
+	return whs.recordInjection(pod, patchBytes)
 }
 
 // mutate is the main mutation function for the webhook server. It determines whether a mutation is required
 // for the specified pod and if so, which mutation to use. It then creates a patch for the pod using the sidecar
-// configuration and annotations.
-func (whs *WebhookServer) mutate(ar *admissionv1.AdmissionReview) *admissionv1.AdmissionResponse {
+// configuration and annotations. Everything is read from st so a reload mid request has no effect on it.
+func (whs *WebhookServer) mutate(ar *admissionv1.AdmissionReview, st *serverState) (response *admissionv1.AdmissionResponse) {
+	start := time.Now()
 	req := ar.Request
+	if req == nil {
+		whs.warningLogger.Println("AdmissionReview without a request")
+		return &admissionv1.AdmissionResponse{
+			Result: &metav1.Status{
+				Message: "the admission review has no request",
+			},
+		}
+	}
+	defer func() {
+		admissions.WithLabelValues(string(req.Operation), admissionResult(response)).Inc()
+	}()
+	// ephemeral containers are added to running pods through their own subresource
+	if isEphemeralContainersUpdate(req) {
+		return whs.injectEphemeral(req, st)
+	}
+	// requests mis-routed to the webhook are admitted before decoding, they aren't pods
+	if reason := passthroughReason(req); reason != "" {
+		return whs.passthrough(req, reason)
+	}
 	var pod corev1.Pod
 	if err := json.Unmarshal(req.Object.Raw, &pod); err != nil {
 		whs.warningLogger.Printf("Could not unmarshal raw object: %v", err)
+		st.onError(whs.injectionEvent(req, nil, ""), err)
 		return &admissionv1.AdmissionResponse{
 			Result: &metav1.Status{
 				Message: err.Error(),
@@ -346,38 +1297,163 @@ func (whs *WebhookServer) mutate(ar *admissionv1.AdmissionReview) *admissionv1.A
 		}
 	}
 
+	// the pod may not have its namespace yet, templates and presets rendered per pod need it
+	if pod.Namespace == "" {
+		pod.Namespace = req.Namespace
+	}
+	id := podIdentity(req.Namespace, &pod)
 	whs.infoLogger.Printf("AdmissionReview for Kind=%v, Namespace=%v Name=%v (%v) UID=%v patchOperation=%v UserInfo=%v",
-		req.Kind, req.Namespace, req.Name, pod.Name, req.UID, req.Operation, req.UserInfo)
+		req.Kind, req.Namespace, req.Name, id, req.UID, req.Operation, req.UserInfo)
+	defer func() {
+		if response != nil {
+			response.AuditAnnotations = map[string]string{podIdentityAuditKey: id, operationAuditKey: string(req.Operation)}
+		}
+	}()
+
+	// a global freeze stops orphan marking too, pods are admitted as they are without a warning
+	if req.Operation == admissionv1.Update && whs.markOrphaned && !st.freeze.All {
+		if response := whs.orphanedStatus(st, &pod, id); response != nil {
+			return response
+		}
+	}
+
+	// pods are only injected on the configured operations, the containers of existing pods can't change
+	if !whs.injectsOn(req.Operation) {
+		whs.infoLogger.Printf("Skipping mutation for %s, pods aren't injected on %s", id, req.Operation)
+		return &admissionv1.AdmissionResponse{
+			Allowed: true,
+		}
+	}
 
 	// determine whether to perform mutation
-	required, mut := whs.mutationRequired(ignoredNamespaces, &pod.ObjectMeta)
+	enforced := st.enforcement(req.Namespace)
+	if injectionDisabled(pod.GetAnnotations()[whs.annotations.inject]) {
+		if enforced != nil {
+			return whs.denyUninjected(enforced, req.Namespace, id, "injection is disabled by the inject annotation")
+		}
+		if response := st.onDecision(whs.injectionEvent(req, &pod, "")); response != nil {
+			return response
+		}
+		// removing an injection is frozen along with injecting
+		if st.freeze.All && isInjectedStatus(pod.Annotations[whs.annotations.status]) {
+			return whs.frozenAdmission(freezeAll, id)
+		}
+		return whs.uninject(&pod, id)
+	}
+	required, mut, err := whs.mutationRequired(st, req.Namespace, &pod)
+	if err != nil {
+		var denial *PolicyDenial
+		if errors.As(err, &denial) {
+			whs.warningLogger.Printf("Denying %s by policy: %s", id, denial.Message)
+			return &admissionv1.AdmissionResponse{
+				Result: &metav1.Status{
+					Message: denial.Message,
+				},
+			}
+		}
+		whs.warningLogger.Printf("Can't resolve the config for %s: %v", id, err)
+		st.onError(whs.injectionEvent(req, &pod, ""), err)
+		return &admissionv1.AdmissionResponse{
+			Result: &metav1.Status{
+				Message: fmt.Sprintf("could not resolve the simple-sidecar config: %v", err),
+			},
+		}
+	}
 	if !required {
-		whs.infoLogger.Printf("Skipping mutation for %s/%s due to policy check", pod.Namespace, pod.Name)
+		if enforced != nil && !isInjectedStatus(pod.Annotations[whs.annotations.status]) {
+			return whs.denyUninjected(enforced, req.Namespace, id, "no injection requested")
+		}
+		whs.infoLogger.Printf("Skipping mutation for %s due to policy check", id)
+		if response := st.onDecision(whs.injectionEvent(req, &pod, "")); response != nil {
+			return response
+		}
 		return &admissionv1.AdmissionResponse{
 			Allowed: true,
 		}
 	}
 
-	config, ok := whs.sidecarConfigs[mut]
+	// only pods that would be injected are frozen, so the warning and the metric count real injections
+	if st.freeze.All {
+		return whs.frozenResponse(enforced, req.Namespace, freezeAll, id)
+	}
+
+	// pods may request several configs, separated by commas
+	if names := splitConfigNames(mut); len(names) > 1 {
+		return whs.mutateMultiple(req, st, &pod, id, names, enforced)
+	}
+
+	// the config may be requested by an alias or in another case, the rest only sees its name
+	mut = st.configName(mut)
+	if st.freeze.frozen(mut) {
+		return whs.frozenResponse(enforced, req.Namespace, mut, id)
+	}
+
+	config, ok := st.sidecarConfigs[mut]
+	if enforced != nil && (!ok || !enforced.allows(mut)) {
+		return whs.denyUninjected(enforced, req.Namespace, id, fmt.Sprintf("config %q is missing or not accepted", mut))
+	}
 	if !ok {
-		whs.warningLogger.Printf("Skipping mutation for %s/%s due to missing configuration for mutation %s", pod.Namespace, pod.Name, mut)
+		whs.warningLogger.Printf("Skipping mutation for %s due to missing configuration for mutation %s", id, mut)
+		if response := st.onDecision(whs.injectionEvent(req, &pod, "")); response != nil {
+			return response
+		}
 		return &admissionv1.AdmissionResponse{
 			Allowed: true,
 		}
 	}
 
-	annotations := map[string]string{admissionWebhookAnnotationStatusKey: "injected"}
-	patchBytes, err := whs.createPatch(&pod, config, annotations)
-	if err != nil {
+	if err := config.Scope.checkScope(req.Namespace, &pod); err != nil {
+		whs.warningLogger.Printf("Refusing mutation %s for %s: %v", mut, id, err)
+		st.onError(whs.injectionEvent(req, &pod, mut), err)
 		return &admissionv1.AdmissionResponse{
 			Result: &metav1.Status{
-				Message: err.Error(),
+				Message: fmt.Sprintf("simple-sidecar config %q may not be applied to this pod: %v", mut, err),
 			},
 		}
 	}
 
+	if unmet := config.Preconditions.unmet(&pod); len(unmet) > 0 {
+		response := whs.preconditionsUnmet(config, mut, enforced, req.Namespace, id, unmet)
+		if response.Allowed {
+			if veto := st.onDecision(whs.injectionEvent(req, &pod, "")); veto != nil {
+				return veto
+			}
+		}
+		return response
+	}
+
+	// the config injected, which is the experiment's variant for a share of the pods
+	injected := mut
+	experiment := config.Experiment != nil
+	if experiment {
+		injected, config = whs.experimentVariant(st, req.Namespace, &pod, mut, config)
+		if st.freeze.frozen(injected) {
+			return whs.frozenResponse(enforced, req.Namespace, injected, id)
+		}
+	}
+	config = config.forNamespace(req.Namespace)
+	if response := st.onDecision(whs.injectionEvent(req, &pod, injected)); response != nil {
+		return response
+	}
+
+	annotations := whs.injectionAnnotations(config, injected)
+	patchBytes, partial, err := whs.patchWithinBudget(st, req, &pod, injected, config, annotations, experiment, start.Add(whs.latencyBudget))
+	if err != nil {
+		st.onError(whs.injectionEvent(req, &pod, injected), err)
+		return whs.patchFailed(config, injected, enforced, id, err)
+	}
+	event := whs.injectionEvent(req, &pod, injected)
+	event.Patch, event.Partial = patchBytes, partial
+	if response := st.onPatchGenerated(event); response != nil {
+		return response
+	}
+	if err := whs.storeFiles(&pod, config, req.DryRun != nil && *req.DryRun); err != nil {
+		st.onError(whs.injectionEvent(req, &pod, injected), err)
+		return whs.patchFailed(config, injected, enforced, id, err)
+	}
+
 	whs.infoLogger.Printf("AdmissionResponse: patch=%v\n", string(patchBytes))
-	return &admissionv1.AdmissionResponse{
+	response = &admissionv1.AdmissionResponse{
 		Allowed: true,
 		Patch:   patchBytes,
 		PatchType: func() *admissionv1.PatchType {
@@ -385,19 +1461,30 @@ func (whs *WebhookServer) mutate(ar *admissionv1.AdmissionReview) *admissionv1.A
 			return &pt
 		}(),
 	}
+	response.Warnings = whs.overrideWarnings(&pod, config, injected)
+	if partial {
+		response.Warnings = append(response.Warnings, whs.partialWarning(injected))
+	} else {
+		whs.recordOwnerConfig(st, req.Namespace, &pod, mut)
+	}
+	return response
 }
 
 // Serve method for webhook server
 func (whs *WebhookServer) Serve(w http.ResponseWriter, r *http.Request) {
-	var body []byte
-	if r.Body != nil {
-		if data, err := io.ReadAll(r.Body); err == nil {
-			body = data
+	whs.serve(w, r, whs.transport.Compression)
+}
+
+// serve handles an admission review, gzipping the response if compress is set and the client accepts it
+func (whs *WebhookServer) serve(w http.ResponseWriter, r *http.Request, compress bool) {
+	body, err := requestBody(w, r, whs.transport.MaxRequestBytes)
+	if err != nil {
+		whs.warningLogger.Printf("Can't read body: %v", err)
+		status := http.StatusBadRequest
+		if errors.Is(err, errUnsupportedEncoding) {
+			status = http.StatusUnsupportedMediaType
 		}
-	}
-	if len(body) == 0 {
-		whs.warningLogger.Println("empty body")
-		http.Error(w, "empty body", http.StatusBadRequest)
+		http.Error(w, err.Error(), status)
 		return
 	}
 
@@ -409,10 +1496,19 @@ func (whs *WebhookServer) Serve(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// decode the admission request
+	// decode the admission request as it's read, large objects are never buffered whole
 	var admissionResponse *admissionv1.AdmissionResponse
 	ar := admissionv1.AdmissionReview{}
-	if _, _, err := deserializer.Decode(body, nil, &ar); err != nil {
+	var tooLarge *http.MaxBytesError
+	if err := json.NewDecoder(body).Decode(&ar); errors.Is(err, io.EOF) {
+		whs.warningLogger.Println("empty body")
+		http.Error(w, "empty body", http.StatusBadRequest)
+		return
+	} else if errors.As(err, &tooLarge) {
+		whs.warningLogger.Printf("Body is larger than %d bytes", tooLarge.Limit)
+		http.Error(w, fmt.Sprintf("body is larger than %d bytes, see MAX_REQUEST_BYTES", tooLarge.Limit), http.StatusRequestEntityTooLarge)
+		return
+	} else if err != nil {
 		whs.warningLogger.Printf("Can't decode body: %v", err)
 		admissionResponse = &admissionv1.AdmissionResponse{
 			Result: &metav1.Status{
@@ -420,8 +1516,8 @@ func (whs *WebhookServer) Serve(w http.ResponseWriter, r *http.Request) {
 			},
 		}
 	} else {
-		// mutate the pod passed in
-		admissionResponse = whs.mutate(&ar)
+		// mutate the pod passed in against a single snapshot of the server state
+		admissionResponse = whs.mutate(&ar, whs.state())
 	}
 
 	// encode the admission response
@@ -432,6 +1528,10 @@ func (whs *WebhookServer) Serve(w http.ResponseWriter, r *http.Request) {
 		},
 	}
 
+	if !whs.injectChaos(w, r, admissionResponse) {
+		return
+	}
+
 	// set the response
 	if admissionResponse != nil {
 		admissionReview.Response = admissionResponse
@@ -445,11 +1545,12 @@ func (whs *WebhookServer) Serve(w http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		whs.warningLogger.Printf("Can't encode response: %v", err)
 		http.Error(w, fmt.Sprintf("could not encode response: %v", err), http.StatusInternalServerError)
+		return
 	}
 
 	// write the response
 	whs.infoLogger.Printf("Ready to write reponse ...")
-	if _, err := w.Write(resp); err != nil {
+	if err := writeResponse(w, r, resp, compress); err != nil {
 		whs.warningLogger.Printf("Can't write response: %v", err)
 		http.Error(w, fmt.Sprintf("could not write response: %v", err), http.StatusInternalServerError)
 	}
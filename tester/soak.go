@@ -0,0 +1,344 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/yaml"
+
+	"github.com/centml/simple-sidecar/pkg/webhook"
+)
+
+const mib = 1 << 20
+
+// soakInterval is what the soak test measured during one report interval
+type soakInterval struct {
+	requests  int
+	errors    int
+	denied    int
+	dropped   int
+	latencies []time.Duration
+
+	// heap is the live heap after a GC at the end of the interval
+	heap       uint64
+	goroutines int
+}
+
+// percentile returns the latency below which the fraction p of the interval's requests completed
+func (i *soakInterval) percentile(p float64) time.Duration {
+	if len(i.latencies) == 0 {
+		return 0
+	}
+	return i.latencies[int(float64(len(i.latencies)-1)*p)]
+}
+
+// soakRecorder collects the results of the replayed admissions of the current interval
+type soakRecorder struct {
+	mu      sync.Mutex
+	current soakInterval
+	errors  map[string]int
+}
+
+// record adds the result of one admission, err is why it failed
+func (r *soakRecorder) record(latency time.Duration, denied bool, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.current.requests++
+	r.current.latencies = append(r.current.latencies, latency)
+	if denied {
+		r.current.denied++
+	}
+	if err != nil {
+		r.current.errors++
+		r.errors[err.Error()]++
+	}
+}
+
+// drop counts an admission that wasn't sent because every worker was busy
+func (r *soakRecorder) drop() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.current.dropped++
+}
+
+// rotate returns the current interval, with its latencies sorted and the memory in use, and starts the next
+func (r *soakRecorder) rotate() soakInterval {
+	r.mu.Lock()
+	interval := r.current
+	r.current = soakInterval{}
+	r.mu.Unlock()
+
+	sort.Slice(interval.latencies, func(a, b int) bool { return interval.latencies[a] < interval.latencies[b] })
+	runtime.GC()
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	interval.heap = mem.HeapAlloc
+	interval.goroutines = runtime.NumGoroutine()
+	return interval
+}
+
+// loadCorpus reads the admission reviews of a file, or of every .json, .yaml and .yml file in a directory,
+// and returns them by file name
+func loadCorpus(path string) (map[string]*admissionv1.AdmissionReview, error) {
+	files := []string{path}
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		entries, err := os.ReadDir(path)
+		if err != nil {
+			return nil, err
+		}
+		files = nil
+		for _, entry := range entries {
+			switch filepath.Ext(entry.Name()) {
+			case ".json", ".yaml", ".yml":
+				if !entry.IsDir() {
+					files = append(files, filepath.Join(path, entry.Name()))
+				}
+			}
+		}
+	}
+
+	corpus := map[string]*admissionv1.AdmissionReview{}
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		ar := &admissionv1.AdmissionReview{}
+		if err := yaml.Unmarshal(data, ar); err != nil {
+			return nil, fmt.Errorf("%s: %v", file, err)
+		}
+		if ar.Request == nil {
+			return nil, fmt.Errorf("%s: the admission review has no request", file)
+		}
+		corpus[filepath.Base(file)] = ar
+	}
+	if len(corpus) == 0 {
+		return nil, fmt.Errorf("no admission reviews in %s", path)
+	}
+	return corpus, nil
+}
+
+// admit sends the admission review through the server's HTTP handler, with a UID of its own, and returns
+// whether it was denied or why it failed
+func admit(handler http.Handler, ar admissionv1.AdmissionReview, uid string) (bool, error) {
+	request := *ar.Request
+	request.UID = types.UID(uid)
+	ar.Request = &request
+	ar.Response = nil
+	body, err := json.Marshal(&ar)
+	if err != nil {
+		return false, err
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/inject", bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		return false, fmt.Errorf("status %d: %s", w.Code, strings.TrimSpace(w.Body.String()))
+	}
+
+	response := admissionv1.AdmissionReview{}
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		return false, fmt.Errorf("can't decode the response: %v", err)
+	}
+	if response.Response == nil {
+		return false, fmt.Errorf("the admission review has no response")
+	}
+	if response.Response.UID != request.UID {
+		return false, fmt.Errorf("the response is for UID %q instead of %q", response.Response.UID, request.UID)
+	}
+	return !response.Response.Allowed, nil
+}
+
+// soak replays a corpus of admission reviews against a webhook server running the configs at a steady
+// rate, reporting the latency, memory and errors of every interval, and fails if they drift too far from
+// the first interval. It returns the exit code for the process.
+func soak(args []string) int {
+	flags := flag.NewFlagSet("soak", flag.ExitOnError)
+	corpusPath := flags.String("corpus", "", "a file or directory of AdmissionReviews to replay")
+	rate := flags.Float64("rate", 50, "admissions per second")
+	duration := flags.Duration("duration", time.Hour, "how long to replay the corpus")
+	concurrency := flags.Int("concurrency", 8, "admissions in flight at once, admissions are dropped when every one is busy")
+	report := flags.Duration("report", time.Minute, "how often to report")
+	patchCacheTTL := flags.Duration("patch-cache-ttl", 0, "how long patches are cached, 0 disables the cache")
+	patchCacheSize := flags.Int("patch-cache-size", 1000, "the maximum number of cached patches")
+	maxErrors := flags.Int("max-errors", 0, "fail if more admissions fail, -1 disables the check")
+	maxP99Drift := flags.Float64("max-p99-drift", 2, "fail if the p99 latency of the last interval is more than this times the first's, 0 disables the check")
+	maxHeapGrowth := flags.Int("max-heap-growth", 64, "fail if the live heap grows by more MiB between the first and last interval, -1 disables the check")
+	verbose := flags.Bool("v", false, "log the webhook's output to stderr")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: tester soak -corpus <path> [flags] <config>\n")
+		flags.PrintDefaults()
+	}
+	_ = flags.Parse(args)
+	if flags.NArg() != 1 || *corpusPath == "" || *rate <= 0 || *concurrency < 1 || *report <= 0 {
+		flags.Usage()
+		return 2
+	}
+
+	configs, err := webhook.LoadConfig(flags.Arg(0))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to load configuration %s: %v\n", flags.Arg(0), err)
+		return 1
+	}
+	corpus, err := loadCorpus(*corpusPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to load the corpus: %v\n", err)
+		return 1
+	}
+	names := make([]string, 0, len(corpus))
+	for name := range corpus {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	output := io.Discard
+	if *verbose {
+		output = os.Stderr
+	}
+	var cache webhook.PatchCache
+	if *patchCacheTTL > 0 {
+		cache = webhook.NewTTLPatchCache(*patchCacheTTL, *patchCacheSize)
+	}
+	whs := webhook.NewWebhookServer(&webhook.WebhookServerConfig{
+		SidecarConfigs: configs,
+		PatchCache:     cache,
+		InfoLogger:     log.New(output, "INFO: ", log.LstdFlags),
+		WarnLogger:     log.New(output, "WARN: ", log.LstdFlags),
+		ErrorLogger:    log.New(output, "ERROR: ", log.LstdFlags),
+	})
+	handler := http.HandlerFunc(whs.Serve)
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	ctx, cancel := context.WithTimeout(ctx, *duration)
+	defer cancel()
+
+	recorder := &soakRecorder{errors: map[string]int{}}
+	jobs := make(chan int, *concurrency)
+	var workers sync.WaitGroup
+	for i := 0; i < *concurrency; i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for n := range jobs {
+				start := time.Now()
+				denied, err := admit(handler, *corpus[names[n%len(names)]], fmt.Sprintf("soak-%d", n))
+				recorder.record(time.Since(start), denied, err)
+			}
+		}()
+	}
+
+	fmt.Printf("Replaying %d admission reviews at %g/s for %v with %d workers\n", len(corpus), *rate, *duration, *concurrency)
+	start := time.Now()
+	ticker := time.NewTicker(time.Duration(float64(time.Second) / *rate))
+	defer ticker.Stop()
+	reports := time.NewTicker(*report)
+	defer reports.Stop()
+
+	var first, last *soakInterval
+	total := soakInterval{}
+	// the interval cut short by the end of the run is reported but only compared if it's the only one
+	rotate := func(partial bool) {
+		interval := recorder.rotate()
+		if interval.requests == 0 && interval.dropped == 0 {
+			return
+		}
+		fmt.Printf("%v requests=%d errors=%d denied=%d dropped=%d p50=%v p99=%v max=%v heap=%.1fMiB goroutines=%d\n",
+			time.Since(start).Round(time.Second), interval.requests, interval.errors, interval.denied, interval.dropped,
+			interval.percentile(0.5), interval.percentile(0.99), interval.percentile(1),
+			float64(interval.heap)/mib, interval.goroutines)
+		total.requests += interval.requests
+		total.errors += interval.errors
+		total.denied += interval.denied
+		total.dropped += interval.dropped
+		if first == nil {
+			first = &interval
+		}
+		if !partial || last == nil {
+			last = &interval
+		}
+	}
+
+	for n := 0; ctx.Err() == nil; {
+		select {
+		case <-ctx.Done():
+		case <-ticker.C:
+			select {
+			case jobs <- n:
+				n++
+			default:
+				recorder.drop()
+			}
+		case <-reports.C:
+			rotate(false)
+		}
+	}
+	close(jobs)
+	workers.Wait()
+	rotate(true)
+
+	fmt.Printf("Done after %v: requests=%d errors=%d denied=%d dropped=%d\n",
+		time.Since(start).Round(time.Second), total.requests, total.errors, total.denied, total.dropped)
+	messages := make([]string, 0, len(recorder.errors))
+	for msg := range recorder.errors {
+		messages = append(messages, msg)
+	}
+	sort.Strings(messages)
+	for _, msg := range messages {
+		fmt.Printf("    %dx %s\n", recorder.errors[msg], msg)
+	}
+	if first == nil {
+		fmt.Println("FAIL no admissions were replayed")
+		return 1
+	}
+
+	var failures []string
+	if *maxErrors >= 0 && total.errors > *maxErrors {
+		failures = append(failures, fmt.Sprintf("%d admissions failed, at most %d may", total.errors, *maxErrors))
+	}
+	if *maxP99Drift > 0 && first.percentile(0.99) > 0 {
+		drift := float64(last.percentile(0.99)) / float64(first.percentile(0.99))
+		fmt.Printf("p99 drift: %v -> %v (%.2fx)\n", first.percentile(0.99), last.percentile(0.99), drift)
+		if drift > *maxP99Drift {
+			failures = append(failures, fmt.Sprintf("the p99 latency drifted %.2fx, at most %gx may", drift, *maxP99Drift))
+		}
+	}
+	growth := (float64(last.heap) - float64(first.heap)) / mib
+	fmt.Printf("heap growth: %.1fMiB -> %.1fMiB (%+.1fMiB)\n", float64(first.heap)/mib, float64(last.heap)/mib, growth)
+	if *maxHeapGrowth >= 0 && growth > float64(*maxHeapGrowth) {
+		failures = append(failures, fmt.Sprintf("the heap grew by %.1fMiB, at most %dMiB may", growth, *maxHeapGrowth))
+	}
+
+	for _, failure := range failures {
+		fmt.Printf("FAIL %s\n", failure)
+	}
+	if len(failures) > 0 {
+		return 1
+	}
+	fmt.Println("PASS")
+	return 0
+}
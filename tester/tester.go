@@ -9,6 +9,10 @@ import (
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "soak" {
+		os.Exit(soak(os.Args[2:]))
+	}
+
 	if len(os.Args) < 2 {
 		fmt.Println("Please provide a config file as a command line argument.")
 		os.Exit(1)